@@ -0,0 +1,990 @@
+// Code generated by protoc-gen-gogo. DO NOT EDIT.
+// source: casgrpc/casgrpc.proto
+
+package casgrpc
+
+import proto "github.com/gogo/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+import context "golang.org/x/net/context"
+import grpc "google.golang.org/grpc"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.GoGoProtoPackageIsVersion2 // please upgrade the proto package
+
+type Op_Type int32
+
+const (
+	Op_CHECK  Op_Type = 0
+	Op_SET    Op_Type = 1
+	Op_DELETE Op_Type = 2
+)
+
+var Op_Type_name = map[int32]string{
+	0: "CHECK",
+	1: "SET",
+	2: "DELETE",
+}
+var Op_Type_value = map[string]int32{
+	"CHECK":  0,
+	"SET":    1,
+	"DELETE": 2,
+}
+
+func (x Op_Type) String() string {
+	return proto.EnumName(Op_Type_name, int32(x))
+}
+func (Op_Type) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_casgrpc_3e2a653f734e1970, []int{9, 0}
+}
+
+type KeyValue struct {
+	Key                  string   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Value                []byte   `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *KeyValue) Reset()         { *m = KeyValue{} }
+func (m *KeyValue) String() string { return proto.CompactTextString(m) }
+func (*KeyValue) ProtoMessage()    {}
+func (*KeyValue) Descriptor() ([]byte, []int) {
+	return fileDescriptor_casgrpc_3e2a653f734e1970, []int{0}
+}
+func (m *KeyValue) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_KeyValue.Unmarshal(m, b)
+}
+func (m *KeyValue) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_KeyValue.Marshal(b, m, deterministic)
+}
+func (dst *KeyValue) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_KeyValue.Merge(dst, src)
+}
+func (m *KeyValue) XXX_Size() int {
+	return xxx_messageInfo_KeyValue.Size(m)
+}
+func (m *KeyValue) XXX_DiscardUnknown() {
+	xxx_messageInfo_KeyValue.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_KeyValue proto.InternalMessageInfo
+
+func (m *KeyValue) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *KeyValue) GetValue() []byte {
+	if m != nil {
+		return m.Value
+	}
+	return nil
+}
+
+type GetRequest struct {
+	Key                  string   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetRequest) Reset()         { *m = GetRequest{} }
+func (m *GetRequest) String() string { return proto.CompactTextString(m) }
+func (*GetRequest) ProtoMessage()    {}
+func (*GetRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_casgrpc_3e2a653f734e1970, []int{1}
+}
+func (m *GetRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetRequest.Unmarshal(m, b)
+}
+func (m *GetRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetRequest.Marshal(b, m, deterministic)
+}
+func (dst *GetRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetRequest.Merge(dst, src)
+}
+func (m *GetRequest) XXX_Size() int {
+	return xxx_messageInfo_GetRequest.Size(m)
+}
+func (m *GetRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetRequest proto.InternalMessageInfo
+
+func (m *GetRequest) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+type GetResponse struct {
+	Kv *KeyValue `protobuf:"bytes,1,opt,name=kv" json:"kv,omitempty"`
+	// Whether the value was verified against a trusted block header, which
+	// only a gateway with a trusted genesis does.
+	Verified             bool     `protobuf:"varint,2,opt,name=verified,proto3" json:"verified,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *GetResponse) Reset()         { *m = GetResponse{} }
+func (m *GetResponse) String() string { return proto.CompactTextString(m) }
+func (*GetResponse) ProtoMessage()    {}
+func (*GetResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_casgrpc_3e2a653f734e1970, []int{2}
+}
+func (m *GetResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_GetResponse.Unmarshal(m, b)
+}
+func (m *GetResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_GetResponse.Marshal(b, m, deterministic)
+}
+func (dst *GetResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_GetResponse.Merge(dst, src)
+}
+func (m *GetResponse) XXX_Size() int {
+	return xxx_messageInfo_GetResponse.Size(m)
+}
+func (m *GetResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_GetResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_GetResponse proto.InternalMessageInfo
+
+func (m *GetResponse) GetKv() *KeyValue {
+	if m != nil {
+		return m.Kv
+	}
+	return nil
+}
+
+func (m *GetResponse) GetVerified() bool {
+	if m != nil {
+		return m.Verified
+	}
+	return false
+}
+
+type CASRequest struct {
+	Key                  string   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Old                  []byte   `protobuf:"bytes,2,opt,name=old,proto3" json:"old,omitempty"`
+	New                  []byte   `protobuf:"bytes,3,opt,name=new,proto3" json:"new,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *CASRequest) Reset()         { *m = CASRequest{} }
+func (m *CASRequest) String() string { return proto.CompactTextString(m) }
+func (*CASRequest) ProtoMessage()    {}
+func (*CASRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_casgrpc_3e2a653f734e1970, []int{3}
+}
+func (m *CASRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CASRequest.Unmarshal(m, b)
+}
+func (m *CASRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CASRequest.Marshal(b, m, deterministic)
+}
+func (dst *CASRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CASRequest.Merge(dst, src)
+}
+func (m *CASRequest) XXX_Size() int {
+	return xxx_messageInfo_CASRequest.Size(m)
+}
+func (m *CASRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_CASRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CASRequest proto.InternalMessageInfo
+
+func (m *CASRequest) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *CASRequest) GetOld() []byte {
+	if m != nil {
+		return m.Old
+	}
+	return nil
+}
+
+func (m *CASRequest) GetNew() []byte {
+	if m != nil {
+		return m.New
+	}
+	return nil
+}
+
+type CASResponse struct {
+	Kv                   *KeyValue `protobuf:"bytes,1,opt,name=kv" json:"kv,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}  `json:"-"`
+	XXX_unrecognized     []byte    `json:"-"`
+	XXX_sizecache        int32     `json:"-"`
+}
+
+func (m *CASResponse) Reset()         { *m = CASResponse{} }
+func (m *CASResponse) String() string { return proto.CompactTextString(m) }
+func (*CASResponse) ProtoMessage()    {}
+func (*CASResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_casgrpc_3e2a653f734e1970, []int{4}
+}
+func (m *CASResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_CASResponse.Unmarshal(m, b)
+}
+func (m *CASResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_CASResponse.Marshal(b, m, deterministic)
+}
+func (dst *CASResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_CASResponse.Merge(dst, src)
+}
+func (m *CASResponse) XXX_Size() int {
+	return xxx_messageInfo_CASResponse.Size(m)
+}
+func (m *CASResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_CASResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_CASResponse proto.InternalMessageInfo
+
+func (m *CASResponse) GetKv() *KeyValue {
+	if m != nil {
+		return m.Kv
+	}
+	return nil
+}
+
+type DeleteRequest struct {
+	Key                  string   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Old                  []byte   `protobuf:"bytes,2,opt,name=old,proto3" json:"old,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DeleteRequest) Reset()         { *m = DeleteRequest{} }
+func (m *DeleteRequest) String() string { return proto.CompactTextString(m) }
+func (*DeleteRequest) ProtoMessage()    {}
+func (*DeleteRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_casgrpc_3e2a653f734e1970, []int{5}
+}
+func (m *DeleteRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DeleteRequest.Unmarshal(m, b)
+}
+func (m *DeleteRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DeleteRequest.Marshal(b, m, deterministic)
+}
+func (dst *DeleteRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DeleteRequest.Merge(dst, src)
+}
+func (m *DeleteRequest) XXX_Size() int {
+	return xxx_messageInfo_DeleteRequest.Size(m)
+}
+func (m *DeleteRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_DeleteRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DeleteRequest proto.InternalMessageInfo
+
+func (m *DeleteRequest) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *DeleteRequest) GetOld() []byte {
+	if m != nil {
+		return m.Old
+	}
+	return nil
+}
+
+type DeleteResponse struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *DeleteResponse) Reset()         { *m = DeleteResponse{} }
+func (m *DeleteResponse) String() string { return proto.CompactTextString(m) }
+func (*DeleteResponse) ProtoMessage()    {}
+func (*DeleteResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_casgrpc_3e2a653f734e1970, []int{6}
+}
+func (m *DeleteResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_DeleteResponse.Unmarshal(m, b)
+}
+func (m *DeleteResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_DeleteResponse.Marshal(b, m, deterministic)
+}
+func (dst *DeleteResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_DeleteResponse.Merge(dst, src)
+}
+func (m *DeleteResponse) XXX_Size() int {
+	return xxx_messageInfo_DeleteResponse.Size(m)
+}
+func (m *DeleteResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_DeleteResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_DeleteResponse proto.InternalMessageInfo
+
+type ListRequest struct {
+	Prefix               string   `protobuf:"bytes,1,opt,name=prefix,proto3" json:"prefix,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ListRequest) Reset()         { *m = ListRequest{} }
+func (m *ListRequest) String() string { return proto.CompactTextString(m) }
+func (*ListRequest) ProtoMessage()    {}
+func (*ListRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_casgrpc_3e2a653f734e1970, []int{7}
+}
+func (m *ListRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ListRequest.Unmarshal(m, b)
+}
+func (m *ListRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ListRequest.Marshal(b, m, deterministic)
+}
+func (dst *ListRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ListRequest.Merge(dst, src)
+}
+func (m *ListRequest) XXX_Size() int {
+	return xxx_messageInfo_ListRequest.Size(m)
+}
+func (m *ListRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ListRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ListRequest proto.InternalMessageInfo
+
+func (m *ListRequest) GetPrefix() string {
+	if m != nil {
+		return m.Prefix
+	}
+	return ""
+}
+
+type ListResponse struct {
+	Kvs                  []*KeyValue `protobuf:"bytes,1,rep,name=kvs" json:"kvs,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}    `json:"-"`
+	XXX_unrecognized     []byte      `json:"-"`
+	XXX_sizecache        int32       `json:"-"`
+}
+
+func (m *ListResponse) Reset()         { *m = ListResponse{} }
+func (m *ListResponse) String() string { return proto.CompactTextString(m) }
+func (*ListResponse) ProtoMessage()    {}
+func (*ListResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_casgrpc_3e2a653f734e1970, []int{8}
+}
+func (m *ListResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ListResponse.Unmarshal(m, b)
+}
+func (m *ListResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ListResponse.Marshal(b, m, deterministic)
+}
+func (dst *ListResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ListResponse.Merge(dst, src)
+}
+func (m *ListResponse) XXX_Size() int {
+	return xxx_messageInfo_ListResponse.Size(m)
+}
+func (m *ListResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ListResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ListResponse proto.InternalMessageInfo
+
+func (m *ListResponse) GetKvs() []*KeyValue {
+	if m != nil {
+		return m.Kvs
+	}
+	return nil
+}
+
+type Op struct {
+	Type                 Op_Type  `protobuf:"varint,1,opt,name=type,proto3,enum=casgrpc.Op_Type" json:"type,omitempty"`
+	Key                  string   `protobuf:"bytes,2,opt,name=key,proto3" json:"key,omitempty"`
+	Old                  []byte   `protobuf:"bytes,3,opt,name=old,proto3" json:"old,omitempty"`
+	New                  []byte   `protobuf:"bytes,4,opt,name=new,proto3" json:"new,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Op) Reset()         { *m = Op{} }
+func (m *Op) String() string { return proto.CompactTextString(m) }
+func (*Op) ProtoMessage()    {}
+func (*Op) Descriptor() ([]byte, []int) {
+	return fileDescriptor_casgrpc_3e2a653f734e1970, []int{9}
+}
+func (m *Op) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Op.Unmarshal(m, b)
+}
+func (m *Op) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Op.Marshal(b, m, deterministic)
+}
+func (dst *Op) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Op.Merge(dst, src)
+}
+func (m *Op) XXX_Size() int {
+	return xxx_messageInfo_Op.Size(m)
+}
+func (m *Op) XXX_DiscardUnknown() {
+	xxx_messageInfo_Op.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Op proto.InternalMessageInfo
+
+func (m *Op) GetType() Op_Type {
+	if m != nil {
+		return m.Type
+	}
+	return Op_CHECK
+}
+
+func (m *Op) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *Op) GetOld() []byte {
+	if m != nil {
+		return m.Old
+	}
+	return nil
+}
+
+func (m *Op) GetNew() []byte {
+	if m != nil {
+		return m.New
+	}
+	return nil
+}
+
+type TxnRequest struct {
+	Ops                  []*Op    `protobuf:"bytes,1,rep,name=ops" json:"ops,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *TxnRequest) Reset()         { *m = TxnRequest{} }
+func (m *TxnRequest) String() string { return proto.CompactTextString(m) }
+func (*TxnRequest) ProtoMessage()    {}
+func (*TxnRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_casgrpc_3e2a653f734e1970, []int{10}
+}
+func (m *TxnRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_TxnRequest.Unmarshal(m, b)
+}
+func (m *TxnRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_TxnRequest.Marshal(b, m, deterministic)
+}
+func (dst *TxnRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_TxnRequest.Merge(dst, src)
+}
+func (m *TxnRequest) XXX_Size() int {
+	return xxx_messageInfo_TxnRequest.Size(m)
+}
+func (m *TxnRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_TxnRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_TxnRequest proto.InternalMessageInfo
+
+func (m *TxnRequest) GetOps() []*Op {
+	if m != nil {
+		return m.Ops
+	}
+	return nil
+}
+
+type TxnResponse struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *TxnResponse) Reset()         { *m = TxnResponse{} }
+func (m *TxnResponse) String() string { return proto.CompactTextString(m) }
+func (*TxnResponse) ProtoMessage()    {}
+func (*TxnResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_casgrpc_3e2a653f734e1970, []int{11}
+}
+func (m *TxnResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_TxnResponse.Unmarshal(m, b)
+}
+func (m *TxnResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_TxnResponse.Marshal(b, m, deterministic)
+}
+func (dst *TxnResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_TxnResponse.Merge(dst, src)
+}
+func (m *TxnResponse) XXX_Size() int {
+	return xxx_messageInfo_TxnResponse.Size(m)
+}
+func (m *TxnResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_TxnResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_TxnResponse proto.InternalMessageInfo
+
+type WatchRequest struct {
+	Key                  string   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Prefix               bool     `protobuf:"varint,2,opt,name=prefix,proto3" json:"prefix,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *WatchRequest) Reset()         { *m = WatchRequest{} }
+func (m *WatchRequest) String() string { return proto.CompactTextString(m) }
+func (*WatchRequest) ProtoMessage()    {}
+func (*WatchRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_casgrpc_3e2a653f734e1970, []int{12}
+}
+func (m *WatchRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_WatchRequest.Unmarshal(m, b)
+}
+func (m *WatchRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_WatchRequest.Marshal(b, m, deterministic)
+}
+func (dst *WatchRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_WatchRequest.Merge(dst, src)
+}
+func (m *WatchRequest) XXX_Size() int {
+	return xxx_messageInfo_WatchRequest.Size(m)
+}
+func (m *WatchRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_WatchRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_WatchRequest proto.InternalMessageInfo
+
+func (m *WatchRequest) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *WatchRequest) GetPrefix() bool {
+	if m != nil {
+		return m.Prefix
+	}
+	return false
+}
+
+type WatchEvent struct {
+	Height               int64     `protobuf:"varint,1,opt,name=height,proto3" json:"height,omitempty"`
+	Kv                   *KeyValue `protobuf:"bytes,2,opt,name=kv" json:"kv,omitempty"`
+	Deleted              bool      `protobuf:"varint,3,opt,name=deleted,proto3" json:"deleted,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}  `json:"-"`
+	XXX_unrecognized     []byte    `json:"-"`
+	XXX_sizecache        int32     `json:"-"`
+}
+
+func (m *WatchEvent) Reset()         { *m = WatchEvent{} }
+func (m *WatchEvent) String() string { return proto.CompactTextString(m) }
+func (*WatchEvent) ProtoMessage()    {}
+func (*WatchEvent) Descriptor() ([]byte, []int) {
+	return fileDescriptor_casgrpc_3e2a653f734e1970, []int{13}
+}
+func (m *WatchEvent) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_WatchEvent.Unmarshal(m, b)
+}
+func (m *WatchEvent) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_WatchEvent.Marshal(b, m, deterministic)
+}
+func (dst *WatchEvent) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_WatchEvent.Merge(dst, src)
+}
+func (m *WatchEvent) XXX_Size() int {
+	return xxx_messageInfo_WatchEvent.Size(m)
+}
+func (m *WatchEvent) XXX_DiscardUnknown() {
+	xxx_messageInfo_WatchEvent.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_WatchEvent proto.InternalMessageInfo
+
+func (m *WatchEvent) GetHeight() int64 {
+	if m != nil {
+		return m.Height
+	}
+	return 0
+}
+
+func (m *WatchEvent) GetKv() *KeyValue {
+	if m != nil {
+		return m.Kv
+	}
+	return nil
+}
+
+func (m *WatchEvent) GetDeleted() bool {
+	if m != nil {
+		return m.Deleted
+	}
+	return false
+}
+
+func init() {
+	proto.RegisterType((*KeyValue)(nil), "casgrpc.KeyValue")
+	proto.RegisterType((*GetRequest)(nil), "casgrpc.GetRequest")
+	proto.RegisterType((*GetResponse)(nil), "casgrpc.GetResponse")
+	proto.RegisterType((*CASRequest)(nil), "casgrpc.CASRequest")
+	proto.RegisterType((*CASResponse)(nil), "casgrpc.CASResponse")
+	proto.RegisterType((*DeleteRequest)(nil), "casgrpc.DeleteRequest")
+	proto.RegisterType((*DeleteResponse)(nil), "casgrpc.DeleteResponse")
+	proto.RegisterType((*ListRequest)(nil), "casgrpc.ListRequest")
+	proto.RegisterType((*ListResponse)(nil), "casgrpc.ListResponse")
+	proto.RegisterType((*Op)(nil), "casgrpc.Op")
+	proto.RegisterType((*TxnRequest)(nil), "casgrpc.TxnRequest")
+	proto.RegisterType((*TxnResponse)(nil), "casgrpc.TxnResponse")
+	proto.RegisterType((*WatchRequest)(nil), "casgrpc.WatchRequest")
+	proto.RegisterType((*WatchEvent)(nil), "casgrpc.WatchEvent")
+	proto.RegisterEnum("casgrpc.Op_Type", Op_Type_name, Op_Type_value)
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// Client API for CompareAndSwap service
+
+type CompareAndSwapClient interface {
+	// Get returns the current value of a key.
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	// CAS sets a key to a new value, if its current value is old.
+	CAS(ctx context.Context, in *CASRequest, opts ...grpc.CallOption) (*CASResponse, error)
+	// Delete removes a key, if its current value is old.
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// List returns every key with a prefix, and its value.
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
+	// Txn applies a sequence of operations atomically.
+	Txn(ctx context.Context, in *TxnRequest, opts ...grpc.CallOption) (*TxnResponse, error)
+	// Watch streams changes to a key, or keys with a prefix, as they're
+	// committed.
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (CompareAndSwap_WatchClient, error)
+}
+
+type compareAndSwapClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewCompareAndSwapClient(cc *grpc.ClientConn) CompareAndSwapClient {
+	return &compareAndSwapClient{cc}
+}
+
+func (c *compareAndSwapClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error) {
+	out := new(GetResponse)
+	err := c.cc.Invoke(ctx, "/casgrpc.CompareAndSwap/Get", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *compareAndSwapClient) CAS(ctx context.Context, in *CASRequest, opts ...grpc.CallOption) (*CASResponse, error) {
+	out := new(CASResponse)
+	err := c.cc.Invoke(ctx, "/casgrpc.CompareAndSwap/CAS", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *compareAndSwapClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, "/casgrpc.CompareAndSwap/Delete", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *compareAndSwapClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	out := new(ListResponse)
+	err := c.cc.Invoke(ctx, "/casgrpc.CompareAndSwap/List", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *compareAndSwapClient) Txn(ctx context.Context, in *TxnRequest, opts ...grpc.CallOption) (*TxnResponse, error) {
+	out := new(TxnResponse)
+	err := c.cc.Invoke(ctx, "/casgrpc.CompareAndSwap/Txn", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *compareAndSwapClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (CompareAndSwap_WatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_CompareAndSwap_serviceDesc.Streams[0], "/casgrpc.CompareAndSwap/Watch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &compareAndSwapWatchClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type CompareAndSwap_WatchClient interface {
+	Recv() (*WatchEvent, error)
+	grpc.ClientStream
+}
+
+type compareAndSwapWatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *compareAndSwapWatchClient) Recv() (*WatchEvent, error) {
+	m := new(WatchEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Server API for CompareAndSwap service
+
+type CompareAndSwapServer interface {
+	// Get returns the current value of a key.
+	Get(context.Context, *GetRequest) (*GetResponse, error)
+	// CAS sets a key to a new value, if its current value is old.
+	CAS(context.Context, *CASRequest) (*CASResponse, error)
+	// Delete removes a key, if its current value is old.
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// List returns every key with a prefix, and its value.
+	List(context.Context, *ListRequest) (*ListResponse, error)
+	// Txn applies a sequence of operations atomically.
+	Txn(context.Context, *TxnRequest) (*TxnResponse, error)
+	// Watch streams changes to a key, or keys with a prefix, as they're
+	// committed.
+	Watch(*WatchRequest, CompareAndSwap_WatchServer) error
+}
+
+func RegisterCompareAndSwapServer(s *grpc.Server, srv CompareAndSwapServer) {
+	s.RegisterService(&_CompareAndSwap_serviceDesc, srv)
+}
+
+func _CompareAndSwap_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CompareAndSwapServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/casgrpc.CompareAndSwap/Get",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CompareAndSwapServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CompareAndSwap_CAS_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CASRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CompareAndSwapServer).CAS(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/casgrpc.CompareAndSwap/CAS",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CompareAndSwapServer).CAS(ctx, req.(*CASRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CompareAndSwap_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CompareAndSwapServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/casgrpc.CompareAndSwap/Delete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CompareAndSwapServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CompareAndSwap_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CompareAndSwapServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/casgrpc.CompareAndSwap/List",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CompareAndSwapServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CompareAndSwap_Txn_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TxnRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CompareAndSwapServer).Txn(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/casgrpc.CompareAndSwap/Txn",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CompareAndSwapServer).Txn(ctx, req.(*TxnRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CompareAndSwap_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CompareAndSwapServer).Watch(m, &compareAndSwapWatchServer{stream})
+}
+
+type CompareAndSwap_WatchServer interface {
+	Send(*WatchEvent) error
+	grpc.ServerStream
+}
+
+type compareAndSwapWatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *compareAndSwapWatchServer) Send(m *WatchEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _CompareAndSwap_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "casgrpc.CompareAndSwap",
+	HandlerType: (*CompareAndSwapServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Get",
+			Handler:    _CompareAndSwap_Get_Handler,
+		},
+		{
+			MethodName: "CAS",
+			Handler:    _CompareAndSwap_CAS_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _CompareAndSwap_Delete_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _CompareAndSwap_List_Handler,
+		},
+		{
+			MethodName: "Txn",
+			Handler:    _CompareAndSwap_Txn_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Watch",
+			Handler:       _CompareAndSwap_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "casgrpc/casgrpc.proto",
+}
+
+func init() { proto.RegisterFile("casgrpc/casgrpc.proto", fileDescriptor_casgrpc_3e2a653f734e1970) }
+
+var fileDescriptor_casgrpc_3e2a653f734e1970 = []byte{
+	// 518 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x94, 0x54, 0xdb, 0x6e, 0xd3, 0x40,
+	0x10, 0xc5, 0xde, 0x34, 0x49, 0xc7, 0x69, 0x64, 0xb6, 0x69, 0x89, 0x2c, 0x81, 0xc2, 0x72, 0x51,
+	0x25, 0xa4, 0x10, 0x25, 0x42, 0x82, 0xc7, 0xe0, 0x5a, 0x45, 0x6a, 0xa4, 0x4a, 0x8e, 0x05, 0xcf,
+	0x26, 0x99, 0x36, 0x56, 0x82, 0xbd, 0xd8, 0xae, 0x93, 0xfc, 0x01, 0x3f, 0xc7, 0x3f, 0x21, 0xaf,
+	0xd7, 0x37, 0x42, 0x11, 0x3c, 0x79, 0xe7, 0xcc, 0x9e, 0x99, 0xe3, 0x33, 0x63, 0xc3, 0xd9, 0xc2,
+	0x8d, 0xee, 0x42, 0xbe, 0x78, 0x2b, 0x9f, 0x43, 0x1e, 0x06, 0x71, 0x40, 0x5b, 0x32, 0x64, 0x63,
+	0x68, 0x5f, 0xe3, 0xfe, 0xb3, 0xbb, 0xb9, 0x47, 0xaa, 0x03, 0x59, 0xe3, 0xbe, 0xaf, 0x0c, 0x94,
+	0x8b, 0x63, 0x3b, 0x3d, 0xd2, 0x1e, 0x1c, 0x25, 0x69, 0xaa, 0xaf, 0x0e, 0x94, 0x8b, 0x8e, 0x9d,
+	0x05, 0xec, 0x19, 0xc0, 0x15, 0xc6, 0x36, 0x7e, 0xbf, 0xc7, 0x28, 0x3e, 0x64, 0xb1, 0x19, 0x68,
+	0x22, 0x1f, 0xf1, 0xc0, 0x8f, 0x90, 0x3e, 0x07, 0x75, 0x9d, 0x88, 0xbc, 0x36, 0x7e, 0x3c, 0xcc,
+	0x75, 0xe4, 0x5d, 0x6d, 0x75, 0x9d, 0x50, 0x03, 0xda, 0x09, 0x86, 0xde, 0xad, 0x87, 0x4b, 0xd1,
+	0xaa, 0x6d, 0x17, 0x31, 0xfb, 0x08, 0x60, 0x4e, 0xe7, 0x0f, 0x76, 0x4b, 0x91, 0x60, 0xb3, 0x94,
+	0x0a, 0xd3, 0x63, 0x8a, 0xf8, 0xb8, 0xed, 0x93, 0x0c, 0xf1, 0x71, 0xcb, 0x46, 0xa0, 0x89, 0x1a,
+	0xff, 0xac, 0x88, 0x4d, 0xe0, 0xe4, 0x12, 0x37, 0x18, 0xe3, 0x7f, 0x34, 0x66, 0x3a, 0x74, 0x73,
+	0x52, 0xd6, 0x89, 0xbd, 0x02, 0x6d, 0xe6, 0x45, 0x85, 0x57, 0xe7, 0xd0, 0xe4, 0x21, 0xde, 0x7a,
+	0x3b, 0x59, 0x47, 0x46, 0x6c, 0x02, 0x9d, 0xec, 0x9a, 0x14, 0xf8, 0x02, 0xc8, 0x3a, 0x89, 0xfa,
+	0xca, 0x80, 0xfc, 0x59, 0x61, 0x9a, 0x65, 0x3f, 0x14, 0x50, 0x6f, 0x38, 0x7d, 0x09, 0x8d, 0x78,
+	0xcf, 0x51, 0x54, 0xec, 0x8e, 0xf5, 0xe2, 0xf2, 0x0d, 0x1f, 0x3a, 0x7b, 0x8e, 0xb6, 0xc8, 0xe6,
+	0xf2, 0xd5, 0x03, 0xf9, 0xe4, 0xc0, 0xb7, 0x46, 0xe9, 0xdb, 0x6b, 0x68, 0xa4, 0x35, 0xe8, 0x31,
+	0x1c, 0x99, 0x9f, 0x2c, 0xf3, 0x5a, 0x7f, 0x44, 0x5b, 0x40, 0xe6, 0x96, 0xa3, 0x2b, 0x14, 0xa0,
+	0x79, 0x69, 0xcd, 0x2c, 0xc7, 0xd2, 0x55, 0xf6, 0x06, 0xc0, 0xd9, 0xf9, 0xf9, 0x5b, 0x3e, 0x05,
+	0x12, 0xf0, 0x5c, 0xbd, 0x56, 0x11, 0x64, 0xa7, 0x38, 0x3b, 0x01, 0x4d, 0x5c, 0x96, 0x16, 0xbd,
+	0x87, 0xce, 0x17, 0x37, 0x5e, 0xac, 0x1e, 0x36, 0xba, 0x74, 0x2d, 0xdb, 0x8d, 0xdc, 0x35, 0x17,
+	0x40, 0x30, 0xad, 0x04, 0x7d, 0xe1, 0xed, 0x0a, 0xbd, 0xbb, 0x55, 0x2c, 0xa8, 0xc4, 0x96, 0x91,
+	0x1c, 0xb6, 0xfa, 0xb7, 0xf5, 0xeb, 0x43, 0x6b, 0x29, 0xe6, 0x96, 0xd9, 0xd1, 0xb6, 0xf3, 0x70,
+	0xfc, 0x53, 0x85, 0xae, 0x19, 0x7c, 0xe3, 0x6e, 0x88, 0x53, 0x7f, 0x39, 0xdf, 0xba, 0x9c, 0x8e,
+	0x80, 0x5c, 0x61, 0x4c, 0x4f, 0x8b, 0x52, 0xe5, 0xb7, 0x60, 0xf4, 0xea, 0xa0, 0x9c, 0xe6, 0x08,
+	0x88, 0x39, 0x9d, 0x57, 0x18, 0xe5, 0x3e, 0x1b, 0xbd, 0x3a, 0x28, 0x19, 0x1f, 0xa0, 0x99, 0x2d,
+	0x12, 0x3d, 0x2f, 0xf2, 0xb5, 0x75, 0x34, 0x9e, 0x1c, 0xe0, 0x92, 0x3a, 0x81, 0x46, 0xba, 0x4a,
+	0xb4, 0x2c, 0x5c, 0x59, 0x40, 0xe3, 0xec, 0x37, 0xb4, 0x54, 0xe8, 0xec, 0xfc, 0x8a, 0xc2, 0x72,
+	0x9a, 0x46, 0xaf, 0x0e, 0x4a, 0xc6, 0x3b, 0x38, 0x12, 0xde, 0xd3, 0xb2, 0x62, 0x75, 0x8a, 0xc6,
+	0x69, 0x1d, 0x16, 0x23, 0x1a, 0x29, 0x5f, 0x9b, 0xe2, 0xf7, 0x33, 0xf9, 0x35, 0x00, 0xc5, 0x86,
+	0xa2, 0x0d, 0x97, 0x04, 0x00, 0x00,
+}
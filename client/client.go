@@ -0,0 +1,439 @@
+// Package client provides a Go client for the tendermint-cas-demo HTTP API.
+//
+// A Client is constructed with the API addresses of one or more nodes in the
+// same network, and fails over between them if a node is unreachable or, for
+// reads, can't reach its Tendermint node. Consumers that want to be unit-testable should
+// depend on the KV interface, which is also implemented by Fake.
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors returned by KV implementations.
+var (
+	// ErrNotFound is returned by Get when the key doesn't exist.
+	ErrNotFound = errors.New("key not found")
+
+	// ErrConflict is returned by CompareAndSwap and Delete when the current
+	// value of the key isn't the expected old value.
+	ErrConflict = errors.New("compare-and-swap conflict")
+)
+
+// KV is the set of operations supported by the compare-and-swap store.
+type KV interface {
+	// Get returns the current value of the key, or ErrNotFound.
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// CompareAndSwap sets the key to new, if its current value is old. A key
+	// that doesn't exist has an empty value. Returns ErrConflict if the
+	// current value isn't old.
+	CompareAndSwap(ctx context.Context, key string, old, new []byte) error
+
+	// Delete removes the key, if its current value is old. Returns
+	// ErrConflict if the current value isn't old.
+	Delete(ctx context.Context, key string, old []byte) error
+
+	// List returns every key with the prefix, and its value, in key order.
+	List(ctx context.Context, prefix string) ([]KeyValue, error)
+
+	// Watch calls f with each committed change to the key, or to every key
+	// with the prefix, until the context is canceled or f returns an error.
+	Watch(ctx context.Context, key string, prefix bool, f func(Event) error) error
+
+	// History returns every committed change to the key, in order.
+	History(ctx context.Context, key string) ([]Event, error)
+}
+
+// KeyValue is a single key and its value.
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// Event describes a committed change to a key.
+type Event struct {
+	Height  int64
+	Key     string
+	Value   []byte
+	Deleted bool
+}
+
+// Error is returned when the API responds with an unexpected status code.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Backoff configures the retries made by Update.
+type Backoff struct {
+	Initial  time.Duration // delay after the first conflict
+	Max      time.Duration // delays double after each conflict, up to this
+	Attempts int           // give up after this many attempts; 0 means never
+}
+
+// DefaultBackoff is used by Update unless otherwise configured.
+var DefaultBackoff = Backoff{
+	Initial:  50 * time.Millisecond,
+	Max:      2 * time.Second,
+	Attempts: 20,
+}
+
+// Client is a KV calling out to the HTTP API of one or more nodes.
+type Client struct {
+	endpoints []string
+	client    *http.Client
+	backoff   Backoff
+
+	mtx     sync.Mutex
+	current int // index of the endpoint that last worked
+}
+
+var _ KV = (*Client)(nil)
+
+// Option configures optional aspects of a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used to make requests. It shouldn't have
+// a timeout, as that would break Watch; use contexts instead. By default,
+// http.DefaultClient is used.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Client) { c.client = client }
+}
+
+// WithBackoff configures the retries made by Update.
+// By default, DefaultBackoff is used.
+func WithBackoff(b Backoff) Option {
+	return func(c *Client) { c.backoff = b }
+}
+
+// New returns a client for the nodes with the given API addresses, e.g.
+// "localhost:8081" or "http://10.1.2.3:8081". Requests are sent to one node at
+// a time, failing over to the next if it's unreachable or, for reads,
+// unhealthy. A write that may have reached a node isn't sent to another, as it
+// may have been applied, so that it would then conflict with itself.
+func New(endpoints []string, options ...Option) (*Client, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("no endpoints")
+	}
+	c := &Client{
+		client:  http.DefaultClient,
+		backoff: DefaultBackoff,
+	}
+	for _, endpoint := range endpoints {
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", endpoint, err)
+		}
+		c.endpoints = append(c.endpoints, strings.TrimRight(u.String(), "/"))
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c, nil
+}
+
+// Get implements KV.
+func (c *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	var response apiResponse
+	if err := c.call(ctx, "GET", "/"+url.PathEscape(key), nil, &response); err != nil {
+		return nil, err
+	}
+	if response.Code == codeKeyNotFound {
+		return nil, ErrNotFound
+	}
+	return []byte(response.Value), nil
+}
+
+// CompareAndSwap implements KV.
+func (c *Client) CompareAndSwap(ctx context.Context, key string, old, new []byte) error {
+	query := url.Values{"old": {string(old)}, "new": {string(new)}}
+	return c.call(ctx, "POST", "/"+url.PathEscape(key), query, nil)
+}
+
+// Delete implements KV.
+func (c *Client) Delete(ctx context.Context, key string, old []byte) error {
+	query := url.Values{"old": {string(old)}}
+	return c.call(ctx, "DELETE", "/"+url.PathEscape(key), query, nil)
+}
+
+// List implements KV.
+func (c *Client) List(ctx context.Context, prefix string) ([]KeyValue, error) {
+	var response apiResponse
+	if err := c.call(ctx, "GET", "/", url.Values{"prefix": {prefix}}, &response); err != nil {
+		return nil, err
+	}
+	kvs := make([]KeyValue, len(response.KVs))
+	for i, kv := range response.KVs {
+		kvs[i] = KeyValue{Key: kv.Key, Value: []byte(kv.Value)}
+	}
+	return kvs, nil
+}
+
+// Watch implements KV. If the connection to the node is lost, Watch returns an
+// error rather than reconnecting, as changes may have been missed.
+func (c *Client) Watch(ctx context.Context, key string, prefix bool, f func(Event) error) error {
+	var (
+		path  = "/" + url.PathEscape(key)
+		query = url.Values{"watch": {"true"}}
+	)
+	if prefix {
+		path = "/"
+		query.Set("prefix", key)
+	}
+
+	resp, err := c.do(ctx, "GET", path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	s := bufio.NewScanner(resp.Body)
+	s.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for s.Scan() {
+		var ev apiEvent
+		if err := json.Unmarshal(s.Bytes(), &ev); err != nil {
+			return err
+		}
+		if ev.Error != "" {
+			return errors.New(ev.Error)
+		}
+		if err := f(Event{
+			Height:  ev.Height,
+			Key:     ev.Key,
+			Value:   []byte(ev.Value),
+			Deleted: ev.Deleted,
+		}); err != nil {
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// History implements KV.
+func (c *Client) History(ctx context.Context, key string) ([]Event, error) {
+	var response apiResponse
+	if err := c.call(ctx, "GET", "/"+url.PathEscape(key), url.Values{"history": {"true"}}, &response); err != nil {
+		return nil, err
+	}
+	events := make([]Event, len(response.Events))
+	for i, ev := range response.Events {
+		events[i] = Event{
+			Height:  ev.Height,
+			Key:     ev.Key,
+			Value:   []byte(ev.Value),
+			Deleted: ev.Deleted,
+		}
+	}
+	return events, nil
+}
+
+// Update reads the current value of the key, calls f to compute a new value,
+// and swaps it in. If another writer got there first, it tries again, with
+// backoff. A key that doesn't exist has a nil old value. If f returns an
+// error, Update stops and returns it.
+func (c *Client) Update(ctx context.Context, key string, f func(old []byte) ([]byte, error)) error {
+	return update(ctx, c, c.backoff, key, f)
+}
+
+// call makes a request, and decodes a successful response into dst, if it's
+// non-nil. Unsuccessful responses are converted to errors.
+func (c *Client) call(ctx context.Context, method, path string, query url.Values, dst *apiResponse) error {
+	resp, err := c.do(ctx, method, path, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	if dst == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
+
+// do sends the request to the current endpoint, failing over to the others if
+// it's unreachable, or, if the request is idempotent, if it reports that it
+// can't reach Tendermint. The caller must close the response body.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values) (*http.Response, error) {
+	c.mtx.Lock()
+	first := c.current
+	c.mtx.Unlock()
+
+	var lastErr error
+	for i := 0; i < len(c.endpoints); i++ {
+		index := (first + i) % len(c.endpoints)
+		req, err := http.NewRequest(method, c.endpoints[index]+path+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.client.Do(req.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if !idempotent(method) && !isDialError(err) {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		if idempotent(method) && failover(resp.StatusCode) {
+			lastErr = responseError(resp)
+			resp.Body.Close()
+			continue
+		}
+		c.mtx.Lock()
+		c.current = index
+		c.mtx.Unlock()
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// failover returns true if the status code indicates a problem with the node,
+// rather than with the request, so it's worth trying another node.
+func failover(code int) bool {
+	switch code {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// Application response codes, as reported by the API in apiResponse.Code.
+const (
+	codeCASFailure  = 514
+	codeKeyNotFound = 515
+)
+
+// idempotent returns true if requests with the method can be sent again,
+// e.g. to another node, without changing their effect.
+func idempotent(method string) bool {
+	return method == "GET" || method == "HEAD"
+}
+
+// isDialError returns true if the error means that the request couldn't have
+// reached the node, so it's safe to send it to another.
+func isDialError(err error) bool {
+	if e, ok := err.(*url.Error); ok {
+		err = e.Err
+	}
+	e, ok := err.(*net.OpError)
+	return ok && e.Op == "dial"
+}
+
+func responseError(resp *http.Response) error {
+	buf, _ := ioutil.ReadAll(resp.Body)
+	var response apiResponse
+	if err := json.Unmarshal(buf, &response); err == nil && response.Error != "" {
+		if response.Code == codeCASFailure {
+			return ErrConflict
+		}
+		message := response.Error
+		if response.Log != "" {
+			message += ": " + response.Log
+		}
+		return &Error{StatusCode: resp.StatusCode, Message: message}
+	}
+	return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(buf))}
+}
+
+func update(ctx context.Context, kv KV, b Backoff, key string, f func(old []byte) ([]byte, error)) error {
+	delay := b.Initial
+	for attempt := 1; ; attempt++ {
+		old, err := kv.Get(ctx, key)
+		if err == ErrNotFound {
+			old, err = nil, nil
+		}
+		if err != nil {
+			return err
+		}
+
+		new, err := f(old)
+		if err != nil {
+			return err
+		}
+
+		err = kv.CompareAndSwap(ctx, key, old, new)
+		if err != ErrConflict {
+			return err
+		}
+		if b.Attempts > 0 && attempt >= b.Attempts {
+			return err
+		}
+
+		// Reads are served from committed state, but writes are checked
+		// against pending state, so conflicts persist until the competing
+		// write is committed. Jitter keeps competing writers from retrying
+		// in lockstep.
+		var jittered time.Duration
+		if delay > 0 {
+			jittered = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		}
+		select {
+		case <-time.After(jittered):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if delay *= 2; delay > b.Max {
+			delay = b.Max
+		}
+	}
+}
+
+// These mirror the JSON produced by the HTTP API.
+
+type apiResponse struct {
+	Key    string        `json:"key,omitempty"`
+	Value  string        `json:"value,omitempty"`
+	KVs    []apiKeyValue `json:"kvs,omitempty"`
+	Events []apiEvent    `json:"events,omitempty"`
+	Error  string        `json:"error,omitempty"`
+	Log    string        `json:"log,omitempty"`
+	Code   uint32        `json:"code,omitempty"`
+}
+
+type apiKeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type apiEvent struct {
+	Height  int64  `json:"height,omitempty"`
+	Key     string `json:"key,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
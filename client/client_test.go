@@ -0,0 +1,292 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientFailover(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(`{"error":"Tendermint is down"}`))
+	}))
+	defer broken.Close()
+
+	working := httptest.NewServer(newTestAPI(NewFake()))
+	defer working.Close()
+
+	c, err := New([]string{broken.URL, strings.TrimPrefix(working.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if want, have := ErrNotFound, func() error { _, err := c.Get(ctx, "a:b"); return err }(); want != have {
+		t.Errorf("Get(a:b): want %v, have %v", want, have)
+	}
+	if err := c.CompareAndSwap(ctx, "a:b", nil, []byte("one")); err != nil {
+		t.Errorf("CompareAndSwap(a:b): %v", err)
+	}
+	if want, have := ErrConflict, c.CompareAndSwap(ctx, "a:b", nil, []byte("two")); want != have {
+		t.Errorf("CompareAndSwap(a:b): want %v, have %v", want, have)
+	}
+	value, err := c.Get(ctx, "a:b")
+	if err != nil {
+		t.Errorf("Get(a:b): %v", err)
+	}
+	if want, have := "one", string(value); want != have {
+		t.Errorf("Get(a:b): want %q, have %q", want, have)
+	}
+	if err := c.CompareAndSwap(ctx, "c", nil, []byte("three")); err != nil {
+		t.Errorf("CompareAndSwap(c): %v", err)
+	}
+	if err := c.Delete(ctx, "c", []byte("three")); err != nil {
+		t.Errorf("Delete(c): %v", err)
+	}
+	events, err := c.History(ctx, "c")
+	if err != nil {
+		t.Errorf("History(c): %v", err)
+	}
+	if want, have := []Event{
+		{Height: 2, Key: "c", Value: []byte("three")},
+		{Height: 3, Key: "c", Value: []byte{}, Deleted: true},
+	}, events; !reflect.DeepEqual(want, have) {
+		t.Errorf("History(c): want %+v, have %+v", want, have)
+	}
+	kvs, err := c.List(ctx, "")
+	if err != nil {
+		t.Errorf("List: %v", err)
+	}
+	if want, have := []KeyValue{{Key: "a:b", Value: []byte("one")}}, kvs; !reflect.DeepEqual(want, have) {
+		t.Errorf("List: want %v, have %v", want, have)
+	}
+
+	broken.Close() // all endpoints down
+	working.Close()
+	if _, err := c.Get(ctx, "a:b"); err == nil {
+		t.Errorf("Get(a:b): want error, have none")
+	}
+}
+
+func TestClientFailoverWrites(t *testing.T) {
+	// A node that can't say whether a write was applied, e.g. because its
+	// Tendermint node timed out, may have applied it.
+	applied := NewFake()
+	unsure := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		applied.CompareAndSwap(r.Context(), strings.TrimPrefix(r.URL.Path, "/"), []byte(q.Get("old")), []byte(q.Get("new")))
+		w.WriteHeader(http.StatusGatewayTimeout)
+		w.Write([]byte(`{"error":"timed out"}`))
+	}))
+	defer unsure.Close()
+	working := httptest.NewServer(newTestAPI(applied))
+	defer working.Close()
+
+	// So the write isn't sent to another node, where it would conflict with
+	// itself, and the error is returned.
+	c, err := New([]string{unsure.URL, working.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	err = c.CompareAndSwap(ctx, "a", nil, []byte("one"))
+	if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("CompareAndSwap(a): want %d, have %v", http.StatusGatewayTimeout, err)
+	}
+	if value, err := applied.Get(ctx, "a"); err != nil || string(value) != "one" {
+		t.Fatalf("Get(a): want %q, have %q, %v", "one", value, err)
+	}
+
+	// But a write that couldn't be sent at all is.
+	unsure.Close()
+	if err := c.CompareAndSwap(ctx, "a", []byte("one"), []byte("two")); err != nil {
+		t.Fatalf("CompareAndSwap(a): %v", err)
+	}
+	if value, err := c.Get(ctx, "a"); err != nil || string(value) != "two" {
+		t.Fatalf("Get(a): want %q, have %q, %v", "two", value, err)
+	}
+}
+
+func TestClientUpdate(t *testing.T) {
+	server := httptest.NewServer(newTestAPI(NewFake()))
+	defer server.Close()
+
+	c, err := New([]string{server.URL}, WithBackoff(Backoff{Initial: time.Millisecond, Max: 10 * time.Millisecond}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		ctx = context.Background()
+		n   = 10
+		wg  sync.WaitGroup
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.Update(ctx, "counter", func(old []byte) ([]byte, error) {
+				i, _ := strconv.Atoi(string(old))
+				return []byte(strconv.Itoa(i + 1)), nil
+			}); err != nil {
+				t.Errorf("Update: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := c.Get(ctx, "counter")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if want, have := strconv.Itoa(n), string(value); want != have {
+		t.Errorf("counter: want %s, have %s", want, have)
+	}
+}
+
+func TestClientWatch(t *testing.T) {
+	fake := NewFake()
+	server := httptest.NewServer(newTestAPI(fake))
+	defer server.Close()
+
+	c, err := New([]string{server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan Event)
+	go c.Watch(ctx, "x/", true, func(ev Event) error {
+		events <- ev
+		return nil
+	})
+	waitForWatchers(t, fake, 1)
+
+	fake.CompareAndSwap(ctx, "y", nil, []byte("ignored"))
+	fake.CompareAndSwap(ctx, "x/1", nil, []byte("one"))
+	fake.Delete(ctx, "x/1", []byte("one"))
+
+	for _, want := range []Event{
+		{Height: 2, Key: "x/1", Value: []byte("one")},
+		{Height: 3, Key: "x/1", Value: []byte{}, Deleted: true},
+	} {
+		select {
+		case have := <-events:
+			if !reflect.DeepEqual(want, have) {
+				t.Errorf("Watch: want %+v, have %+v", want, have)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Watch: timeout waiting for %+v", want)
+		}
+	}
+}
+
+func waitForWatchers(t *testing.T, f *Fake, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		f.mtx.Lock()
+		have := len(f.watchers)
+		f.mtx.Unlock()
+		if have >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %d watcher(s)", n)
+}
+
+// newTestAPI serves a KV with the same protocol as the HTTP API.
+func newTestAPI(kv KV) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			ctx   = r.Context()
+			key   = strings.TrimPrefix(r.URL.Path, "/")
+			query = r.URL.Query()
+			enc   = json.NewEncoder(w)
+		)
+		fail := func(err error) {
+			switch err {
+			case ErrNotFound:
+				enc.Encode(apiResponse{Key: key, Log: err.Error(), Code: codeKeyNotFound})
+			case ErrConflict:
+				w.WriteHeader(http.StatusBadRequest)
+				enc.Encode(apiResponse{Key: key, Error: "result code 514", Log: err.Error(), Code: codeCASFailure})
+			default:
+				w.WriteHeader(http.StatusInternalServerError)
+				enc.Encode(apiResponse{Key: key, Error: err.Error()})
+			}
+		}
+
+		switch {
+		case r.Method == "GET" && query.Get("history") == "true":
+			events, err := kv.History(ctx, key)
+			if err != nil {
+				fail(err)
+				return
+			}
+			response := apiResponse{Key: key}
+			for _, ev := range events {
+				response.Events = append(response.Events, apiEvent{Height: ev.Height, Key: ev.Key, Value: string(ev.Value), Deleted: ev.Deleted})
+			}
+			enc.Encode(response)
+
+		case r.Method == "GET" && query.Get("watch") == "true":
+			prefix := key == ""
+			if prefix {
+				key = query.Get("prefix")
+			}
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			kv.Watch(ctx, key, prefix, func(ev Event) error {
+				enc.Encode(apiEvent{Height: ev.Height, Key: ev.Key, Value: string(ev.Value), Deleted: ev.Deleted})
+				w.(http.Flusher).Flush()
+				return nil
+			})
+
+		case r.Method == "GET" && key == "":
+			kvs, err := kv.List(ctx, query.Get("prefix"))
+			if err != nil {
+				fail(err)
+				return
+			}
+			var response apiResponse
+			for _, kv := range kvs {
+				response.KVs = append(response.KVs, apiKeyValue{Key: kv.Key, Value: string(kv.Value)})
+			}
+			enc.Encode(response)
+
+		case r.Method == "GET":
+			value, err := kv.Get(ctx, key)
+			if err != nil {
+				fail(err)
+				return
+			}
+			enc.Encode(apiResponse{Key: key, Value: string(value)})
+
+		case r.Method == "POST":
+			if err := kv.CompareAndSwap(ctx, key, []byte(query.Get("old")), []byte(query.Get("new"))); err != nil {
+				fail(err)
+				return
+			}
+			enc.Encode(apiResponse{Key: key, Value: query.Get("new")})
+
+		case r.Method == "DELETE":
+			if err := kv.Delete(ctx, key, []byte(query.Get("old"))); err != nil {
+				fail(err)
+				return
+			}
+			enc.Encode(apiResponse{Key: key})
+		}
+	})
+}
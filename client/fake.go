@@ -0,0 +1,158 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Fake is an in-memory KV for use in tests. It has the same compare-and-swap
+// semantics as the real store, except that every change is committed
+// immediately, at a new height.
+type Fake struct {
+	mtx      sync.Mutex
+	data     map[string][]byte
+	height   int64
+	history  map[string][]Event
+	watchers map[*fakeWatcher]struct{}
+
+	// Backoff is used by Update.
+	Backoff Backoff
+}
+
+var _ KV = (*Fake)(nil)
+
+// NewFake returns an empty Fake.
+func NewFake() *Fake {
+	return &Fake{
+		data:     map[string][]byte{},
+		history:  map[string][]Event{},
+		watchers: map[*fakeWatcher]struct{}{},
+		Backoff:  DefaultBackoff,
+	}
+}
+
+// Get implements KV.
+func (f *Fake) Get(ctx context.Context, key string) ([]byte, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	value, ok := f.data[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+// CompareAndSwap implements KV.
+func (f *Fake) CompareAndSwap(ctx context.Context, key string, old, new []byte) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if !bytes.Equal(f.data[key], old) {
+		return ErrConflict
+	}
+	f.data[key] = append([]byte{}, new...)
+	f.commit(Event{Key: key, Value: f.data[key]})
+	return nil
+}
+
+// Delete implements KV.
+func (f *Fake) Delete(ctx context.Context, key string, old []byte) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if !bytes.Equal(f.data[key], old) {
+		return ErrConflict
+	}
+	delete(f.data, key)
+	f.commit(Event{Key: key, Deleted: true})
+	return nil
+}
+
+// List implements KV.
+func (f *Fake) List(ctx context.Context, prefix string) ([]KeyValue, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	kvs := []KeyValue{}
+	for k, v := range f.data {
+		if strings.HasPrefix(k, prefix) {
+			kvs = append(kvs, KeyValue{Key: k, Value: v})
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs, nil
+}
+
+// Watch implements KV.
+func (f *Fake) Watch(ctx context.Context, key string, prefix bool, fn func(Event) error) error {
+	w := &fakeWatcher{key: key, prefix: prefix, events: make(chan Event, 1024)}
+	f.mtx.Lock()
+	f.watchers[w] = struct{}{}
+	f.mtx.Unlock()
+	defer func() {
+		f.mtx.Lock()
+		delete(f.watchers, w)
+		f.mtx.Unlock()
+	}()
+
+	for {
+		select {
+		case ev, ok := <-w.events:
+			if !ok {
+				return errors.New("watcher fell too far behind")
+			}
+			if err := fn(ev); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// History implements KV.
+func (f *Fake) History(ctx context.Context, key string) ([]Event, error) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return append([]Event{}, f.history[key]...), nil
+}
+
+// Update reads the current value of the key, calls f to compute a new value,
+// and swaps it in, retrying on conflict, like Client.Update.
+func (f *Fake) Update(ctx context.Context, key string, fn func(old []byte) ([]byte, error)) error {
+	return update(ctx, f, f.Backoff, key, fn)
+}
+
+// commit increments the height, and notifies watchers of the change.
+// The caller must hold the mutex.
+func (f *Fake) commit(ev Event) {
+	f.height++
+	ev.Height = f.height
+	f.history[ev.Key] = append(f.history[ev.Key], ev)
+	for w := range f.watchers {
+		if !w.match(ev.Key) || w.overflowed {
+			continue
+		}
+		select {
+		case w.events <- ev:
+		default:
+			w.overflowed = true
+			close(w.events)
+		}
+	}
+}
+
+type fakeWatcher struct {
+	key        string
+	prefix     bool
+	events     chan Event
+	overflowed bool
+}
+
+func (w *fakeWatcher) match(key string) bool {
+	if w.prefix {
+		return strings.HasPrefix(key, w.key)
+	}
+	return key == w.key
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/client"
+	"github.com/peterbourgon/usage"
+	"github.com/pkg/errors"
+)
+
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	var (
+		endpoint      = fs.String("endpoint", "127.0.0.1:8081", "comma-separated HTTP API addresses, of which each client uses one")
+		concurrency   = fs.Int("concurrency", 16, "number of concurrent clients")
+		reads         = fs.Float64("reads", 0.5, "fraction of operations that are gets, rather than compare-and-swaps")
+		keys          = fs.Int("keys", 1000, "number of keys")
+		distribution  = fs.String("distribution", "uniform", "distribution of operations over keys: uniform or zipfian")
+		zipfS         = fs.Float64("zipf-s", 1.1, "exponent of the zipfian distribution, greater than 1; the greater, the more contention for the first few keys")
+		valueSize     = fs.Int("value-size", 64, "size of values, in bytes")
+		duration      = fs.Duration("duration", 30*time.Second, "how long to run for")
+		timeout       = fs.Duration("timeout", 5*time.Second, "timeout for each operation")
+		commitTimeout = fs.Duration("commit-timeout", 5*time.Second, "how long to wait after the run for compare-and-swaps that passed CheckTx to be committed")
+		prefix        = fs.String("prefix", "bench-", "prefix of the keys, to which a unique run ID is added; keys can't contain slashes")
+		seed          = fs.Int64("seed", 0, "seed for the clients' choices (default the time)")
+		output        = fs.String("output", "table", "output format: table or json")
+	)
+	fs.Usage = usage.For(fs, "tendermint-cas-demo bench [flags]")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return usageError(fmt.Sprintf("want 0 arguments, have %d", fs.NArg()))
+	}
+	switch {
+	case *concurrency < 1 || *keys < 1:
+		return usageError("-concurrency and -keys must be at least 1")
+	case *reads < 0 || *reads > 1:
+		return usageError("-reads must be between 0 and 1")
+	case *distribution != "uniform" && *distribution != "zipfian":
+		return usageError(fmt.Sprintf("invalid -distribution %q", *distribution))
+	case *distribution == "zipfian" && *zipfS <= 1:
+		return usageError("-zipf-s must be greater than 1")
+	case *output != "table" && *output != "json":
+		return usageError(fmt.Sprintf("invalid -output %q", *output))
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	b := &bench{
+		prefix:        fmt.Sprintf("%s%d-", *prefix, time.Now().UnixNano()),
+		keys:          *keys,
+		reads:         *reads,
+		valueSize:     *valueSize,
+		timeout:       *timeout,
+		commitTimeout: *commitTimeout,
+		seed:          *seed,
+	}
+	if *distribution == "zipfian" {
+		b.zipfS = *zipfS
+	}
+	endpoints := strings.Split(*endpoint, ",")
+	for i := 0; i < *concurrency; i++ {
+		c, err := client.New([]string{endpoints[i%len(endpoints)]})
+		if err != nil {
+			return err
+		}
+		b.clients = append(b.clients, c)
+	}
+
+	if *output == "table" {
+		fmt.Fprintf(os.Stderr, "running %d client(s) on %d %s key(s) for %s, with seed %d\n", *concurrency, *keys, *distribution, *duration, *seed)
+	}
+	result, err := b.run(*duration)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return writeJSON(os.Stdout, result)
+	}
+	return result.writeTable(os.Stdout)
+}
+
+// bench runs clients that get and compare-and-swap random keys, as fast as
+// they can, and measures their latency. Each compare-and-swap returns once
+// it's passed CheckTx, and writes a value that's never been written before, so
+// a watch of every key, through the first client's node, can tell when it's
+// committed.
+type bench struct {
+	clients       []client.KV
+	prefix        string // of the keys, which should be unused
+	keys          int
+	reads         float64 // fraction of operations that are gets
+	zipfS         float64 // or 0 for a uniform distribution
+	valueSize     int
+	timeout       time.Duration // for each operation
+	commitTimeout time.Duration // after the run
+	seed          int64
+
+	mtx       sync.Mutex
+	known     map[string]string    // the last value seen of each key
+	accepted  map[string]time.Time // when compare-and-swaps of each value returned
+	committed map[string]time.Time // when each value was seen to be committed
+}
+
+// benchStats are one client's measurements.
+type benchStats struct {
+	gets, swaps []time.Duration // latencies of successful operations
+	conflicts   int
+	errors      int
+}
+
+// run the clients for the duration, once the watch has started, and then wait
+// for the writes they made to be committed. A write that passed CheckTx, but
+// failed in DeliverTx, never is, so if there are any, it waits for the whole
+// commit timeout.
+func (b *bench) run(duration time.Duration) (*benchResult, error) {
+	b.known = map[string]string{}
+	b.accepted = map[string]time.Time{}
+	b.committed = map[string]time.Time{}
+
+	watchCtx, cancelWatch := context.WithCancel(context.Background())
+	defer cancelWatch()
+	watched := make(chan error, 1)
+	go func() {
+		watched <- b.clients[0].Watch(watchCtx, b.prefix, true, func(ev client.Event) error {
+			b.mtx.Lock()
+			defer b.mtx.Unlock()
+			b.committed[string(ev.Value)] = time.Now()
+			return nil
+		})
+	}()
+	if err := b.waitForWatch(watched); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+	var (
+		begin = time.Now()
+		stats = make([]benchStats, len(b.clients))
+		wg    sync.WaitGroup
+	)
+	for i := range b.clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b.runClient(ctx, i, &stats[i])
+		}(i)
+	}
+	wg.Wait()
+	elapsed := time.Since(begin)
+
+	deadline := time.After(b.commitTimeout)
+	for b.uncommitted() > 0 {
+		select {
+		case err := <-watched:
+			return nil, errors.Wrap(err, "watch")
+		case <-deadline:
+			return b.result(elapsed, stats), nil
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return b.result(elapsed, stats), nil
+}
+
+// waitForWatch writes a key, and waits until the watch has seen it, as the
+// watch might otherwise miss the first writes.
+func (b *bench) waitForWatch(watched <-chan error) error {
+	key, value := b.prefix+"ready", b.prefix
+	ctx, cancel := context.WithTimeout(context.Background(), b.commitTimeout)
+	defer cancel()
+	if err := b.clients[0].CompareAndSwap(ctx, key, nil, []byte(value)); err != nil {
+		return errors.Wrap(err, "writing the first key")
+	}
+	for {
+		b.mtx.Lock()
+		_, ok := b.committed[value]
+		b.mtx.Unlock()
+		if ok {
+			return nil
+		}
+		select {
+		case err := <-watched:
+			return errors.Wrap(err, "watch")
+		case <-ctx.Done():
+			return errors.New("the watch didn't see the first key committed")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (b *bench) runClient(ctx context.Context, i int, stats *benchStats) {
+	var (
+		kv   = b.clients[i]
+		rng  = rand.New(rand.NewSource(b.seed + int64(i)))
+		zipf *rand.Zipf
+	)
+	if b.zipfS > 0 {
+		zipf = rand.NewZipf(rng, b.zipfS, 1, uint64(b.keys-1))
+	}
+	for seq := 0; ctx.Err() == nil; seq++ {
+		k := rng.Intn(b.keys)
+		if zipf != nil {
+			k = int(zipf.Uint64())
+		}
+		key := fmt.Sprintf("%s%d", b.prefix, k)
+
+		opCtx, cancel := context.WithTimeout(context.Background(), b.timeout)
+		if rng.Float64() < b.reads {
+			begin := time.Now()
+			value, err := kv.Get(opCtx, key)
+			latency := time.Since(begin)
+			cancel()
+			switch err {
+			case nil, client.ErrNotFound:
+				stats.gets = append(stats.gets, latency)
+				b.mtx.Lock()
+				b.known[key] = string(value)
+				b.mtx.Unlock()
+			default:
+				stats.errors++
+			}
+			continue
+		}
+
+		b.mtx.Lock()
+		old := b.known[key]
+		b.mtx.Unlock()
+		new := b.value(i, seq)
+		begin := time.Now()
+		err := kv.CompareAndSwap(opCtx, key, []byte(old), []byte(new))
+		returned := time.Now()
+		cancel()
+		switch err {
+		case nil:
+			stats.swaps = append(stats.swaps, returned.Sub(begin))
+			b.mtx.Lock()
+			b.known[key] = new
+			b.accepted[new] = returned
+			b.mtx.Unlock()
+		case client.ErrConflict:
+			stats.conflicts++
+		default:
+			stats.errors++
+		}
+	}
+}
+
+// value returns a unique value of the client's, of the value size, or longer
+// if it's too short to be unique.
+func (b *bench) value(i, seq int) string {
+	v := fmt.Sprintf("%d-%d-", i, seq)
+	if len(v) < b.valueSize {
+		v += strings.Repeat("x", b.valueSize-len(v))
+	}
+	return v
+}
+
+// uncommitted returns the number of accepted compare-and-swaps that haven't
+// been seen to be committed.
+func (b *bench) uncommitted() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	n := 0
+	for value := range b.accepted {
+		if _, ok := b.committed[value]; !ok {
+			n++
+		}
+	}
+	return n
+}
+
+func (b *bench) result(elapsed time.Duration, stats []benchStats) *benchResult {
+	var (
+		r           = &benchResult{Duration: elapsed.Seconds()}
+		gets, swaps []time.Duration
+		commitWaits []time.Duration
+	)
+	for _, s := range stats {
+		gets = append(gets, s.gets...)
+		swaps = append(swaps, s.swaps...)
+		r.Conflicts += s.conflicts
+		r.Errors += s.errors
+	}
+	attempts := len(swaps) + r.Conflicts
+	r.Operations = len(gets) + attempts + r.Errors
+	r.Throughput = float64(r.Operations) / elapsed.Seconds()
+	r.Get = newLatencySummary(gets)
+	r.CAS = newLatencySummary(swaps)
+	if attempts > 0 {
+		r.ConflictRate = float64(r.Conflicts) / float64(attempts)
+	}
+
+	b.mtx.Lock()
+	for value, accepted := range b.accepted {
+		committed, seen := b.committed[value]
+		if !seen {
+			r.Uncommitted++
+			continue
+		}
+		wait := committed.Sub(accepted)
+		if wait < 0 {
+			wait = 0 // the watch saw it before the client did
+		}
+		commitWaits = append(commitWaits, wait)
+	}
+	b.mtx.Unlock()
+	r.CommitWait = newLatencySummary(commitWaits)
+	return r
+}
+
+// benchResult is the output of the bench subcommand. Latencies are in
+// milliseconds.
+type benchResult struct {
+	Duration     float64        `json:"duration_seconds"`
+	Operations   int            `json:"operations"`
+	Throughput   float64        `json:"throughput"` // operations per second
+	Errors       int            `json:"errors"`
+	Get          latencySummary `json:"get"`
+	CAS          latencySummary `json:"cas"`         // until CheckTx passes
+	CommitWait   latencySummary `json:"commit_wait"` // from then until it's committed
+	Conflicts    int            `json:"conflicts"`
+	ConflictRate float64        `json:"conflict_rate"` // of compare-and-swaps that didn't fail
+	Uncommitted  int            `json:"uncommitted"`   // compare-and-swaps that passed CheckTx, but weren't seen to be committed
+}
+
+type latencySummary struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P95   float64 `json:"p95_ms"`
+	P99   float64 `json:"p99_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+func newLatencySummary(latencies []time.Duration) latencySummary {
+	if len(latencies) == 0 {
+		return latencySummary{}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	ms := func(d time.Duration) float64 { return d.Seconds() * 1000 }
+	percentile := func(p float64) float64 {
+		return ms(latencies[int(math.Ceil(p*float64(len(latencies))))-1])
+	}
+	return latencySummary{
+		Count: len(latencies),
+		P50:   percentile(0.50),
+		P95:   percentile(0.95),
+		P99:   percentile(0.99),
+		Max:   ms(latencies[len(latencies)-1]),
+	}
+}
+
+func (r *benchResult) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "%d operation(s) in %.1fs: %.1f/s, %d error(s)\n\n", r.Operations, r.Duration, r.Throughput, r.Errors)
+	fmt.Fprintf(tw, "LATENCY\tCOUNT\tP50\tP95\tP99\tMAX\n")
+	for _, row := range []struct {
+		name string
+		s    latencySummary
+	}{
+		{"get", r.Get},
+		{"cas check", r.CAS},
+		{"cas commit wait", r.CommitWait},
+	} {
+		fmt.Fprintf(tw, "%s\t%d\t%.2fms\t%.2fms\t%.2fms\t%.2fms\n", row.name, row.s.Count, row.s.P50, row.s.P95, row.s.P99, row.s.Max)
+	}
+	fmt.Fprintf(tw, "\n%d conflict(s): %.1f%% of compare-and-swaps\n", r.Conflicts, 100*r.ConflictRate)
+	if r.Uncommitted > 0 {
+		fmt.Fprintf(tw, "%d compare-and-swap(s) passed CheckTx, but weren't seen to be committed\n", r.Uncommitted)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/client"
+)
+
+func TestBenchFake(t *testing.T) {
+	fake := slowKV{client.NewFake()}
+	b := &bench{
+		clients:       []client.KV{fake, fake, fake, fake},
+		prefix:        "bench-",
+		keys:          10,
+		reads:         0.2,
+		zipfS:         1.5,
+		valueSize:     16,
+		timeout:       time.Second,
+		commitTimeout: time.Second,
+		seed:          1,
+	}
+	r, err := b.run(200 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Errors != 0 {
+		t.Errorf("Errors: want 0, have %d", r.Errors)
+	}
+	if want, have := r.Operations, r.Get.Count+r.CAS.Count+r.Conflicts; want != have {
+		t.Errorf("gets, swaps and conflicts: want %d, have %d", want, have)
+	}
+	if r.Get.Count == 0 || r.CAS.Count == 0 || r.Conflicts == 0 {
+		t.Errorf("want some of each of gets, swaps and conflicts, have %d, %d and %d", r.Get.Count, r.CAS.Count, r.Conflicts)
+	}
+	if want, have := r.CAS.Count, r.CommitWait.Count; want != have {
+		t.Errorf("commit waits: want %d, have %d", want, have)
+	}
+	if r.Uncommitted != 0 {
+		t.Errorf("Uncommitted: want 0, have %d", r.Uncommitted)
+	}
+	if want, have := float64(r.Conflicts)/float64(r.Conflicts+r.CAS.Count), r.ConflictRate; want != have {
+		t.Errorf("ConflictRate: want %v, have %v", want, have)
+	}
+	if have := len(b.value(1, 2)); have != 16 {
+		t.Errorf("value size: want 16, have %d", have)
+	}
+}
+
+func TestLatencySummary(t *testing.T) {
+	var latencies []time.Duration
+	for i := 100; i >= 1; i-- {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	want := latencySummary{Count: 100, P50: 50, P95: 95, P99: 99, Max: 100}
+	if have := newLatencySummary(latencies); want != have {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+	if want, have := (latencySummary{}), newLatencySummary(nil); want != have {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+}
@@ -4,38 +4,61 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
 	"github.com/gorilla/mux"
 	"github.com/peterbourgon/ctxlog"
-	tendermintabci "github.com/tendermint/tendermint/abci/types"
-	tendermintrpcclient "github.com/tendermint/tendermint/rpc/client"
-	tenderminttypes "github.com/tendermint/tendermint/types"
 )
 
 // CompareAndSwapAPI provides a simple HTTP API to a Tendermint client running
 // the compare-and-swap key-value ABCI applciation.
 type CompareAndSwapAPI struct {
 	http.Handler
-	client tendermintrpcclient.Client
+	router   *mux.Router
+	store    store
+	status   statusClient
+	minPeers int
 }
 
 // NewCompareAndSwapAPI returns a usable API calling out to the provided
-// Tendermint client.
-func NewCompareAndSwapAPI(client tendermintrpcclient.Client) *CompareAndSwapAPI {
+// Tendermint client. If verifier is non-nil, reads of single keys are verified
+// with it. The node isn't ready for traffic with fewer than minPeers peers.
+func NewCompareAndSwapAPI(client apiClient, verifier *lightClient, minPeers int) *CompareAndSwapAPI {
 	a := &CompareAndSwapAPI{
-		client: client,
+		store:    store{client, verifier},
+		status:   client,
+		minPeers: minPeers,
 	}
 	r := mux.NewRouter()
 	r.StrictSlash(true)
-	r.Methods("GET").Path("/{key}").HandlerFunc(a.handleGet)
-	r.Methods("POST").Path("/{key}").HandlerFunc(a.handleSet)
-	a.Handler = r
+	r.Methods("GET").Path("/admin/healthz").Name("healthz").HandlerFunc(a.handleHealthz)
+	r.Methods("GET").Path("/admin/readyz").Name("readyz").HandlerFunc(a.handleReadyz)
+	r.Methods("GET").Path("/admin/status").Name("status").HandlerFunc(a.handleStatus)
+	r.Methods("GET").Path("/admin/digest").Name("digest").HandlerFunc(a.handleDigest)
+	r.Methods("GET").Path("/admin/snapshot").Name("snapshot").HandlerFunc(a.handleSnapshot)
+	r.Methods("GET").Path("/admin/snapshot/{chunk:[0-9]+}").Name("snapshot_chunk").HandlerFunc(a.handleSnapshotChunk)
+	r.Methods("GET").Path("/").Queries("watch", "true").Name("watch").HandlerFunc(a.handleWatch)
+	r.Methods("GET").Path("/").Name("list").HandlerFunc(a.handleList)
+	r.Methods("GET").Path("/{key}").Queries("watch", "true").Name("watch").HandlerFunc(a.handleWatch)
+	r.Methods("GET").Path("/{key}").Queries("history", "true").Name("history").HandlerFunc(a.handleHistory)
+	r.Methods("GET").Path("/{key}").Name("get").HandlerFunc(a.handleGet)
+	r.Methods("POST").Path("/{key}").Name("set").HandlerFunc(a.handleSet)
+	r.Methods("DELETE").Path("/{key}").Name("delete").HandlerFunc(a.handleDelete)
+	a.Handler, a.router = r, r
 	return a
 }
 
+// Match implements routeMatcher, allowing middlewares to find the name of the
+// route that will serve a request.
+func (a *CompareAndSwapAPI) Match(r *http.Request, match *mux.RouteMatch) bool {
+	return a.router.Match(r, match)
+}
+
 func (a *CompareAndSwapAPI) handleGet(w http.ResponseWriter, r *http.Request) {
 	key := mux.Vars(r)["key"]
 	if key == "" {
@@ -43,17 +66,21 @@ func (a *CompareAndSwapAPI) handleGet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := a.client.ABCIQuery("", []byte(key))
-	if err != nil {
-		respond(w, http.StatusBadGateway, apiResponse{Key: key, Error: err.Error()})
+	result, err := a.store.Get(key)
+	if _, ok := err.(appError); err != nil && !ok {
+		response := errorResponse(key, err)
+		response.Verified = &result.Verified
+		respond(w, errorCodes(err).http, response)
 		return
 	}
 
-	respond(w, http.StatusOK, apiResponse{
-		Key:   key,
-		Value: string(result.Response.Value),
-		Info:  result.Response.Info,
-		Log:   result.Response.Log,
+	respond(w, errorCodes(err).http, apiResponse{
+		Key:      key,
+		Value:    string(result.Value),
+		Code:     result.Code,
+		Info:     result.Info,
+		Log:      result.Log,
+		Verified: &result.Verified,
 	})
 }
 
@@ -70,46 +97,187 @@ func (a *CompareAndSwapAPI) handleSet(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var (
-		old  = r.Form.Get("old")
-		new  = r.Form.Get("new")
-		data = fmt.Sprintf("%s:%s:%s", key, old, new)
+		old = r.Form.Get("old")
+		new = r.Form.Get("new")
 	)
 
-	// BroadcastTxAsync fires-and-forgets. BroadcastTxSync waits until CheckTx
-	// is successful. BroadcastTxCommit waits until the transaction is included
-	// in a signed block.
-	result, err := a.client.BroadcastTxSync(tenderminttypes.Tx(data))
-	if err != nil {
-		respond(w, http.StatusBadGateway, apiResponse{Error: err.Error()})
+	if err := a.store.Txn(cas.SetTx(key, []byte(old), []byte(new))); err != nil {
+		respondError(w, key, err)
+		return
+	}
+
+	respond(w, http.StatusOK, apiResponse{
+		Key:   key,
+		Value: new,
+	})
+}
+
+func (a *CompareAndSwapAPI) handleDelete(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	if key == "" {
+		respond(w, http.StatusBadRequest, apiResponse{Error: "no key"})
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		respond(w, http.StatusInternalServerError, apiResponse{Error: err.Error()})
 		return
 	}
 
-	if result.Code != tendermintabci.CodeTypeOK {
-		respond(w, http.StatusBadRequest, apiResponse{
-			Error: fmt.Sprintf("result code %d", result.Code),
-			Log:   result.Log,
-		})
+	old := r.Form.Get("old")
+
+	if err := a.store.Txn(cas.DeleteTx(key, []byte(old))); err != nil {
+		respondError(w, key, err)
 		return
 	}
 
 	respond(w, http.StatusOK, apiResponse{
-		Key:   key,
-		Value: new,
+		Key: key,
+	})
+}
+
+func (a *CompareAndSwapAPI) handleList(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+
+	kvs, err := a.store.List(prefix)
+	if err != nil {
+		respondError(w, "", err)
+		return
+	}
+
+	response := apiResponse{KVs: make([]apiKeyValue, len(kvs))}
+	for i, kv := range kvs {
+		response.KVs[i] = apiKeyValue{Key: kv.Key, Value: string(kv.Value)}
+	}
+	respond(w, http.StatusOK, response)
+}
+
+func (a *CompareAndSwapAPI) handleHistory(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+
+	events, err := a.store.History(key)
+	if err != nil {
+		respondError(w, key, err)
+		return
+	}
+
+	response := apiResponse{Key: key, Events: make([]apiEvent, len(events))}
+	for i, ev := range events {
+		response.Events[i] = apiEvent{
+			Height:  ev.Height,
+			Key:     ev.KV.Key,
+			Value:   string(ev.KV.Value),
+			Deleted: ev.Deleted,
+		}
+	}
+	respond(w, http.StatusOK, response)
+}
+
+// handleWatch streams committed changes to a key, or to every key with the
+// given prefix, as newline-delimited JSON events. The response status is
+// always 200, as it's sent before the watch is established. If the watch
+// fails, the final event contains an error.
+func (a *CompareAndSwapAPI) handleWatch(w http.ResponseWriter, r *http.Request) {
+	var (
+		key    = mux.Vars(r)["key"]
+		prefix = key == ""
+	)
+	if prefix {
+		key = r.URL.Query().Get("prefix")
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respond(w, http.StatusInternalServerError, apiResponse{Error: "streaming not supported"})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	err := a.store.Watch(r.Context(), key, prefix, func(ev watchEvent) error {
+		if err := enc.Encode(apiEvent{
+			Height:  ev.Height,
+			Key:     ev.KV.Key,
+			Value:   string(ev.KV.Value),
+			Deleted: ev.Deleted,
+		}); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
 	})
+	if err != nil && r.Context().Err() == nil {
+		enc.Encode(apiEvent{Error: err.Error()})
+	}
+}
+
+// respondError reports an error returned by the store, with the status code
+// given by the shared error mapping.
+func respondError(w http.ResponseWriter, key string, err error) {
+	respond(w, errorCodes(err).http, errorResponse(key, err))
+}
+
+func errorResponse(key string, err error) apiResponse {
+	response := apiResponse{Key: key, Error: err.Error()}
+	if e, ok := err.(appError); ok {
+		response.Error = fmt.Sprintf("result code %d", e.code)
+		response.Code = e.code
+		response.Log = e.log
+	}
+	return response
+}
+
+// heightParam returns the height query parameter, or 0 if there isn't one.
+func heightParam(r *http.Request) (int64, error) {
+	s := r.URL.Query().Get("height")
+	if s == "" {
+		return 0, nil
+	}
+	height, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || height < 0 {
+		return 0, fmt.Errorf("invalid height %q", s)
+	}
+	return height, nil
 }
 
 func respond(w http.ResponseWriter, code int, response apiResponse) {
+	respondJSON(w, code, response)
+}
+
+func respondJSON(w http.ResponseWriter, code int, response interface{}) {
 	w.WriteHeader(code)
 	buf, _ := json.MarshalIndent(response, "", "    ")
 	w.Write(buf)
 }
 
 type apiResponse struct {
-	Key   string `json:"key,omitempty"`
-	Value string `json:"value,omitempty"`
-	Error string `json:"error,omitempty"`
-	Info  string `json:"info,omitempty"`
-	Log   string `json:"log,omitempty"`
+	Key    string        `json:"key,omitempty"`
+	Value  string        `json:"value,omitempty"`
+	KVs    []apiKeyValue `json:"kvs,omitempty"`
+	Events []apiEvent    `json:"events,omitempty"`
+	Error  string        `json:"error,omitempty"`
+	Info   string        `json:"info,omitempty"`
+	Log    string        `json:"log,omitempty"`
+
+	// Code is the application's response code, if it's not OK.
+	Code uint32 `json:"code,omitempty"`
+
+	// Verified is set for reads of a single key.
+	Verified *bool `json:"verified,omitempty"`
+}
+
+type apiKeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type apiEvent struct {
+	Height  int64  `json:"height,omitempty"`
+	Key     string `json:"key,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+	Error   string `json:"error,omitempty"`
 }
 
 //
@@ -117,8 +285,9 @@ type apiResponse struct {
 //
 
 type loggingMiddleware struct {
-	next   http.Handler
-	logger log.Logger
+	next     http.Handler
+	logger   log.Logger
+	duration metrics.Histogram // method, route, status_code
 }
 
 func (mw loggingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -131,16 +300,42 @@ func (mw loggingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	iw := &interceptingWriter{w, http.StatusOK}
 	defer func(begin time.Time) {
+		took := time.Since(begin)
 		logger.Log(
 			"http_status_code", iw.code,
-			"http_duration", time.Since(begin),
+			"http_duration", took,
 		)
 		level.Info(mw.logger).Log(logger.Keyvals()...)
+		mw.duration.With(
+			"method", r.Method,
+			"route", routeName(mw.next, r),
+			"status_code", strconv.Itoa(iw.code),
+		).Observe(took.Seconds())
 	}(time.Now())
 
 	mw.next.ServeHTTP(iw, r.WithContext(ctx))
 }
 
+// routeMatcher is implemented by handlers built on a mux.Router.
+type routeMatcher interface {
+	Match(*http.Request, *mux.RouteMatch) bool
+}
+
+// routeName returns the name of the route in h that serves r, so that metrics
+// aren't labeled with unbounded values like keys. Unnamed and unmatched routes
+// are reported as "other".
+func routeName(h http.Handler, r *http.Request) string {
+	m, ok := h.(routeMatcher)
+	if !ok {
+		return "other"
+	}
+	var match mux.RouteMatch
+	if !m.Match(r, &match) || match.Route == nil || match.Route.GetName() == "" {
+		return "other"
+	}
+	return match.Route.GetName()
+}
+
 type interceptingWriter struct {
 	http.ResponseWriter
 	code int
@@ -150,3 +345,11 @@ func (iw *interceptingWriter) WriteHeader(code int) {
 	iw.code = code
 	iw.ResponseWriter.WriteHeader(code)
 }
+
+// Flush implements http.Flusher, if the wrapped writer does, so that streaming
+// responses work through the middleware.
+func (iw *interceptingWriter) Flush() {
+	if f, ok := iw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
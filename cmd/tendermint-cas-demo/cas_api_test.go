@@ -0,0 +1,723 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	"github.com/6thc/tendermint-cas-demo/internal/mockrpc"
+	"github.com/go-kit/kit/log"
+	tendermintabci "github.com/tendermint/tendermint/abci/types"
+	tendermintcommon "github.com/tendermint/tendermint/libs/common"
+	tendermintcoretypes "github.com/tendermint/tendermint/rpc/core/types"
+	"google.golang.org/grpc/codes"
+)
+
+func TestAPIGetSet(t *testing.T) {
+	client, api, done := newTestAPI(t, 0)
+	defer done()
+
+	// A key that doesn't exist isn't found, though, as it always has been,
+	// that's reported with the application's code, not the status.
+	checkNotFound(t, api, "a")
+
+	// A set returns once it's passed CheckTx, but reads are of the committed
+	// state, so it's not seen until the next block.
+	checkSet(t, api, "a", "", "one", http.StatusOK)
+	checkNotFound(t, api, "a")
+	commit(t, client)
+	checkGet(t, api, "a", http.StatusOK, "one")
+
+	// A set conflicts with the committed state, and with sets in the mempool.
+	checkSet(t, api, "a", "", "two", http.StatusBadRequest)
+	checkSet(t, api, "a", "one", "two", http.StatusOK)
+	checkSet(t, api, "a", "one", "three", http.StatusBadRequest)
+	commit(t, client)
+	checkGet(t, api, "a", http.StatusOK, "two")
+
+	// A delete too, and a deleted key isn't found.
+	code, response := do(t, api, "DELETE", "/a?"+url.Values{"old": {"one"}}.Encode())
+	if want, have := http.StatusBadRequest, code; want != have {
+		t.Fatalf("DELETE a: want %d, have %d: %+v", want, have, response)
+	}
+	if want, have := uint32(cas.CodeCASFailure), response.Code; want != have {
+		t.Fatalf("DELETE a: want code %d, have %d", want, have)
+	}
+	code, response = do(t, api, "DELETE", "/a?"+url.Values{"old": {"two"}}.Encode())
+	if want, have := http.StatusOK, code; want != have {
+		t.Fatalf("DELETE a: want %d, have %d: %+v", want, have, response)
+	}
+	commit(t, client)
+	checkNotFound(t, api, "a")
+	if want, have := 0, client.Mempool(); want != have {
+		t.Errorf("mempool: want %d transaction(s), have %d", want, have)
+	}
+}
+
+func TestAPIVerifiedGet(t *testing.T) {
+	client, _, done := newTestAPI(t, 0)
+	defer done()
+	genesis, err := client.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := newLightClient(genesis.Genesis, client, 10*time.Second)
+	api := NewCompareAndSwapAPI(client, verifier, 0)
+
+	// A value, and the absence of one, are verified against the headers that
+	// the validator signed.
+	checkSet(t, api, "a", "", "one", http.StatusOK)
+	commit(t, client)
+	code, response := verifiedGet(t, client, api, "a")
+	if code != http.StatusOK || response.Value != "one" || response.Verified == nil || !*response.Verified {
+		t.Fatalf("GET a: want %d, verified, with %q, have %d: %+v", http.StatusOK, "one", code, response)
+	}
+	code, response = verifiedGet(t, client, api, "b")
+	if code != http.StatusOK || response.Code != cas.CodeKeyNotFound || response.Verified == nil || !*response.Verified {
+		t.Fatalf("GET b: want %d, verified, with code %d, have %d: %+v", http.StatusOK, cas.CodeKeyNotFound, code, response)
+	}
+
+	// A node that forges a value is caught, and reported as a bad gateway.
+	forging := NewCompareAndSwapAPI(forgingClient{client}, verifier, 0)
+	code, response = verifiedGet(t, client, forging, "a")
+	if code != http.StatusBadGateway || response.Value != "" || (response.Verified != nil && *response.Verified) {
+		t.Fatalf("GET a from a forging node: want %d, unverified, have %d: %+v", http.StatusBadGateway, code, response)
+	}
+}
+
+// forgingClient answers every query with a forged value, and the proof of the
+// real one.
+type forgingClient struct {
+	*mockrpc.Client
+}
+
+func (c forgingClient) ABCIQuery(path string, data tendermintcommon.HexBytes) (*tendermintcoretypes.ResultABCIQuery, error) {
+	result, err := c.Client.ABCIQuery(path, data)
+	if err == nil {
+		result.Response.Code, result.Response.Value = tendermintabci.CodeTypeOK, []byte("forged")
+	}
+	return result, err
+}
+
+func TestAPIKeys(t *testing.T) {
+	client, api, done := newTestAPI(t, 0)
+	defer done()
+
+	// Keys and values can have colons, which separate them in the original
+	// transaction format, and other punctuation, escaped.
+	for _, key := range []string{
+		"a:b",
+		":",
+		"a::b:",
+		"with space",
+		"100%",
+		"ünïcödé",
+		"a?b",
+		"a#b",
+	} {
+		checkSet(t, api, key, "", "c:d", http.StatusOK)
+		commit(t, client)
+		checkGet(t, api, key, http.StatusOK, "c:d")
+	}
+
+	// A key can't be empty: the path is the list of keys, which can't be set,
+	// and the handlers reject it anyway.
+	if code := codeOf(t, api, "POST", "/?new=x"); code == http.StatusOK {
+		t.Errorf("POST /: want an error, have %d", code)
+	}
+	for _, h := range []http.HandlerFunc{api.handleGet, api.handleSet, api.handleDelete} {
+		rec := httptest.NewRecorder()
+		h(rec, httptest.NewRequest("POST", "/?new=x", nil))
+		if want, have := http.StatusBadRequest, rec.Code; want != have {
+			t.Errorf("empty key: want %d, have %d", want, have)
+		}
+	}
+
+	// Nor can it contain a slash, as the path would be of a different route.
+	if want, have := http.StatusNotFound, codeOf(t, api, "POST", "/a%2Fb?new=x"); want != have {
+		t.Errorf("POST a/b: want %d, have %d", want, have)
+	}
+
+	// A key can be the name of a route, as the routes that aren't of keys are
+	// all under /admin/.
+	for _, key := range []string{"admin", "healthz", "readyz", "status"} {
+		checkSet(t, api, key, "", "x", http.StatusOK)
+	}
+	commit(t, client)
+	for _, key := range []string{"admin", "healthz", "readyz", "status"} {
+		checkGet(t, api, key, http.StatusOK, "x")
+	}
+	code, response := do(t, api, "GET", "/admin/healthz")
+	if code != http.StatusOK || response.Value != "" {
+		t.Errorf("GET admin/healthz: want the health check, have %d: %+v", code, response)
+	}
+}
+
+func TestAPIList(t *testing.T) {
+	client, api, done := newTestAPI(t, 0)
+	defer done()
+
+	if want, have := 0, len(mustList(t, api, "/").KVs); want != have {
+		t.Fatalf("list: want %d key(s), have %d", want, have)
+	}
+	for _, key := range []string{"a", "ab", "b"} {
+		checkSet(t, api, key, "", "v-"+key, http.StatusOK)
+	}
+	commit(t, client)
+	for _, tc := range []struct {
+		target string
+		want   []apiKeyValue
+	}{
+		{"/", []apiKeyValue{{"a", "v-a"}, {"ab", "v-ab"}, {"b", "v-b"}}},
+		{"/?prefix=a", []apiKeyValue{{"a", "v-a"}, {"ab", "v-ab"}}},
+		{"/?prefix=ab", []apiKeyValue{{"ab", "v-ab"}}},
+		{"/?prefix=c", nil},
+	} {
+		have := mustList(t, api, tc.target).KVs
+		if !kvsEqual(tc.want, have) {
+			t.Errorf("GET %s: want %+v, have %+v", tc.target, tc.want, have)
+		}
+	}
+}
+
+func TestAPIHistory(t *testing.T) {
+	client, api, done := newTestAPI(t, 0)
+	defer done()
+
+	checkSet(t, api, "a:b", "", "one", http.StatusOK)
+	checkSet(t, api, "a", "", "other", http.StatusOK)
+	h1 := commit(t, client)
+	checkSet(t, api, "a:b", "one", "two", http.StatusOK)
+	h2 := commit(t, client)
+	if code, _ := do(t, api, "DELETE", "/a:b?old=two"); code != http.StatusOK {
+		t.Fatalf("DELETE a:b: want %d, have %d", http.StatusOK, code)
+	}
+	h3 := commit(t, client)
+
+	code, response := do(t, api, "GET", "/a:b?history=true")
+	if want, have := http.StatusOK, code; want != have {
+		t.Fatalf("history: want %d, have %d: %+v", want, have, response)
+	}
+	want := []apiEvent{
+		{Height: h1, Key: "a:b", Value: "one"},
+		{Height: h2, Key: "a:b", Value: "two"},
+		{Height: h3, Key: "a:b", Deleted: true},
+	}
+	if len(want) != len(response.Events) {
+		t.Fatalf("history: want %+v, have %+v", want, response.Events)
+	}
+	for i := range want {
+		if want[i] != response.Events[i] {
+			t.Errorf("history: event %d: want %+v, have %+v", i, want[i], response.Events[i])
+		}
+	}
+
+	// Quotes would break the query of the transaction index.
+	if want, have := http.StatusBadRequest, codeOf(t, api, "GET", "/a'b?history=true"); want != have {
+		t.Errorf("history of a'b: want %d, have %d", want, have)
+	}
+	code, response = do(t, api, "GET", "/never?history=true")
+	if code != http.StatusOK || len(response.Events) != 0 {
+		t.Errorf("history of a key that was never set: want no events, have %d: %+v", code, response)
+	}
+}
+
+func TestAPIWatch(t *testing.T) {
+	client, api, done := newTestAPI(t, 0)
+	defer done()
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequest("GET", server.URL+"/?watch=true&prefix=w:", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if want, have := http.StatusOK, resp.StatusCode; want != have {
+		t.Fatalf("watch: want %d, have %d", want, have)
+	}
+
+	// The watch is established after the response's headers are sent, so
+	// write a key until it's seen.
+	events := make(chan apiEvent)
+	go func() {
+		defer close(events)
+		s := bufio.NewScanner(resp.Body)
+		for s.Scan() {
+			var ev apiEvent
+			if err := json.Unmarshal(s.Bytes(), &ev); err != nil {
+				t.Errorf("watch: %v", err)
+				return
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	var (
+		ev    apiEvent
+		ready = false
+		old   string
+	)
+	for i := 0; !ready; i++ {
+		new := strings.Repeat("x", i+1)
+		checkSet(t, api, "w:ready", old, new, http.StatusOK)
+		old = new
+		commit(t, client)
+		select {
+		case ev = <-events:
+			ready = true
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal("watch: no events")
+		}
+	}
+	if want, have := "w:ready", ev.Key; want != have {
+		t.Fatalf("watch: want %q, have %q", want, have)
+	}
+
+	// Changes to other keys aren't seen. Events of the ready key may still be
+	// on their way, if it was written more than once, so they're skipped.
+	checkSet(t, api, "other", "", "x", http.StatusOK)
+	checkSet(t, api, "w:a", "", "one", http.StatusOK)
+	h := commit(t, client)
+	if code, _ := do(t, api, "DELETE", "/w:a?old=one"); code != http.StatusOK {
+		t.Fatalf("DELETE w:a: want %d, have %d", http.StatusOK, code)
+	}
+	commit(t, client)
+	for _, want := range []apiEvent{
+		{Height: h, Key: "w:a", Value: "one"},
+		{Height: h + 1, Key: "w:a", Deleted: true},
+	} {
+		have := apiEvent{Key: "w:ready"}
+		for have.Key == "w:ready" {
+			select {
+			case have = <-events:
+			case <-ctx.Done():
+				t.Fatalf("watch: want %+v, have nothing", want)
+			}
+		}
+		if want != have {
+			t.Errorf("watch: want %+v, have %+v", want, have)
+		}
+	}
+}
+
+func TestAPIWatchSlow(t *testing.T) {
+	client, api, done := newTestAPI(t, 0)
+	defer done()
+
+	// A watcher that stops reading falls behind, and is disconnected, but it
+	// mustn't block the node's event bus meanwhile, as that would stall
+	// consensus.
+	var (
+		blocked = make(chan struct{})
+		release = make(chan struct{})
+		errc    = make(chan error, 1)
+	)
+	go func() {
+		first := true
+		errc <- api.store.Watch(context.Background(), "w:", true, func(watchEvent) error {
+			if first {
+				close(blocked)
+				first = false
+			}
+			<-release
+			return nil
+		})
+	}()
+	for i := 0; ; i++ {
+		if err := api.store.Txn(cas.SetTx(fmt.Sprintf("w:ready%d", i), nil, []byte("x"))); err != nil {
+			t.Fatal(err)
+		}
+		commit(t, client)
+		select {
+		case <-blocked:
+		case <-time.After(10 * time.Millisecond):
+			continue
+		}
+		break
+	}
+
+	for i := 0; i < 3*watchBuffer; i++ {
+		if err := api.store.Txn(cas.SetTx(fmt.Sprintf("w:%d", i), nil, []byte("x"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	committed := make(chan struct{})
+	go func() {
+		defer close(committed)
+		commit(t, client)
+	}()
+	select {
+	case <-committed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("commit blocked by a slow watcher")
+	}
+
+	close(release)
+	select {
+	case err := <-errc:
+		if _, ok := err.(transportError); !ok {
+			t.Errorf("Watch: want a transportError, have %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Watch didn't return")
+	}
+}
+
+func TestAPIStatus(t *testing.T) {
+	client, api, done := newTestAPI(t, 2)
+	defer done()
+
+	checkSet(t, api, "a", "", "one", http.StatusOK)
+	height := commit(t, client)
+
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/status", nil))
+	if want, have := http.StatusOK, rec.Code; want != have {
+		t.Fatalf("status: want %d, have %d: %s", want, have, rec.Body)
+	}
+	var status statusResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := height, status.LatestBlockHeight; want != have {
+		t.Errorf("latest_block_height: want %d, have %d", want, have)
+	}
+	if want, have := mockrpc.ChainID, status.ChainID; want != have {
+		t.Errorf("chain_id: want %q, have %q", want, have)
+	}
+	if want, have := 1, len(status.Validators); want != have {
+		t.Errorf("validators: want %d, have %d", want, have)
+	}
+	if want, have := 1, status.App.Keys; want != have {
+		t.Errorf("app.keys: want %d, have %d", want, have)
+	}
+	if len(status.LatestAppHash) == 0 {
+		t.Errorf("latest_app_hash: want a hash")
+	}
+
+	for _, tc := range []struct {
+		name       string
+		peers      int
+		catchingUp bool
+		err        error
+		want       string
+		code       int
+	}{
+		{"ready", 2, false, nil, "ready", http.StatusOK},
+		{"too few peers", 1, false, nil, "too few peers", http.StatusServiceUnavailable},
+		{"catching up", 2, true, nil, "catching up", http.StatusServiceUnavailable},
+		{"unavailable", 2, false, errors.New("connection refused"), "unavailable", http.StatusServiceUnavailable},
+	} {
+		client.SetPeers(tc.peers)
+		client.SetCatchingUp(tc.catchingUp)
+		client.Fail(tc.err)
+		for _, target := range []string{"/admin/readyz", "/admin/healthz"} {
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+			var health healthResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil {
+				t.Fatal(err)
+			}
+			want, code := tc.want, tc.code
+			if target == "/admin/healthz" {
+				want, code = "ok", http.StatusOK
+			}
+			if want != health.Status || code != rec.Code {
+				t.Errorf("%s: %s: want %d %q, have %d %q", tc.name, target, code, want, rec.Code, health.Status)
+			}
+		}
+	}
+}
+
+func TestAPIReadyPersistFailure(t *testing.T) {
+	app, err := cas.NewApplication(nil, failingWriteCloser{errors.New("disk full")}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	client, err := mockrpc.New(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	api := NewCompareAndSwapAPI(client, nil, 0)
+
+	// State is persisted in the background, after the commit.
+	commit(t, client)
+	var health healthResponse
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/readyz", nil))
+		if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusOK || time.Now().After(deadline) {
+			break
+		}
+	}
+	if want, have := "not persisting", health.Status; want != have || !strings.Contains(health.Error, "disk full") {
+		t.Errorf("readyz: want %q, have %q: %s", want, have, health.Error)
+	}
+}
+
+type failingWriteCloser struct{ err error }
+
+func (w failingWriteCloser) Write([]byte) (int, error) { return 0, w.err }
+func (w failingWriteCloser) Close() error              { return w.err }
+
+func TestAPIAdmin(t *testing.T) {
+	client, api, done := newTestAPI(t, 0)
+	defer done()
+
+	checkSet(t, api, "a", "", "one", http.StatusOK)
+	checkSet(t, api, "b", "", "two", http.StatusOK)
+	height := commit(t, client)
+
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/digest?keys=true&prefix=a", nil))
+	var d cas.Digest
+	if err := json.Unmarshal(rec.Body.Bytes(), &d); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("digest: want %d, have %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+	if want, have := 1, d.Count; want != have {
+		t.Errorf("digest: want %d key(s), have %d", want, have)
+	}
+
+	// A snapshot is built in the background when it's first asked for.
+	code, response := do(t, api, "GET", "/admin/snapshot")
+	if code != http.StatusServiceUnavailable || response.Code != cas.CodeSnapshotPending {
+		t.Fatalf("snapshot: want %d, have %d: %+v", http.StatusServiceUnavailable, code, response)
+	}
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		rec = httptest.NewRecorder()
+		api.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/snapshot", nil))
+		if rec.Code != http.StatusServiceUnavailable || time.Now().After(deadline) {
+			break
+		}
+	}
+	var m cas.Manifest
+	if err := json.Unmarshal(rec.Body.Bytes(), &m); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("snapshot: want %d, have %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+	if want, have := height, m.Height; want != have {
+		t.Errorf("snapshot: want height %d, have %d", want, have)
+	}
+
+	for _, tc := range []struct {
+		target string
+		want   int
+	}{
+		{"/admin/digest?height=-1", http.StatusBadRequest},
+		{"/admin/digest?height=x", http.StatusBadRequest},
+		{"/admin/digest?height=1000", http.StatusNotFound},
+		{"/admin/snapshot?height=1000", http.StatusNotFound},
+		{"/admin/snapshot/0", http.StatusOK},
+		{"/admin/snapshot/1000", http.StatusBadRequest},
+		{"/admin/snapshot/0?height=1000", http.StatusNotFound},
+	} {
+		if have := codeOf(t, api, "GET", tc.target); tc.want != have {
+			t.Errorf("GET %s: want %d, have %d", tc.target, tc.want, have)
+		}
+	}
+}
+
+func TestAPIUnavailable(t *testing.T) {
+	client, api, done := newTestAPI(t, 0)
+	defer done()
+
+	checkSet(t, api, "a", "", "one", http.StatusOK)
+	commit(t, client)
+	client.Fail(errors.New("connection refused"))
+	for _, tc := range []struct {
+		method, target string
+	}{
+		{"GET", "/a"},
+		{"POST", "/a?old=one&new=two"},
+		{"DELETE", "/a?old=one"},
+		{"GET", "/"},
+		{"GET", "/a?history=true"},
+		{"GET", "/admin/status"},
+		{"GET", "/admin/digest"},
+		{"GET", "/admin/snapshot"},
+	} {
+		code, response := do(t, api, tc.method, tc.target)
+		if want, have := http.StatusBadGateway, code; want != have {
+			t.Errorf("%s %s: want %d, have %d", tc.method, tc.target, want, have)
+		}
+		if !strings.Contains(response.Error, "connection refused") {
+			t.Errorf("%s %s: want the error, have %q", tc.method, tc.target, response.Error)
+		}
+	}
+
+	// Nothing was written, and the node's back.
+	client.Fail(nil)
+	commit(t, client)
+	checkGet(t, api, "a", http.StatusOK, "one")
+}
+
+func TestErrorCodes(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want codeMapping
+	}{
+		{nil, codeMapping{http.StatusOK, codes.OK}},
+		{appError{cas.CodeBadRequest, "bad"}, codeMapping{http.StatusBadRequest, codes.InvalidArgument}},
+		{appError{cas.CodeCASFailure, ""}, codeMapping{http.StatusBadRequest, codes.FailedPrecondition}},
+		{appError{cas.CodeKeyNotFound, ""}, codeMapping{http.StatusOK, codes.NotFound}},
+		{appError{cas.CodeHeightNotFound, ""}, codeMapping{http.StatusNotFound, codes.NotFound}},
+		{appError{999, "unknown"}, codeMapping{http.StatusInternalServerError, codes.Unknown}},
+		{transportError{errors.New("connection refused")}, codeMapping{http.StatusBadGateway, codes.Unavailable}},
+		{context.Canceled, codeMapping{http.StatusServiceUnavailable, codes.Canceled}},
+		{errors.New("other"), codeMapping{http.StatusInternalServerError, codes.Internal}},
+	} {
+		if have := errorCodes(tc.err); tc.want != have {
+			t.Errorf("%v: want %+v, have %+v", tc.err, tc.want, have)
+		}
+	}
+
+	// Application errors are reported with their code, and their log.
+	response := errorResponse("a", appError{cas.CodeCASFailure, "compare failed"})
+	if response.Key != "a" || response.Error != "result code 514" || response.Code != cas.CodeCASFailure || response.Log != "compare failed" {
+		t.Errorf("errorResponse: have %+v", response)
+	}
+}
+
+// newTestAPI returns an API, and the client of the in-memory node that it
+// calls, and a function that stops them.
+func newTestAPI(t *testing.T, minPeers int) (*mockrpc.Client, *CompareAndSwapAPI, func()) {
+	t.Helper()
+	app, err := cas.NewApplication(nil, nil, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := mockrpc.New(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, NewCompareAndSwapAPI(client, nil, minPeers), func() {
+		client.Close()
+		app.Close()
+	}
+}
+
+func commit(t *testing.T, client *mockrpc.Client) int64 {
+	t.Helper()
+	height, err := client.MakeBlock()
+	if err != nil {
+		t.Fatalf("MakeBlock: %v", err)
+	}
+	return height
+}
+
+// verifiedGet GETs the key from an API that verifies reads. A read is of the
+// state after the last block, whose app hash is in the next block's header, so
+// empty blocks are made until it returns, as they would be by a node.
+func verifiedGet(t *testing.T, client *mockrpc.Client, h http.Handler, key string) (int, apiResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/"+url.PathEscape(key), nil))
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			var response apiResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatalf("GET %q: %d: %v: %s", key, rec.Code, err, rec.Body)
+			}
+			return rec.Code, response
+		case <-time.After(10 * time.Millisecond):
+			commit(t, client)
+		}
+	}
+}
+
+func do(t *testing.T, h http.Handler, method, target string) (int, apiResponse) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	var response apiResponse
+	if rec.Body.Len() > 0 {
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s %s: %d: %v: %s", method, target, rec.Code, err, rec.Body)
+		}
+	}
+	return rec.Code, response
+}
+
+func codeOf(t *testing.T, h http.Handler, method, target string) int {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	return rec.Code
+}
+
+func checkGet(t *testing.T, h http.Handler, key string, code int, value string) {
+	t.Helper()
+	have, response := do(t, h, "GET", "/"+url.PathEscape(key))
+	if code != have {
+		t.Fatalf("GET %q: want %d, have %d: %+v", key, code, have, response)
+	}
+	if have == http.StatusOK && (response.Key != key || response.Value != value) {
+		t.Fatalf("GET %q: want %q, have %+v", key, value, response)
+	}
+}
+
+func checkNotFound(t *testing.T, h http.Handler, key string) {
+	t.Helper()
+	code, response := do(t, h, "GET", "/"+url.PathEscape(key))
+	if code != http.StatusOK || response.Code != cas.CodeKeyNotFound || response.Value != "" || response.Log == "" {
+		t.Fatalf("GET %q: want %d with code %d and a log, have %d: %+v", key, http.StatusOK, cas.CodeKeyNotFound, code, response)
+	}
+}
+
+func checkSet(t *testing.T, h http.Handler, key, old, new string, code int) {
+	t.Helper()
+	target := "/" + url.PathEscape(key) + "?" + url.Values{"old": {old}, "new": {new}}.Encode()
+	if have, response := do(t, h, "POST", target); code != have {
+		t.Fatalf("POST %q %q to %q: want %d, have %d: %+v", key, old, new, code, have, response)
+	}
+}
+
+func mustList(t *testing.T, h http.Handler, target string) apiResponse {
+	t.Helper()
+	code, response := do(t, h, "GET", target)
+	if code != http.StatusOK {
+		t.Fatalf("GET %s: want %d, have %d: %+v", target, http.StatusOK, code, response)
+	}
+	return response
+}
+
+func kvsEqual(a, b []apiKeyValue) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+
+	"github.com/6thc/tendermint-cas-demo/casgrpc"
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// CompareAndSwapGRPC provides a gRPC API to a Tendermint client running the
+// compare-and-swap key-value ABCI application. It's equivalent to the
+// CompareAndSwapAPI, and reports errors in the same way.
+type CompareAndSwapGRPC struct {
+	store store
+}
+
+var _ casgrpc.CompareAndSwapServer = (*CompareAndSwapGRPC)(nil)
+
+// NewCompareAndSwapGRPC returns a usable gRPC service calling out to the
+// provided Tendermint client. Register it with a gRPC server via
+// casgrpc.RegisterCompareAndSwapServer.
+func NewCompareAndSwapGRPC(client storeClient, verifier *lightClient) *CompareAndSwapGRPC {
+	return &CompareAndSwapGRPC{
+		store: store{client, verifier},
+	}
+}
+
+// Get implements casgrpc.CompareAndSwapServer.
+func (g *CompareAndSwapGRPC) Get(ctx context.Context, req *casgrpc.GetRequest) (*casgrpc.GetResponse, error) {
+	result, err := g.store.Get(req.Key)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &casgrpc.GetResponse{Kv: &casgrpc.KeyValue{Key: req.Key, Value: result.Value}, Verified: result.Verified}, nil
+}
+
+// CAS implements casgrpc.CompareAndSwapServer.
+func (g *CompareAndSwapGRPC) CAS(ctx context.Context, req *casgrpc.CASRequest) (*casgrpc.CASResponse, error) {
+	if err := g.store.Txn(cas.SetTx(req.Key, req.Old, req.New)); err != nil {
+		return nil, grpcError(err)
+	}
+	return &casgrpc.CASResponse{Kv: &casgrpc.KeyValue{Key: req.Key, Value: req.New}}, nil
+}
+
+// Delete implements casgrpc.CompareAndSwapServer.
+func (g *CompareAndSwapGRPC) Delete(ctx context.Context, req *casgrpc.DeleteRequest) (*casgrpc.DeleteResponse, error) {
+	if err := g.store.Txn(cas.DeleteTx(req.Key, req.Old)); err != nil {
+		return nil, grpcError(err)
+	}
+	return &casgrpc.DeleteResponse{}, nil
+}
+
+// List implements casgrpc.CompareAndSwapServer.
+func (g *CompareAndSwapGRPC) List(ctx context.Context, req *casgrpc.ListRequest) (*casgrpc.ListResponse, error) {
+	kvs, err := g.store.List(req.Prefix)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	response := &casgrpc.ListResponse{Kvs: make([]*casgrpc.KeyValue, len(kvs))}
+	for i, kv := range kvs {
+		response.Kvs[i] = &casgrpc.KeyValue{Key: kv.Key, Value: kv.Value}
+	}
+	return response, nil
+}
+
+// Txn implements casgrpc.CompareAndSwapServer.
+func (g *CompareAndSwapGRPC) Txn(ctx context.Context, req *casgrpc.TxnRequest) (*casgrpc.TxnResponse, error) {
+	tx := cas.Tx{Ops: make([]cas.Op, len(req.Ops))}
+	for i, op := range req.Ops {
+		tx.Ops[i] = cas.Op{Type: grpcOpTypes[op.Type], Key: op.Key, Old: op.Old, New: op.New}
+	}
+	if err := g.store.Txn(tx); err != nil {
+		return nil, grpcError(err)
+	}
+	return &casgrpc.TxnResponse{}, nil
+}
+
+// Watch implements casgrpc.CompareAndSwapServer.
+func (g *CompareAndSwapGRPC) Watch(req *casgrpc.WatchRequest, stream casgrpc.CompareAndSwap_WatchServer) error {
+	err := g.store.Watch(stream.Context(), req.Key, req.Prefix, func(ev watchEvent) error {
+		return stream.Send(&casgrpc.WatchEvent{
+			Height:  ev.Height,
+			Kv:      &casgrpc.KeyValue{Key: ev.KV.Key, Value: ev.KV.Value},
+			Deleted: ev.Deleted,
+		})
+	})
+	if err != nil {
+		return grpcError(err)
+	}
+	return nil
+}
+
+var grpcOpTypes = map[casgrpc.Op_Type]cas.OpType{
+	casgrpc.Op_CHECK:  cas.OpCheck,
+	casgrpc.Op_SET:    cas.OpSet,
+	casgrpc.Op_DELETE: cas.OpDelete,
+}
+
+// grpcError converts an error returned by the store to a gRPC status error,
+// with the code given by the shared error mapping.
+func grpcError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err // already a gRPC error, e.g. from stream.Send
+	}
+	return status.Error(errorCodes(err).grpc, err.Error())
+}
+
+// newGRPCServer returns a gRPC server with the CompareAndSwap service
+// registered.
+func newGRPCServer(client storeClient, verifier *lightClient) *grpc.Server {
+	server := grpc.NewServer()
+	casgrpc.RegisterCompareAndSwapServer(server, NewCompareAndSwapGRPC(client, verifier))
+	return server
+}
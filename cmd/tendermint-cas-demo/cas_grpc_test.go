@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/casgrpc"
+	"github.com/6thc/tendermint-cas-demo/internal/mockrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPC(t *testing.T) {
+	client, api, done := newTestAPI(t, 0)
+	defer done()
+	g, stop := newTestGRPC(t, client)
+	defer stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A key that doesn't exist isn't found, and a CAS that conflicts fails its
+	// precondition. The codes are those that the shared mapping gives the
+	// result code that the HTTP API reports for the same request.
+	if _, err := g.CAS(ctx, &casgrpc.CASRequest{Key: "a", New: []byte("one")}); err != nil {
+		t.Fatalf("CAS(a): %v", err)
+	}
+	commit(t, client)
+	for _, testcase := range []struct {
+		name   string
+		call   func() error
+		method string
+		target string
+		want   codeMapping
+	}{
+		{
+			name:   "get",
+			call:   func() error { _, err := g.Get(ctx, &casgrpc.GetRequest{Key: "a"}); return err },
+			method: "GET",
+			target: "/a",
+			want:   codeMapping{http.StatusOK, codes.OK},
+		},
+		{
+			name:   "not found",
+			call:   func() error { _, err := g.Get(ctx, &casgrpc.GetRequest{Key: "b"}); return err },
+			method: "GET",
+			target: "/b",
+			want:   codeMapping{http.StatusOK, codes.NotFound},
+		},
+		{
+			name: "conflict",
+			call: func() error {
+				_, err := g.CAS(ctx, &casgrpc.CASRequest{Key: "a", Old: []byte("two"), New: []byte("three")})
+				return err
+			},
+			method: "POST",
+			target: "/a?old=two&new=three",
+			want:   codeMapping{http.StatusBadRequest, codes.FailedPrecondition},
+		},
+	} {
+		code, response := do(t, api, testcase.method, testcase.target)
+		have := codeMapping{code, status.Code(testcase.call())}
+		if testcase.want != have {
+			t.Errorf("%s: want %+v, have %+v", testcase.name, testcase.want, have)
+		}
+		if want := errorCodes(appError{response.Code, ""}); want != have {
+			t.Errorf("%s: want the mapping of result code %d, %+v, have %+v", testcase.name, response.Code, want, have)
+		}
+	}
+	response, err := g.Get(ctx, &casgrpc.GetRequest{Key: "a"})
+	if err != nil {
+		t.Fatalf("Get(a): %v", err)
+	}
+	if want, have := "one", string(response.Kv.Value); want != have {
+		t.Fatalf("Get(a): want %q, have %q", want, have)
+	}
+
+	// List returns the keys with the prefix, in order.
+	for _, key := range []string{"l:b", "l:a", "other"} {
+		if _, err := g.CAS(ctx, &casgrpc.CASRequest{Key: key, New: []byte(key)}); err != nil {
+			t.Fatalf("CAS(%s): %v", key, err)
+		}
+	}
+	commit(t, client)
+	list, err := g.List(ctx, &casgrpc.ListRequest{Prefix: "l:"})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	var keys []string
+	for _, kv := range list.Kvs {
+		keys = append(keys, kv.Key)
+	}
+	if want, have := "l:a l:b", strings.Join(keys, " "); want != have {
+		t.Fatalf("List: want %s, have %s", want, have)
+	}
+}
+
+func TestGRPCWatch(t *testing.T) {
+	client, _, done := newTestAPI(t, 0)
+	defer done()
+	g, stop := newTestGRPC(t, client)
+	defer stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := g.Watch(ctx, &casgrpc.WatchRequest{Key: "w:", Prefix: true})
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	events := make(chan *casgrpc.WatchEvent)
+	go func() {
+		defer close(events)
+		for {
+			ev, err := stream.Recv()
+			if err != nil {
+				return
+			}
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// The watch may not be established by the time Watch returns, so write a
+	// key until it's seen.
+	var (
+		ev    *casgrpc.WatchEvent
+		ready = false
+		old   []byte
+	)
+	for i := 0; !ready; i++ {
+		new := []byte(strings.Repeat("x", i+1))
+		if _, err := g.CAS(ctx, &casgrpc.CASRequest{Key: "w:ready", Old: old, New: new}); err != nil {
+			t.Fatalf("CAS(w:ready): %v", err)
+		}
+		old = new
+		commit(t, client)
+		select {
+		case ev = <-events:
+			ready = true
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			t.Fatal("watch: no events")
+		}
+	}
+	if want, have := "w:ready", ev.Kv.Key; want != have {
+		t.Fatalf("watch: want %q, have %q", want, have)
+	}
+
+	// Changes to other keys aren't seen. Events of the ready key may still be
+	// on their way, if it was written more than once, so they're skipped.
+	if _, err := g.CAS(ctx, &casgrpc.CASRequest{Key: "other", New: []byte("x")}); err != nil {
+		t.Fatalf("CAS(other): %v", err)
+	}
+	if _, err := g.CAS(ctx, &casgrpc.CASRequest{Key: "w:a", New: []byte("one")}); err != nil {
+		t.Fatalf("CAS(w:a): %v", err)
+	}
+	h := commit(t, client)
+	if _, err := g.Delete(ctx, &casgrpc.DeleteRequest{Key: "w:a", Old: []byte("one")}); err != nil {
+		t.Fatalf("Delete(w:a): %v", err)
+	}
+	commit(t, client)
+	for _, want := range []casgrpc.WatchEvent{
+		{Height: h, Kv: &casgrpc.KeyValue{Key: "w:a", Value: []byte("one")}},
+		{Height: h + 1, Kv: &casgrpc.KeyValue{Key: "w:a"}, Deleted: true},
+	} {
+		have := &casgrpc.WatchEvent{Kv: &casgrpc.KeyValue{Key: "w:ready"}}
+		for have.Kv.Key == "w:ready" {
+			var ok bool
+			select {
+			case have, ok = <-events:
+				if !ok {
+					t.Fatalf("watch: want %+v, have the stream closed", want)
+				}
+			case <-ctx.Done():
+				t.Fatalf("watch: want %+v, have nothing", want)
+			}
+		}
+		if want.Height != have.Height || want.Kv.Key != have.Kv.Key || string(want.Kv.Value) != string(have.Kv.Value) || want.Deleted != have.Deleted {
+			t.Errorf("watch: want %+v, have %+v", want, *have)
+		}
+	}
+}
+
+// newTestGRPC serves the gRPC API of the client, and returns a client of it,
+// and a function that stops them.
+func newTestGRPC(t *testing.T, client *mockrpc.Client) (casgrpc.CompareAndSwapClient, func()) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newGRPCServer(client, nil)
+	go server.Serve(ln)
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		server.Stop()
+		t.Fatal(err)
+	}
+	return casgrpc.NewCompareAndSwapClient(conn), func() {
+		conn.Close()
+		server.Stop()
+	}
+}
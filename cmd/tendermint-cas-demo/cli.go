@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/6thc/tendermint-cas-demo/client"
+	"github.com/peterbourgon/usage"
+)
+
+// clientFlags are shared by all of the client subcommands.
+type clientFlags struct {
+	fs       *flag.FlagSet
+	endpoint *string
+	output   *string
+}
+
+func newClientFlags(name string) *clientFlags {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	return &clientFlags{
+		fs:       fs,
+		endpoint: fs.String("endpoint", "127.0.0.1:8081", "comma-separated HTTP API addresses"),
+		output:   fs.String("output", "table", "output format: table or json"),
+	}
+}
+
+// parse parses the args, and returns a client for the endpoints, and the
+// positional arguments, of which there must be exactly nargs.
+func (f *clientFlags) parse(args []string, shortUsage string, nargs int) (*client.Client, []string, error) {
+	f.fs.Usage = usage.For(f.fs, shortUsage)
+	f.fs.Parse(args)
+	if f.fs.NArg() != nargs {
+		f.fs.Usage()
+		return nil, nil, usageError(fmt.Sprintf("want %d argument(s), have %d", nargs, f.fs.NArg()))
+	}
+	switch *f.output {
+	case "table", "json":
+	default:
+		return nil, nil, usageError(fmt.Sprintf("invalid -output %q", *f.output))
+	}
+	c, err := client.New(strings.Split(*f.endpoint, ","))
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, f.fs.Args(), nil
+}
+
+func (f *clientFlags) json() bool { return *f.output == "json" }
+
+func runGet(args []string) error {
+	flags := newClientFlags("get")
+	c, args, err := flags.parse(args, "tendermint-cas-demo get [flags] <key>", 1)
+	if err != nil {
+		return err
+	}
+
+	key := args[0]
+	value, err := c.Get(context.Background(), key)
+	if err != nil {
+		return err
+	}
+	if flags.json() {
+		return writeJSON(os.Stdout, cliKeyValue{Key: key, Value: string(value)})
+	}
+	_, err = fmt.Fprintf(os.Stdout, "%s\n", value)
+	return err
+}
+
+func runCAS(args []string) error {
+	flags := newClientFlags("cas")
+	var (
+		old     = flags.fs.String("old", "", "expected current value (empty for a new key)")
+		oldFile = flags.fs.String("old-file", "", "read the expected current value from this file (- for stdin)")
+		new     = flags.fs.String("new", "", "new value")
+		newFile = flags.fs.String("new-file", "", "read the new value from this file (- for stdin)")
+	)
+	c, args, err := flags.parse(args, "tendermint-cas-demo cas [flags] <key>", 1)
+	if err != nil {
+		return err
+	}
+	if *oldFile == "-" && *newFile == "-" {
+		return usageError("-old-file and -new-file can't both be stdin")
+	}
+
+	key := args[0]
+	oldValue, err := readValue(*old, *oldFile)
+	if err != nil {
+		return err
+	}
+	newValue, err := readValue(*new, *newFile)
+	if err != nil {
+		return err
+	}
+	if err := c.CompareAndSwap(context.Background(), key, oldValue, newValue); err != nil {
+		return err
+	}
+	if flags.json() {
+		return writeJSON(os.Stdout, cliKeyValue{Key: key, Value: string(newValue)})
+	}
+	_, err = fmt.Fprintf(os.Stdout, "%s\n", newValue)
+	return err
+}
+
+func runDelete(args []string) error {
+	flags := newClientFlags("delete")
+	var (
+		old     = flags.fs.String("old", "", "expected current value")
+		oldFile = flags.fs.String("old-file", "", "read the expected current value from this file (- for stdin)")
+	)
+	c, args, err := flags.parse(args, "tendermint-cas-demo delete [flags] <key>", 1)
+	if err != nil {
+		return err
+	}
+
+	key := args[0]
+	oldValue, err := readValue(*old, *oldFile)
+	if err != nil {
+		return err
+	}
+	if err := c.Delete(context.Background(), key, oldValue); err != nil {
+		return err
+	}
+	if flags.json() {
+		return writeJSON(os.Stdout, cliKeyValue{Key: key})
+	}
+	return nil
+}
+
+func runList(args []string) error {
+	flags := newClientFlags("list")
+	prefix := flags.fs.String("prefix", "", "only list keys with this prefix")
+	c, _, err := flags.parse(args, "tendermint-cas-demo list [flags]", 0)
+	if err != nil {
+		return err
+	}
+
+	kvs, err := c.List(context.Background(), *prefix)
+	if err != nil {
+		return err
+	}
+	if flags.json() {
+		out := make([]cliKeyValue, len(kvs))
+		for i, kv := range kvs {
+			out[i] = cliKeyValue{Key: kv.Key, Value: string(kv.Value)}
+		}
+		return writeJSON(os.Stdout, out)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "KEY\tVALUE\n")
+	for _, kv := range kvs {
+		fmt.Fprintf(tw, "%s\t%s\n", kv.Key, kv.Value)
+	}
+	return tw.Flush()
+}
+
+func runWatch(args []string) error {
+	flags := newClientFlags("watch")
+	prefix := flags.fs.Bool("prefix", false, "watch every key with the given prefix")
+	c, args, err := flags.parse(args, "tendermint-cas-demo watch [flags] <key>", 1)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		select {
+		case <-c:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// Table output for a stream can't be aligned ahead of time, so events
+	// are written tab-separated, one per line, as they arrive.
+	err = c.Watch(ctx, args[0], *prefix, func(ev client.Event) error {
+		if flags.json() {
+			return writeJSON(os.Stdout, newCLIEvent(ev))
+		}
+		_, err := fmt.Fprintf(os.Stdout, "%d\t%s\t%s\t%s\n", ev.Height, eventAction(ev), ev.Key, ev.Value)
+		return err
+	})
+	if err == context.Canceled {
+		return nil // interrupted
+	}
+	return err
+}
+
+func runHistory(args []string) error {
+	flags := newClientFlags("history")
+	c, args, err := flags.parse(args, "tendermint-cas-demo history [flags] <key>", 1)
+	if err != nil {
+		return err
+	}
+
+	events, err := c.History(context.Background(), args[0])
+	if err != nil {
+		return err
+	}
+	if flags.json() {
+		out := make([]cliEvent, len(events))
+		for i, ev := range events {
+			out[i] = newCLIEvent(ev)
+		}
+		return writeJSON(os.Stdout, out)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "HEIGHT\tACTION\tVALUE\n")
+	for _, ev := range events {
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", ev.Height, eventAction(ev), ev.Value)
+	}
+	return tw.Flush()
+}
+
+// readValue returns the value of a flag, or the contents of the corresponding
+// file flag, if it's set. A file of "-" means stdin.
+func readValue(value, filename string) ([]byte, error) {
+	switch filename {
+	case "":
+		return []byte(value), nil
+	case "-":
+		return ioutil.ReadAll(os.Stdin)
+	default:
+		return ioutil.ReadFile(filename)
+	}
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+func eventAction(ev client.Event) string {
+	if ev.Deleted {
+		return "delete"
+	}
+	return "set"
+}
+
+type cliKeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+type cliEvent struct {
+	Height  int64  `json:"height"`
+	Key     string `json:"key"`
+	Value   string `json:"value,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+func newCLIEvent(ev client.Event) cliEvent {
+	return cliEvent{Height: ev.Height, Key: ev.Key, Value: string(ev.Value), Deleted: ev.Deleted}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestCLI(t *testing.T) {
+	client, api, done := newTestAPI(t, 0)
+	defer done()
+	server := httptest.NewServer(api)
+	defer server.Close()
+	endpoint := server.Listener.Addr().String()
+
+	// Each command is run in turn, and a block is made after each, so writes
+	// are seen by the next.
+	for _, testcase := range []struct {
+		name string
+		run  func([]string) error
+		args []string
+		code int
+		want string // on stdout
+	}{
+		{"get missing", runGet, []string{"a"}, exitNotFound, ""},
+		{"cas new", runCAS, []string{"-new", "one", "a"}, exitOK, "one\n"},
+		{"get", runGet, []string{"a"}, exitOK, "one\n"},
+		{"get json", runGet, []string{"-output", "json", "a"}, exitOK, `{"key":"a","value":"one"}` + "\n"},
+		{"cas conflict", runCAS, []string{"-old", "two", "-new", "three", "a"}, exitConflict, ""},
+		{"cas", runCAS, []string{"-old", "one", "-new", "two", "a"}, exitOK, "two\n"},
+		{"list", runList, nil, exitOK, "KEY  VALUE\na    two\n"},
+		{"list json", runList, []string{"-output", "json", "-prefix", "a"}, exitOK, `[{"key":"a","value":"two"}]` + "\n"},
+		{"delete conflict", runDelete, []string{"-old", "one", "a"}, exitConflict, ""},
+		{"delete", runDelete, []string{"-old", "two", "a"}, exitOK, ""},
+		{"get deleted", runGet, []string{"a"}, exitNotFound, ""},
+		{"no key", runGet, nil, exitUsage, getUsage},
+		{"bad output", runGet, []string{"-output", "yaml", "a"}, exitUsage, ""},
+		{"both stdin", runCAS, []string{"-old-file", "-", "-new-file", "-", "a"}, exitUsage, ""},
+	} {
+		var err error
+		have := captureStdout(t, func() {
+			err = testcase.run(append([]string{"-endpoint", endpoint}, testcase.args...))
+		})
+		code := exitOK
+		if err != nil {
+			code = exitCode(err)
+		}
+		if testcase.code != code {
+			t.Errorf("%s: exit code: want %d, have %d (%v)", testcase.name, testcase.code, code, err)
+		}
+		if testcase.want != have {
+			t.Errorf("%s: output: want %q, have %q", testcase.name, testcase.want, have)
+		}
+		commit(t, client)
+	}
+}
+
+// getUsage is the usage of the get subcommand, which is written to stdout.
+const getUsage = `USAGE
+  tendermint-cas-demo get [flags] <key>
+
+FLAGS
+  -endpoint 127.0.0.1:8081  comma-separated HTTP API addresses
+  -output table             output format: table or json
+`
+
+// captureStdout returns what f writes to stdout. What it writes to stderr,
+// such as errors, is discarded.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	stdout, err := ioutil.TempFile("", "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(stdout.Name())
+	defer stdout.Close()
+	stderr, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+
+	defer func(stdout, stderr *os.File) { os.Stdout, os.Stderr = stdout, stderr }(os.Stdout, os.Stderr)
+	os.Stdout, os.Stderr = stdout, stderr
+	f()
+	out, err := ioutil.ReadFile(stdout.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
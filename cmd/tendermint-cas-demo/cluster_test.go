@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/client"
+	"github.com/6thc/tendermint-cas-demo/internal/cluster"
+)
+
+func TestClusterAPI(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a cluster")
+	}
+	c, err := cluster.New(cluster.Config{
+		Nodes: 4,
+		Handler: func(client *cluster.Client) http.Handler {
+			return NewCompareAndSwapAPI(client, nil, 0)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// A write through one node's API is committed, and can then be read
+	// through every node's. It returns once it's passed CheckTx, so it's not
+	// necessarily committed yet.
+	if err := nodeClient(t, c.Node(0)).CompareAndSwap(ctx, "a", nil, []byte("one")); err != nil {
+		t.Fatalf("CompareAndSwap(a): %v", err)
+	}
+	if err := c.Eventually(ctx, apiHasValue(t, "a", "one")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A stopped node's API is down, but a client fails over to the others. A
+	// write over a connection kept alive from before the node stopped could
+	// have reached it, though, so it wouldn't fail over, and the client has
+	// its own.
+	stopped := c.Node(3)
+	if err := stopped.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	failover, err := client.New(
+		[]string{stopped.APIAddr, c.Node(1).APIAddr},
+		client.WithHTTPClient(&http.Client{Transport: &http.Transport{}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := failover.CompareAndSwap(ctx, "a", []byte("one"), []byte("two")); err != nil {
+		t.Fatalf("CompareAndSwap(a): %v", err)
+	}
+	if want, have := client.ErrConflict, failover.CompareAndSwap(ctx, "a", []byte("one"), []byte("three")); want != have {
+		t.Fatalf("CompareAndSwap(a): want %v, have %v", want, have)
+	}
+
+	// Started again, at the same address, it serves what it missed.
+	if err := stopped.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Eventually(ctx, apiHasValue(t, "a", "two")); err != nil {
+		t.Fatal(err)
+	}
+	events, err := nodeClient(t, stopped).History(ctx, "a")
+	if err != nil {
+		t.Fatalf("History(a): %v", err)
+	}
+	if want, have := 2, len(events); want != have {
+		t.Fatalf("History(a): want %d events, have %d: %+v", want, have, events)
+	}
+}
+
+func nodeClient(t *testing.T, n *cluster.Node) *client.Client {
+	t.Helper()
+	c, err := client.New([]string{n.APIAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func apiHasValue(t *testing.T, key, value string) func(*cluster.Node) error {
+	return func(n *cluster.Node) error {
+		have, err := nodeClient(t, n).Get(context.Background(), key)
+		if err != nil {
+			return err
+		}
+		if string(have) != value {
+			return fmt.Errorf("%s: want %q, have %q", key, value, have)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	"github.com/peterbourgon/usage"
+	"github.com/pkg/errors"
+)
+
+// handleDigest serves the digest of the keys with the prefix at the height,
+// which defaults to the latest.
+func (a *CompareAndSwapAPI) handleDigest(w http.ResponseWriter, r *http.Request) {
+	var (
+		prefix = r.URL.Query().Get("prefix")
+		keys   = r.URL.Query().Get("keys") == "true"
+	)
+	height, err := heightParam(r)
+	if err != nil {
+		respond(w, http.StatusBadRequest, apiResponse{Error: err.Error()})
+		return
+	}
+
+	d, err := a.store.Digest(height, prefix, keys)
+	if err != nil {
+		respondError(w, prefix, err)
+		return
+	}
+	respondJSON(w, http.StatusOK, d)
+}
+
+func runDiffNodes(args []string) error {
+	fs := flag.NewFlagSet("diff-nodes", flag.ExitOnError)
+	var (
+		height  = fs.Int64("height", 0, "height to compare (default the lowest latest height of the nodes)")
+		maxKeys = fs.Int("max-keys", 64, "compare keys one by one once no node has more than this many with a prefix")
+		timeout = fs.Duration("timeout", 10*time.Second, "timeout for each request")
+	)
+	fs.Usage = usage.For(fs, "tendermint-cas-demo diff-nodes [flags] <api-addr> <api-addr> [<api-addr>...]")
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return usageError(fmt.Sprintf("want at least 2 nodes, have %d", fs.NArg()))
+	}
+
+	d := &differ{
+		client:  &http.Client{Timeout: *timeout},
+		maxKeys: *maxKeys,
+	}
+	for _, addr := range fs.Args() {
+		if !strings.Contains(addr, "://") {
+			addr = "http://" + addr
+		}
+		d.nodes = append(d.nodes, strings.TrimRight(addr, "/"))
+	}
+
+	// Nodes that have diverged have usually halted at the same height, but
+	// otherwise, compare the latest height that they've all reached.
+	if *height == 0 {
+		for i, node := range d.nodes {
+			var status statusResponse
+			if err := d.get(node, "/admin/status", nil, &status); err != nil {
+				return err
+			}
+			if i == 0 || status.LatestBlockHeight < *height {
+				*height = status.LatestBlockHeight
+			}
+		}
+	}
+	d.height = *height
+
+	if err := d.diff(""); err != nil {
+		return err
+	}
+	if len(d.keys) == 0 {
+		fmt.Printf("no differences at height %d\n", d.height)
+		return nil
+	}
+
+	fmt.Printf("%d key(s) differ at height %d\n\n", len(d.keys), d.height)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "KEY\t%s\n", strings.Join(d.nodes, "\t"))
+	for _, k := range d.keys {
+		fmt.Fprintf(tw, "%q\t%s\n", k.key, strings.Join(k.valueHashes, "\t"))
+	}
+	tw.Flush()
+	return errors.New("nodes differ")
+}
+
+// differ narrows down the keys that differ between nodes, by recursively
+// comparing the digests of the key prefixes whose digests differ.
+type differ struct {
+	client  *http.Client
+	nodes   []string
+	height  int64
+	maxKeys int
+	keys    []keyDiff
+}
+
+type keyDiff struct {
+	key         string
+	valueHashes []string // by node, or "-" if the node doesn't have the key
+}
+
+func (d *differ) diff(prefix string) error {
+	digests, err := d.digests(prefix, false)
+	if err != nil {
+		return err
+	}
+	if digestsEqual(digests) {
+		return nil
+	}
+
+	small := true
+	for _, digest := range digests {
+		small = small && digest.Count <= d.maxKeys
+	}
+	if small {
+		digests, err := d.digests(prefix, true)
+		if err != nil {
+			return err
+		}
+		d.diffKeys(digests)
+		return nil
+	}
+
+	// Recurse into every bucket whose contents differ between nodes. The
+	// bucket with the same prefix as the digest holds a single key.
+	var (
+		buckets = map[string][]cas.Bucket{}
+		order   []string
+	)
+	for i, digest := range digests {
+		for _, b := range digest.Buckets {
+			if _, ok := buckets[b.Prefix]; !ok {
+				buckets[b.Prefix] = make([]cas.Bucket, len(digests))
+				order = append(order, b.Prefix)
+			}
+			buckets[b.Prefix][i] = b
+		}
+	}
+	sort.Strings(order)
+	for _, p := range order {
+		if bucketsEqual(buckets[p]) {
+			continue
+		}
+		if p == prefix {
+			d.diffKeys(digests) // just the key equal to the prefix
+			continue
+		}
+		if err := d.diff(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffKeys compares the keys in the digests one by one.
+func (d *differ) diffKeys(digests []cas.Digest) {
+	var (
+		hashes = map[string][]string{}
+		order  []string
+	)
+	for i, digest := range digests {
+		for _, k := range digest.Keys {
+			if _, ok := hashes[k.Key]; !ok {
+				hashes[k.Key] = make([]string, len(digests))
+				for j := range hashes[k.Key] {
+					hashes[k.Key][j] = "-"
+				}
+				order = append(order, k.Key)
+			}
+			hashes[k.Key][i] = fmt.Sprintf("%X", k.ValueHash)
+		}
+	}
+	sort.Strings(order)
+	for _, k := range order {
+		for _, h := range hashes[k][1:] {
+			if h != hashes[k][0] {
+				d.keys = append(d.keys, keyDiff{key: k, valueHashes: hashes[k]})
+				break
+			}
+		}
+	}
+}
+
+func (d *differ) digests(prefix string, keys bool) ([]cas.Digest, error) {
+	query := url.Values{
+		"height": {strconv.FormatInt(d.height, 10)},
+		"prefix": {prefix},
+		"keys":   {strconv.FormatBool(keys)},
+	}
+	digests := make([]cas.Digest, len(d.nodes))
+	for i, node := range d.nodes {
+		if err := d.get(node, "/admin/digest", query, &digests[i]); err != nil {
+			return nil, err
+		}
+	}
+	return digests, nil
+}
+
+func (d *differ) get(node, path string, query url.Values, dst interface{}) error {
+	u := node + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	resp, err := d.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var response apiResponse
+		json.NewDecoder(resp.Body).Decode(&response)
+		return errors.Errorf("%s: %s: %s %s", node, resp.Status, response.Error, response.Log)
+	}
+	return errors.Wrap(json.NewDecoder(resp.Body).Decode(dst), node)
+}
+
+func digestsEqual(digests []cas.Digest) bool {
+	for _, digest := range digests[1:] {
+		if digest.Count != digests[0].Count || !bytes.Equal(digest.Hash, digests[0].Hash) {
+			return false
+		}
+	}
+	return true
+}
+
+func bucketsEqual(buckets []cas.Bucket) bool {
+	for _, b := range buckets[1:] {
+		if b.Count != buckets[0].Count || !bytes.Equal(b.Hash, buckets[0].Hash) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDiffer(t *testing.T) {
+	// Two nodes with the same keys, but for the value of one, which is a
+	// prefix of others, so it's in the same bucket as its digest's prefix.
+	var (
+		nodes  []string
+		height int64
+	)
+	for i := 0; i < 2; i++ {
+		client, api, done := newTestAPI(t, 0)
+		defer done()
+		for j := 0; j < 200; j++ {
+			value := "one"
+			if i == 1 && j == 12 {
+				value = "two"
+			}
+			checkSet(t, api, fmt.Sprintf("k%d", j), "", value, http.StatusOK)
+		}
+		height = commit(t, client)
+		server := httptest.NewServer(api)
+		defer server.Close()
+		nodes = append(nodes, server.URL)
+	}
+
+	// However far the digests are narrowed down before keys are compared one
+	// by one, exactly that key is found.
+	for _, maxKeys := range []int{1, 8, 64, 1000} {
+		d := &differ{client: http.DefaultClient, nodes: nodes, height: height, maxKeys: maxKeys}
+		if err := d.diff(""); err != nil {
+			t.Fatalf("max keys %d: %v", maxKeys, err)
+		}
+		if len(d.keys) != 1 || d.keys[0].key != "k12" {
+			t.Fatalf("max keys %d: want k12, have %+v", maxKeys, d.keys)
+		}
+		if hashes := d.keys[0].valueHashes; len(hashes) != 2 || hashes[0] == hashes[1] || hashes[0] == "-" || hashes[1] == "-" {
+			t.Fatalf("max keys %d: want two different value hashes, have %v", maxKeys, hashes)
+		}
+	}
+
+	// A node compared with itself has no differences.
+	d := &differ{client: http.DefaultClient, nodes: []string{nodes[0], nodes[0]}, height: height, maxKeys: 1}
+	if err := d.diff(""); err != nil || len(d.keys) != 0 {
+		t.Fatalf("want no differences, have %v, %+v", err, d.keys)
+	}
+}
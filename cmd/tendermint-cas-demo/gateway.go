@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/prometheus"
+	"github.com/oklog/run"
+	"github.com/peterbourgon/usage"
+	"github.com/pkg/errors"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	tendermintcommon "github.com/tendermint/tendermint/libs/common"
+	tendermintpubsub "github.com/tendermint/tendermint/libs/pubsub"
+	tendermintrpcclient "github.com/tendermint/tendermint/rpc/client"
+	tendermintcoretypes "github.com/tendermint/tendermint/rpc/core/types"
+	tenderminttypes "github.com/tendermint/tendermint/types"
+)
+
+func runGateway(args []string) error {
+	fs := flag.NewFlagSet("gateway", flag.ExitOnError)
+	var (
+		apiAddr        = fs.String("api-addr", "127.0.0.1:8081", "HTTP API address")
+		grpcAddr       = fs.String("grpc-addr", "", "gRPC API address (empty to disable)")
+		metricsAddr    = fs.String("metrics-addr", "", "Prometheus metrics HTTP address (empty to disable)")
+		tendermintRPC  = fs.String("tendermint-rpc", "tcp://127.0.0.1:26657", "comma-separated Tendermint RPC addresses")
+		healthInterval = fs.Duration("health-interval", 2*time.Second, "how often to check the health of each Tendermint node")
+		rpcTimeout     = fs.Duration("tendermint-rpc-timeout", 5*time.Second, "timeout of each call to a Tendermint node, after which it fails, or the node is unhealthy")
+		genesisFile    = fs.String("genesis", "", "trusted genesis file, to verify reads against (empty to not verify)")
+		verifyTimeout  = fs.Duration("verify-timeout", 5*time.Second, "how long to wait for the block that verifies a read")
+	)
+	fs.Usage = usage.For(fs, "tendermint-cas-demo gateway [flags]")
+	fs.Parse(args)
+
+	var logger log.Logger
+	{
+		logger = log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout))
+	}
+
+	var pool *nodePool
+	{
+		healthy := prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "cas",
+			Subsystem: "gateway",
+			Name:      "node_healthy",
+			Help:      "Whether the Tendermint node is healthy (1) or not (0).",
+		}, []string{"node"})
+		pool = newNodePool(strings.Split(*tendermintRPC, ","), *rpcTimeout, log.With(logger, "component", "Pool"), healthy)
+		defer pool.stop()
+	}
+
+	var verifier *lightClient
+	if *genesisFile != "" {
+		genesis, err := tenderminttypes.GenesisDocFromFile(*genesisFile)
+		if err != nil {
+			return errors.Wrap(err, "reading genesis")
+		}
+		verifier = newLightClient(genesis, pool, *verifyTimeout)
+		level.Info(logger).Log("context", "light client", "chain_id", genesis.ChainID, "validators", len(genesis.Validators))
+	}
+
+	var g run.Group
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			level.Info(logger).Log("context", "Tendermint nodes", "addrs", *tendermintRPC, "health_interval", *healthInterval, "rpc_timeout", *rpcTimeout)
+			pool.checkHealth() // once up front
+			ticker := time.NewTicker(*healthInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					pool.checkHealth()
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		}, func(error) {
+			cancel()
+		})
+	}
+	addAPIs(&g, logger, pool, verifier, 0, *apiAddr, *grpcAddr, *metricsAddr)
+	addSignalHandler(&g)
+	level.Info(logger).Log("exit", g.Run())
+	return nil
+}
+
+// errNoHealthyNodes is returned by the pool when every node is unhealthy.
+var errNoHealthyNodes = errors.New("no healthy Tendermint nodes")
+
+// nodePool is a storeClient spreading requests across the RPC servers of
+// several remote Tendermint nodes, skipping those that are unreachable or
+// catching up. Reads go to each healthy node in turn, failing over on error.
+// Writes do the same, but only fail over if the node couldn't be reached at
+// all, so a transaction is never broadcast twice.
+type nodePool struct {
+	logger  log.Logger
+	healthy metrics.Gauge
+
+	mtx           sync.Mutex
+	nodes         []*poolNode
+	next          int                      // index of the node for the next request
+	subscriptions map[string]*subscription // by subscriber
+}
+
+var (
+	_ apiClient    = (*nodePool)(nil)
+	_ headerClient = (*nodePool)(nil)
+)
+
+type poolNode struct {
+	addr    string
+	client  *remoteClient
+	healthy bool
+}
+
+type subscription struct {
+	node  *poolNode
+	query tendermintpubsub.Query
+}
+
+// newNodePool returns a pool of the nodes with the given RPC addresses, each
+// of whose calls fails if it takes longer than the timeout.
+func newNodePool(addrs []string, timeout time.Duration, logger log.Logger, healthy metrics.Gauge) *nodePool {
+	p := &nodePool{
+		logger:        logger,
+		healthy:       healthy,
+		subscriptions: map[string]*subscription{},
+	}
+	for _, addr := range addrs {
+		p.nodes = append(p.nodes, &poolNode{
+			addr:    addr,
+			client:  newRemoteClient(addr, timeout),
+			healthy: true, // until the first check says otherwise
+		})
+	}
+	return p
+}
+
+// checkHealth checks the status of every node concurrently. A node is healthy
+// if it responds, within the pool's timeout, and isn't catching up. Watches on
+// nodes that become unhealthy are closed, so that the watchers can reconnect
+// to another node, rather than silently missing events.
+func (p *nodePool) checkHealth() {
+	var wg sync.WaitGroup
+	for _, n := range p.nodes {
+		wg.Add(1)
+		go func(n *poolNode) {
+			defer wg.Done()
+			err := nodeHealth(n)
+			healthy := err == nil
+
+			p.mtx.Lock()
+			var closed map[string]*subscription
+			if healthy != n.healthy {
+				if healthy {
+					level.Info(p.logger).Log("node", n.addr, "healthy", true)
+				} else {
+					level.Warn(p.logger).Log("node", n.addr, "healthy", false, "err", err)
+					closed = p.removeSubscriptions(n)
+				}
+			}
+			n.healthy = healthy
+			p.healthy.With("node", n.addr).Set(boolGauge(healthy))
+			p.mtx.Unlock()
+
+			for subscriber, s := range closed {
+				n.client.Unsubscribe(context.Background(), subscriber, s.query) // closes the channel
+			}
+		}(n)
+	}
+	wg.Wait()
+}
+
+func nodeHealth(n *poolNode) error {
+	status, err := n.client.Status()
+	if err != nil {
+		return err
+	}
+	if status.SyncInfo.CatchingUp {
+		return errors.New("catching up")
+	}
+	return nil
+}
+
+// removeSubscriptions forgets, and returns, every subscription to the node,
+// which the caller must then close. The caller must hold the mutex.
+func (p *nodePool) removeSubscriptions(n *poolNode) map[string]*subscription {
+	removed := map[string]*subscription{}
+	for subscriber, s := range p.subscriptions {
+		if s.node == n {
+			removed[subscriber] = s
+			delete(p.subscriptions, subscriber)
+		}
+	}
+	return removed
+}
+
+// healthyNodes returns the healthy nodes, starting with the next one in turn,
+// or, if rotate is false, the first one.
+func (p *nodePool) healthyNodes(rotate bool) []*poolNode {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	start := 0
+	if rotate {
+		start = p.next
+		p.next = (p.next + 1) % len(p.nodes)
+	}
+	var nodes []*poolNode
+	for i := range p.nodes {
+		n := p.nodes[(start+i)%len(p.nodes)]
+		if n.healthy {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// do calls f with each healthy node in turn, until it succeeds, or returns an
+// error that shouldRetry rejects.
+func (p *nodePool) do(shouldRetry func(error) bool, f func(n *poolNode) error) error {
+	return p.try(p.healthyNodes(true), shouldRetry, f)
+}
+
+// doFirst is like do, but starts with the first healthy node, rather than
+// taking turns, so that consecutive calls usually see the same node.
+func (p *nodePool) doFirst(f func(n *poolNode) error) error {
+	return p.try(p.healthyNodes(false), always, f)
+}
+
+func (p *nodePool) try(nodes []*poolNode, shouldRetry func(error) bool, f func(n *poolNode) error) error {
+	if len(nodes) == 0 {
+		return errNoHealthyNodes
+	}
+	var err error
+	for _, n := range nodes {
+		if err = f(n); err == nil || !shouldRetry(err) {
+			return err
+		}
+		level.Debug(p.logger).Log("node", n.addr, "err", err, "failover", true)
+	}
+	return err
+}
+
+func always(error) bool { return true }
+
+// ABCIQuery implements storeClient.
+func (p *nodePool) ABCIQuery(path string, data tendermintcommon.HexBytes) (result *tendermintcoretypes.ResultABCIQuery, err error) {
+	err = p.do(always, func(n *poolNode) (err error) {
+		result, err = n.client.ABCIQuery(path, data)
+		return err
+	})
+	return result, err
+}
+
+// ABCIQueryWithOptions implements storeClient.
+func (p *nodePool) ABCIQueryWithOptions(path string, data tendermintcommon.HexBytes, opts tendermintrpcclient.ABCIQueryOptions) (result *tendermintcoretypes.ResultABCIQuery, err error) {
+	err = p.do(always, func(n *poolNode) (err error) {
+		result, err = n.client.ABCIQueryWithOptions(path, data, opts)
+		return err
+	})
+	return result, err
+}
+
+// TxSearch implements storeClient.
+func (p *nodePool) TxSearch(query string, prove bool, page, perPage int) (result *tendermintcoretypes.ResultTxSearch, err error) {
+	err = p.do(always, func(n *poolNode) (err error) {
+		result, err = n.client.TxSearch(query, prove, page, perPage)
+		return err
+	})
+	return result, err
+}
+
+// Commit implements headerClient. Headers are verified by the light client,
+// so they can come from any node.
+func (p *nodePool) Commit(height *int64) (result *tendermintcoretypes.ResultCommit, err error) {
+	err = p.do(always, func(n *poolNode) (err error) {
+		result, err = n.client.Commit(height)
+		return err
+	})
+	return result, err
+}
+
+// Validators implements headerClient.
+func (p *nodePool) Validators(height *int64) (result *tendermintcoretypes.ResultValidators, err error) {
+	err = p.do(always, func(n *poolNode) (err error) {
+		result, err = n.client.Validators(height)
+		return err
+	})
+	return result, err
+}
+
+// Block returns the block at the height. State sync verifies it against the
+// header of the next block, so it can come from any node.
+func (p *nodePool) Block(height *int64) (result *tendermintcoretypes.ResultBlock, err error) {
+	err = p.do(always, func(n *poolNode) (err error) {
+		result, err = n.client.Block(height)
+		return err
+	})
+	return result, err
+}
+
+// Status implements statusClient. It and the other status methods describe
+// the first healthy node.
+func (p *nodePool) Status() (result *tendermintcoretypes.ResultStatus, err error) {
+	err = p.doFirst(func(n *poolNode) (err error) {
+		result, err = n.client.Status()
+		return err
+	})
+	return result, err
+}
+
+// NetInfo implements statusClient.
+func (p *nodePool) NetInfo() (result *tendermintcoretypes.ResultNetInfo, err error) {
+	err = p.doFirst(func(n *poolNode) (err error) {
+		result, err = n.client.NetInfo()
+		return err
+	})
+	return result, err
+}
+
+// ABCIInfo implements statusClient.
+func (p *nodePool) ABCIInfo() (result *tendermintcoretypes.ResultABCIInfo, err error) {
+	err = p.doFirst(func(n *poolNode) (err error) {
+		result, err = n.client.ABCIInfo()
+		return err
+	})
+	return result, err
+}
+
+// BroadcastTxSync implements storeClient.
+func (p *nodePool) BroadcastTxSync(tx tenderminttypes.Tx) (result *tendermintcoretypes.ResultBroadcastTx, err error) {
+	err = p.do(isDialError, func(n *poolNode) (err error) {
+		result, err = n.client.BroadcastTxSync(tx)
+		return err
+	})
+	return result, err
+}
+
+// Subscribe implements storeClient. The subscription is made to a single
+// healthy node, and closed if that node becomes unhealthy. The mutex isn't
+// held while subscribing, which may take a while, so the subscriber is
+// reserved, without a node, until then.
+func (p *nodePool) Subscribe(ctx context.Context, subscriber string, query tendermintpubsub.Query, out chan<- interface{}) error {
+	p.mtx.Lock()
+	if _, ok := p.subscriptions[subscriber]; ok {
+		p.mtx.Unlock()
+		return tendermintpubsub.ErrAlreadySubscribed
+	}
+	s := &subscription{query: query}
+	p.subscriptions[subscriber] = s
+	p.mtx.Unlock()
+
+	err := p.do(always, func(n *poolNode) error {
+		if err := n.client.Subscribe(ctx, subscriber, query, out); err != nil {
+			return err
+		}
+
+		// The node may have become unhealthy meanwhile, after its
+		// subscriptions were closed.
+		p.mtx.Lock()
+		healthy := n.healthy
+		if healthy {
+			s.node = n
+		}
+		p.mtx.Unlock()
+		if !healthy {
+			n.client.Unsubscribe(context.Background(), subscriber, query)
+			return errors.Errorf("node %s became unhealthy", n.addr)
+		}
+		return nil
+	})
+	if err != nil {
+		p.mtx.Lock()
+		delete(p.subscriptions, subscriber)
+		p.mtx.Unlock()
+	}
+	return err
+}
+
+// Unsubscribe implements storeClient.
+func (p *nodePool) Unsubscribe(ctx context.Context, subscriber string, query tendermintpubsub.Query) error {
+	s, ok := p.removeSubscription(subscriber)
+	if !ok {
+		return tendermintpubsub.ErrSubscriptionNotFound
+	}
+	return s.node.client.Unsubscribe(ctx, subscriber, query)
+}
+
+// UnsubscribeAll implements storeClient.
+func (p *nodePool) UnsubscribeAll(ctx context.Context, subscriber string) error {
+	s, ok := p.removeSubscription(subscriber)
+	if !ok {
+		return tendermintpubsub.ErrSubscriptionNotFound
+	}
+	return s.node.client.UnsubscribeAll(ctx, subscriber)
+}
+
+// removeSubscription forgets the subscriber's subscription, and returns it,
+// if it's been made.
+func (p *nodePool) removeSubscription(subscriber string) (*subscription, bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	s, ok := p.subscriptions[subscriber]
+	if !ok || s.node == nil {
+		return nil, false
+	}
+	delete(p.subscriptions, subscriber)
+	return s, true
+}
+
+func (p *nodePool) stop() {
+	for _, n := range p.nodes {
+		if n.client.IsRunning() {
+			n.client.Stop()
+		}
+	}
+}
+
+// isDialError returns true if the error means that the request couldn't have
+// reached the node, so it's safe to send it to another.
+func isDialError(err error) bool {
+	if err == errNoHealthyNodes {
+		return false
+	}
+	if e, ok := errors.Cause(err).(*url.Error); ok {
+		err = e.Err
+	}
+	e, ok := err.(*net.OpError)
+	return ok && e.Op == "dial"
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/discard"
+)
+
+func TestNodePoolHungNode(t *testing.T) {
+	// A node that accepts connections, but never responds.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	timeout := 100 * time.Millisecond
+	pool := newNodePool([]string{"tcp://" + ln.Addr().String()}, timeout, log.NewNopLogger(), discard.NewGauge())
+	defer pool.stop()
+
+	done := make(chan struct{})
+	go func() {
+		pool.checkHealth()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(50 * timeout):
+		t.Fatal("checkHealth: still waiting for the node")
+	}
+	if nodes := pool.healthyNodes(false); len(nodes) != 0 {
+		t.Fatalf("want no healthy nodes, have %d", len(nodes))
+	}
+	if _, err := pool.Status(); err != errNoHealthyNodes {
+		t.Fatalf("Status: want %v, have %v", errNoHealthyNodes, err)
+	}
+}
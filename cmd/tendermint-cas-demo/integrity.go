@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	tendermintabci "github.com/tendermint/tendermint/abci/types"
+	tendermintblockchain "github.com/tendermint/tendermint/blockchain"
+	tendermintconfig "github.com/tendermint/tendermint/config"
+	tendermintdb "github.com/tendermint/tendermint/libs/db"
+	tendermintnode "github.com/tendermint/tendermint/node"
+	tendermintstate "github.com/tendermint/tendermint/state"
+)
+
+// Tendermint's handshake trusts the height and app hash that the application
+// reports in Info, and only replays the blocks that come after that height. If
+// the application file was edited, or restored from a backup of some other
+// height, the node goes on from the wrong state, and only fails when its app
+// hash disagrees with the rest of the network, if ever. So, before starting the
+// node, check the application's state against the app hashes that Tendermint
+// has stored.
+
+// appStateMismatch describes an application state that doesn't match the
+// Tendermint state and block store.
+type appStateMismatch struct {
+	height      int64  // reported by the application
+	appHash     []byte // reported by the application
+	storeHeight int64  // of the block store
+	want        []byte // nil if the application is ahead of the block store
+	source      string // of want
+}
+
+func (e appStateMismatch) Error() string {
+	if e.want == nil {
+		return fmt.Sprintf("application state is at height %d, but the block store is only at height %d", e.height, e.storeHeight)
+	}
+	return fmt.Sprintf("application state at height %d has app hash %X, but %s has %X", e.height, e.appHash, e.source, e.want)
+}
+
+// checkAppState compares the height and app hash reported by the application
+// with the Tendermint state and block store. It returns an appStateMismatch if
+// they disagree.
+func checkAppState(stateDB, blockStoreDB tendermintdb.DB, app tendermintabci.Application) error {
+	info := app.Info(tendermintabci.RequestInfo{})
+	if info.LastBlockHeight == 0 {
+		return nil // Tendermint replays every block, anyway
+	}
+
+	var (
+		state       = tendermintstate.LoadState(stateDB)
+		blockStore  = tendermintblockchain.NewBlockStore(blockStoreDB)
+		storeHeight = blockStore.Height()
+		mismatch    = appStateMismatch{
+			height:      info.LastBlockHeight,
+			appHash:     info.LastBlockAppHash,
+			storeHeight: storeHeight,
+		}
+	)
+	switch {
+	case info.LastBlockHeight == state.LastBlockHeight:
+		// The app hash after the last block that Tendermint applied.
+		mismatch.want, mismatch.source = state.AppHash, "the Tendermint state"
+	case info.LastBlockHeight < storeHeight:
+		// The app hash in the header of the next block.
+		meta := blockStore.LoadBlockMeta(info.LastBlockHeight + 1)
+		if meta == nil {
+			return fmt.Errorf("block %d missing from the block store", info.LastBlockHeight+1)
+		}
+		mismatch.want, mismatch.source = meta.Header.AppHash, fmt.Sprintf("the header of block %d", meta.Header.Height)
+	case info.LastBlockHeight == storeHeight:
+		// The application committed the last block, but Tendermint stopped
+		// before saving its state, and there's no later header to check.
+		return nil
+	default:
+		return mismatch
+	}
+	if !bytes.Equal(info.LastBlockAppHash, mismatch.want) {
+		return mismatch
+	}
+	return nil
+}
+
+// matchAppState returns the application, if its state matches the Tendermint
+// state and block store. If it doesn't, and rebuild is set, it closes the
+// application, and returns a new one from newApp, with an empty state, to which
+// Tendermint replays every block. Otherwise, it returns the appStateMismatch.
+func matchAppState(stateDB, blockStoreDB tendermintdb.DB, app *cas.Application, rebuild bool, newApp func(initial io.Reader) (*cas.Application, error), logger log.Logger) (*cas.Application, error) {
+	err := checkAppState(stateDB, blockStoreDB, app)
+	if _, ok := err.(appStateMismatch); !ok || !rebuild {
+		return app, err
+	}
+	level.Warn(logger).Log("during", "checkAppState", "err", err, "action", "rebuilding from genesis")
+	app.Close()
+	return newApp(nil)
+}
+
+// openTendermintDB opens one of the node's databases, as the node would. The
+// databases are locked while the node is running, and Tendermint panics if it
+// can't open one, so that's recovered as an error.
+func openTendermintDB(config *tendermintconfig.Config, id string) (db tendermintdb.DB, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("open Tendermint %s database in %s (is the node running?): %v", id, config.DBDir(), r)
+		}
+	}()
+	return tendermintnode.DefaultDBProvider(&tendermintnode.DBContext{ID: id, Config: config})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	"github.com/go-kit/kit/log"
+	tendermintabci "github.com/tendermint/tendermint/abci/types"
+	tendermintblockchain "github.com/tendermint/tendermint/blockchain"
+	tendermintconfig "github.com/tendermint/tendermint/config"
+	tendermintstate "github.com/tendermint/tendermint/state"
+)
+
+func TestCheckAppState(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a cluster")
+	}
+	c, n := stoppedNode(t)
+	defer c.Close()
+	var (
+		stateDB      = n.DB("state")
+		blockStoreDB = n.DB("blockstore")
+		state        = tendermintstate.LoadState(stateDB)
+		storeHeight  = tendermintblockchain.NewBlockStore(blockStoreDB).Height()
+		next         = tendermintblockchain.NewBlockStore(blockStoreDB).LoadBlockMeta(2).Header.AppHash
+		other        = []byte("other")
+	)
+	if state.LastBlockHeight < 3 || storeHeight != state.LastBlockHeight {
+		t.Fatalf("want a Tendermint state at the block store's height, of at least 3, have %d and %d", state.LastBlockHeight, storeHeight)
+	}
+
+	for _, testcase := range []struct {
+		name     string
+		height   int64
+		appHash  []byte
+		mismatch bool
+		want     []byte // of the mismatch
+		source   string // of the mismatch
+	}{
+		{"empty", 0, nil, false, nil, ""},
+		{"matches", state.LastBlockHeight, state.AppHash, false, nil, ""},
+		{"mismatch", state.LastBlockHeight, other, true, state.AppHash, "the Tendermint state"},
+		{"behind", 1, next, false, nil, ""},
+		{"behind mismatch", 1, other, true, next, "the header of block 2"},
+		{"ahead", storeHeight + 1, state.AppHash, true, nil, ""},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			err := checkAppState(stateDB, blockStoreDB, infoApp{height: testcase.height, appHash: testcase.appHash})
+			if !testcase.mismatch {
+				if err != nil {
+					t.Fatalf("want no error, have %v", err)
+				}
+				return
+			}
+			mismatch, ok := err.(appStateMismatch)
+			if !ok {
+				t.Fatalf("want a mismatch, have %v", err)
+			}
+			if !bytes.Equal(testcase.want, mismatch.want) || testcase.source != mismatch.source || storeHeight != mismatch.storeHeight {
+				t.Fatalf("want %X from %q, at block store height %d, have %X from %q, at %d", testcase.want, testcase.source, storeHeight, mismatch.want, mismatch.source, mismatch.storeHeight)
+			}
+		})
+	}
+}
+
+func TestMatchAppState(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a cluster")
+	}
+	c, n := stoppedNode(t)
+	defer c.Close()
+	var (
+		stateDB      = n.DB("state")
+		blockStoreDB = n.DB("blockstore")
+		rebuilt      *cas.Application
+		newApp       = func(initial io.Reader) (*cas.Application, error) {
+			var err error
+			rebuilt, err = cas.NewApplication(initial, nil, log.NewNopLogger())
+			return rebuilt, err
+		}
+	)
+
+	// The state the node persisted matches, with or without -rebuild-on-mismatch.
+	for _, rebuild := range []bool{false, true} {
+		app, err := cas.NewApplication(bytes.NewReader(n.Persisted()), nil, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err := matchAppState(stateDB, blockStoreDB, app, rebuild, newApp, log.NewNopLogger())
+		if err != nil || have != app {
+			t.Fatalf("rebuild %v: want the same application, have %v", rebuild, err)
+		}
+		app.Close()
+	}
+
+	// A state that's diverged from the chain's, at height 1, doesn't.
+	diverged := func() *cas.Application {
+		app, err := cas.NewApplication(nil, nil, log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.BeginBlock(tendermintabci.RequestBeginBlock{})
+		app.DeliverTx(cas.SetTx("c", nil, []byte("three")).Encode())
+		app.EndBlock(tendermintabci.RequestEndBlock{Height: 1})
+		app.Commit()
+		return app
+	}
+	app := diverged()
+	have, err := matchAppState(stateDB, blockStoreDB, app, false, newApp, log.NewNopLogger())
+	if _, ok := err.(appStateMismatch); !ok || have != app {
+		t.Fatalf("want a mismatch, and the same application, have %v", err)
+	}
+	app.Close()
+
+	// With -rebuild-on-mismatch, it's replaced by an empty application, which
+	// Tendermint replays every block to.
+	have, err = matchAppState(stateDB, blockStoreDB, diverged(), true, newApp, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("want no error, have %v", err)
+	}
+	if have == nil || have != rebuilt {
+		t.Fatalf("want the rebuilt application")
+	}
+	defer have.Close()
+	if info := have.Info(tendermintabci.RequestInfo{}); info.LastBlockHeight != 0 || have.State().Len() != 0 {
+		t.Fatalf("want an empty application, have height %d, and %d key(s)", info.LastBlockHeight, have.State().Len())
+	}
+}
+
+func TestOpenTendermintDBLocked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "integrity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := tendermintconfig.DefaultConfig().SetRoot(dir)
+
+	// A database that's open, as it is while the node is running, is locked,
+	// and Tendermint panics opening it again, which is an error instead.
+	db, err := openTendermintDB(config, "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := openTendermintDB(config, "state"); err == nil || !strings.Contains(err.Error(), "is the node running?") {
+		t.Fatalf("want an error asking if the node is running, have %v", err)
+	}
+}
+
+// infoApp is an application that only reports a height and app hash.
+type infoApp struct {
+	tendermintabci.BaseApplication
+	height  int64
+	appHash []byte
+}
+
+func (a infoApp) Info(tendermintabci.RequestInfo) tendermintabci.ResponseInfo {
+	return tendermintabci.ResponseInfo{LastBlockHeight: a.height, LastBlockAppHash: a.appHash}
+}
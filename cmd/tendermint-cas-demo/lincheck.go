@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/client"
+	"github.com/6thc/tendermint-cas-demo/internal/linearizability"
+	"github.com/peterbourgon/usage"
+	"github.com/pkg/errors"
+)
+
+func runLincheck(args []string) error {
+	fs := flag.NewFlagSet("lincheck", flag.ExitOnError)
+	var (
+		endpoint    = fs.String("endpoint", "127.0.0.1:8081", "comma-separated HTTP API addresses, of which each client uses one")
+		clients     = fs.Int("clients", 8, "number of concurrent clients")
+		keys        = fs.Int("keys", 4, "number of keys")
+		prefix      = fs.String("prefix", "lincheck-", "prefix of the keys, to which a unique run ID is added; keys can't contain slashes")
+		duration    = fs.Duration("duration", 10*time.Second, "how long to run the clients for")
+		timeout     = fs.Duration("timeout", 5*time.Second, "timeout for each operation, after which its outcome is unknown")
+		seed        = fs.Int64("seed", 0, "seed for the clients' choices (default the time)")
+		historyFile = fs.String("history", "", "write the history to this file, as JSON")
+		checkFile   = fs.String("check", "", "check the history in this file, written by -history, instead of running clients")
+		reportFile  = fs.String("report", "lincheck.html", "write an HTML report to this file if the history isn't linearizable")
+	)
+	fs.Usage = usage.For(fs, "tendermint-cas-demo lincheck [flags]")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return usageError(fmt.Sprintf("want 0 arguments, have %d", fs.NArg()))
+	}
+	if *clients < 1 || *keys < 1 {
+		return usageError("-clients and -keys must be at least 1")
+	}
+	if strings.Contains(*prefix, "/") {
+		return usageError(fmt.Sprintf("invalid -prefix %q: keys can't contain slashes", *prefix))
+	}
+
+	var history []linearizability.Operation
+	if *checkFile != "" {
+		buf, err := ioutil.ReadFile(*checkFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(buf, &history); err != nil {
+			return errors.Wrap(err, *checkFile)
+		}
+	} else {
+		if *seed == 0 {
+			*seed = time.Now().UnixNano()
+		}
+		w := &workload{
+			timeout: *timeout,
+			seed:    *seed,
+		}
+		endpoints := strings.Split(*endpoint, ",")
+		for i := 0; i < *clients; i++ {
+			c, err := client.New([]string{endpoints[i%len(endpoints)]})
+			if err != nil {
+				return err
+			}
+			w.clients = append(w.clients, c)
+		}
+		run := time.Now().UnixNano()
+		for i := 0; i < *keys; i++ {
+			w.keys = append(w.keys, fmt.Sprintf("%s%d-%d", *prefix, run, i))
+		}
+
+		fmt.Printf("running %d client(s) on %d key(s) for %s, with seed %d\n", *clients, *keys, *duration, *seed)
+		ctx, cancel := context.WithTimeout(context.Background(), *duration)
+		history = w.run(ctx)
+		cancel()
+		if *historyFile != "" {
+			if err := writeHistory(*historyFile, history); err != nil {
+				return err
+			}
+		}
+	}
+
+	result := linearizability.Check(history)
+	if result.Linearizable {
+		fmt.Printf("%d operation(s): linearizable\n", len(history))
+		return nil
+	}
+
+	fmt.Printf("%d operation(s): key %q isn't linearizable\n\n", len(history), result.Key)
+	writeCounterexample(os.Stdout, result.Counterexample)
+	if *reportFile != "" {
+		f, err := os.Create(*reportFile)
+		if err != nil {
+			return err
+		}
+		if err := linearizability.WriteReport(f, history, result); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		fmt.Printf("\nwrote a report to %s\n", *reportFile)
+	}
+	return errors.Errorf("key %q isn't linearizable", result.Key)
+}
+
+// workload runs clients that concurrently get and compare-and-swap random
+// keys, and records the history of their operations. A client swaps from the
+// last value it saw to a value that's never been written before, so that every
+// read can be matched with the write it reads.
+type workload struct {
+	clients []client.KV
+	keys    []string
+	timeout time.Duration // for each operation
+	seed    int64
+}
+
+// run the clients until the context is done, and return the history.
+func (w *workload) run(ctx context.Context) []linearizability.Operation {
+	var (
+		recorder linearizability.Recorder
+		wg       sync.WaitGroup
+	)
+	for i, kv := range w.clients {
+		wg.Add(1)
+		go func(i int, kv client.KV) {
+			defer wg.Done()
+			w.runClient(ctx, i, kv, &recorder)
+		}(i, kv)
+	}
+	wg.Wait()
+	return recorder.History()
+}
+
+func (w *workload) runClient(ctx context.Context, i int, kv client.KV, recorder *linearizability.Recorder) {
+	var (
+		rng  = rand.New(rand.NewSource(w.seed + int64(i)))
+		last = map[string]string{} // the last value seen of each key
+	)
+	for seq := 0; ctx.Err() == nil; seq++ {
+		op := linearizability.Operation{
+			Client: i,
+			Key:    w.keys[rng.Intn(len(w.keys))],
+			Kind:   linearizability.Get,
+		}
+		if rng.Intn(2) == 0 {
+			op.Kind = linearizability.CAS
+			op.Old, op.New = last[op.Key], fmt.Sprintf("%d-%d", i, seq)
+		}
+
+		// An operation isn't canceled when the run ends, so that its outcome
+		// is known.
+		opCtx, cancel := context.WithTimeout(context.Background(), w.timeout)
+		op.Call = time.Now()
+		var err error
+		if op.Kind == linearizability.Get {
+			var value []byte
+			value, err = kv.Get(opCtx, op.Key)
+			op.Value = string(value)
+		} else {
+			err = kv.CompareAndSwap(opCtx, op.Key, []byte(op.Old), []byte(op.New))
+		}
+		op.Return = time.Now()
+		cancel()
+
+		switch err {
+		case nil:
+			op.Outcome = linearizability.OK
+		case client.ErrNotFound:
+			op.Outcome, op.Value = linearizability.OK, ""
+		case client.ErrConflict:
+			op.Outcome = linearizability.Conflict
+		default:
+			op.Outcome = linearizability.Unknown
+		}
+		recorder.Record(op)
+
+		switch {
+		case op.Outcome == linearizability.Unknown:
+			// The client's node is probably down, and would fail the next
+			// operation straight away. Every compare-and-swap that fails
+			// might take effect at any time, which makes the history harder
+			// to check, so don't make many.
+			select {
+			case <-ctx.Done():
+			case <-time.After(failureBackoff):
+			}
+		case op.Outcome == linearizability.Conflict:
+		case op.Kind == linearizability.Get:
+			last[op.Key] = op.Value
+		default:
+			last[op.Key] = op.New
+		}
+	}
+}
+
+// failureBackoff is how long a client waits after an operation fails.
+const failureBackoff = 100 * time.Millisecond
+
+func writeHistory(filename string, history []linearizability.Operation) error {
+	buf, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(buf, '\n'), 0644)
+}
+
+// writeCounterexample writes a table of the operations, with times since the
+// first call.
+func writeCounterexample(w io.Writer, ops []linearizability.Operation) {
+	if len(ops) == 0 {
+		return
+	}
+	start := ops[0].Call
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "CLIENT\tOPERATION\tOUTCOME\tCALL\tRETURN\n")
+	for _, op := range ops {
+		var (
+			operation = fmt.Sprintf("get → %q", op.Value)
+			ret       = "-"
+		)
+		if op.Kind == linearizability.CAS {
+			operation = fmt.Sprintf("cas %q → %q", op.Old, op.New)
+		}
+		if op.Outcome != linearizability.Unknown {
+			ret = op.Return.Sub(start).String()
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", op.Client, operation, op.Outcome, op.Call.Sub(start), ret)
+	}
+	tw.Flush()
+}
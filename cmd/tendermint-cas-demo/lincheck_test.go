@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/client"
+	"github.com/6thc/tendermint-cas-demo/internal/cluster"
+	"github.com/6thc/tendermint-cas-demo/internal/linearizability"
+)
+
+func TestLincheckPrefix(t *testing.T) {
+	// A slash in the prefix would make every key a path of a different route,
+	// so it's refused before any client runs.
+	err := runLincheck([]string{"-prefix", "a/b-"})
+	if _, ok := err.(usageError); !ok || !strings.Contains(err.Error(), "-prefix") {
+		t.Fatalf("want a usage error about -prefix, have %v", err)
+	}
+}
+
+// TestWorkloadFake runs the workload against a Fake, which is linearizable,
+// with latency so that the operations are concurrent.
+func TestWorkloadFake(t *testing.T) {
+	fake := slowKV{client.NewFake()}
+	w := &workload{
+		clients: []client.KV{fake, fake, fake, fake},
+		keys:    []string{"a", "b"},
+		timeout: time.Second,
+		seed:    1,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	history := w.run(ctx)
+	if len(history) == 0 {
+		t.Fatal("no operations")
+	}
+	if result := linearizability.Check(history); !result.Linearizable {
+		var buf bytes.Buffer
+		writeCounterexample(&buf, result.Counterexample)
+		t.Fatalf("%q isn't linearizable:\n%s", result.Key, buf.String())
+	}
+}
+
+// slowKV sleeps before and after each get and compare-and-swap.
+type slowKV struct {
+	client.KV
+}
+
+func (kv slowKV) Get(ctx context.Context, key string) ([]byte, error) {
+	defer sleep()
+	sleep()
+	return kv.KV.Get(ctx, key)
+}
+
+func (kv slowKV) CompareAndSwap(ctx context.Context, key string, old, new []byte) error {
+	defer sleep()
+	sleep()
+	return kv.KV.CompareAndSwap(ctx, key, old, new)
+}
+
+func sleep() {
+	time.Sleep(time.Duration(rand.Intn(1000)) * time.Microsecond)
+}
+
+// TestWorkloadCluster runs the workload against a cluster's API. Writes return
+// once they've passed CheckTx, and reads are of a node's committed state, so
+// the history mightn't be linearizable. If it isn't, the counterexample must
+// show why.
+func TestWorkloadCluster(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a cluster")
+	}
+	c, err := cluster.New(cluster.Config{
+		Nodes: 3,
+		Handler: func(client *cluster.Client) http.Handler {
+			return NewCompareAndSwapAPI(client, nil, 0)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	w := &workload{
+		keys:    []string{"a", "b"},
+		timeout: 10 * time.Second,
+		seed:    1,
+	}
+	for i := 0; i < 6; i++ {
+		w.clients = append(w.clients, nodeClient(t, c.Node(i%3)))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	history := w.run(ctx)
+
+	var swapped bool
+	for _, op := range history {
+		swapped = swapped || op.Kind == linearizability.CAS && op.Outcome == linearizability.OK
+	}
+	if !swapped {
+		t.Fatalf("no successful compare-and-swaps in %d operation(s)", len(history))
+	}
+
+	result := linearizability.Check(history)
+	if result.Linearizable {
+		return
+	}
+	var buf bytes.Buffer
+	writeCounterexample(&buf, result.Counterexample)
+	t.Logf("%q isn't linearizable:\n%s", result.Key, buf.String())
+	if len(result.Counterexample) == 0 {
+		t.Fatal("no counterexample")
+	}
+	if linearizability.Check(result.Counterexample).Linearizable {
+		t.Fatal("the counterexample is linearizable")
+	}
+}
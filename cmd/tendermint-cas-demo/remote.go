@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	amino "github.com/tendermint/go-amino"
+	tendermintabciserver "github.com/tendermint/tendermint/abci/server"
+	tendermintabci "github.com/tendermint/tendermint/abci/types"
+	tendermintcommon "github.com/tendermint/tendermint/libs/common"
+	tendermintpubsub "github.com/tendermint/tendermint/libs/pubsub"
+	tendermintrpcclient "github.com/tendermint/tendermint/rpc/client"
+	tendermintcoretypes "github.com/tendermint/tendermint/rpc/core/types"
+	tendermintrpctypes "github.com/tendermint/tendermint/rpc/lib/types"
+	tenderminttypes "github.com/tendermint/tendermint/types"
+)
+
+// newABCIServer returns a server for the application, to be connected to by a
+// separately managed Tendermint node. The transport is "socket" or "grpc".
+func newABCIServer(addr, transport string, app tendermintabci.Application) (tendermintcommon.Service, error) {
+	// The socket server serializes calls to the application, like the local
+	// client used by an embedded node, but the gRPC server doesn't.
+	if transport == "grpc" {
+		app = &serializedApplication{app: app}
+	}
+	return tendermintabciserver.NewServer(addr, transport, app)
+}
+
+// serializedApplication makes only one call at a time to the wrapped
+// application, which, like cas.Application, needn't be safe for concurrent use.
+type serializedApplication struct {
+	mtx sync.Mutex
+	app tendermintabci.Application
+}
+
+func (a *serializedApplication) Info(request tendermintabci.RequestInfo) tendermintabci.ResponseInfo {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.app.Info(request)
+}
+
+func (a *serializedApplication) SetOption(request tendermintabci.RequestSetOption) tendermintabci.ResponseSetOption {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.app.SetOption(request)
+}
+
+func (a *serializedApplication) Query(request tendermintabci.RequestQuery) tendermintabci.ResponseQuery {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.app.Query(request)
+}
+
+func (a *serializedApplication) CheckTx(tx []byte) tendermintabci.ResponseCheckTx {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.app.CheckTx(tx)
+}
+
+func (a *serializedApplication) InitChain(request tendermintabci.RequestInitChain) tendermintabci.ResponseInitChain {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.app.InitChain(request)
+}
+
+func (a *serializedApplication) BeginBlock(request tendermintabci.RequestBeginBlock) tendermintabci.ResponseBeginBlock {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.app.BeginBlock(request)
+}
+
+func (a *serializedApplication) DeliverTx(tx []byte) tendermintabci.ResponseDeliverTx {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.app.DeliverTx(tx)
+}
+
+func (a *serializedApplication) EndBlock(request tendermintabci.RequestEndBlock) tendermintabci.ResponseEndBlock {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.app.EndBlock(request)
+}
+
+func (a *serializedApplication) Commit() tendermintabci.ResponseCommit {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	return a.app.Commit()
+}
+
+// remoteClient is a client for the RPC server of a remote Tendermint node.
+//
+// The websocket client underneath keeps one subscription per query, ignoring
+// the subscriber, and the node refuses duplicate subscriptions from the same
+// address. So every subscriber to a query shares a single upstream
+// subscription, which is made on first use and then kept for the lifetime of
+// the client.
+//
+// Tendermint's HTTP client never times out, so a hung node would hang its
+// callers, and the methods the APIs use are instead made with an rpcClient,
+// which does. Only the websocket goes through Tendermint's client.
+type remoteClient struct {
+	*tendermintrpcclient.HTTP
+	rpc *rpcClient
+
+	mtx       sync.Mutex
+	upstreams map[string]*upstream // by query
+}
+
+type upstream struct {
+	subscribers map[string]chan<- interface{}
+}
+
+// newRemoteClient returns a client for the node with the given RPC address,
+// e.g. tcp://127.0.0.1:26657, whose calls fail if they take longer than the
+// timeout. The node needn't be up yet.
+func newRemoteClient(addr string, timeout time.Duration) *remoteClient {
+	return &remoteClient{
+		HTTP:      tendermintrpcclient.NewHTTP(addr, "/websocket"),
+		rpc:       newRPCClient(addr, timeout),
+		upstreams: map[string]*upstream{},
+	}
+}
+
+// Status implements statusClient.
+func (c *remoteClient) Status() (*tendermintcoretypes.ResultStatus, error) {
+	result := new(tendermintcoretypes.ResultStatus)
+	if err := c.rpc.call("status", map[string]interface{}{}, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// NetInfo implements statusClient.
+func (c *remoteClient) NetInfo() (*tendermintcoretypes.ResultNetInfo, error) {
+	result := new(tendermintcoretypes.ResultNetInfo)
+	if err := c.rpc.call("net_info", map[string]interface{}{}, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ABCIInfo implements statusClient.
+func (c *remoteClient) ABCIInfo() (*tendermintcoretypes.ResultABCIInfo, error) {
+	result := new(tendermintcoretypes.ResultABCIInfo)
+	if err := c.rpc.call("abci_info", map[string]interface{}{}, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ABCIQuery implements storeClient.
+func (c *remoteClient) ABCIQuery(path string, data tendermintcommon.HexBytes) (*tendermintcoretypes.ResultABCIQuery, error) {
+	return c.ABCIQueryWithOptions(path, data, tendermintrpcclient.DefaultABCIQueryOptions)
+}
+
+// ABCIQueryWithOptions implements storeClient.
+func (c *remoteClient) ABCIQueryWithOptions(path string, data tendermintcommon.HexBytes, opts tendermintrpcclient.ABCIQueryOptions) (*tendermintcoretypes.ResultABCIQuery, error) {
+	result := new(tendermintcoretypes.ResultABCIQuery)
+	params := map[string]interface{}{"path": path, "data": data, "height": opts.Height, "trusted": opts.Trusted}
+	if err := c.rpc.call("abci_query", params, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// BroadcastTxSync implements storeClient.
+func (c *remoteClient) BroadcastTxSync(tx tenderminttypes.Tx) (*tendermintcoretypes.ResultBroadcastTx, error) {
+	result := new(tendermintcoretypes.ResultBroadcastTx)
+	if err := c.rpc.call("broadcast_tx_sync", map[string]interface{}{"tx": tx}, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// TxSearch implements storeClient.
+func (c *remoteClient) TxSearch(query string, prove bool, page, perPage int) (*tendermintcoretypes.ResultTxSearch, error) {
+	result := new(tendermintcoretypes.ResultTxSearch)
+	params := map[string]interface{}{"query": query, "prove": prove, "page": page, "per_page": perPage}
+	if err := c.rpc.call("tx_search", params, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Commit implements headerClient.
+func (c *remoteClient) Commit(height *int64) (*tendermintcoretypes.ResultCommit, error) {
+	result := new(tendermintcoretypes.ResultCommit)
+	if err := c.rpc.call("commit", map[string]interface{}{"height": height}, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Validators implements headerClient.
+func (c *remoteClient) Validators(height *int64) (*tendermintcoretypes.ResultValidators, error) {
+	result := new(tendermintcoretypes.ResultValidators)
+	if err := c.rpc.call("validators", map[string]interface{}{"height": height}, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Block returns the block at the height.
+func (c *remoteClient) Block(height *int64) (*tendermintcoretypes.ResultBlock, error) {
+	result := new(tendermintcoretypes.ResultBlock)
+	if err := c.rpc.call("block", map[string]interface{}{"height": height}, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Subscribe implements tendermintrpcclient.EventsClient. If the subscriber
+// falls behind, its channel is closed.
+func (c *remoteClient) Subscribe(ctx context.Context, subscriber string, query tendermintpubsub.Query, out chan<- interface{}) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	// The websocket is connected on first use, rather than up front, so
+	// that the node can be started after us.
+	if !c.HTTP.IsRunning() {
+		if err := c.HTTP.Start(); err != nil {
+			return err
+		}
+	}
+
+	q := query.String()
+	u, ok := c.upstreams[q]
+	if !ok {
+		in := make(chan interface{}, watchBuffer)
+		if err := c.HTTP.Subscribe(ctx, "", query, in); err != nil {
+			return err
+		}
+		u = &upstream{subscribers: map[string]chan<- interface{}{}}
+		c.upstreams[q] = u
+		go c.fanOut(q, u, in)
+	}
+	if _, ok := u.subscribers[subscriber]; ok {
+		return tendermintpubsub.ErrAlreadySubscribed
+	}
+	u.subscribers[subscriber] = out
+	return nil
+}
+
+// Unsubscribe implements tendermintrpcclient.EventsClient.
+func (c *remoteClient) Unsubscribe(ctx context.Context, subscriber string, query tendermintpubsub.Query) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	u, ok := c.upstreams[query.String()]
+	if !ok {
+		return tendermintpubsub.ErrSubscriptionNotFound
+	}
+	out, ok := u.subscribers[subscriber]
+	if !ok {
+		return tendermintpubsub.ErrSubscriptionNotFound
+	}
+	delete(u.subscribers, subscriber)
+	close(out)
+	return nil
+}
+
+// UnsubscribeAll implements tendermintrpcclient.EventsClient.
+func (c *remoteClient) UnsubscribeAll(ctx context.Context, subscriber string) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var found bool
+	for _, u := range c.upstreams {
+		if out, ok := u.subscribers[subscriber]; ok {
+			delete(u.subscribers, subscriber)
+			close(out)
+			found = true
+		}
+	}
+	if !found {
+		return tendermintpubsub.ErrSubscriptionNotFound
+	}
+	return nil
+}
+
+// fanOut copies events from the upstream subscription to every subscriber,
+// without blocking, so one slow subscriber can't hold up the others.
+func (c *remoteClient) fanOut(q string, u *upstream, in <-chan interface{}) {
+	for v := range in {
+		c.mtx.Lock()
+		for subscriber, out := range u.subscribers {
+			select {
+			case out <- v:
+			default:
+				delete(u.subscribers, subscriber)
+				close(out)
+			}
+		}
+		c.mtx.Unlock()
+	}
+
+	// The upstream subscription was closed, so close every subscriber, and
+	// forget it, so the next subscriber makes a new one.
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, out := range u.subscribers {
+		close(out)
+	}
+	if c.upstreams[q] == u {
+		delete(c.upstreams, q)
+	}
+}
+
+// rpcClient calls the JSON-RPC server of a Tendermint node, as Tendermint's
+// own client does, but with a timeout.
+type rpcClient struct {
+	url    string
+	client *http.Client
+	cdc    *amino.Codec
+}
+
+// newRPCClient returns a client for the node with the given RPC address, as
+// understood by Tendermint: tcp://, http:// or https:// and a host and port,
+// or unix:// and a path.
+func newRPCClient(addr string, timeout time.Duration) *rpcClient {
+	protocol, address := "tcp", addr
+	if i := strings.Index(addr, "://"); i >= 0 {
+		protocol, address = addr[:i], addr[i+len("://"):]
+	}
+	scheme := "http"
+	if protocol == "http" || protocol == "https" {
+		scheme, protocol = protocol, "tcp"
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	cdc := amino.NewCodec()
+	tendermintcoretypes.RegisterAmino(cdc)
+	return &rpcClient{
+		// The host only matters for TLS, and to Tendermint, a unix socket's
+		// path with dots.
+		url: scheme + "://" + strings.Replace(address, "/", ".", -1),
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, protocol, address)
+				},
+			},
+		},
+		cdc: cdc,
+	}
+}
+
+// call calls the method, and decodes its result into result. Errors are
+// wrapped with the method, and a request that couldn't be sent fails with the
+// *url.Error of a dial, as isDialError expects.
+func (c *rpcClient) call(method string, params map[string]interface{}, result interface{}) error {
+	request, err := tendermintrpctypes.MapToRequest(c.cdc, "jsonrpc-client", method, params)
+	if err != nil {
+		return errors.Wrap(err, method)
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return errors.Wrap(err, method)
+	}
+	resp, err := c.client.Post(c.url, "text/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, method)
+	}
+	defer resp.Body.Close()
+	var response tendermintrpctypes.RPCResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return errors.Wrapf(err, "%s: decoding response", method)
+	}
+	if response.Error != nil {
+		return errors.Wrap(response.Error, method)
+	}
+	if err := c.cdc.UnmarshalJSON(response.Result, result); err != nil {
+		return errors.Wrapf(err, "%s: decoding result", method)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	"github.com/go-kit/kit/log"
+	amino "github.com/tendermint/go-amino"
+	tendermintabciclient "github.com/tendermint/tendermint/abci/client"
+	tendermintabciserver "github.com/tendermint/tendermint/abci/server"
+	tendermintabci "github.com/tendermint/tendermint/abci/types"
+	tendermintcommon "github.com/tendermint/tendermint/libs/common"
+	tendermintlog "github.com/tendermint/tendermint/libs/log"
+	tendermintcore "github.com/tendermint/tendermint/rpc/core"
+	tendermintcoretypes "github.com/tendermint/tendermint/rpc/core/types"
+	tendermintrpcserver "github.com/tendermint/tendermint/rpc/lib/server"
+	tenderminttypes "github.com/tendermint/tendermint/types"
+)
+
+func TestABCIServerGRPC(t *testing.T) {
+	// The gRPC server makes concurrent calls to an application on its own,
+	// which is why it's wrapped.
+	if overlapped := callABCIServer(t, func(addr string, app tendermintabci.Application) (tendermintcommon.Service, error) {
+		return tendermintabciserver.NewServer(addr, "grpc", app)
+	}); !overlapped {
+		t.Log("the gRPC server didn't make concurrent calls, so the test can't tell whether they're serialized")
+	}
+
+	// Wrapped, it makes one call at a time.
+	if overlapped := callABCIServer(t, func(addr string, app tendermintabci.Application) (tendermintcommon.Service, error) {
+		return newABCIServer(addr, "grpc", app)
+	}); overlapped {
+		t.Fatal("want calls serialized, have concurrent calls")
+	}
+}
+
+// callABCIServer serves a cas.Application with the server, calls it from
+// several goroutines at once, and returns whether any calls overlapped.
+func callABCIServer(t *testing.T, newServer func(addr string, app tendermintabci.Application) (tendermintcommon.Service, error)) bool {
+	t.Helper()
+	app, err := cas.NewApplication(nil, nil, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	overlaps := &overlapApp{Application: app}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := "tcp://" + ln.Addr().String()
+	ln.Close()
+	server, err := newServer(addr, overlaps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	client := tendermintabciclient.NewGRPCClient(addr, true)
+	if err := client.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer client.Stop()
+
+	// Each key is set in the mempool's state, and read from the committed
+	// state, where it isn't yet.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				key := fmt.Sprintf("%d-%d", i, j)
+				checked, err := client.CheckTxSync(cas.SetTx(key, nil, []byte("one")).Encode())
+				if err != nil || checked.Code != tendermintabci.CodeTypeOK {
+					t.Errorf("CheckTx(%s): %v %+v", key, err, checked)
+					return
+				}
+				queried, err := client.QuerySync(tendermintabci.RequestQuery{Path: cas.QueryPathKey, Data: []byte(key)})
+				if err != nil || queried.Code != cas.CodeKeyNotFound {
+					t.Errorf("Query(%s): %v %+v", key, err, queried)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	return atomic.LoadInt32(&overlaps.overlapped) != 0
+}
+
+// overlapApp records whether calls to CheckTx and Query overlapped, as they
+// would if they were concurrent, as each takes a while.
+type overlapApp struct {
+	tendermintabci.Application
+	calls      int32
+	overlapped int32
+}
+
+func (a *overlapApp) call() func() {
+	if atomic.AddInt32(&a.calls, 1) > 1 {
+		atomic.StoreInt32(&a.overlapped, 1)
+	}
+	time.Sleep(time.Millisecond)
+	return func() { atomic.AddInt32(&a.calls, -1) }
+}
+
+func (a *overlapApp) CheckTx(tx []byte) tendermintabci.ResponseCheckTx {
+	defer a.call()()
+	return a.Application.CheckTx(tx)
+}
+
+func (a *overlapApp) Query(request tendermintabci.RequestQuery) tendermintabci.ResponseQuery {
+	defer a.call()()
+	return a.Application.Query(request)
+}
+
+func TestRemoteClientSubscribers(t *testing.T) {
+	// A node's websocket, which serves the events of its event bus, with
+	// Tendermint's own handlers, which log to a logger of their package.
+	tendermintcore.SetLogger(tendermintlog.NewNopLogger())
+	events := tenderminttypes.NewEventBus()
+	if err := events.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer events.Stop()
+	cdc := amino.NewCodec()
+	tendermintcoretypes.RegisterAmino(cdc)
+	websocket := tendermintrpcserver.NewWebsocketManager(map[string]*tendermintrpcserver.RPCFunc{
+		"subscribe":       tendermintrpcserver.NewWSRPCFunc(tendermintcore.Subscribe, "query"),
+		"unsubscribe":     tendermintrpcserver.NewWSRPCFunc(tendermintcore.Unsubscribe, "query"),
+		"unsubscribe_all": tendermintrpcserver.NewWSRPCFunc(tendermintcore.UnsubscribeAll, ""),
+	}, cdc, tendermintrpcserver.EventSubscriber(events))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/websocket", websocket.WebsocketHandler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client := newRemoteClient("tcp://"+server.Listener.Addr().String(), time.Second)
+	defer func() {
+		if client.IsRunning() {
+			client.Stop()
+		}
+	}()
+	a, b := make(chan interface{}, watchBuffer), make(chan interface{}, watchBuffer)
+	for subscriber, out := range map[string]chan interface{}{"a": a, "b": b} {
+		if err := client.Subscribe(context.Background(), subscriber, tenderminttypes.EventQueryTx, out); err != nil {
+			t.Fatalf("Subscribe(%s): %v", subscriber, err)
+		}
+	}
+
+	// Both subscribers to the query get its events, though there's one
+	// subscription to the node. That's established after Subscribe returns,
+	// so events at height 0 are published until one's seen, and skipped.
+	publish := func(height int64) {
+		t.Helper()
+		if err := events.PublishEventTx(tenderminttypes.EventDataTx{TxResult: tenderminttypes.TxResult{Height: height, Tx: []byte("tx")}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func(subscriber string, out chan interface{}, height int64) {
+		t.Helper()
+		for {
+			select {
+			case v, ok := <-out:
+				if !ok {
+					t.Fatalf("%s: want an event at height %d, have the channel closed", subscriber, height)
+				}
+				ev, ok := v.(tenderminttypes.EventDataTx)
+				if ok && ev.Height == 0 {
+					continue
+				}
+				if !ok || ev.Height != height {
+					t.Fatalf("%s: want an event at height %d, have %+v", subscriber, height, v)
+				}
+				return
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: want an event at height %d, have nothing", subscriber, height)
+			}
+		}
+	}
+	for ready := false; !ready; {
+		publish(0)
+		select {
+		case <-a:
+			ready = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	publish(1)
+	receive("a", a, 1)
+	receive("b", b, 1)
+
+	// Unsubscribing one closes its channel, once it's been sent any events at
+	// height 0 still on their way, and the other still gets events.
+	if err := client.Unsubscribe(context.Background(), "a", tenderminttypes.EventQueryTx); err != nil {
+		t.Fatalf("Unsubscribe(a): %v", err)
+	}
+	for range a {
+	}
+	publish(2)
+	receive("b", b, 2)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/peterbourgon/usage"
+	"github.com/pkg/errors"
+	tendermintabci "github.com/tendermint/tendermint/abci/types"
+	tendermintblockchain "github.com/tendermint/tendermint/blockchain"
+	tendermintdb "github.com/tendermint/tendermint/libs/db"
+	tendermintstate "github.com/tendermint/tendermint/state"
+	tenderminttypes "github.com/tendermint/tendermint/types"
+)
+
+// runReplay rebuilds the application state from the blocks in a node's block
+// store, rather than from its peers, checking each app hash as it goes.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	var (
+		tendermintDir = fs.String("tendermint-dir", "tendermint", "Tendermint directory (config, data, etc.) of a stopped node")
+		appFile       = fs.String("app-file", "db.json", "application persistence file to write")
+		height        = fs.Int64("height", 0, "height to stop at (default the latest height that can be verified)")
+		verbose       = fs.Bool("verbose", false, "verbose logging of application information")
+	)
+	fs.Usage = usage.For(fs, "tendermint-cas-demo replay [flags]")
+	fs.Parse(args)
+
+	config, err := loadTendermintConfig(*tendermintDir)
+	if err != nil {
+		return err
+	}
+	genesis, err := tenderminttypes.GenesisDocFromFile(config.GenesisFile())
+	if err != nil {
+		return errors.Wrap(err, "load genesis")
+	}
+
+	// The databases are locked while the node is running.
+	stateDB, err := openTendermintDB(config, "state")
+	if err != nil {
+		return err
+	}
+	defer stateDB.Close()
+	blockStoreDB, err := openTendermintDB(config, "blockstore")
+	if err != nil {
+		return err
+	}
+	defer blockStoreDB.Close()
+
+	logger := log.With(log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), "component", "App")
+	if !*verbose {
+		logger = level.NewFilter(logger, level.AllowWarn()) // info logs every commit
+	}
+
+	// Only the state after the last block is written out, and only once it's
+	// been verified.
+	state, err := replayBlocks(genesis, stateDB, blockStoreDB, *height, logger)
+	if err != nil {
+		return err
+	}
+	if err := saveFileAtomic(*appFile, state); err != nil {
+		return err
+	}
+	fmt.Printf("replayed blocks 1 to %d, and wrote the state, with app hash %X, to %s\n", state.Commits(), state.Hash(), *appFile)
+	return nil
+}
+
+// replayBlocks applies the blocks in the block store, up to the height, or the
+// latest that can be verified, if it's 0, to a new application, checking each
+// app hash against the Tendermint state and block store, and returns the
+// application's state after the last block.
+func replayBlocks(genesis *tenderminttypes.GenesisDoc, stateDB, blockStoreDB tendermintdb.DB, height int64, logger log.Logger) (*cas.State, error) {
+	var (
+		state      = tendermintstate.LoadState(stateDB)
+		blockStore = tendermintblockchain.NewBlockStore(blockStoreDB)
+	)
+
+	// The app hash after a block is in the header of the next block or, for
+	// the last block that Tendermint applied, in its state.
+	appHash := func(h int64) ([]byte, string) {
+		if h < blockStore.Height() {
+			if meta := blockStore.LoadBlockMeta(h + 1); meta != nil {
+				return meta.Header.AppHash, fmt.Sprintf("the header of block %d", h+1)
+			}
+		}
+		if h == state.LastBlockHeight {
+			return state.AppHash, "the Tendermint state"
+		}
+		return nil, ""
+	}
+	maxHeight := blockStore.Height() - 1
+	if state.LastBlockHeight > maxHeight {
+		maxHeight = state.LastBlockHeight
+	}
+	switch {
+	case maxHeight < 1:
+		return nil, errors.New("no blocks to replay")
+	case height == 0:
+		height = maxHeight
+	case height < 0 || height > maxHeight:
+		return nil, usageError(fmt.Sprintf("-height must be between 1 and %d, the latest height that can be verified", maxHeight))
+	}
+
+	app, err := cas.NewApplication(nil, nil, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer app.Close() // nothing's persisted, so it can't fail
+
+	validators := make([]tendermintabci.ValidatorUpdate, len(genesis.Validators))
+	for i, v := range genesis.Validators {
+		validators[i] = tenderminttypes.TM2PB.NewValidatorUpdate(v.PubKey, v.Power)
+	}
+	app.InitChain(tendermintabci.RequestInitChain{
+		Time:            genesis.GenesisTime,
+		ChainId:         genesis.ChainID,
+		ConsensusParams: tenderminttypes.TM2PB.ConsensusParams(genesis.ConsensusParams),
+		Validators:      validators,
+		AppStateBytes:   genesis.AppState,
+	})
+
+	for h := int64(1); h <= height; h++ {
+		block := blockStore.LoadBlock(h)
+		if block == nil {
+			return nil, errors.Errorf("block %d missing from the block store", h)
+		}
+		app.BeginBlock(tendermintabci.RequestBeginBlock{
+			Hash:   block.Hash(),
+			Header: tenderminttypes.TM2PB.Header(&block.Header),
+		})
+		for _, tx := range block.Data.Txs {
+			app.DeliverTx(tx)
+		}
+		app.EndBlock(tendermintabci.RequestEndBlock{Height: h})
+		have := app.Commit().Data
+
+		want, source := appHash(h)
+		if !bytes.Equal(want, have) {
+			return nil, errors.Errorf("app hash mismatch after block %d: replay has %X, but %s has %X", h, have, source, want)
+		}
+	}
+	return app.State(), nil
+}
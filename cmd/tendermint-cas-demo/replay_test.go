@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	"github.com/6thc/tendermint-cas-demo/internal/cluster"
+	"github.com/go-kit/kit/log"
+	tendermintstate "github.com/tendermint/tendermint/state"
+)
+
+func TestReplay(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a cluster")
+	}
+	c, n := stoppedNode(t)
+	defer c.Close()
+	last := tendermintstate.LoadState(n.DB("state"))
+
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	appFile := filepath.Join(dir, "db.json")
+
+	// Replaying every block writes the state after the last one, whose app
+	// hash is the one Tendermint has.
+	state, err := replayBlocks(c.Genesis(), n.DB("state"), n.DB("blockstore"), 0, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveFileAtomic(appFile, state); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(appFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	written := cas.NewState()
+	if err := written.Restore(f); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if want, have := last.LastBlockHeight, written.Commits(); want != have {
+		t.Errorf("height: want %d, have %d", want, have)
+	}
+	if want, have := last.AppHash, written.Hash(); !bytes.Equal(want, have) {
+		t.Errorf("app hash: want %X, have %X", want, have)
+	}
+	if want, have := 2, written.Len(); want != have {
+		t.Errorf("keys: want %d, have %d", want, have)
+	}
+
+	// Replaying to an earlier height stops there.
+	state, err = replayBlocks(c.Genesis(), n.DB("state"), n.DB("blockstore"), 1, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := int64(1), state.Commits(); want != have {
+		t.Errorf("height: want %d, have %d", want, have)
+	}
+
+	// A later height than can be verified is a usage error.
+	if _, err := replayBlocks(c.Genesis(), n.DB("state"), n.DB("blockstore"), last.LastBlockHeight+1, log.NewNopLogger()); err == nil {
+		t.Errorf("height %d: want an error, have none", last.LastBlockHeight+1)
+	} else if _, ok := err.(usageError); !ok {
+		t.Errorf("height %d: want a usage error, have %v", last.LastBlockHeight+1, err)
+	}
+}
+
+// stoppedNode returns a cluster of one node, which has committed a few blocks,
+// setting two keys, and has been stopped, so that its databases can be read
+// as a subcommand would read a stopped node's. The caller must close the
+// cluster.
+func stoppedNode(t *testing.T) (*cluster.Cluster, *cluster.Node) {
+	t.Helper()
+	c, err := cluster.New(cluster.Config{Nodes: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	n := c.Node(0)
+	for _, tx := range []cas.Tx{
+		cas.SetTx("a", nil, []byte("one")),
+		cas.SetTx("b", nil, []byte("two")),
+	} {
+		result, err := n.Client().BroadcastTxSync(tx.Encode())
+		if err != nil || result.Code != 0 {
+			c.Close()
+			t.Fatalf("BroadcastTxSync: %v %+v", err, result)
+		}
+	}
+	height, err := n.Height()
+	if err == nil {
+		err = n.WaitForHeight(ctx, height+3)
+	}
+	if err == nil {
+		err = n.Stop()
+	}
+	if err != nil {
+		c.Close()
+		t.Fatal(err)
+	}
+	return c, n
+}
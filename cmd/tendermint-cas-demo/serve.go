@@ -0,0 +1,499 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	"github.com/BurntSushi/toml"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/go-kit/kit/metrics/prometheus"
+	"github.com/mitchellh/mapstructure"
+	"github.com/oklog/run"
+	"github.com/peterbourgon/usage"
+	"github.com/pkg/errors"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	tendermintconfig "github.com/tendermint/tendermint/config"
+	tendermintcommon "github.com/tendermint/tendermint/libs/common"
+	tendermintlog "github.com/tendermint/tendermint/libs/log"
+	tendermintnode "github.com/tendermint/tendermint/node"
+	tendermintp2p "github.com/tendermint/tendermint/p2p"
+	tendermintprivval "github.com/tendermint/tendermint/privval"
+	tendermintproxy "github.com/tendermint/tendermint/proxy"
+	tendermintrpcclient "github.com/tendermint/tendermint/rpc/client"
+	tenderminttypes "github.com/tendermint/tendermint/types"
+)
+
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var (
+		apiAddr           = fs.String("api-addr", "127.0.0.1:8081", "HTTP API address")
+		abciAddr          = fs.String("abci-addr", "", "ABCI address to serve the application to a separate Tendermint node (empty to embed one)")
+		abciTransport     = fs.String("abci-transport", "socket", "ABCI transport with -abci-addr: socket or grpc")
+		tendermintRPC     = fs.String("tendermint-rpc", "tcp://127.0.0.1:26657", "Tendermint RPC address, with -abci-addr")
+		rpcTimeout        = fs.Duration("tendermint-rpc-timeout", 5*time.Second, "timeout of each call to the Tendermint RPC address(es), with -abci-addr or -state-sync")
+		grpcAddr          = fs.String("grpc-addr", "", "gRPC API address (empty to disable)")
+		appFile           = fs.String("app-file", "db.json", "application persistence file")
+		appVerbose        = fs.Bool("app-verbose", false, "verbose logging of application information")
+		metricsAddr       = fs.String("metrics-addr", "", "Prometheus metrics HTTP address (empty to disable)")
+		readyMinPeers     = fs.Int("ready-min-peers", 0, "minimum number of peers for /admin/readyz to report ready")
+		rebuild           = fs.Bool("rebuild-on-mismatch", false, "rebuild the application state from genesis if it doesn't match the Tendermint block store")
+		retainHeights     = fs.Int("retain-heights", cas.DefaultRetainedHeights, "number of recent heights whose state digests can be queried")
+		stateSyncRPC      = fs.String("state-sync", "", "comma-separated Tendermint RPC addresses of trusted peers to fetch a snapshot from, if the node has no blocks (empty to replay every block)")
+		stateSyncTimeout  = fs.Duration("state-sync-timeout", 10*time.Second, "how long to wait for the block that verifies a snapshot")
+		tendermintDir     = fs.String("tendermint-dir", "tendermint", "Tendermint directory (config, data, etc.)")
+		tendermintVerbose = fs.Bool("tendermint-verbose", false, "verbose logging of Tendermint information")
+	)
+	fs.Usage = usage.For(fs, "tendermint-cas-demo serve [flags]")
+	fs.Parse(args)
+
+	var logger log.Logger
+	{
+		logger = log.NewLogfmtLogger(log.NewSyncWriter(os.Stdout))
+	}
+
+	var (
+		app    *cas.Application
+		newApp func(initial io.Reader) (*cas.Application, error)
+	)
+	{
+		// Set up the one-shot initial io.Reader for server state.
+		var (
+			initial io.Reader
+			close   = func() error { return nil }
+		)
+		if f, err := os.Open(*appFile); err == nil {
+			initial, close = f, f.Close // actually use the file
+		} else if os.IsNotExist(err) {
+			// doesn't exist, no problem, don't use it
+		} else {
+			level.Error(logger).Log("file", *appFile, "during", "Open", "err", err)
+			os.Exit(1)
+		}
+
+		// Create the app logger.
+		appLogger := log.With(logger, "component", "App")
+		if !*appVerbose {
+			appLogger = level.NewFilter(appLogger, level.AllowInfo()) // info is OK for app
+		}
+
+		// Create our ABCI application. It may need to be created again, from
+		// scratch, if its state doesn't match the block store.
+		metrics := cas.PrometheusMetrics("cas")
+		newApp = func(initial io.Reader) (*cas.Application, error) {
+			return cas.NewApplication(initial, newSyncWriter(*appFile), appLogger,
+				cas.WithMetrics(metrics),
+				cas.WithRetainedHeights(*retainHeights),
+			)
+		}
+		var err error
+		app, err = newApp(initial)
+		if err != nil {
+			level.Error(logger).Log("during", "NewApplicationServer", "err", err)
+			os.Exit(1)
+		}
+
+		// Close the file we opened for the initial state load (if any).
+		if err = close(); err != nil {
+			level.Error(logger).Log("file", *appFile, "during", "Close", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	var node *tendermintnode.Node
+	if *abciAddr == "" {
+		// Make sure someone ran `tendermint init`, or the testnet subcommand.
+		if fi, err := os.Stat(*tendermintDir); os.IsNotExist(err) {
+			level.Error(logger).Log("err", "-tendermint-dir missing", "try", "tendermint-cas-demo testnet -n 1")
+			os.Exit(1)
+		} else if err != nil {
+			level.Error(logger).Log("err", err, "try", "tendermint-cas-demo testnet -n 1")
+			os.Exit(1)
+		} else if !fi.IsDir() {
+			level.Error(logger).Log("err", "-tendermint-dir isn't a directory", "try", "tendermint-cas-demo testnet -n 1")
+			os.Exit(1)
+		}
+
+		nodeConfig, err := loadTendermintConfig(*tendermintDir)
+		if err != nil {
+			level.Error(logger).Log("during", "load Tendermint config", "err", err)
+			os.Exit(1)
+		}
+
+		// The databases are closed again for the node to open.
+		stateDB, err := openTendermintDB(nodeConfig, "state")
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+		blockStoreDB, err := openTendermintDB(nodeConfig, "blockstore")
+		if err != nil {
+			level.Error(logger).Log("err", err)
+			os.Exit(1)
+		}
+
+		// Start a new node from a snapshot of its peers' state, rather than
+		// replaying every block. Whether it's new is up to its block store, as
+		// a sync that was interrupted may have written the application file.
+		if *stateSyncRPC != "" {
+			genesis, err := tenderminttypes.GenesisDocFromFile(nodeConfig.GenesisFile())
+			if err != nil {
+				level.Error(logger).Log("during", "load genesis", "err", err)
+				os.Exit(1)
+			}
+			var (
+				pool = newNodePool(strings.Split(*stateSyncRPC, ","), *rpcTimeout, log.With(logger, "component", "Pool"), discard.NewGauge())
+				save = func(s *cas.State) error { return errors.Wrap(saveFileAtomic(*appFile, s), *appFile) }
+			)
+			synced, err := stateSync(genesis, stateDB, blockStoreDB, pool, newLightClient(genesis, pool, *stateSyncTimeout), save, log.With(logger, "component", "StateSync"))
+			pool.stop()
+			if err != nil {
+				level.Error(logger).Log("during", "stateSync", "err", err)
+				os.Exit(1)
+			}
+			if synced != nil {
+				f, err := os.Open(*appFile)
+				if err != nil {
+					level.Error(logger).Log("file", *appFile, "during", "Open", "err", err)
+					os.Exit(1)
+				}
+				app.Close() // nothing's been committed, so there's nothing to persist
+				app, err = newApp(f)
+				f.Close()
+				if err != nil {
+					level.Error(logger).Log("during", "NewApplicationServer", "err", err)
+					os.Exit(1)
+				}
+			}
+		}
+
+		// Refuse to start from an application state that doesn't match the
+		// chain, unless asked to rebuild it, in which case Tendermint replays
+		// every block to an empty application.
+		app, err = matchAppState(stateDB, blockStoreDB, app, *rebuild, newApp, log.With(logger, "file", *appFile))
+		stateDB.Close()
+		blockStoreDB.Close()
+		if _, ok := err.(appStateMismatch); ok {
+			level.Error(logger).Log("file", *appFile, "during", "checkAppState", "err", err, "try", "-rebuild-on-mismatch")
+			os.Exit(1)
+		} else if err != nil {
+			level.Error(logger).Log("during", "checkAppState", "err", err)
+			os.Exit(1)
+		}
+
+		// Key history is served from the Tendermint transaction index, so
+		// make sure the tag we need is indexed.
+		if tx := nodeConfig.TxIndex; !tx.IndexAllTags && !containsTag(tx.IndexTags, cas.TagKey) {
+			nodeConfig.TxIndex.IndexTags = strings.TrimPrefix(tx.IndexTags+","+cas.TagKey, ",")
+		}
+
+		// Gotta load the node key separately, for some reason.
+		nodeKey, err := tendermintp2p.LoadOrGenNodeKey(nodeConfig.NodeKeyFile())
+		if err != nil {
+			level.Error(logger).Log("during", "tendermintp2p.LoadOrGenNodeKey", "err", err)
+			os.Exit(1)
+		}
+
+		// The Tendermint logger has its own filtering rules.
+		tendermintLogger := log.With(logger, "component", "Node")
+		if !*tendermintVerbose {
+			tendermintLogger = level.NewFilter(tendermintLogger, level.AllowWarn()) // info is too noisy for Tendermint
+		}
+
+		// Create the node.
+		node, err = tendermintnode.NewNode(
+			nodeConfig,
+			tendermintprivval.LoadOrGenFilePV(nodeConfig.PrivValidatorFile()),
+			nodeKey,
+			tendermintproxy.NewLocalClientCreator(app),
+			tendermintnode.DefaultGenesisDocProviderFunc(nodeConfig),
+			tendermintnode.DefaultDBProvider, // n.b. Tendermint DB, not our state
+			tendermintnode.DefaultMetricsProvider(nodeConfig.Instrumentation),
+			tendermintAdapter{tendermintLogger},
+		)
+		if err != nil {
+			level.Error(logger).Log("during", "tendermint.DefaultNewNode", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	var abciServer tendermintcommon.Service
+	if *abciAddr != "" {
+		var err error
+		abciServer, err = newABCIServer(*abciAddr, *abciTransport, app)
+		if err != nil {
+			level.Error(logger).Log("during", "newABCIServer", "err", err)
+			os.Exit(1)
+		}
+		abciServer.SetLogger(tendermintAdapter{log.With(logger, "component", "ABCI")})
+	}
+
+	// Both APIs share the same client, which is either in-process, or calls
+	// out to the RPC server of the separate Tendermint node.
+	var client apiClient
+	if node != nil {
+		client = tendermintrpcclient.NewLocal(node)
+	} else {
+		remote := newRemoteClient(*tendermintRPC, *rpcTimeout)
+		defer remote.Stop()
+		client = remote
+	}
+
+	var g run.Group
+	if node != nil {
+		g.Add(func() error {
+			level.Info(logger).Log("context", "Tendermint node", "addr", node.NodeInfo().ListenAddr)
+			if err := node.Start(); err != nil {
+				return errors.Wrap(err, "error starting Tendermint node")
+			}
+			node.Wait()
+			return nil
+		}, func(error) {
+			if err := node.Stop(); err != nil {
+				level.Error(logger).Log("during", "node.Stop", "err", err)
+			}
+		})
+	}
+	if abciServer != nil {
+		g.Add(func() error {
+			level.Info(logger).Log("context", "ABCI server", "addr", *abciAddr, "transport", *abciTransport, "tendermint_rpc", *tendermintRPC)
+			if err := abciServer.Start(); err != nil {
+				return errors.Wrap(err, "error starting ABCI server")
+			}
+			<-abciServer.Quit()
+			return nil
+		}, func(error) {
+			if err := abciServer.Stop(); err != nil {
+				level.Error(logger).Log("during", "abciServer.Stop", "err", err)
+			}
+		})
+	}
+	addAPIs(&g, logger, client, nil, *readyMinPeers, *apiAddr, *grpcAddr, *metricsAddr)
+	addSignalHandler(&g)
+	level.Info(logger).Log("exit", g.Run())
+
+	// Tendermint has stopped, so there are no more commits, and the last one
+	// can be persisted.
+	if err := app.Close(); err != nil {
+		level.Error(logger).Log("file", *appFile, "during", "Close", "err", err)
+	}
+	return nil
+}
+
+// loadTendermintConfig loads the config of the Tendermint node in dir. It's
+// weird that Tendermint doesn't have a helper function for this; they always go
+// through Viper, so I'm just copying that logic, essentially.
+func loadTendermintConfig(dir string) (*tendermintconfig.Config, error) {
+	config := tendermintconfig.DefaultConfig().SetRoot(dir)
+	var (
+		configFile = filepath.Join(config.BaseConfig.RootDir, "config", "config.toml")
+		configMap  map[string]interface{} // like viper.AllSettings()
+	)
+	if _, err := toml.DecodeFile(configFile, &configMap); err != nil {
+		return nil, errors.Wrap(err, "decode Tendermint config.toml")
+	}
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           config,
+		WeaklyTypedInput: true,
+		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "build config parser")
+	}
+	if err := decoder.Decode(configMap); err != nil {
+		return nil, errors.Wrap(err, "parse config")
+	}
+	return config, nil
+}
+
+// addAPIs adds the HTTP API, and optionally the gRPC API and the Prometheus
+// metrics server, to the group. The APIs share the client.
+func addAPIs(g *run.Group, logger log.Logger, client apiClient, verifier *lightClient, minPeers int, apiAddr, grpcAddr, metricsAddr string) {
+	var api http.Handler
+	{
+		duration := prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "cas",
+			Subsystem: "api",
+			Name:      "request_duration_seconds",
+			Help:      "Time spent serving HTTP API requests.",
+			Buckets:   stdprometheus.DefBuckets,
+		}, []string{"method", "route", "status_code"})
+		api = NewCompareAndSwapAPI(client, verifier, minPeers)
+		api = loggingMiddleware{api, log.With(logger, "component", "API"), duration}
+	}
+	{
+		server := &http.Server{
+			Addr:    apiAddr,
+			Handler: api,
+		}
+		g.Add(func() error {
+			level.Info(logger).Log("context", "CompareAndSwap API", "addr", apiAddr)
+			return server.ListenAndServe()
+		}, func(error) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			server.Shutdown(ctx)
+		})
+	}
+	if grpcAddr != "" {
+		server := newGRPCServer(client, verifier)
+		g.Add(func() error {
+			ln, err := net.Listen("tcp", grpcAddr)
+			if err != nil {
+				return err
+			}
+			level.Info(logger).Log("context", "CompareAndSwap gRPC API", "addr", grpcAddr)
+			return server.Serve(ln)
+		}, func(error) {
+			server.Stop() // not GracefulStop, as watches never finish
+		})
+	}
+	if metricsAddr != "" {
+		// Tendermint registers its own metrics with the default registry, if
+		// instrumentation is enabled in its config, so they're served here too.
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		server := &http.Server{
+			Addr:    metricsAddr,
+			Handler: mux,
+		}
+		g.Add(func() error {
+			level.Info(logger).Log("context", "Prometheus metrics", "addr", metricsAddr)
+			return server.ListenAndServe()
+		}, func(error) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			server.Shutdown(ctx)
+		})
+	}
+}
+
+// addSignalHandler adds an actor to the group that returns on SIGINT or
+// SIGTERM, stopping the others.
+func addSignalHandler(g *run.Group) {
+	ctx, cancel := context.WithCancel(context.Background())
+	g.Add(func() error {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+		select {
+		case sig := <-c:
+			return fmt.Errorf("received signal %s", sig)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}, func(error) {
+		cancel()
+	})
+}
+
+type tendermintAdapter struct{ log.Logger }
+
+func (a tendermintAdapter) Debug(msg string, keyvals ...interface{}) {
+	level.Debug(log.With(a.Logger, keyvals...)).Log("msg", msg)
+}
+
+func (a tendermintAdapter) Info(msg string, keyvals ...interface{}) {
+	level.Info(log.With(a.Logger, keyvals...)).Log("msg", msg)
+}
+
+func (a tendermintAdapter) Error(msg string, keyvals ...interface{}) {
+	level.Error(log.With(a.Logger, keyvals...)).Log("msg", msg)
+}
+
+func (a tendermintAdapter) With(keyvals ...interface{}) tendermintlog.Logger {
+	return tendermintAdapter{log.With(a.Logger, keyvals...)}
+}
+
+func containsTag(tags, tag string) bool {
+	for _, t := range strings.Split(tags, ",") {
+		if strings.TrimSpace(t) == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// saveFileAtomic saves the state to the file, atomically, without holding all
+// of it in memory.
+func saveFileAtomic(filename string, s *cas.State) error {
+	w := newSyncWriter(filename)
+	s.Save(w) // any error is returned by Close
+	return w.Close()
+}
+
+// syncWriter writes a file atomically. What's written goes to a temporary
+// file, which Close syncs to disk, and renames over the file, so the file
+// always holds everything written before some Close, even after a crash. If a
+// write failed, Close removes the temporary file instead, and returns the
+// error.
+type syncWriter struct {
+	filename string
+	f        *os.File
+	err      error
+}
+
+func newSyncWriter(filename string) io.WriteCloser {
+	return &syncWriter{
+		filename: filename,
+	}
+}
+
+func (w *syncWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.f == nil {
+		f, err := os.Create(w.filename + ".tmp")
+		if err != nil {
+			w.err = err
+			return 0, err
+		}
+		w.f = f
+	}
+	n, err := w.f.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+func (w *syncWriter) Close() error {
+	f, err := w.f, w.err
+	w.f, w.err = nil, nil
+	if f == nil {
+		return err
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), w.filename); err != nil {
+		return err
+	}
+	// Sync the directory too, so that the rename survives a crash.
+	dir, err := os.Open(filepath.Dir(w.filename))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	"github.com/gorilla/mux"
+	"github.com/peterbourgon/usage"
+	"github.com/pkg/errors"
+)
+
+// handleSnapshot serves the manifest of a snapshot of the state at the height,
+// which defaults to the latest.
+func (a *CompareAndSwapAPI) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	height, err := heightParam(r)
+	if err != nil {
+		respond(w, http.StatusBadRequest, apiResponse{Error: err.Error()})
+		return
+	}
+	m, err := a.store.SnapshotManifest(height)
+	if err != nil {
+		respondError(w, "", err)
+		return
+	}
+	respondJSON(w, http.StatusOK, m)
+}
+
+// handleSnapshotChunk serves a chunk of the snapshot of the state at the
+// height. Chunks should be fetched with the height in the manifest, so that
+// they're of the same snapshot.
+func (a *CompareAndSwapAPI) handleSnapshotChunk(w http.ResponseWriter, r *http.Request) {
+	height, err := heightParam(r)
+	if err != nil {
+		respond(w, http.StatusBadRequest, apiResponse{Error: err.Error()})
+		return
+	}
+	index, err := strconv.Atoi(mux.Vars(r)["chunk"])
+	if err != nil {
+		respond(w, http.StatusBadRequest, apiResponse{Error: err.Error()})
+		return
+	}
+	chunk, err := a.store.SnapshotChunk(height, index)
+	if err != nil {
+		respondError(w, "", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	w.Write(chunk)
+}
+
+// A snapshot directory holds the chunks, one per file, and the manifest, which
+// is written last, so a directory with a manifest is complete.
+const snapshotManifestFile = "manifest.json"
+
+func snapshotChunkFile(dir string, index int) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d.snappy", index))
+}
+
+func runSnapshot(args []string) error {
+	if len(args) < 1 {
+		return usageError("want export or import")
+	}
+	switch args[0] {
+	case "export":
+		return runSnapshotExport(args[1:])
+	case "import":
+		return runSnapshotImport(args[1:])
+	default:
+		return usageError(fmt.Sprintf("unknown snapshot command %q, want export or import", args[0]))
+	}
+}
+
+func runSnapshotExport(args []string) error {
+	fs := flag.NewFlagSet("snapshot export", flag.ExitOnError)
+	var (
+		endpoint  = fs.String("endpoint", "", "HTTP API address of a running node to export from (empty to export -app-file)")
+		appFile   = fs.String("app-file", "db.json", "application persistence file of a stopped node to export")
+		height    = fs.Int64("height", 0, "height to export, which must be retained by the node, or be the height of -app-file (default the latest)")
+		chunkSize = fs.Int("chunk-size", cas.DefaultSnapshotChunkSize, "size of each chunk before compression, with -app-file")
+		timeout   = fs.Duration("timeout", 10*time.Second, "timeout for each request, with -endpoint")
+	)
+	fs.Usage = usage.For(fs, "tendermint-cas-demo snapshot export [flags] <dir>")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return usageError(fmt.Sprintf("want 1 argument, have %d", fs.NArg()))
+	}
+	dir := fs.Arg(0)
+
+	// Either way, the chunks are checked, as they'd be on import, before the
+	// manifest is written.
+	var (
+		manifest cas.Manifest
+		chunk    func(index int) ([]byte, error)
+	)
+	if *endpoint != "" {
+		addr := *endpoint
+		if !strings.Contains(addr, "://") {
+			addr = "http://" + addr
+		}
+		addr = strings.TrimRight(addr, "/")
+		client := &http.Client{Timeout: *timeout}
+
+		buf, err := getSnapshot(client, fmt.Sprintf("%s/admin/snapshot?height=%d", addr, *height))
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(buf, &manifest); err != nil {
+			return errors.Wrap(err, "decode manifest")
+		}
+		chunk = func(index int) ([]byte, error) {
+			return getSnapshot(client, fmt.Sprintf("%s/admin/snapshot/%d?height=%d", addr, index, manifest.Height))
+		}
+	} else {
+		f, err := os.Open(*appFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		state := cas.NewState()
+		if err := state.Restore(f); err != nil {
+			return errors.Wrap(err, *appFile)
+		}
+		if *height != 0 && *height != state.Commits() {
+			return errors.Errorf("%s is at height %d, not %d; replay it to that height, or export from a running node", *appFile, state.Commits(), *height)
+		}
+		snapshot := state.Snapshot(*chunkSize)
+		manifest = snapshot.Manifest
+		chunk = func(index int) ([]byte, error) {
+			return snapshot.Chunks[index], nil
+		}
+	}
+
+	restorer, err := cas.NewSnapshotRestorer(manifest)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i := restorer.Next(); i >= 0; i = restorer.Next() {
+		buf, err := chunk(i)
+		if err != nil {
+			return errors.Wrapf(err, "chunk %d", i)
+		}
+		if err := restorer.Add(buf); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(snapshotChunkFile(dir, i), buf, 0644); err != nil {
+			return err
+		}
+	}
+	if _, err := restorer.State(); err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, snapshotManifestFile), buf, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("exported height %d, with %d key(s) in %d chunk(s), and app hash %X, to %s\n", manifest.Height, manifest.Keys, len(manifest.Chunks), manifest.AppHash, dir)
+	return nil
+}
+
+func runSnapshotImport(args []string) error {
+	fs := flag.NewFlagSet("snapshot import", flag.ExitOnError)
+	var (
+		appFile = fs.String("app-file", "db.json", "application persistence file of a stopped node to replace")
+	)
+	fs.Usage = usage.For(fs, "tendermint-cas-demo snapshot import [flags] <dir>")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return usageError(fmt.Sprintf("want 1 argument, have %d", fs.NArg()))
+	}
+	dir := fs.Arg(0)
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, snapshotManifestFile))
+	if err != nil {
+		return err
+	}
+	var manifest cas.Manifest
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		return errors.Wrap(err, "decode manifest")
+	}
+	restorer, err := cas.NewSnapshotRestorer(manifest)
+	if err != nil {
+		return err
+	}
+	for i := restorer.Next(); i >= 0; i = restorer.Next() {
+		buf, err := ioutil.ReadFile(snapshotChunkFile(dir, i))
+		if err != nil {
+			return err
+		}
+		if err := restorer.Add(buf); err != nil {
+			return err
+		}
+	}
+	state, err := restorer.State()
+	if err != nil {
+		return err
+	}
+
+	// Only replace the file once the new one is complete.
+	if err := saveFileAtomic(*appFile, state); err != nil {
+		return err
+	}
+	fmt.Printf("imported height %d, with %d key(s), and app hash %X, to %s\n", manifest.Height, manifest.Keys, manifest.AppHash, *appFile)
+	return nil
+}
+
+// getSnapshot gets the manifest or a chunk of a snapshot from a node's API,
+// waiting for the snapshot to be built if need be.
+func getSnapshot(client *http.Client, url string) (buf []byte, err error) {
+	err = whileSnapshotPending(func() error {
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		buf, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			var response apiResponse
+			json.Unmarshal(buf, &response)
+			if response.Code != 0 {
+				return errors.Wrapf(appError{response.Code, response.Log}, "%s: %s", url, resp.Status)
+			}
+			return errors.Errorf("%s: %s: %s", url, resp.Status, response.Error)
+		}
+		return nil
+	})
+	return buf, err
+}
+
+// A node builds a snapshot in the background when it's first asked for, and
+// reports cas.CodeSnapshotPending until it's built, which takes time in the
+// number of keys.
+const (
+	snapshotRetryInterval = 250 * time.Millisecond
+	snapshotBuildTimeout  = time.Minute
+)
+
+// whileSnapshotPending calls f again for as long as it fails because the
+// snapshot is being built, up to snapshotBuildTimeout, and returns its error.
+func whileSnapshotPending(f func() error) error {
+	deadline := time.Now().Add(snapshotBuildTimeout)
+	for {
+		err := f()
+		if e, ok := errors.Cause(err).(appError); !ok || e.code != cas.CodeSnapshotPending || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(snapshotRetryInterval)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+)
+
+func TestSnapshotExportImport(t *testing.T) {
+	client, api, done := newTestAPI(t, 0)
+	defer done()
+	server := httptest.NewServer(api)
+	defer server.Close()
+	for i := 0; i < 100; i++ {
+		checkSet(t, api, fmt.Sprintf("k%d", i), "", strings.Repeat("v", i), http.StatusOK)
+	}
+	commit(t, client)
+	info, err := client.ABCIInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	appHash := info.Response.LastBlockAppHash
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A snapshot exported from a node, and imported into an empty directory,
+	// has the node's app hash. So does one exported from that file, in
+	// several chunks, and imported again.
+	var (
+		exported   = filepath.Join(dir, "exported")
+		imported   = filepath.Join(dir, "imported", "db.json")
+		reexported = filepath.Join(dir, "reexported")
+		reimported = filepath.Join(dir, "reimported", "db.json")
+	)
+	for _, filename := range []string{imported, reimported} {
+		if err := os.Mkdir(filepath.Dir(filename), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, args := range [][]string{
+		{"export", "-endpoint", server.URL, exported},
+		{"import", "-app-file", imported, exported},
+		{"export", "-app-file", imported, "-chunk-size", "64", reexported},
+		{"import", "-app-file", reimported, reexported},
+	} {
+		var err error
+		captureStdout(t, func() { err = runSnapshot(args) })
+		if err != nil {
+			t.Fatalf("%s: %v", strings.Join(args, " "), err)
+		}
+	}
+	for _, filename := range []string{imported, reimported} {
+		state := loadStateFile(t, filename)
+		if want, have := appHash, state.Hash(); !bytes.Equal(want, have) {
+			t.Errorf("%s: app hash: want %X, have %X", filename, want, have)
+		}
+		if want, have := 100, state.Len(); want != have {
+			t.Errorf("%s: keys: want %d, have %d", filename, want, have)
+		}
+	}
+	if _, err := os.Stat(snapshotChunkFile(reexported, 1)); err != nil {
+		t.Errorf("want several chunks, have %v", err)
+	}
+
+	// A chunk file that's been corrupted is refused, and nothing's imported.
+	buf, err := ioutil.ReadFile(snapshotChunkFile(reexported, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[len(buf)-1] ^= 1
+	if err := ioutil.WriteFile(snapshotChunkFile(reexported, 1), buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	corrupted := filepath.Join(dir, "corrupted.json")
+	captureStdout(t, func() { err = runSnapshot([]string{"import", "-app-file", corrupted, reexported}) })
+	if err == nil || !strings.Contains(err.Error(), cas.ErrInvalidSnapshot.Error()) || !strings.Contains(err.Error(), "chunk 1") {
+		t.Fatalf("want chunk 1 to be invalid, have %v", err)
+	}
+	if _, err := os.Stat(corrupted); !os.IsNotExist(err) {
+		t.Fatalf("want no application file, have %v", err)
+	}
+}
+
+// loadStateFile restores the state in an application persistence file.
+func loadStateFile(t *testing.T, filename string) *cas.State {
+	t.Helper()
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	state := cas.NewState()
+	if err := state.Restore(f); err != nil {
+		t.Fatalf("%s: %v", filename, err)
+	}
+	return state
+}
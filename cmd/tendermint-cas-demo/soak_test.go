@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/client"
+	"github.com/6thc/tendermint-cas-demo/internal/cluster"
+	"github.com/6thc/tendermint-cas-demo/internal/linearizability"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+var (
+	soakDuration = flag.Duration("soak.duration", 0, "run TestSoak for this long")
+	soakSeed     = flag.Int64("soak.seed", 0, "seed for TestSoak's faults and clients (default the time)")
+	soakReport   = flag.String("soak.report", "", "write TestSoak's linearizability report to this file")
+)
+
+// TestSoak runs the lincheck workload against a cluster's API, while killing
+// nodes, cutting the network between them, and failing and slowing their
+// writes. Then it heals the cluster, and checks that the nodes agree, and that
+// the history is linearizable, or fails only in the way that's expected of the
+// API as it stands. It only runs with -soak.duration, e.g. go test -run Soak
+// -soak.duration 10m -v.
+func TestSoak(t *testing.T) {
+	if *soakDuration == 0 {
+		t.Skip("run with -soak.duration")
+	}
+	seed := *soakSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	t.Logf("seed %d", seed)
+
+	const nodes = 4
+	c, err := cluster.New(cluster.Config{
+		Nodes: nodes,
+		Handler: func(client *cluster.Client) http.Handler {
+			return NewCompareAndSwapAPI(client, nil, 0)
+		},
+		Logger: level.NewFilter(log.NewLogfmtLogger(testWriter{t}), level.AllowInfo()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	w := &workload{
+		keys:    []string{"a", "b", "c"},
+		timeout: 5 * time.Second,
+		seed:    seed,
+	}
+	for i := 0; i < 8; i++ {
+		w.clients = append(w.clients, nodeClient(t, c.Node(i%nodes)))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *soakDuration)
+	defer cancel()
+	injected := make(chan error, 1)
+	go func() {
+		injected <- c.Inject(ctx, cluster.Schedule{
+			Seed:      seed,
+			Interval:  2 * time.Second,
+			Duration:  3 * time.Second,
+			Kill:      true,
+			Partition: true,
+			Disk:      cluster.DiskFaults{ErrorRate: 0.05, Latency: 5 * time.Millisecond},
+		})
+	}()
+	history := w.run(ctx)
+	if err := <-injected; err != nil {
+		t.Fatalf("Inject: %v", err)
+	}
+
+	// Every node is running again, and connected, and they agree.
+	checkCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var height int64
+	for _, n := range c.Running() {
+		h, err := n.Height()
+		if err != nil {
+			t.Fatalf("%s: %v", n.Name, err)
+		}
+		if h > height {
+			height = h
+		}
+	}
+	if err := c.CheckAgreement(checkCtx, height+2); err != nil {
+		t.Fatal(err)
+	}
+
+	result := linearizability.Check(history)
+	if *soakReport != "" {
+		f, err := os.Create(*soakReport)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if err := linearizability.WriteReport(f, history, result); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if result.Linearizable {
+		t.Logf("%d operation(s): linearizable", len(history))
+		return
+	}
+	if linearizability.Check(result.Counterexample).Linearizable {
+		t.Fatal("the counterexample is linearizable")
+	}
+
+	// A compare-and-swap returns once it's passed CheckTx, before it's
+	// committed, and may still fail in DeliverTx, and a get reads the state
+	// its node has committed, which may be behind the others', so the API
+	// isn't linearizable as it stands, as the README says. That's an expected
+	// failure, as long as the history is consistent with what the API does
+	// promise. Anything else is a bug.
+	final := map[string]string{}
+	for _, key := range w.keys {
+		value, err := nodeClient(t, c.Node(0)).Get(checkCtx, key)
+		if err != nil && err != client.ErrNotFound {
+			t.Fatal(err)
+		}
+		final[key] = string(value)
+	}
+	if err := checkCommitted(history, final, func(client int) int { return client % nodes }); err != nil {
+		t.Fatalf("%d operation(s): %v", len(history), err)
+	}
+	var buf bytes.Buffer
+	writeCounterexample(&buf, result.Counterexample)
+	t.Logf("%d operation(s): expected failure: %q isn't linearizable, as writes return after CheckTx, and nodes lag:\n%s", len(history), result.Key, buf.String())
+}
+
+// checkCommitted checks the history against what the API promises, given the
+// final value of each key. As each compare-and-swap writes a value that's never
+// been written before, the changes committed to a key are the chain of swaps
+// that leads from the empty value to its final value, each from the value that
+// the one before it wrote. A swap may be committed whatever it returned, or
+// not, but only after its call, and one that conflicted never is. A get reads
+// a value in the chain, committed by the time it returns, and as a node's
+// committed state only moves forward, the gets through each node read values
+// in the chain's order. The node of each client is given by node.
+func checkCommitted(history []linearizability.Operation, final map[string]string, node func(client int) int) error {
+	byKey := map[string][]linearizability.Operation{}
+	for _, op := range history {
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+	for key, ops := range byKey {
+		writers := map[string]linearizability.Operation{}
+		for _, op := range ops {
+			if op.Kind == linearizability.CAS && op.Outcome != linearizability.Conflict {
+				writers[op.New] = op
+			}
+		}
+		var chain []linearizability.Operation // from the final value back
+		for value := final[key]; value != ""; value = chain[len(chain)-1].Old {
+			w, ok := writers[value]
+			if !ok || len(chain) == len(writers) {
+				return fmt.Errorf("%q: no chain of swaps wrote %q", key, final[key])
+			}
+			chain = append(chain, w)
+		}
+
+		// The position of each value in the chain, and the earliest it can
+		// have been committed.
+		var (
+			position = map[string]int{"": 0}
+			earliest = []time.Time{{}}
+		)
+		for i := len(chain) - 1; i >= 0; i-- {
+			at := earliest[len(earliest)-1]
+			if chain[i].Call.After(at) {
+				at = chain[i].Call
+			}
+			position[chain[i].New] = len(earliest)
+			earliest = append(earliest, at)
+		}
+
+		// Each get reads at a time between its call and its return, which
+		// goes forward with the position of what it reads, for each node. The
+		// earliest time for each get, in the order of the chain, is best.
+		gets := map[int][]linearizability.Operation{}
+		for _, op := range ops {
+			if op.Kind != linearizability.Get || op.Outcome != linearizability.OK {
+				continue
+			}
+			if _, ok := position[op.Value]; !ok {
+				return fmt.Errorf("%q: client %d read %q, which was never committed", key, op.Client, op.Value)
+			}
+			gets[node(op.Client)] = append(gets[node(op.Client)], op)
+		}
+		for n, ops := range gets {
+			sort.SliceStable(ops, func(i, j int) bool { return position[ops[i].Value] < position[ops[j].Value] })
+			var before, last time.Time // of the gets of earlier positions, and of this one
+			for i, op := range ops {
+				if i > 0 && position[op.Value] > position[ops[i-1].Value] {
+					before = last
+				}
+				at := op.Call
+				for _, t := range []time.Time{earliest[position[op.Value]], before} {
+					if t.After(at) {
+						at = t
+					}
+				}
+				if at.After(op.Return) {
+					return fmt.Errorf("%q: client %d, of node %d, read %q between %s and %s, which can't have been committed there by then", key, op.Client, n, op.Value, op.Call.Format(time.StampMicro), op.Return.Format(time.StampMicro))
+				}
+				if at.After(last) {
+					last = at
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func TestCheckCommitted(t *testing.T) {
+	at := func(ms int) time.Time { return time.Unix(0, 0).Add(time.Duration(ms) * time.Millisecond) }
+	cas := func(client int, old, new string, outcome linearizability.Outcome, call, ret int) linearizability.Operation {
+		return linearizability.Operation{Client: client, Key: "k", Kind: linearizability.CAS, Old: old, New: new, Outcome: outcome, Call: at(call), Return: at(ret)}
+	}
+	get := func(client int, value string, call, ret int) linearizability.Operation {
+		return linearizability.Operation{Client: client, Key: "k", Kind: linearizability.Get, Value: value, Outcome: linearizability.OK, Call: at(call), Return: at(ret)}
+	}
+	for _, tc := range []struct {
+		name    string
+		history []linearizability.Operation
+		final   string
+		ok      bool
+	}{
+		{"two swaps from the same value", []linearizability.Operation{
+			cas(0, "", "a", linearizability.OK, 0, 1),
+			cas(1, "", "b", linearizability.OK, 2, 3),
+		}, "a", true},
+		{"a get that misses a swap", []linearizability.Operation{
+			cas(0, "", "a", linearizability.OK, 0, 1),
+			get(1, "", 2, 3),
+		}, "a", true},
+		{"a get that's behind another node's", []linearizability.Operation{
+			cas(0, "", "a", linearizability.OK, 0, 1),
+			get(1, "a", 2, 3),
+			get(2, "", 4, 5),
+		}, "a", true},
+		{"a final value of a swap that conflicted", []linearizability.Operation{
+			cas(0, "", "a", linearizability.Conflict, 0, 1),
+		}, "a", false},
+		{"a get of a value that was never committed", []linearizability.Operation{
+			cas(0, "", "a", linearizability.OK, 0, 1),
+			cas(1, "", "b", linearizability.OK, 0, 1),
+			get(1, "b", 2, 3),
+		}, "a", false},
+		{"a get that goes back", []linearizability.Operation{
+			cas(0, "", "a", linearizability.OK, 0, 1),
+			get(1, "a", 2, 3),
+			get(1, "", 4, 5),
+		}, "a", false},
+		{"a get of a value before it was written", []linearizability.Operation{
+			get(1, "a", 0, 1),
+			cas(0, "", "a", linearizability.OK, 2, 3),
+		}, "a", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if linearizability.Check(tc.history).Linearizable {
+				t.Fatal("want a history that isn't linearizable")
+			}
+			err := checkCommitted(tc.history, map[string]string{"k": tc.final}, func(client int) int { return client })
+			if want, have := tc.ok, err == nil; want != have {
+				t.Errorf("want ok %v, have %v", want, err)
+			}
+		})
+	}
+}
+
+// testWriter writes to the test's log.
+type testWriter struct{ t *testing.T }
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Log(string(bytes.TrimRight(p, "\n")))
+	return len(p), nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	tendermintblockchain "github.com/tendermint/tendermint/blockchain"
+	tendermintdb "github.com/tendermint/tendermint/libs/db"
+	tendermintcoretypes "github.com/tendermint/tendermint/rpc/core/types"
+	tendermintstate "github.com/tendermint/tendermint/state"
+	tenderminttypes "github.com/tendermint/tendermint/types"
+)
+
+// A new node would normally replay every block from genesis. Instead, it can
+// start from a snapshot of a peer's state, at a height whose header the light
+// client verifies, and replay only the blocks after it.
+//
+// Tendermint v0.25 has no state sync of its own, and won't start with an
+// application that's ahead of its block store, so the node's state and block
+// store are written too, as if it had applied the snapshot's block itself:
+// the state after that block, and the block, with the commit for it. Both are
+// verified against the headers. The validator sets aren't fetched, as the
+// proposer order that they carry can't be verified, but computed from the
+// genesis, which works because the application never changes them.
+//
+// The application state is saved, and synced, first, and the block store
+// last, as it's the block store's height that says whether the node has been
+// synced. A crash part of the way through leaves an empty block store, so the
+// node syncs again when it restarts, rather than starting with an application
+// that's behind the Tendermint state.
+
+// stateSyncClient is the part of the Tendermint client used by stateSync.
+type stateSyncClient interface {
+	storeClient
+	headerClient
+	Block(height *int64) (*tendermintcoretypes.ResultBlock, error)
+}
+
+// stateSync restores the latest snapshot of the client's peers, saves it, and
+// writes the Tendermint state and block store to match. It returns the
+// restored application state. If the block store isn't empty, it does
+// nothing, and returns a nil state, as the node can replay its own blocks.
+func stateSync(genesis *tenderminttypes.GenesisDoc, stateDB, blockStoreDB tendermintdb.DB, client stateSyncClient, verifier *lightClient, save func(*cas.State) error, logger log.Logger) (*cas.State, error) {
+	if h := tendermintblockchain.NewBlockStore(blockStoreDB).Height(); h > 0 {
+		level.Info(logger).Log("state_sync", "skipped", "block_store_height", h)
+		return nil, nil
+	}
+	genesisState, err := tendermintstate.MakeGenesisState(genesis)
+	if err != nil {
+		return nil, err
+	}
+
+	// The snapshot is of the state after the block at its height, so its app
+	// hash is in the header of the next block.
+	s := store{client: client}
+	var manifest cas.Manifest
+	if err := whileSnapshotPending(func() (err error) {
+		manifest, err = s.SnapshotManifest(0)
+		return err
+	}); err != nil {
+		return nil, errors.Wrap(err, "fetch snapshot manifest")
+	}
+	height := manifest.Height
+	if height < 1 {
+		return nil, errors.New("no snapshot yet")
+	}
+	level.Info(logger).Log("state_sync", "verifying", "height", height, "keys", manifest.Keys, "chunks", len(manifest.Chunks))
+	signed, _, err := verifier.verify(height)
+	if err != nil {
+		return nil, err
+	}
+	next, err := verifier.header(height + 1)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(manifest.AppHash, next.AppHash) {
+		return nil, errors.Errorf("snapshot has app hash %X, but the header of block %d has %X", manifest.AppHash, height+1, next.AppHash)
+	}
+
+	restorer, err := cas.NewSnapshotRestorer(manifest)
+	if err != nil {
+		return nil, err
+	}
+	for i := restorer.Next(); i >= 0; i = restorer.Next() {
+		var chunk []byte
+		if err := whileSnapshotPending(func() (err error) {
+			chunk, err = s.SnapshotChunk(height, i)
+			return err
+		}); err != nil {
+			return nil, errors.Wrapf(err, "fetch chunk %d", i)
+		}
+		if err := restorer.Add(chunk); err != nil {
+			return nil, err
+		}
+	}
+	state, err := restorer.State()
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := client.Block(&height)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetch block %d", height)
+	}
+	var (
+		block   = result.Block
+		parts   = block.MakePartSet(tenderminttypes.BlockPartSizeBytes)
+		blockID = tenderminttypes.BlockID{Hash: block.Hash(), PartsHeader: parts.Header()}
+	)
+	if !blockID.Equals(next.LastBlockID) {
+		return nil, errors.Errorf("block %d doesn't match the header of block %d", height, height+1)
+	}
+
+	// Validator sets are rotated once per block, starting with the genesis
+	// state's set for block 1.
+	lastValidators := genesisState.Validators
+	if height > 1 {
+		lastValidators = lastValidators.CopyIncrementAccum(int(height - 1))
+	}
+	var (
+		validators     = lastValidators.CopyIncrementAccum(1)
+		nextValidators = validators.CopyIncrementAccum(1)
+	)
+	switch {
+	case !bytes.Equal(lastValidators.Hash(), signed.ValidatorsHash),
+		!bytes.Equal(validators.Hash(), next.ValidatorsHash),
+		!bytes.Equal(nextValidators.Hash(), next.NextValidatorsHash):
+		return nil, errors.New("the validator set has changed since genesis")
+	case !bytes.Equal(genesisState.ConsensusParams.Hash(), next.ConsensusHash):
+		return nil, errors.New("the consensus parameters have changed since genesis")
+	}
+
+	tendermintState := genesisState.Copy()
+	tendermintState.LastBlockHeight = height
+	tendermintState.LastBlockTotalTx = signed.TotalTxs
+	tendermintState.LastBlockID = blockID
+	tendermintState.LastBlockTime = signed.Time
+	tendermintState.NextValidators = nextValidators
+	tendermintState.Validators = validators
+	tendermintState.LastValidators = lastValidators
+	tendermintState.LastResultsHash = next.LastResultsHash
+	tendermintState.AppHash = next.AppHash
+
+	if err := save(state); err != nil {
+		return nil, err
+	}
+
+	// For the validators and consensus parameters of every height since
+	// genesis to be found, the state must be saved at genesis, and just
+	// before the block. The block store must be just behind the block to save
+	// it.
+	tendermintstate.SaveState(stateDB, genesisState)
+	if height > 1 {
+		previous := tendermintState.Copy()
+		previous.LastBlockHeight = height - 1
+		tendermintstate.SaveState(stateDB, previous)
+	}
+	tendermintstate.SaveState(stateDB, tendermintState)
+	tendermintblockchain.BlockStoreStateJSON{Height: height - 1}.Save(blockStoreDB)
+	tendermintblockchain.NewBlockStore(blockStoreDB).SaveBlock(block, parts, signed.Commit)
+
+	level.Info(logger).Log("state_sync", "done", "height", height, "app_hash", manifest.AppHash)
+	return state, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	"github.com/6thc/tendermint-cas-demo/internal/cluster"
+	"github.com/go-kit/kit/log"
+	tendermintblockchain "github.com/tendermint/tendermint/blockchain"
+	tendermintcommon "github.com/tendermint/tendermint/libs/common"
+	tendermintrpcclient "github.com/tendermint/tendermint/rpc/client"
+	tendermintcoretypes "github.com/tendermint/tendermint/rpc/core/types"
+	tendermintstate "github.com/tendermint/tendermint/state"
+)
+
+func TestStateSync(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a cluster")
+	}
+	c, err := cluster.New(cluster.Config{Nodes: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	peer := c.Node(0)
+	for _, tx := range []cas.Tx{
+		cas.SetTx("a", nil, []byte("one")),
+		cas.SetTx("b", nil, []byte("two")),
+	} {
+		if result, err := peer.Client().BroadcastTxSync(tx.Encode()); err != nil || result.Code != 0 {
+			t.Fatalf("BroadcastTxSync: %v %+v", err, result)
+		}
+	}
+	height, err := peer.Height()
+	if err == nil {
+		err = peer.WaitForHeight(ctx, height+2)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := c.AddNode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sync := func(client stateSyncClient, save func(*cas.State) error) (*cas.State, error) {
+		verifier := newLightClient(c.Genesis(), client, 10*time.Second)
+		return stateSync(c.Genesis(), n.DB("state"), n.DB("blockstore"), client, verifier, save, log.NewNopLogger())
+	}
+	storeHeight := func() int64 {
+		return tendermintblockchain.NewBlockStore(n.DB("blockstore")).Height()
+	}
+
+	// A snapshot that fails verification is refused, before anything's
+	// written: a chunk that doesn't match its hash in the manifest, or a
+	// manifest whose app hash isn't the one in the header.
+	for _, testcase := range []struct {
+		name    string
+		path    string
+		corrupt func([]byte) []byte
+		want    string
+	}{
+		{
+			name: "bad chunk",
+			path: cas.QueryPathSnapshotChunk,
+			corrupt: func(chunk []byte) []byte {
+				chunk = append([]byte{}, chunk...)
+				chunk[len(chunk)-1] ^= 1
+				return chunk
+			},
+			want: cas.ErrInvalidSnapshot.Error(),
+		},
+		{
+			name: "bad manifest",
+			path: cas.QueryPathSnapshot,
+			corrupt: func(value []byte) []byte {
+				var manifest cas.Manifest
+				if err := json.Unmarshal(value, &manifest); err != nil {
+					t.Fatal(err)
+				}
+				manifest.AppHash = []byte("other")
+				value, err := json.Marshal(manifest)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return value
+			},
+			want: "snapshot has app hash 6F74686572",
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			state, err := sync(corruptClient{peer.Client(), testcase.path, testcase.corrupt}, n.Persist)
+			if err == nil || !strings.Contains(err.Error(), testcase.want) {
+				t.Fatalf("want an error containing %q, have %v", testcase.want, err)
+			}
+			if state != nil || n.Persisted() != nil || storeHeight() != 0 {
+				t.Fatalf("want nothing written, have a state file of %d bytes, and a block store at height %d", len(n.Persisted()), storeHeight())
+			}
+		})
+	}
+
+	// A crash after the application state's saved, but before Tendermint's
+	// stores are written, leaves an empty block store, so the node syncs
+	// again.
+	crash := errors.New("crash")
+	if _, err := sync(peer.Client(), func(s *cas.State) error {
+		if err := n.Persist(s); err != nil {
+			return err
+		}
+		return crash
+	}); err != crash {
+		t.Fatalf("want %v, have %v", crash, err)
+	}
+	if n.Persisted() == nil || storeHeight() != 0 {
+		t.Fatalf("want a state file, and an empty block store, have a state file of %d bytes, and a block store at height %d", len(n.Persisted()), storeHeight())
+	}
+
+	// Synced, the node has the peer's state, at a height where the Tendermint
+	// state and block store agree with it.
+	state, err := sync(peer.Client(), n.Persist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	synced := state.Commits()
+	next := synced + 1
+	commit, err := peer.Client().Commit(&next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []byte(commit.Header.AppHash), state.Hash(); !bytes.Equal(want, have) {
+		t.Fatalf("app hash: want the peer's %X, have %X", want, have)
+	}
+	if want, have := 2, state.Len(); want != have {
+		t.Fatalf("keys: want %d, have %d", want, have)
+	}
+	if tendermintState := tendermintstate.LoadState(n.DB("state")); tendermintState.LastBlockHeight != synced || !bytes.Equal(tendermintState.AppHash, state.Hash()) {
+		t.Fatalf("Tendermint state: want height %d, and app hash %X, have %d, and %X", synced, state.Hash(), tendermintState.LastBlockHeight, tendermintState.AppHash)
+	}
+	if want, have := synced, storeHeight(); want != have {
+		t.Fatalf("block store height: want %d, have %d", want, have)
+	}
+	if state, err := sync(peer.Client(), n.Persist); state != nil || err != nil {
+		t.Fatalf("synced again: want nothing done, have %v", err)
+	}
+
+	// Started, it catches up with its peer, and keeps committing, with the
+	// same state: its app hash is in the peer's header of the next block.
+	if err := n.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if result, err := peer.Client().BroadcastTxSync(cas.SetTx("c", nil, []byte("three")).Encode()); err != nil || result.Code != 0 {
+		t.Fatalf("BroadcastTxSync: %v %+v", err, result)
+	}
+	height, err = peer.Height()
+	if err == nil {
+		err = n.WaitForHeight(ctx, height+3)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := n.Client().ABCIInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next = info.Response.LastBlockHeight + 1
+	if err := peer.WaitForHeight(ctx, next); err != nil {
+		t.Fatal(err)
+	}
+	if commit, err = peer.Client().Commit(&next); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []byte(commit.Header.AppHash), info.Response.LastBlockAppHash; !bytes.Equal(want, have) {
+		t.Fatalf("height %d: app hash: want the peer's %X, have %X", next-1, want, have)
+	}
+	result, err := n.Client().ABCIQuery(cas.QueryPathKey, []byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "three", string(result.Response.Value); want != have {
+		t.Fatalf("c: want %q, have %q", want, have)
+	}
+}
+
+// corruptClient corrupts the responses to queries of one path.
+type corruptClient struct {
+	*cluster.Client
+	path    string
+	corrupt func([]byte) []byte
+}
+
+func (c corruptClient) ABCIQueryWithOptions(path string, data tendermintcommon.HexBytes, opts tendermintrpcclient.ABCIQueryOptions) (*tendermintcoretypes.ResultABCIQuery, error) {
+	result, err := c.Client.ABCIQueryWithOptions(path, data, opts)
+	if err == nil && path == c.path && result.Response.IsOK() {
+		result.Response.Value = c.corrupt(result.Response.Value)
+	}
+	return result, err
+}
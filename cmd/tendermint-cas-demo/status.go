@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	tendermintcommon "github.com/tendermint/tendermint/libs/common"
+	tendermintcoretypes "github.com/tendermint/tendermint/rpc/core/types"
+)
+
+// statusClient is the part of the Tendermint client used by the health and
+// status endpoints.
+type statusClient interface {
+	Status() (*tendermintcoretypes.ResultStatus, error)
+	NetInfo() (*tendermintcoretypes.ResultNetInfo, error)
+	Validators(height *int64) (*tendermintcoretypes.ResultValidators, error)
+	ABCIInfo() (*tendermintcoretypes.ResultABCIInfo, error)
+}
+
+// apiClient is the part of the Tendermint client used by the HTTP API.
+type apiClient interface {
+	storeClient
+	statusClient
+}
+
+// handleHealthz reports that the API is up, whatever the state of the node.
+func (a *CompareAndSwapAPI) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	respondJSON(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// handleReadyz reports whether the node should be sent traffic: it mustn't be
+// catching up, its application must be persisting its state, and it must have
+// at least the minimum number of peers.
+func (a *CompareAndSwapAPI) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	status, err := a.status.Status()
+	if err != nil {
+		respondJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "unavailable", Error: err.Error()})
+		return
+	}
+	if status.SyncInfo.CatchingUp {
+		respondJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "catching up"})
+		return
+	}
+	info, err := a.status.ABCIInfo()
+	if err != nil {
+		respondJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "unavailable", Error: err.Error()})
+		return
+	}
+	var stats cas.Stats
+	if err := json.Unmarshal([]byte(info.Response.Data), &stats); err != nil {
+		respondJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "unavailable", Error: fmt.Sprintf("decoding app stats: %v", err)})
+		return
+	}
+	if stats.PersistFailures > 0 {
+		respondJSON(w, http.StatusServiceUnavailable, healthResponse{
+			Status: "not persisting",
+			Error:  fmt.Sprintf("%d write(s) in a row failed, the last with: %s", stats.PersistFailures, stats.PersistError),
+		})
+		return
+	}
+	if a.minPeers > 0 {
+		netInfo, err := a.status.NetInfo()
+		if err != nil {
+			respondJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "unavailable", Error: err.Error()})
+			return
+		}
+		if netInfo.NPeers < a.minPeers {
+			respondJSON(w, http.StatusServiceUnavailable, healthResponse{
+				Status: "too few peers",
+				Error:  fmt.Sprintf("%d peer(s), want at least %d", netInfo.NPeers, a.minPeers),
+			})
+			return
+		}
+	}
+	respondJSON(w, http.StatusOK, healthResponse{Status: "ready"})
+}
+
+// handleStatus reports the state of the node, its view of the cluster, and
+// the application's stats.
+func (a *CompareAndSwapAPI) handleStatus(w http.ResponseWriter, r *http.Request) {
+	response, err := a.getStatus()
+	if err != nil {
+		respondError(w, "", transportError{err})
+		return
+	}
+	respondJSON(w, http.StatusOK, response)
+}
+
+func (a *CompareAndSwapAPI) getStatus() (statusResponse, error) {
+	status, err := a.status.Status()
+	if err != nil {
+		return statusResponse{}, err
+	}
+	height := status.SyncInfo.LatestBlockHeight
+	validators, err := a.status.Validators(&height)
+	if err != nil {
+		return statusResponse{}, err
+	}
+	netInfo, err := a.status.NetInfo()
+	if err != nil {
+		return statusResponse{}, err
+	}
+	info, err := a.status.ABCIInfo()
+	if err != nil {
+		return statusResponse{}, err
+	}
+
+	response := statusResponse{
+		NodeID:            string(status.NodeInfo.ID),
+		Moniker:           status.NodeInfo.Moniker,
+		ChainID:           status.NodeInfo.Network,
+		LatestBlockHeight: height,
+		LatestBlockTime:   status.SyncInfo.LatestBlockTime,
+		LatestAppHash:     status.SyncInfo.LatestAppHash,
+		CatchingUp:        status.SyncInfo.CatchingUp,
+		VotingPower:       status.ValidatorInfo.VotingPower,
+		Validators:        make([]statusValidator, len(validators.Validators)),
+		Peers:             make([]statusPeer, len(netInfo.Peers)),
+	}
+	for i, v := range validators.Validators {
+		response.Validators[i] = statusValidator{Address: v.Address, VotingPower: v.VotingPower}
+	}
+	for i, p := range netInfo.Peers {
+		response.Peers[i] = statusPeer{
+			ID:         string(p.NodeInfo.ID),
+			Moniker:    p.NodeInfo.Moniker,
+			ListenAddr: p.NodeInfo.ListenAddr,
+			IsOutbound: p.IsOutbound,
+		}
+	}
+	if err := json.Unmarshal([]byte(info.Response.Data), &response.App); err != nil {
+		return statusResponse{}, fmt.Errorf("decoding app stats: %v", err)
+	}
+	return response, nil
+}
+
+type healthResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type statusResponse struct {
+	NodeID            string                    `json:"node_id"`
+	Moniker           string                    `json:"moniker"`
+	ChainID           string                    `json:"chain_id"`
+	LatestBlockHeight int64                     `json:"latest_block_height"`
+	LatestBlockTime   time.Time                 `json:"latest_block_time"`
+	LatestAppHash     tendermintcommon.HexBytes `json:"latest_app_hash"`
+	CatchingUp        bool                      `json:"catching_up"`
+	VotingPower       int64                     `json:"voting_power"` // of this node
+	Validators        []statusValidator         `json:"validators"`
+	Peers             []statusPeer              `json:"peers"`
+	App               cas.Stats                 `json:"app"`
+}
+
+type statusValidator struct {
+	Address     tendermintcommon.HexBytes `json:"address"`
+	VotingPower int64                     `json:"voting_power"`
+}
+
+type statusPeer struct {
+	ID         string `json:"id"`
+	Moniker    string `json:"moniker"`
+	ListenAddr string `json:"listen_addr"`
+	IsOutbound bool   `json:"is_outbound"`
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	tendermintabci "github.com/tendermint/tendermint/abci/types"
+	tendermintcommon "github.com/tendermint/tendermint/libs/common"
+	tendermintrpcclient "github.com/tendermint/tendermint/rpc/client"
+	tendermintcoretypes "github.com/tendermint/tendermint/rpc/core/types"
+	tenderminttypes "github.com/tendermint/tendermint/types"
+	"google.golang.org/grpc/codes"
+)
+
+// store performs key-value operations against the compare-and-swap ABCI
+// application, via a Tendermint client. It's shared by the HTTP and gRPC APIs,
+// so that they behave, and report errors, in the same way.
+type store struct {
+	client   storeClient
+	verifier *lightClient // nil if reads aren't verified
+}
+
+// storeClient is the part of the Tendermint client used by the store. It's
+// implemented by the in-process and HTTP clients, and by the gateway's pool of
+// remote nodes.
+type storeClient interface {
+	ABCIQuery(path string, data tendermintcommon.HexBytes) (*tendermintcoretypes.ResultABCIQuery, error)
+	ABCIQueryWithOptions(path string, data tendermintcommon.HexBytes, opts tendermintrpcclient.ABCIQueryOptions) (*tendermintcoretypes.ResultABCIQuery, error)
+	BroadcastTxSync(tx tenderminttypes.Tx) (*tendermintcoretypes.ResultBroadcastTx, error)
+	TxSearch(query string, prove bool, page, perPage int) (*tendermintcoretypes.ResultTxSearch, error)
+	tendermintrpcclient.EventsClient
+}
+
+// getResult is the application's answer to a read of a single key.
+type getResult struct {
+	Value    []byte
+	Code     uint32
+	Info     string
+	Log      string
+	Verified bool
+}
+
+// Get the current value of the key. If the store has a verifier, the value,
+// or its absence, is verified, and a response that fails verification is
+// reported as a transportError. If the application answers with an appError,
+// its answer is returned with it.
+func (s store) Get(key string) (getResult, error) {
+	result, err := s.client.ABCIQuery(cas.QueryPathKey, []byte(key))
+	if err != nil {
+		return getResult{}, transportError{err}
+	}
+	var verified bool
+	if s.verifier != nil {
+		if err := s.verifier.verifyKey(key, result.Response); err != nil {
+			return getResult{}, transportError{fmt.Errorf("verifying response: %v", err)}
+		}
+		verified = true
+	}
+	r := getResult{
+		Value:    result.Response.Value,
+		Code:     result.Response.Code,
+		Info:     result.Response.Info,
+		Log:      result.Response.Log,
+		Verified: verified,
+	}
+	if r.Code != tendermintabci.CodeTypeOK {
+		return r, appError{r.Code, r.Log}
+	}
+	return r, nil
+}
+
+// List every key with the prefix, and its value.
+func (s store) List(prefix string) ([]cas.KeyValue, error) {
+	result, err := s.client.ABCIQuery(cas.QueryPathList, []byte(prefix))
+	if err != nil {
+		return nil, transportError{err}
+	}
+	if result.Response.Code != tendermintabci.CodeTypeOK {
+		return nil, appError{result.Response.Code, result.Response.Log}
+	}
+	var kvs []cas.KeyValue
+	if err := json.Unmarshal(result.Response.Value, &kvs); err != nil {
+		return nil, transportError{err}
+	}
+	return kvs, nil
+}
+
+// Digest returns the digest of the keys with the prefix at the height, or the
+// latest height if it's 0, with either buckets or, if keys is true, keys.
+func (s store) Digest(height int64, prefix string, keys bool) (cas.Digest, error) {
+	path := cas.QueryPathDigest
+	if keys {
+		path = cas.QueryPathDigestKeys
+	}
+	result, err := s.client.ABCIQueryWithOptions(path, []byte(prefix), tendermintrpcclient.ABCIQueryOptions{Height: height, Trusted: true})
+	if err != nil {
+		return cas.Digest{}, transportError{err}
+	}
+	if result.Response.Code != tendermintabci.CodeTypeOK {
+		return cas.Digest{}, appError{result.Response.Code, result.Response.Log}
+	}
+	var d cas.Digest
+	if err := json.Unmarshal(result.Response.Value, &d); err != nil {
+		return cas.Digest{}, transportError{err}
+	}
+	return d, nil
+}
+
+// SnapshotManifest returns the manifest of a snapshot of the state at the
+// height, or the latest height if it's 0.
+func (s store) SnapshotManifest(height int64) (cas.Manifest, error) {
+	result, err := s.client.ABCIQueryWithOptions(cas.QueryPathSnapshot, nil, tendermintrpcclient.ABCIQueryOptions{Height: height, Trusted: true})
+	if err != nil {
+		return cas.Manifest{}, transportError{err}
+	}
+	if result.Response.Code != tendermintabci.CodeTypeOK {
+		return cas.Manifest{}, appError{result.Response.Code, result.Response.Log}
+	}
+	var m cas.Manifest
+	if err := json.Unmarshal(result.Response.Value, &m); err != nil {
+		return cas.Manifest{}, transportError{err}
+	}
+	return m, nil
+}
+
+// SnapshotChunk returns a chunk of the snapshot of the state at the height.
+func (s store) SnapshotChunk(height int64, index int) ([]byte, error) {
+	result, err := s.client.ABCIQueryWithOptions(cas.QueryPathSnapshotChunk, []byte(strconv.Itoa(index)), tendermintrpcclient.ABCIQueryOptions{Height: height, Trusted: true})
+	if err != nil {
+		return nil, transportError{err}
+	}
+	if result.Response.Code != tendermintabci.CodeTypeOK {
+		return nil, appError{result.Response.Code, result.Response.Log}
+	}
+	return result.Response.Value, nil
+}
+
+// Txn broadcasts the transaction, and returns once it's passed CheckTx.
+func (s store) Txn(tx cas.Tx) error {
+	if err := tx.Validate(); err != nil {
+		return appError{cas.CodeBadRequest, err.Error()}
+	}
+
+	// BroadcastTxAsync fires-and-forgets. BroadcastTxSync waits until CheckTx
+	// is successful. BroadcastTxCommit waits until the transaction is included
+	// in a signed block.
+	result, err := s.client.BroadcastTxSync(tenderminttypes.Tx(tx.Encode()))
+	if err != nil {
+		return transportError{err}
+	}
+	if result.Code != tendermintabci.CodeTypeOK {
+		return appError{result.Code, result.Log}
+	}
+	return nil
+}
+
+// historyPageSize is the number of transactions requested per TxSearch.
+const historyPageSize = 100
+
+// History returns every committed change to the key, in order. It's served
+// from the Tendermint transaction index, which must index TagKey.
+func (s store) History(key string) ([]watchEvent, error) {
+	if key == "" || strings.Contains(key, "'") {
+		return nil, appError{cas.CodeBadRequest, "bad request: history isn't available for keys that are empty or contain quotes"}
+	}
+
+	var (
+		query   = fmt.Sprintf("%s='%s'", cas.TagKey, key)
+		results []*tendermintcoretypes.ResultTx
+		seen    = map[string]bool{}
+	)
+	for page := 1; ; page++ {
+		result, err := s.client.TxSearch(query, false, page, historyPageSize)
+		if err != nil {
+			return nil, transportError{err}
+		}
+		for _, tx := range result.Txs {
+			if !seen[string(tx.Hash)] { // pages aren't stable within a height
+				results = append(results, tx)
+				seen[string(tx.Hash)] = true
+			}
+		}
+		if page*historyPageSize >= result.TotalCount {
+			break
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Height == results[j].Height {
+			return results[i].Index < results[j].Index
+		}
+		return results[i].Height < results[j].Height
+	})
+
+	var events []watchEvent
+	for _, result := range results {
+		if result.TxResult.Code != tendermintabci.CodeTypeOK {
+			continue
+		}
+		tx, err := cas.DecodeTx(result.Tx)
+		if err != nil {
+			continue
+		}
+		for _, ev := range txEvents(result.Height, tx) {
+			if ev.KV.Key == key {
+				events = append(events, ev)
+			}
+		}
+	}
+	return events, nil
+}
+
+// watchEvent describes a committed change to a key.
+type watchEvent struct {
+	Height  int64
+	KV      cas.KeyValue
+	Deleted bool
+}
+
+// watchBuffer is the number of events a watcher may fall behind by before
+// it's disconnected. Tendermint's event bus blocks on slow subscribers, which
+// would stall consensus, so we can't let watchers apply backpressure.
+const watchBuffer = 1024
+
+var watchSubscribers uint64
+
+// Watch calls f with each committed change to the key, or to every key with
+// the prefix, until the context is canceled or f returns an error.
+func (s store) Watch(ctx context.Context, key string, prefix bool, f func(watchEvent) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		subscriber = fmt.Sprintf("cas-watch-%d", atomic.AddUint64(&watchSubscribers, 1))
+		query      = tenderminttypes.EventQueryTx
+		out        = make(chan interface{}, watchBuffer)
+		events     = make(chan tenderminttypes.EventDataTx, watchBuffer)
+		failed     = make(chan struct{}) // closed after setting failure
+		failure    error
+	)
+	if err := s.client.Subscribe(ctx, subscriber, query, out); err != nil {
+		return transportError{err}
+	}
+	unsubscribed := make(chan struct{})
+	defer func() {
+		s.client.Unsubscribe(context.Background(), subscriber, query)
+		close(unsubscribed)
+	}()
+
+	// Read out until the subscription ends, even after a failure, or while f
+	// blocks, so that the event bus never blocks on it.
+	go func() {
+		fail := func(err error) {
+			if failure == nil {
+				failure = err
+				close(failed)
+			}
+		}
+		for {
+			select {
+			case v, ok := <-out:
+				if !ok {
+					fail(errors.New("subscription closed"))
+					return
+				}
+				data, ok := v.(tenderminttypes.EventDataTx)
+				if !ok || failure != nil {
+					continue
+				}
+				select {
+				case events <- data:
+				default:
+					fail(fmt.Errorf("watcher fell more than %d events behind", watchBuffer))
+				}
+			case <-unsubscribed:
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case data := <-events:
+			if data.Result.Code != tendermintabci.CodeTypeOK {
+				continue
+			}
+			tx, err := cas.DecodeTx(data.Tx)
+			if err != nil {
+				continue
+			}
+			for _, ev := range txEvents(data.Height, tx) {
+				if !watchMatch(key, prefix, ev.KV.Key) {
+					continue
+				}
+				if err := f(ev); err != nil {
+					return err
+				}
+			}
+		case <-failed:
+			return transportError{failure}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// txEvents returns the final effect of a committed transaction on each key
+// that it changed.
+func txEvents(height int64, tx cas.Tx) []watchEvent {
+	final := map[string]watchEvent{}
+	for _, op := range tx.Ops {
+		switch op.Type {
+		case cas.OpSet:
+			final[op.Key] = watchEvent{Height: height, KV: cas.KeyValue{Key: op.Key, Value: op.New}}
+		case cas.OpDelete:
+			final[op.Key] = watchEvent{Height: height, KV: cas.KeyValue{Key: op.Key}, Deleted: true}
+		}
+	}
+	var events []watchEvent
+	for _, key := range tx.Keys() {
+		if ev, ok := final[key]; ok {
+			events = append(events, ev)
+		}
+	}
+	return events
+}
+
+func watchMatch(key string, prefix bool, candidate string) bool {
+	if prefix {
+		return strings.HasPrefix(candidate, key)
+	}
+	return candidate == key
+}
+
+// appError is returned when the application responds with a non-OK code.
+type appError struct {
+	code uint32
+	log  string
+}
+
+func (e appError) Error() string {
+	if e.log == "" {
+		return fmt.Sprintf("result code %d", e.code)
+	}
+	return e.log
+}
+
+// transportError is returned when we can't communicate with Tendermint, or
+// can't understand its response.
+type transportError struct{ error }
+
+// codeMapping describes how an application response code is reported by each
+// API.
+type codeMapping struct {
+	http int
+	grpc codes.Code
+}
+
+// The HTTP API has always reported a failed write as a 400, and a read of a
+// missing key as a 200, with an empty value and the application's log, so the
+// response's code tells them apart.
+var appCodes = map[uint32]codeMapping{
+	tendermintabci.CodeTypeOK: {http.StatusOK, codes.OK},
+	cas.CodeBadRequest:        {http.StatusBadRequest, codes.InvalidArgument},
+	cas.CodeCASFailure:        {http.StatusBadRequest, codes.FailedPrecondition},
+	cas.CodeKeyNotFound:       {http.StatusOK, codes.NotFound},
+	cas.CodeHeightNotFound:    {http.StatusNotFound, codes.NotFound},
+	cas.CodeSnapshotPending:   {http.StatusServiceUnavailable, codes.Unavailable},
+}
+
+// errorCodes maps an error returned by the store to the codes reported by
+// each API.
+func errorCodes(err error) codeMapping {
+	switch e := err.(type) {
+	case nil:
+		return appCodes[tendermintabci.CodeTypeOK]
+	case appError:
+		if m, ok := appCodes[e.code]; ok {
+			return m
+		}
+		return codeMapping{http.StatusInternalServerError, codes.Unknown}
+	case transportError:
+		return codeMapping{http.StatusBadGateway, codes.Unavailable}
+	default:
+		if err == context.Canceled {
+			return codeMapping{http.StatusServiceUnavailable, codes.Canceled}
+		}
+		return codeMapping{http.StatusInternalServerError, codes.Internal}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	"github.com/peterbourgon/usage"
+	"github.com/pkg/errors"
+	tendermintconfig "github.com/tendermint/tendermint/config"
+	tendermintcommon "github.com/tendermint/tendermint/libs/common"
+	tendermintp2p "github.com/tendermint/tendermint/p2p"
+	tendermintprivval "github.com/tendermint/tendermint/privval"
+	tenderminttypes "github.com/tendermint/tendermint/types"
+	tenderminttime "github.com/tendermint/tendermint/types/time"
+)
+
+func runTestnet(args []string) error {
+	fs := flag.NewFlagSet("testnet", flag.ExitOnError)
+	var (
+		n           = fs.Int("n", 3, "number of nodes, all of them validators")
+		outputDir   = fs.String("o", "testnet", "output directory, with one subdirectory per node")
+		chainID     = fs.String("chain-id", "", "chain ID (default random)")
+		host        = fs.String("host", "127.0.0.1", "host that every node listens on")
+		p2pPort     = fs.Int("p2p-port", 10001, "Tendermint P2P port of the first node, incremented for each subsequent node")
+		apiPort     = fs.Int("api-port", 8081, "HTTP API port of the first node, incremented for each subsequent node")
+		grpcPort    = fs.Int("grpc-port", 0, "gRPC API port of the first node, incremented for each subsequent node (0 to disable)")
+		rpcPort     = fs.Int("rpc-port", 0, "Tendermint RPC port of the first node, incremented for each subsequent node (0 to disable)")
+		metricsPort = fs.Int("metrics-port", 9081, "metrics port of the first node, incremented for each subsequent node (0 to disable)")
+	)
+	fs.Usage = usage.For(fs, "tendermint-cas-demo testnet [flags]")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return usageError(fmt.Sprintf("unexpected argument %q", fs.Arg(0)))
+	}
+	if *n < 1 {
+		return usageError("-n must be at least 1")
+	}
+	if *chainID == "" {
+		*chainID = "test-chain-" + tendermintcommon.RandStr(6)
+	}
+
+	// Refuse to clobber an existing testnet, as that would leave its nodes
+	// with state that doesn't match the new genesis.
+	if _, err := os.Stat(*outputDir); err == nil {
+		return fmt.Errorf("%s already exists; remove it first", *outputDir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// Create the keys for each node first, as every node's config and
+	// genesis depends on all of them.
+	var (
+		nodes      = make([]testnetNode, *n)
+		validators = make([]tenderminttypes.GenesisValidator, *n)
+		peers      = make([]string, *n)
+	)
+	for i := range nodes {
+		node := testnetNode{
+			name:          fmt.Sprintf("node%d", i),
+			dir:           filepath.Join(*outputDir, fmt.Sprintf("node%d", i)),
+			p2pAddr:       net.JoinHostPort(*host, strconv.Itoa(*p2pPort+i)),
+			apiAddr:       net.JoinHostPort(*host, strconv.Itoa(*apiPort+i)),
+			grpcAddr:      portAddr(*host, *grpcPort, i),
+			metricsAddr:   portAddr(*host, *metricsPort, i),
+			rpcAddr:       portAddr(*host, *rpcPort, i),
+			tendermintDir: filepath.Join(*outputDir, fmt.Sprintf("node%d", i), "tendermint"),
+		}
+		node.config = tendermintconfig.DefaultConfig().SetRoot(node.tendermintDir)
+		for _, dir := range []string{
+			filepath.Dir(node.config.GenesisFile()),
+			node.config.DBDir(),
+		} {
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return err
+			}
+		}
+
+		nodeKey, err := tendermintp2p.LoadOrGenNodeKey(node.config.NodeKeyFile())
+		if err != nil {
+			return errors.Wrapf(err, "%s: generating node key", node.name)
+		}
+		pv := tendermintprivval.GenFilePV(node.config.PrivValidatorFile())
+		pv.Save()
+
+		validators[i] = tenderminttypes.GenesisValidator{
+			Address: pv.GetAddress(),
+			PubKey:  pv.GetPubKey(),
+			Power:   10,
+			Name:    node.name,
+		}
+		peers[i] = tendermintp2p.IDAddressString(nodeKey.ID(), node.p2pAddr)
+		nodes[i] = node
+	}
+
+	genesis := &tenderminttypes.GenesisDoc{
+		GenesisTime: tenderminttime.Now(),
+		ChainID:     *chainID,
+		Validators:  validators,
+	}
+	if err := genesis.ValidateAndComplete(); err != nil {
+		return errors.Wrap(err, "invalid genesis")
+	}
+
+	for i, node := range nodes {
+		if err := genesis.SaveAs(node.config.GenesisFile()); err != nil {
+			return errors.Wrapf(err, "%s: writing genesis", node.name)
+		}
+
+		// Every node is a persistent peer of every other node.
+		var others []string
+		for j, peer := range peers {
+			if j != i {
+				others = append(others, peer)
+			}
+		}
+
+		c := node.config
+		c.Moniker = node.name
+		c.ProxyApp = ""          // the application runs in-process
+		c.RPC.ListenAddress = "" // the APIs use an in-process client
+		if node.rpcAddr != "" {
+			c.RPC.ListenAddress = "tcp://" + node.rpcAddr // for gateways
+		}
+		c.P2P.ListenAddress = "tcp://" + node.p2pAddr
+		c.P2P.PersistentPeers = strings.Join(others, ",")
+		c.P2P.AddrBookStrict = false // testnets usually run on private addresses
+		c.TxIndex.IndexTags = cas.TagKey
+		tendermintconfig.WriteConfigFile(filepath.Join(c.RootDir, "config", "config.toml"), c)
+	}
+
+	fmt.Printf("wrote %d node(s) with chain ID %s to %s\n", len(nodes), *chainID, *outputDir)
+	fmt.Printf("\n")
+	fmt.Printf("now you can run them\n")
+	fmt.Printf("\n")
+	for _, node := range nodes {
+		fmt.Printf("    %s\n", node.command())
+	}
+	fmt.Printf("\n")
+	fmt.Printf("and try the command-line client\n")
+	fmt.Printf("\n")
+	fmt.Printf("    ./tendermint-cas-demo cas -endpoint %s -new one x\n", nodes[0].apiAddr)
+	fmt.Printf("    ./tendermint-cas-demo get -endpoint %s x\n", nodes[len(nodes)-1].apiAddr)
+	if rpcAddrs := testnetRPCAddrs(nodes); rpcAddrs != "" {
+		fmt.Printf("\n")
+		fmt.Printf("or run a gateway in front of them\n")
+		fmt.Printf("\n")
+		fmt.Printf("    ./tendermint-cas-demo gateway -api-addr %s -tendermint-rpc %s -genesis %s\n", net.JoinHostPort(*host, strconv.Itoa(*apiPort+len(nodes))), rpcAddrs, nodes[0].config.GenesisFile())
+	}
+	return nil
+}
+
+type testnetNode struct {
+	name          string
+	dir           string
+	p2pAddr       string
+	apiAddr       string
+	grpcAddr      string
+	metricsAddr   string
+	rpcAddr       string
+	tendermintDir string
+	config        *tendermintconfig.Config
+}
+
+// command returns the command line that runs the node.
+func (n testnetNode) command() string {
+	args := []string{"./tendermint-cas-demo", "serve", "-api-addr", n.apiAddr}
+	if n.grpcAddr != "" {
+		args = append(args, "-grpc-addr", n.grpcAddr)
+	}
+	if n.metricsAddr != "" {
+		args = append(args, "-metrics-addr", n.metricsAddr)
+	}
+	args = append(args,
+		"-app-file", filepath.Join(n.dir, "app.json"),
+		"-tendermint-dir", n.tendermintDir,
+	)
+	return strings.Join(args, " ")
+}
+
+// portAddr returns the address of the i'th node, given the port of the first
+// node, or the empty string if the port is 0.
+func portAddr(host string, port, i int) string {
+	if port == 0 {
+		return ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port+i))
+}
+
+// testnetRPCAddrs returns the comma-separated RPC addresses of the nodes, if
+// they have any.
+func testnetRPCAddrs(nodes []testnetNode) string {
+	var addrs []string
+	for _, node := range nodes {
+		if node.rpcAddr != "" {
+			addrs = append(addrs, "tcp://"+node.rpcAddr)
+		}
+	}
+	return strings.Join(addrs, ",")
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	tendermintconfig "github.com/tendermint/tendermint/config"
+	tendermintp2p "github.com/tendermint/tendermint/p2p"
+	tendermintprivval "github.com/tendermint/tendermint/privval"
+	tenderminttypes "github.com/tendermint/tendermint/types"
+)
+
+func TestTestnet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	outputDir := filepath.Join(dir, "testnet")
+	args := []string{"-n", "3", "-o", outputDir, "-grpc-port", "9091", "-rpc-port", "26657"}
+	out := captureStdout(t, func() { err = runTestnet(args) })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		configs    []*tendermintconfig.Config
+		validators []string // by node
+		peers      []string // by node
+		addrs      = map[string]string{}
+	)
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("node%d", i)
+		config, err := loadTendermintConfig(filepath.Join(outputDir, name, "tendermint"))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		nodeKey, err := tendermintp2p.LoadNodeKey(config.NodeKeyFile())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		p2pAddr := strings.TrimPrefix(config.P2P.ListenAddress, "tcp://")
+		configs = append(configs, config)
+		validators = append(validators, tendermintprivval.LoadFilePV(config.PrivValidatorFile()).GetAddress().String())
+		peers = append(peers, tendermintp2p.IDAddressString(nodeKey.ID(), p2pAddr))
+		addrs[name+" -p2p-addr"] = p2pAddr
+		addrs[name+" -rpc-addr"] = strings.TrimPrefix(config.RPC.ListenAddress, "tcp://")
+	}
+
+	// Every node has the same genesis, whose validators are the nodes, and
+	// every other node as a persistent peer.
+	sort.Strings(validators)
+	for i, config := range configs {
+		genesis, err := tenderminttypes.GenesisDocFromFile(config.GenesisFile())
+		if err != nil {
+			t.Fatalf("node%d: %v", i, err)
+		}
+		var have []string
+		for _, v := range genesis.Validators {
+			have = append(have, v.Address.String())
+		}
+		sort.Strings(have)
+		if want := validators; !reflect.DeepEqual(want, have) {
+			t.Fatalf("node%d: genesis validators: want %v, have %v", i, want, have)
+		}
+
+		var want []string
+		for j, peer := range peers {
+			if j != i {
+				want = append(want, peer)
+			}
+		}
+		have = strings.Split(config.P2P.PersistentPeers, ",")
+		sort.Strings(want)
+		sort.Strings(have)
+		if !reflect.DeepEqual(want, have) {
+			t.Fatalf("node%d: persistent peers: want %v, have %v", i, want, have)
+		}
+	}
+
+	// Every port is distinct: Tendermint's, above, and the APIs', in the
+	// commands that run the nodes.
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[1] != "serve" {
+			continue
+		}
+		name := filepath.Base(filepath.Dir(fields[len(fields)-1])) // of -tendermint-dir
+		for i, field := range fields[:len(fields)-1] {
+			switch field {
+			case "-api-addr", "-grpc-addr", "-metrics-addr":
+				addrs[name+" "+field] = fields[i+1]
+			}
+		}
+	}
+	if want, have := 3*5, len(addrs); want != have {
+		t.Fatalf("want %d addresses, have %d: %v", want, have, addrs)
+	}
+	seen := map[string]string{}
+	for name, addr := range addrs {
+		if other, ok := seen[addr]; ok {
+			t.Fatalf("%s and %s are both %s", other, name, addr)
+		}
+		seen[addr] = name
+	}
+
+	// An existing testnet isn't overwritten.
+	captureStdout(t, func() { err = runTestnet(args) })
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Fatalf("want an error, as %s already exists, have %v", outputDir, err)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	"github.com/pkg/errors"
+	tendermintabci "github.com/tendermint/tendermint/abci/types"
+	tendermintcoretypes "github.com/tendermint/tendermint/rpc/core/types"
+	tenderminttypes "github.com/tendermint/tendermint/types"
+)
+
+// lightClient verifies query responses from untrusted nodes. It starts out
+// trusting the validator set in the genesis, and trusts each later validator
+// set once more than 2/3 of a set it already trusts has signed a header
+// naming it. A header is trusted if more than 2/3 of its trusted validator
+// set signed it, and a response is trusted if its proof matches the app hash
+// in a trusted header.
+type lightClient struct {
+	chainID string
+	client  headerClient
+	timeout time.Duration // to wait for the next block
+
+	mtx     sync.Mutex
+	trusted []trustedValidators // by height
+	latest  int64               // greatest height of a verified header
+}
+
+// headerClient is the part of the Tendermint client used by the light client.
+type headerClient interface {
+	Commit(height *int64) (*tendermintcoretypes.ResultCommit, error)
+	Validators(height *int64) (*tendermintcoretypes.ResultValidators, error)
+}
+
+type trustedValidators struct {
+	height int64
+	set    *tenderminttypes.ValidatorSet
+}
+
+// headerPollInterval is how often the light client asks for a block that
+// hasn't been committed yet.
+const headerPollInterval = 100 * time.Millisecond
+
+// maxReadLag is how many blocks a verified read may be behind the latest
+// verified header. A node chooses the height it answers at, so it could answer
+// from an old state, with a valid proof against an old header, and that's
+// refused. Reads are spread across nodes that may be a few blocks apart,
+// though, so a read needn't be of the very latest block.
+const maxReadLag = 10
+
+func newLightClient(genesis *tenderminttypes.GenesisDoc, client headerClient, timeout time.Duration) *lightClient {
+	validators := make([]*tenderminttypes.Validator, len(genesis.Validators))
+	for i, v := range genesis.Validators {
+		validators[i] = tenderminttypes.NewValidator(v.PubKey, v.Power)
+	}
+	return &lightClient{
+		chainID: genesis.ChainID,
+		client:  client,
+		timeout: timeout,
+		trusted: []trustedValidators{{height: 1, set: tenderminttypes.NewValidatorSet(validators)}},
+	}
+}
+
+// verifyKey verifies a response to a QueryPathKey query for the key. The
+// response is for the state after the block at its height, whose app hash is
+// in the header of the next block, so it may wait for that block. A response
+// more than maxReadLag blocks behind the latest verified header fails.
+func (c *lightClient) verifyKey(key string, response tendermintabci.ResponseQuery) error {
+	exists := response.Code == tendermintabci.CodeTypeOK
+	if !exists && response.Code != cas.CodeKeyNotFound {
+		return errors.Errorf("can't verify result code %d", response.Code)
+	}
+	if err := c.seed(); err != nil {
+		return err
+	}
+	if latest := c.latestHeight(); response.Height+1 < latest-maxReadLag {
+		return errors.Errorf("height %d is more than %d blocks behind verified header %d", response.Height, maxReadLag, latest)
+	}
+	var proof cas.Proof
+	if err := json.Unmarshal(response.Proof, &proof); err != nil {
+		return errors.Wrap(err, "decoding proof")
+	}
+	header, err := c.header(response.Height + 1)
+	if err != nil {
+		return err
+	}
+	return proof.Verify(header.AppHash, key, response.Value, exists)
+}
+
+// seed verifies the latest header, if no header has been verified yet, so
+// that even the first read is checked against a recent one.
+func (c *lightClient) seed() error {
+	if c.latestHeight() > 0 {
+		return nil
+	}
+	commit, err := c.client.Commit(nil)
+	if err != nil {
+		return errors.Wrap(err, "fetching latest header")
+	}
+	_, _, err = c.verify(commit.SignedHeader.Height)
+	return err
+}
+
+// header returns the header at the height, once it's been verified.
+func (c *lightClient) header(height int64) (*tenderminttypes.Header, error) {
+	sh, _, err := c.verify(height)
+	if err != nil {
+		return nil, err
+	}
+	return sh.Header, nil
+}
+
+func (c *lightClient) verify(height int64) (*tenderminttypes.SignedHeader, *tenderminttypes.ValidatorSet, error) {
+	sh, set, err := c.fetch(height)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	trusted := c.trustedAt(height)
+	if bytes.Equal(trusted.set.Hash(), set.Hash()) {
+		if err := set.VerifyCommit(c.chainID, sh.Commit.BlockID, height, sh.Commit); err != nil {
+			return nil, nil, errors.Wrapf(err, "height %d", height)
+		}
+		c.verified(height)
+		return sh, set, nil
+	}
+
+	if err := trusted.set.VerifyFutureCommit(set, c.chainID, sh.Commit.BlockID, height, sh.Commit); err != nil {
+		// Too much of the validator set may have changed at once, so first
+		// verify the header halfway there, and trust its validator set.
+		mid := (trusted.height + height) / 2
+		if mid == trusted.height {
+			return nil, nil, errors.Wrapf(err, "height %d", height)
+		}
+		_, midSet, err := c.verify(mid)
+		if err != nil {
+			return nil, nil, err
+		}
+		c.trust(mid, midSet)
+		return c.verify(height)
+	}
+	c.trust(height, set)
+	c.verified(height)
+	return sh, set, nil
+}
+
+// fetch returns the signed header at the height, and the validator set that
+// it names, waiting for the block to be committed if need be.
+func (c *lightClient) fetch(height int64) (*tenderminttypes.SignedHeader, *tenderminttypes.ValidatorSet, error) {
+	var (
+		commit   *tendermintcoretypes.ResultCommit
+		err      error
+		deadline = time.Now().Add(c.timeout)
+	)
+	for {
+		if commit, err = c.client.Commit(&height); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, nil, errors.Wrapf(err, "fetching header %d", height)
+		}
+		time.Sleep(headerPollInterval)
+	}
+	sh := commit.SignedHeader
+	if err := sh.ValidateBasic(c.chainID); err != nil {
+		return nil, nil, errors.Wrapf(err, "header %d", height)
+	}
+	if sh.Height != height {
+		return nil, nil, errors.Errorf("asked for header %d, got %d", height, sh.Height)
+	}
+
+	validators, err := c.client.Validators(&height)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "fetching validators %d", height)
+	}
+	set := tenderminttypes.NewValidatorSet(validators.Validators)
+	if !bytes.Equal(set.Hash(), sh.ValidatorsHash) {
+		return nil, nil, errors.Errorf("validators %d don't match header", height)
+	}
+	return &sh, set, nil
+}
+
+// trustedAt returns the trusted validator set with the greatest height at or
+// below the given height.
+func (c *lightClient) trustedAt(height int64) trustedValidators {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	i := sort.Search(len(c.trusted), func(i int) bool { return c.trusted[i].height > height })
+	if i == 0 {
+		return c.trusted[0]
+	}
+	return c.trusted[i-1]
+}
+
+// verified records that the header at the height has been verified.
+func (c *lightClient) verified(height int64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if height > c.latest {
+		c.latest = height
+	}
+}
+
+// latestHeight returns the greatest height of a verified header, or 0.
+func (c *lightClient) latestHeight() int64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.latest
+}
+
+func (c *lightClient) trust(height int64, set *tenderminttypes.ValidatorSet) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	i := sort.Search(len(c.trusted), func(i int) bool { return c.trusted[i].height >= height })
+	if i < len(c.trusted) && c.trusted[i].height == height {
+		return
+	}
+	c.trusted = append(c.trusted, trustedValidators{})
+	copy(c.trusted[i+1:], c.trusted[i:])
+	c.trusted[i] = trustedValidators{height: height, set: set}
+}
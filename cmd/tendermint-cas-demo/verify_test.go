@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	"github.com/6thc/tendermint-cas-demo/internal/mockrpc"
+	"github.com/go-kit/kit/log"
+	tendermintabci "github.com/tendermint/tendermint/abci/types"
+	tenderminttypes "github.com/tendermint/tendermint/types"
+)
+
+func TestLightClientStaleRead(t *testing.T) {
+	genesis := &tenderminttypes.GenesisDoc{
+		ChainID:    "test",
+		Validators: []tenderminttypes.GenesisValidator{{PubKey: tenderminttypes.NewMockPV().GetPubKey(), Power: 10}},
+	}
+	c := newLightClient(genesis, nil, 0)
+	c.verified(100)
+
+	// A read far behind the latest verified header is refused before its
+	// proof is even looked at, however valid it might be.
+	response := tendermintabci.ResponseQuery{Code: cas.CodeKeyNotFound, Height: 100 - maxReadLag - 2}
+	if err := c.verifyKey("a", response); err == nil || !strings.Contains(err.Error(), "behind") {
+		t.Fatalf("verifyKey: want an error about the height, have %v", err)
+	}
+	if want, have := int64(100), c.latestHeight(); want != have {
+		t.Fatalf("latestHeight: want %d, have %d", want, have)
+	}
+}
+
+func TestLightClientStaleFirstRead(t *testing.T) {
+	app, err := cas.NewApplication(nil, nil, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	client, err := mockrpc.New(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for i := 0; i < maxReadLag+3; i++ {
+		commit(t, client)
+	}
+	genesis, err := client.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newLightClient(genesis.Genesis, client, time.Second)
+
+	// Nothing has been verified yet, so the latest header is, before the
+	// read is checked against it.
+	response := tendermintabci.ResponseQuery{Code: cas.CodeKeyNotFound, Height: 1}
+	if err := c.verifyKey("a", response); err == nil || !strings.Contains(err.Error(), "behind") {
+		t.Fatalf("verifyKey: want an error about the height, have %v", err)
+	}
+	if want, have := client.Height(), c.latestHeight(); want != have {
+		t.Fatalf("latestHeight: want %d, have %d", want, have)
+	}
+}
@@ -1,14 +1,18 @@
 package cas
 
 import (
-	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	tendermintabci "github.com/tendermint/tendermint/abci/types"
+	tendermintcommon "github.com/tendermint/tendermint/libs/common"
 )
 
 // https://tendermint.com/docs/spec/abci/abci.html
@@ -40,17 +44,62 @@ var (
 type Application struct {
 	mempool   *State
 	consensus *State
-	persist   io.WriteCloser
+	persister *persister
 	logger    log.Logger
+	metrics   *Metrics
+	stats     Stats
+	retain    int
+	retained  []*merkleTree // oldest first
+	snapshots *snapshotter
+}
+
+// Stats describe the committed state of an application. They're returned as
+// JSON in the Data of the Info response.
+type Stats struct {
+	Keys           int       `json:"keys"`
+	Bytes          int64     `json:"bytes"`            // as last persisted
+	LastCommitTime time.Time `json:"last_commit_time"` // zero if not since startup
+
+	// PersistFailures is how many writes of the committed state in a row
+	// have failed, up to the last, and PersistError the error of the last.
+	PersistFailures int    `json:"persist_failures,omitempty"`
+	PersistError    string `json:"persist_error,omitempty"`
+}
+
+// ApplicationOption configures optional aspects of an Application.
+type ApplicationOption func(*Application)
+
+// WithMetrics instruments the application with the given metrics.
+// By default, the application uses NopMetrics.
+func WithMetrics(m *Metrics) ApplicationOption {
+	return func(a *Application) { a.metrics = m }
+}
+
+// WithRetainedHeights keeps the state of the given number of most recent
+// heights, and at least the latest, so that their digests can be queried. By
+// default, it's DefaultRetainedHeights.
+func WithRetainedHeights(n int) ApplicationOption {
+	return func(a *Application) { a.retain = n }
+}
+
+// DefaultRetainedHeights is the default number of heights whose digests can be
+// queried.
+const DefaultRetainedHeights = 10
+
+// WithSnapshotChunkSize sets the size of the chunks of the snapshots that can be
+// queried. By default, it's DefaultSnapshotChunkSize.
+func WithSnapshotChunkSize(n int) ApplicationOption {
+	return func(a *Application) { a.snapshots.chunkSize = n }
 }
 
 // NewApplication returns a Tendermint application server, implementing the
 // ABCI. If initial is non-nil, initial state is populated from it. If persist
-// is non-nil, state is persisted there on each Tendermint commit.
-func NewApplication(initial io.Reader, persist io.WriteCloser, logger log.Logger) (*Application, error) {
+// is non-nil, state is persisted there after each Tendermint commit, in the
+// background, and Close must be called to persist the last of it.
+func NewApplication(initial io.Reader, persist io.WriteCloser, logger log.Logger, options ...ApplicationOption) (*Application, error) {
 	consensus := NewState()
 	if initial != nil {
-		if err := consensus.Restore(initial); err != nil {
+		if err := consensus.restore(initial, logger); err != nil {
 			return nil, err
 		}
 	}
@@ -62,12 +111,26 @@ func NewApplication(initial io.Reader, persist io.WriteCloser, logger log.Logger
 		persist = newNopWriteCloser(ioutil.Discard)
 	}
 
-	return &Application{
+	a := &Application{
 		mempool:   mempool,
 		consensus: consensus,
-		persist:   persist,
 		logger:    logger,
-	}, nil
+		metrics:   NopMetrics(),
+		retain:    DefaultRetainedHeights,
+		snapshots: &snapshotter{chunkSize: DefaultSnapshotChunkSize},
+	}
+	for _, option := range options {
+		option(a)
+	}
+	a.snapshots.logger = log.With(logger, "component", "Snapshotter")
+	a.persister = newPersister(consensus, persist, logger, a.metrics)
+	a.retainCommitted()
+
+	a.metrics.Keys.Set(float64(consensus.Len()))
+	a.metrics.StateBytes.Set(float64(consensus.Size()))
+	a.stats = Stats{Keys: consensus.Len(), Bytes: consensus.Size()}
+
+	return a, nil
 }
 
 // Info implements ABCI and is called by Tendermint prior to InitChain as a sort
@@ -86,6 +149,7 @@ func NewApplication(initial io.Reader, persist io.WriteCloser, logger log.Logger
 // Tendermint will just replay all blocks.
 //
 // The data and version fields may contain arbitrary app-specific information.
+// We return Stats as JSON in the data field.
 func (a *Application) Info(tendermintabci.RequestInfo) (response tendermintabci.ResponseInfo) {
 	defer func() {
 		level.Debug(a.logger).Log(
@@ -97,8 +161,13 @@ func (a *Application) Info(tendermintabci.RequestInfo) (response tendermintabci.
 		)
 	}()
 
+	stats := a.stats
+	if n, err := a.persister.failing(); n > 0 {
+		stats.PersistFailures, stats.PersistError = n, err.Error()
+	}
+	data, _ := json.Marshal(stats)
 	return tendermintabci.ResponseInfo{
-		Data:             "",
+		Data:             string(data),
 		Version:          "",
 		LastBlockHeight:  a.consensus.Commits(),
 		LastBlockAppHash: a.consensus.Hash(),
@@ -158,41 +227,173 @@ func (a *Application) InitChain(request tendermintabci.RequestInitChain) (respon
 	return tendermintabci.ResponseInitChain{}
 }
 
-// Query implements ABCI and is used for reads. In this application, we
-// interpret the data as the key, and return the current value.
+// Query implements ABCI and is used for reads. The path selects the kind of
+// read: QueryPathKey (or an empty path) interprets the data as a key, and
+// returns its value at the time of the last commit, at the returned height;
+// QueryPathList interprets the data as a key prefix, and returns a JSON array
+// of matching KeyValues.
+//
+// If the query asks for a proof, a key read includes a JSON Proof of the
+// value, or of the key's absence, against the app hash of the returned
+// height, which is in the header of the block after it.
+//
+// QueryPathDigest and QueryPathDigestKeys interpret the data as a key prefix,
+// and return a JSON Digest of the matching keys at the query's height, or the
+// latest height, with either buckets or keys. Only recent heights are retained.
+//
+// QueryPathSnapshot returns the JSON Manifest of a snapshot of the query's
+// height, or of the latest height if it's 0, and QueryPathSnapshotChunk
+// interprets the data as a decimal chunk index, and returns that chunk of the
+// same snapshot. A snapshot that isn't built yet is built in the background,
+// and CodeSnapshotPending is returned until it is. Without a height, the last
+// snapshot built is returned as long as its height is retained, so that it
+// isn't built again at every height.
 func (a *Application) Query(query tendermintabci.RequestQuery) (response tendermintabci.ResponseQuery) {
 	defer func() {
 		level.Debug(a.logger).Log(
 			"abci", "Query",
 			"path", query.Path,
 			"data", string(query.Data),
+			"prove", query.Prove,
 			"ok", response.IsOK(),
 			"code", response.Code,
 			"key", string(response.Key),
 			"value", string(response.Value),
+			"height", response.Height,
 			"log", response.Log,
 			"info", response.Info,
 		)
 	}()
 
 	// TODO(pb): filter out the /p2p paths
-	// TODO(pb): maybe require a /store or /cas path prefix?
 	// TODO(pb): respect query.Height, though I'm not sure how
-	// TODO(pb): respect query.Prove, though I'm not sure how
 
-	value, err := a.consensus.Get(string(query.Data))
-	if err != nil {
+	switch query.Path {
+	case "", QueryPathKey:
+		value, proof, err := a.consensus.Prove(string(query.Data))
+		response = tendermintabci.ResponseQuery{
+			Code:   tendermintabci.CodeTypeOK,
+			Key:    query.Data,
+			Value:  value,
+			Height: a.consensus.Commits(),
+		}
+		if err != nil {
+			response.Code = CodeKeyNotFound
+			response.Log = err.Error()
+		}
+		if query.Prove {
+			response.Proof, err = json.Marshal(proof)
+			if err != nil {
+				return tendermintabci.ResponseQuery{
+					Code: CodeBadRequest,
+					Key:  query.Data,
+					Log:  err.Error(),
+				}
+			}
+		}
+		return response
+
+	case QueryPathDigest, QueryPathDigestKeys:
+		t := a.retainedAt(query.Height)
+		if t == nil {
+			return tendermintabci.ResponseQuery{
+				Code:   CodeHeightNotFound,
+				Key:    query.Data,
+				Log:    fmt.Sprintf("height %d isn't retained", query.Height),
+				Height: query.Height,
+			}
+		}
+		buf, err := json.Marshal(t.digest(string(query.Data), query.Path == QueryPathDigestKeys))
+		if err != nil {
+			return tendermintabci.ResponseQuery{
+				Code: CodeBadRequest,
+				Key:  query.Data,
+				Log:  err.Error(),
+			}
+		}
 		return tendermintabci.ResponseQuery{
-			Code: codeBadRequest,
-			Key:  query.Data,
-			Log:  err.Error(),
+			Code:   tendermintabci.CodeTypeOK,
+			Key:    query.Data,
+			Value:  buf,
+			Height: t.height,
+		}
+
+	case QueryPathSnapshot, QueryPathSnapshotChunk:
+		snapshot := a.snapshots.lastBuilt()
+		switch {
+		case snapshot != nil && query.Height == 0 && snapshot.Manifest.Height >= a.retained[0].height:
+			// Recent enough.
+		case snapshot != nil && query.Height != 0 && snapshot.Manifest.Height == query.Height:
+			// The one asked for.
+		default:
+			t := a.retainedAt(query.Height)
+			if t == nil {
+				return tendermintabci.ResponseQuery{
+					Code:   CodeHeightNotFound,
+					Key:    query.Data,
+					Log:    fmt.Sprintf("height %d isn't retained", query.Height),
+					Height: query.Height,
+				}
+			}
+			a.snapshots.build(t)
+			return tendermintabci.ResponseQuery{
+				Code:   CodeSnapshotPending,
+				Key:    query.Data,
+				Log:    fmt.Sprintf("the snapshot of height %d isn't built yet; try again", t.height),
+				Height: t.height,
+			}
+		}
+		var (
+			value []byte
+			err   error
+		)
+		if query.Path == QueryPathSnapshot {
+			value, err = json.Marshal(snapshot.Manifest)
+		} else {
+			var i int
+			i, err = strconv.Atoi(string(query.Data))
+			if err == nil && (i < 0 || i >= len(snapshot.Chunks)) {
+				err = fmt.Errorf("chunk %d out of range", i)
+			}
+			if err == nil {
+				value = snapshot.Chunks[i]
+			}
+		}
+		if err != nil {
+			return tendermintabci.ResponseQuery{
+				Code: CodeBadRequest,
+				Key:  query.Data,
+				Log:  err.Error(),
+			}
+		}
+		return tendermintabci.ResponseQuery{
+			Code:   tendermintabci.CodeTypeOK,
+			Key:    query.Data,
+			Value:  value,
+			Height: snapshot.Manifest.Height,
 		}
-	}
 
-	return tendermintabci.ResponseQuery{
-		Code:  tendermintabci.CodeTypeOK,
-		Key:   query.Data,
-		Value: value,
+	case QueryPathList:
+		buf, err := json.Marshal(a.consensus.List(string(query.Data)))
+		if err != nil {
+			return tendermintabci.ResponseQuery{
+				Code: CodeBadRequest,
+				Key:  query.Data,
+				Log:  err.Error(),
+			}
+		}
+		return tendermintabci.ResponseQuery{
+			Code:  tendermintabci.CodeTypeOK,
+			Key:   query.Data,
+			Value: buf,
+		}
+
+	default:
+		return tendermintabci.ResponseQuery{
+			Code: CodeBadRequest,
+			Key:  query.Data,
+			Log:  fmt.Sprintf("bad request: unknown query path %q", query.Path),
+		}
 	}
 }
 
@@ -222,17 +423,13 @@ func (a *Application) BeginBlock(request tendermintabci.RequestBeginBlock) (resp
 // Invalid transactions can be rejected before they're persisted or gossiped.
 // This is an optimization step: simply returning OK won't affect correctness.
 func (a *Application) CheckTx(p []byte) (response tendermintabci.ResponseCheckTx) {
-	var (
-		key      string
-		old, new []byte
-	)
+	var tx Tx
 
 	defer func() {
 		level.Debug(a.logger).Log(
 			"abci", "CheckTx",
-			"key", key,
-			"old", string(old),
-			"new", string(new),
+			"ops", len(tx.Ops),
+			"keys", strings.Join(tx.Keys(), ","),
 			"ok", response.IsOK(),
 			"code", response.Code,
 			"gas_used", response.GasUsed,
@@ -246,7 +443,7 @@ func (a *Application) CheckTx(p []byte) (response tendermintabci.ResponseCheckTx
 		code uint32
 		log  string
 	)
-	key, old, new, code, log = parseTx(p)
+	tx, code, log = parseTx(p)
 	if code != tendermintabci.CodeTypeOK {
 		return tendermintabci.ResponseCheckTx{
 			Code: code,
@@ -256,9 +453,11 @@ func (a *Application) CheckTx(p []byte) (response tendermintabci.ResponseCheckTx
 	}
 
 	// Note this is mempool, not consensus.
-	if err := a.mempool.CompareAndSwap(key, old, new); err != nil {
+	err := a.mempool.Apply(tx.Ops)
+	a.metrics.CompareAndSwaps.With("state", "mempool", "success", strconv.FormatBool(err == nil)).Add(1)
+	if err != nil {
 		return tendermintabci.ResponseCheckTx{
-			Code: codeCASFailure,
+			Code: CodeCASFailure,
 			Log:  err.Error(),
 			// TODO(pb): Gas accounting
 		}
@@ -270,19 +469,16 @@ func (a *Application) CheckTx(p []byte) (response tendermintabci.ResponseCheckTx
 	}
 }
 
-// DeliverTx implements ABCI and is used for all writes.
+// DeliverTx implements ABCI and is used for all writes. Successful
+// transactions are tagged with each key they touch, under TagKey.
 func (a *Application) DeliverTx(p []byte) (response tendermintabci.ResponseDeliverTx) {
-	var (
-		key      string
-		old, new []byte
-	)
+	var tx Tx
 
 	defer func() {
 		level.Debug(a.logger).Log(
 			"abci", "DeliverTx",
-			"key", key,
-			"old", string(old),
-			"new", string(new),
+			"ops", len(tx.Ops),
+			"keys", strings.Join(tx.Keys(), ","),
 			"ok", response.IsOK(),
 			"code", response.Code,
 			"log", response.Log,
@@ -294,7 +490,7 @@ func (a *Application) DeliverTx(p []byte) (response tendermintabci.ResponseDeliv
 		code uint32
 		log  string
 	)
-	key, old, new, code, log = parseTx(p)
+	tx, code, log = parseTx(p)
 	if code != tendermintabci.CodeTypeOK {
 		return tendermintabci.ResponseDeliverTx{
 			Code: code,
@@ -304,16 +500,24 @@ func (a *Application) DeliverTx(p []byte) (response tendermintabci.ResponseDeliv
 	}
 
 	// Note this is consensus, not mempool.
-	if err := a.consensus.CompareAndSwap(key, old, new); err != nil {
+	err := a.consensus.Apply(tx.Ops)
+	a.metrics.CompareAndSwaps.With("state", "consensus", "success", strconv.FormatBool(err == nil)).Add(1)
+	if err != nil {
 		return tendermintabci.ResponseDeliverTx{
-			Code: codeCASFailure,
+			Code: CodeCASFailure,
 			Log:  err.Error(),
 			// TODO(pb): Gas accounting
 		}
 	}
 
+	var tags []tendermintcommon.KVPair
+	for _, key := range tx.Keys() {
+		tags = append(tags, tendermintcommon.KVPair{Key: []byte(TagKey), Value: []byte(key)})
+	}
+
 	return tendermintabci.ResponseDeliverTx{
 		Code: tendermintabci.CodeTypeOK,
+		Tags: tags,
 		// TODO(pb): Gas accounting
 	}
 }
@@ -334,8 +538,9 @@ func (a *Application) EndBlock(request tendermintabci.RequestEndBlock) (response
 	return tendermintabci.ResponseEndBlock{}
 }
 
-// Commit implements ABCI and persists the current state.
-// A hash of that state is returned to the caller, i.e. the Tendermint core machinery.
+// Commit implements ABCI and commits the current state, which is persisted in
+// the background. A hash of that state is returned to the caller, i.e. the
+// Tendermint core machinery.
 func (a *Application) Commit() (response tendermintabci.ResponseCommit) {
 	defer func() {
 		level.Debug(a.logger).Log(
@@ -344,33 +549,110 @@ func (a *Application) Commit() (response tendermintabci.ResponseCommit) {
 		)
 	}()
 
-	err := a.consensus.Commit(a.persist)
-	if err != nil {
-		panic(fmt.Sprintf("error: Commit failed: %v", err)) // TODO(pb): I guess Commit isn't allowed to fail?
-	}
+	begin := time.Now()
+	a.persister.persist(a.consensus.freeze())
 
 	// Tendermint expects mempool state to be equal to consensus state after a
 	// successful commit.
 	copyState(a.mempool, a.consensus)
 
+	a.metrics.CommitDuration.Observe(time.Since(begin).Seconds())
+	a.metrics.Keys.Set(float64(a.consensus.Len()))
+	a.stats = Stats{
+		Keys:           a.consensus.Len(),
+		Bytes:          a.consensus.Size(),
+		LastCommitTime: time.Now(),
+	}
+
+	// Log the app hash of every commit, so that if nodes ever disagree on it,
+	// their logs show at which height. Digests, which take time in the number
+	// of keys, are computed on request, from the retained states.
+	t := a.retainCommitted()
+	level.Info(a.logger).Log("height", t.height, "app_hash", fmt.Sprintf("%X", t.hash()), "keys", t.data.len())
+
 	return tendermintabci.ResponseCommit{
 		Data: a.consensus.Hash(),
 	}
 }
 
-func parseTx(p []byte) (key string, old, new []byte, code uint32, log string) {
-	tokens := bytes.SplitN(p, []byte{':'}, 3)
-	if len(tokens) != 3 {
-		return key, old, new, codeBadRequest, `bad request: tx data must be "<key>:<old>:<new>"`
+// Close waits for the last committed state to be persisted, and any snapshot
+// being built, and stops persisting. It returns the error of the last write,
+// if it failed. The application mustn't be used afterwards.
+func (a *Application) Close() error {
+	a.snapshots.wait()
+	return a.persister.close()
+}
+
+// State returns a copy of the consensus state, which costs nothing, as the
+// state is persistent. Between blocks, it's the state of the last commit.
+func (a *Application) State() *State {
+	s := NewState()
+	copyState(s, a.consensus)
+	return s
+}
+
+// retainCommitted retains the state at the time of the last commit, forgets
+// the oldest retained state if need be, and returns the committed state.
+func (a *Application) retainCommitted() *merkleTree {
+	t := a.consensus.committed()
+	a.retained = append(a.retained, t)
+	keep := a.retain
+	if keep < 1 {
+		keep = 1
+	}
+	if n := len(a.retained) - keep; n > 0 {
+		a.retained = append(a.retained[:0], a.retained[n:]...)
+	}
+	return t
+}
+
+// retainedAt returns the retained state at the height, or the latest, if the
+// height is 0, or nil if it isn't retained.
+func (a *Application) retainedAt(height int64) *merkleTree {
+	if height == 0 {
+		return a.retained[len(a.retained)-1]
+	}
+	for _, t := range a.retained {
+		if t.height == height {
+			return t
+		}
+	}
+	return nil
+}
+
+func parseTx(p []byte) (tx Tx, code uint32, log string) {
+	tx, err := DecodeTx(p)
+	if err != nil {
+		return tx, CodeBadRequest, err.Error()
 	}
-	return string(tokens[0]), tokens[1], tokens[2], tendermintabci.CodeTypeOK, log
+	return tx, tendermintabci.CodeTypeOK, log
 }
 
+// Response codes returned by the application, in addition to
+// tendermintabci.CodeTypeOK.
 const (
-	codeBadRequest = 513 // arbitrary non-zero
-	codeCASFailure = 514 // arbitrary non-zero
+	CodeBadRequest      = 513 // arbitrary non-zero
+	CodeCASFailure      = 514 // arbitrary non-zero
+	CodeKeyNotFound     = 515 // arbitrary non-zero
+	CodeHeightNotFound  = 516 // arbitrary non-zero
+	CodeSnapshotPending = 517 // arbitrary non-zero
 )
 
+// Query paths understood by the application.
+const (
+	QueryPathKey        = "/key"
+	QueryPathList       = "/list"
+	QueryPathDigest     = "/digest"
+	QueryPathDigestKeys = "/digest/keys"
+
+	QueryPathSnapshot      = "/snapshot"
+	QueryPathSnapshotChunk = "/snapshot/chunk"
+)
+
+// TagKey is the DeliverTx tag under which the keys touched by a successful
+// transaction are recorded, e.g. for indexing or event subscriptions.
+const TagKey = "cas.key"
+
 func newNopWriteCloser(w io.Writer) io.WriteCloser {
 	return writeCloser{Writer: w, Closer: nopCloser}
 }
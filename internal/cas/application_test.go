@@ -23,6 +23,9 @@ func TestApplicationPersistLoad(t *testing.T) {
 		a.Commit()
 		a.BeginBlock(tendermintabci.RequestBeginBlock{})
 		a.DeliverTx([]byte("a:three:four")) // delivered but not persisted
+		if err := a.Close(); err != nil {
+			t.Fatalf("Close: %v", err)
+		}
 	}
 
 	// Load a new application from that persisted buffer.
@@ -42,3 +45,28 @@ func TestApplicationPersistLoad(t *testing.T) {
 		}
 	}
 }
+
+func TestApplicationState(t *testing.T) {
+	a, _ := NewApplication(nil, nil, log.NewNopLogger())
+	defer a.Close()
+	a.BeginBlock(tendermintabci.RequestBeginBlock{})
+	a.DeliverTx([]byte("a::one"))
+	a.EndBlock(tendermintabci.RequestEndBlock{})
+	hash := a.Commit().Data
+	s := a.State()
+
+	// The copy is of the state as it was, however the application goes on.
+	a.BeginBlock(tendermintabci.RequestBeginBlock{})
+	a.DeliverTx([]byte("a:one:two"))
+	a.EndBlock(tendermintabci.RequestEndBlock{})
+	a.Commit()
+	if want, have := int64(1), s.Commits(); want != have {
+		t.Errorf("Commits: want %d, have %d", want, have)
+	}
+	if want, have := hash, s.Hash(); !bytes.Equal(want, have) {
+		t.Errorf("Hash: want %X, have %X", want, have)
+	}
+	if value, err := s.Get("a"); err != nil || string(value) != "one" {
+		t.Errorf("Get(a): want %q, have %q, %v", "one", value, err)
+	}
+}
@@ -0,0 +1,108 @@
+package cas
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	tendermintcommon "github.com/tendermint/tendermint/libs/common"
+)
+
+// If nodes compute different app hashes, Tendermint halts, without saying
+// which keys differ. Digests help narrow them down. A digest describes the
+// keys with a given prefix at a height, split into buckets by the character
+// after the prefix, so comparing the digests of two nodes shows which buckets
+// differ, and comparing the digests of those buckets' prefixes narrows it
+// down further, until there are few enough keys to compare one by one.
+
+// Digest describes the keys with a prefix in the state at a height. It has
+// either buckets or, if asked for, every key. A digest with buckets also has
+// the key equal to the prefix, if there is one.
+type Digest struct {
+	Height  int64                     `json:"height"`
+	Prefix  string                    `json:"prefix"`
+	Count   int                       `json:"count"`
+	Hash    tendermintcommon.HexBytes `json:"hash"`
+	Buckets []Bucket                  `json:"buckets,omitempty"`
+	Keys    []KeyHash                 `json:"keys,omitempty"`
+}
+
+// Bucket describes the keys in a digest with a longer prefix: the digest's
+// prefix and one more character. A bucket with the same prefix as its digest holds
+// just the key equal to the prefix, if there is one.
+type Bucket struct {
+	Prefix string                    `json:"prefix"`
+	Count  int                       `json:"count"`
+	Hash   tendermintcommon.HexBytes `json:"hash"`
+}
+
+// KeyHash is a key, and the hash of its value.
+type KeyHash struct {
+	Key       string                    `json:"key"`
+	ValueHash tendermintcommon.HexBytes `json:"value_hash"`
+}
+
+// digest returns the digest of the keys with the prefix, with either their
+// buckets or, if keys is true, the keys themselves.
+func (t *merkleTree) digest(prefix string, keys bool) Digest {
+	nodes := t.prefixRange(prefix)
+	d := Digest{
+		Height: t.height,
+		Prefix: prefix,
+		Count:  len(nodes),
+		Hash:   hashLeaves(nodes),
+	}
+	if keys {
+		for _, n := range nodes {
+			d.Keys = append(d.Keys, KeyHash{Key: n.key, ValueHash: valueHash(n.value)})
+		}
+		return d
+	}
+	for i := 0; i < len(nodes); {
+		bucket := prefix
+		if key := nodes[i].key; len(key) > len(prefix) {
+			_, size := utf8.DecodeRuneInString(key[len(prefix):])
+			bucket = key[:len(prefix)+size]
+		}
+		j := i + 1
+		if bucket == prefix {
+			d.Keys = append(d.Keys, KeyHash{Key: nodes[i].key, ValueHash: valueHash(nodes[i].value)})
+		} else {
+			j = i + sort.Search(len(nodes)-i, func(n int) bool { return !strings.HasPrefix(nodes[i+n].key, bucket) })
+		}
+		d.Buckets = append(d.Buckets, Bucket{Prefix: bucket, Count: j - i, Hash: hashLeaves(nodes[i:j])})
+		i = j
+	}
+	return d
+}
+
+// prefixRange returns the nodes of the keys with the prefix, in key order.
+func (t *merkleTree) prefixRange(prefix string) []*treapNode {
+	var nodes []*treapNode
+	t.data.ascend(t.data.rank(prefix), func(n *treapNode) bool {
+		if !strings.HasPrefix(n.key, prefix) {
+			return false
+		}
+		nodes = append(nodes, n)
+		return true
+	})
+	return nodes
+}
+
+func hashLeaves(nodes []*treapNode) []byte {
+	hasher := newHasher()
+	for _, n := range nodes {
+		hasher.Write(n.leaf)
+	}
+	return hasher.Sum(nil)
+}
+
+// String returns a compact summary of the digest's buckets, for logging.
+func (d Digest) String() string {
+	buckets := make([]string, len(d.Buckets))
+	for i, b := range d.Buckets {
+		buckets[i] = fmt.Sprintf("%q:%d:%X", b.Prefix, b.Count, b.Hash[:4])
+	}
+	return strings.Join(buckets, " ")
+}
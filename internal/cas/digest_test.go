@@ -0,0 +1,67 @@
+package cas
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestDigest(t *testing.T) {
+	newTree := func(kvs ...string) *merkleTree {
+		data := map[string][]byte{}
+		for i := 0; i < len(kvs); i += 2 {
+			data[kvs[i]] = []byte(kvs[i+1])
+		}
+		return newMerkleTree(1, newTreap(data))
+	}
+	var (
+		a = newTree("a", "1", "ab", "2", "ac", "3", "b", "4", "é", "5", "éa", "6")
+		b = newTree("a", "1", "ab", "2", "ac", "X", "b", "4", "é", "5", "éa", "6")
+	)
+
+	da, db := a.digest("", false), b.digest("", false)
+	if want, have := 6, da.Count; want != have {
+		t.Errorf("Count: want %d, have %d", want, have)
+	}
+	if bytes.Equal(da.Hash, db.Hash) {
+		t.Errorf("Hash: want different hashes, have the same")
+	}
+	if want, have := []string{"a", "b", "é"}, bucketPrefixes(da); !reflect.DeepEqual(want, have) {
+		t.Errorf("Buckets: want %q, have %q", want, have)
+	}
+	for i := range da.Buckets {
+		if want, have := da.Buckets[i].Prefix != "a", bytes.Equal(da.Buckets[i].Hash, db.Buckets[i].Hash); want != have {
+			t.Errorf("Bucket %q: want equal %v, have %v", da.Buckets[i].Prefix, want, have)
+		}
+	}
+
+	// Narrowing down to the bucket that differs finds the exact key "a", and
+	// the buckets of the rest.
+	da = a.digest("a", false)
+	if want, have := []string{"a", "ab", "ac"}, bucketPrefixes(da); !reflect.DeepEqual(want, have) {
+		t.Errorf("Buckets: want %q, have %q", want, have)
+	}
+	if want, have := 1, len(da.Keys); want != have || da.Keys[0].Key != "a" {
+		t.Errorf("Keys: want just %q, have %v", "a", da.Keys)
+	}
+
+	da = a.digest("a", true)
+	if want, have := 3, len(da.Keys); want != have {
+		t.Errorf("Keys: want %d, have %d", want, have)
+	}
+	if want, have := 0, len(da.Buckets); want != have {
+		t.Errorf("Buckets: want %d, have %d", want, have)
+	}
+
+	if want, have := 0, a.digest("nope", false).Count; want != have {
+		t.Errorf("Count: want %d, have %d", want, have)
+	}
+}
+
+func bucketPrefixes(d Digest) []string {
+	var prefixes []string
+	for _, b := range d.Buckets {
+		prefixes = append(prefixes, b.Prefix)
+	}
+	return prefixes
+}
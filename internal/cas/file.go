@@ -0,0 +1,157 @@
+package cas
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+// The state is persisted as a stream that's written from a committed state,
+// and read back into one, a key at a time, so that neither needs much more
+// memory than the state itself, and the app hash is checked as it's read.
+//
+// The stream is compressed with Snappy's framing format, which checksums each
+// frame. Uncompressed, it holds the following, where U(x) is x as an unsigned
+// varint (as encoding/binary's PutUvarint writes it), and B(x) is defined in
+// hash.go.
+//
+//   - The magic bytes "cas-state", and U(version).
+//   - U(height), U(number of keys), and B(app hash).
+//   - B(key) || B(value) for each key, in ascending order.
+//
+// The treap of the keys, which is also the Merkle tree of the app hash, is
+// built as they're read, and hashed, and checked against the app hash, at the
+// end.
+//
+// Earlier versions wrote a JSON object, whose state belongs to a chain with an
+// app hash of another definition, so it's refused.
+
+const (
+	stateFileMagic   = "cas-state"
+	stateFileVersion = 1
+
+	// maxStateFieldSize is the largest key or value a state file can hold. It
+	// stops a corrupt length from allocating without limit.
+	maxStateFieldSize = 1 << 30
+
+	// stateFieldChunk is how much of a field is allocated before it's read. A
+	// longer field is allocated as it's read, so a corrupt length can't
+	// allocate much more than the file holds.
+	stateFieldChunk = 1 << 16
+)
+
+// ErrInvalidStateFile is returned when a state fails to restore.
+var ErrInvalidStateFile = errors.New("invalid state file")
+
+// writeStateFile writes the committed state t to w.
+func writeStateFile(w io.Writer, t *merkleTree) error {
+	sw := snappy.NewBufferedWriter(w)
+	sw.Write([]byte(stateFileMagic))
+	writeUvarint(sw, stateFileVersion)
+	writeUvarint(sw, uint64(t.height))
+	writeUvarint(sw, uint64(t.data.len()))
+	writeBytes(sw, t.hash())
+	t.data.ascend(0, func(n *treapNode) bool {
+		writeBytes(sw, []byte(n.key))
+		writeBytes(sw, n.value)
+		return true
+	})
+	return sw.Close() // returns the first error
+}
+
+// readStateFile reads a committed state from r, calling progress with the
+// number of keys read so far, and the total, after each key.
+func readStateFile(r io.Reader, progress func(read, total int)) (*merkleTree, error) {
+	br := bufio.NewReader(r)
+	if b, err := br.Peek(1); err == nil && b[0] == '{' {
+		return nil, fmt.Errorf("%v: JSON state from an incompatible version; start the chain again from genesis", ErrInvalidStateFile)
+	}
+
+	br = bufio.NewReader(snappy.NewReader(br))
+	magic := make([]byte, len(stateFileMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != stateFileMagic {
+		return nil, fmt.Errorf("%v: not a state file", ErrInvalidStateFile)
+	}
+	var (
+		version, height, total uint64
+		appHash                []byte
+		err                    error
+	)
+	for _, field := range []*uint64{&version, &height, &total} {
+		if err == nil {
+			*field, err = binary.ReadUvarint(br)
+		}
+	}
+	if err == nil {
+		appHash, err = readField(br)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: header: %v", ErrInvalidStateFile, err)
+	}
+	if version != stateFileVersion {
+		return nil, fmt.Errorf("%v: version %d, want %d", ErrInvalidStateFile, version, stateFileVersion)
+	}
+	if int(total) < 0 || uint64(int(total)) != total {
+		return nil, fmt.Errorf("%v: %d keys", ErrInvalidStateFile, total)
+	}
+
+	var (
+		data treapBuilder
+		last string // key
+	)
+	for read := 0; read < int(total); read++ {
+		key, err := readField(br)
+		if err != nil {
+			return nil, fmt.Errorf("%v: key %d: %v", ErrInvalidStateFile, read, err)
+		}
+		value, err := readField(br)
+		if err != nil {
+			return nil, fmt.Errorf("%v: key %q: %v", ErrInvalidStateFile, key, err)
+		}
+		if read > 0 && string(key) <= last {
+			return nil, fmt.Errorf("%v: key %q out of order", ErrInvalidStateFile, key)
+		}
+		last = data.add(string(key), value).key
+		progress(read+1, int(total))
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		return nil, fmt.Errorf("%v: more than %d keys", ErrInvalidStateFile, total)
+	}
+	t := newMerkleTree(int64(height), data.treap())
+	if !bytes.Equal(t.hash(), appHash) {
+		return nil, fmt.Errorf("%v: app hash %X, want %X", ErrInvalidStateFile, t.hash(), appHash)
+	}
+	return t, nil
+}
+
+// readField reads B(x), and returns x.
+func readField(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxStateFieldSize {
+		return nil, fmt.Errorf("field of %d bytes", n)
+	}
+	if n > stateFieldChunk {
+		var buf bytes.Buffer
+		buf.Grow(stateFieldChunk)
+		if _, err := io.CopyN(&buf, r, int64(n)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
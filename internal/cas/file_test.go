@@ -0,0 +1,185 @@
+package cas
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func TestStateFile(t *testing.T) {
+	for _, keys := range []int{0, 1, 3, 10000} {
+		t.Run(fmt.Sprint(keys), func(t *testing.T) {
+			s := NewState()
+			for i := 0; i < keys; i++ {
+				if err := s.CompareAndSwap(fmt.Sprintf("k%05d", i), nil, bytes.Repeat([]byte{byte(i)}, i%50)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if keys > 0 {
+				if err := s.CompareAndSwap("", nil, nil); err != nil {
+					t.Fatal(err)
+				}
+				if err := s.CompareAndSwap("large", nil, bytes.Repeat([]byte{1}, 3*stateFieldChunk+1)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var buf bytes.Buffer
+			if err := s.Commit(newNopWriteCloser(&buf)); err != nil {
+				t.Fatal(err)
+			}
+			if want, have := int64(buf.Len()), s.Size(); want != have {
+				t.Errorf("Size: want %d, have %d", want, have)
+			}
+
+			restored := NewState()
+			if err := restored.Restore(bytes.NewReader(buf.Bytes())); err != nil {
+				t.Fatal(err)
+			}
+			if want, have := int64(1), restored.Commits(); want != have {
+				t.Errorf("Commits: want %d, have %d", want, have)
+			}
+			if want, have := s.Hash(), restored.Hash(); !bytes.Equal(want, have) {
+				t.Errorf("Hash: want %X, have %X", want, have)
+			}
+			want, have := s.List(""), restored.List("")
+			if len(want) != len(have) {
+				t.Fatalf("List: want %d keys, have %d", len(want), len(have))
+			}
+			for i := range want {
+				if want[i].Key != have[i].Key || !bytes.Equal(want[i].Value, have[i].Value) {
+					t.Fatalf("List: want %q at %d, have %q", want[i], i, have[i])
+				}
+			}
+			checkHeap(t, "restored", restored.data)
+
+			var progress []int
+			if _, err := readStateFile(bytes.NewReader(buf.Bytes()), func(read, total int) {
+				if total != s.Len() {
+					t.Fatalf("progress: want total %d, have %d", s.Len(), total)
+				}
+				progress = append(progress, read)
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if want, have := s.Len(), len(progress); want != have {
+				t.Errorf("progress: want %d calls, have %d", want, have)
+			}
+
+			// Save writes the last commit, not any changes since.
+			if err := s.CompareAndSwap("uncommitted", nil, []byte("x")); err != nil {
+				t.Fatal(err)
+			}
+			var saved bytes.Buffer
+			if err := s.Save(&saved); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), saved.Bytes()) {
+				t.Errorf("Save: differs from Commit")
+			}
+		})
+	}
+}
+
+func TestStateFileJSON(t *testing.T) {
+	// As earlier versions wrote it.
+	buf := bytes.NewBufferString(`{"data":{"a":"MQ=="},"commit_count":3}`)
+	err := NewState().Restore(buf)
+	if err == nil || !strings.Contains(err.Error(), "incompatible version") {
+		t.Fatalf("want an error about an incompatible version, have %v", err)
+	}
+}
+
+func TestStateFileInvalid(t *testing.T) {
+	valid := rawStateFile{
+		magic:   stateFileMagic,
+		version: stateFileVersion,
+		height:  7,
+		kvs:     [][2]string{{"a", "1"}, {"b", "2"}, {"c", "3"}},
+	}
+	valid.keys = uint64(len(valid.kvs))
+	valid.hash = newMerkleTree(0, newTreap(map[string][]byte{"a": []byte("1"), "b": []byte("2"), "c": []byte("3")})).hash()
+	if err := NewState().Restore(bytes.NewReader(valid.bytes())); err != nil {
+		t.Fatalf("valid: %v", err)
+	}
+
+	for name, corrupt := range map[string]func(*rawStateFile){
+		"magic":     func(f *rawStateFile) { f.magic = "cas-stat" },
+		"version":   func(f *rawStateFile) { f.version++ },
+		"hash":      func(f *rawStateFile) { f.hash = valueHash(nil) },
+		"value":     func(f *rawStateFile) { f.kvs[1][1] = "x" },
+		"order":     func(f *rawStateFile) { f.kvs[0], f.kvs[1] = f.kvs[1], f.kvs[0] },
+		"duplicate": func(f *rawStateFile) { f.kvs[1] = f.kvs[0] },
+		"missing":   func(f *rawStateFile) { f.kvs = f.kvs[:2] },
+		"extra":     func(f *rawStateFile) { f.kvs = append(f.kvs, [2]string{"d", "4"}) },
+		"trailing":  func(f *rawStateFile) { f.trailing = []byte{0} },
+		"keys":      func(f *rawStateFile) { f.keys = 1 << 63 },
+	} {
+		t.Run(name, func(t *testing.T) {
+			f := valid
+			f.kvs = append([][2]string{}, valid.kvs...)
+			corrupt(&f)
+			if err := NewState().Restore(bytes.NewReader(f.bytes())); err == nil {
+				t.Errorf("want error, have none")
+			}
+		})
+	}
+
+	// A corrupt length allocates as much as the file holds, not as it says.
+	t.Run("length", func(t *testing.T) {
+		var buf bytes.Buffer
+		w := snappy.NewBufferedWriter(&buf)
+		w.Write([]byte(stateFileMagic))
+		for _, x := range []uint64{stateFileVersion, 7, 1, maxStateFieldSize} {
+			writeUvarint(w, x)
+		}
+		w.Close()
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if err := NewState().Restore(bytes.NewReader(buf.Bytes())); err == nil {
+			t.Errorf("want error, have none")
+		}
+		runtime.ReadMemStats(&after)
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Errorf("%d byte file: want at most 1 MiB allocated, have %d bytes", buf.Len(), allocated)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		b := valid.bytes()
+		for i := 0; i < len(b); i++ {
+			if err := NewState().Restore(bytes.NewReader(b[:i])); err == nil {
+				t.Fatalf("%d of %d bytes: want error, have none", i, len(b))
+			}
+		}
+	})
+}
+
+// rawStateFile is the contents of a state file, which needn't be valid.
+type rawStateFile struct {
+	magic                 string
+	version, height, keys uint64
+	hash                  []byte
+	kvs                   [][2]string
+	trailing              []byte
+}
+
+func (f rawStateFile) bytes() []byte {
+	var buf bytes.Buffer
+	w := snappy.NewBufferedWriter(&buf)
+	w.Write([]byte(f.magic))
+	writeUvarint(w, f.version)
+	writeUvarint(w, f.height)
+	writeUvarint(w, f.keys)
+	writeBytes(w, f.hash)
+	for _, kv := range f.kvs {
+		writeBytes(w, []byte(kv[0]))
+		writeBytes(w, []byte(kv[1]))
+	}
+	w.Write(f.trailing)
+	w.Close()
+	return buf.Bytes()
+}
@@ -0,0 +1,138 @@
+//go:build gofuzz
+// +build gofuzz
+
+package cas
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/go-kit/kit/log"
+	tendermintabci "github.com/tendermint/tendermint/abci/types"
+)
+
+// Fuzz functions for go-fuzz (github.com/dvyukov/go-fuzz), of the inputs that
+// come from the network, or from disk. Each is built and run separately, with
+// its own corpus, seeded in testdata/fuzz, e.g.
+//
+//   go-fuzz-build -func FuzzTx ./internal/cas
+//   go-fuzz -bin cas-fuzz.zip -workdir internal/cas/testdata/fuzz/tx
+//
+// They panic if an invariant doesn't hold, and return 1 for inputs that are
+// valid, which go-fuzz prefers, and 0 for the rest.
+
+// FuzzTx decodes a transaction, as CheckTx and DeliverTx do, and checks that
+// it's valid, or a legacy transaction of the empty key, and that it encodes to
+// a transaction that decodes to the same.
+func FuzzTx(data []byte) int {
+	tx, code, reason := parseTx(data)
+	if code != tendermintabci.CodeTypeOK {
+		if reason == "" {
+			panic("invalid transaction without a log")
+		}
+		return 0
+	}
+	if err := tx.Validate(); err != nil {
+		// Only a legacy transaction may be invalid, and only by having an
+		// empty key, which Encode can't express.
+		if len(tx.Ops) != 1 || tx.Ops[0].Key != "" {
+			panic(fmt.Sprintf("decoded an invalid transaction: %v", err))
+		}
+		return 1
+	}
+	encoded := tx.Encode()
+	again, err := DecodeTx(encoded)
+	if err != nil {
+		panic(fmt.Sprintf("decoding %q: %v", encoded, err))
+	}
+	if !bytes.Equal(encoded, again.Encode()) {
+		panic(fmt.Sprintf("%q decoded and encoded as %q", encoded, again.Encode()))
+	}
+	if len(tx.Keys()) == 0 || len(tx.Keys()) > len(tx.Ops) {
+		panic(fmt.Sprintf("%d key(s) in %d operation(s)", len(tx.Keys()), len(tx.Ops)))
+	}
+	return 1
+}
+
+// FuzzRestore restores a state file, and checks that a state that fails to
+// restore is unchanged, and that one that restores is saved as a file that
+// restores to the same state, and is saved as the same file.
+func FuzzRestore(data []byte) int {
+	s := NewState()
+	if err := s.Restore(bytes.NewReader(data)); err != nil {
+		if s.Len() != 0 || s.Commits() != 0 || !bytes.Equal(s.Hash(), NewState().Hash()) {
+			panic(fmt.Sprintf("state changed by a failed restore: %v", err))
+		}
+		return 0
+	}
+	var saved bytes.Buffer
+	if err := s.Save(&saved); err != nil {
+		panic(err)
+	}
+	again := NewState()
+	if err := again.Restore(bytes.NewReader(saved.Bytes())); err != nil {
+		panic(fmt.Sprintf("restoring a saved state: %v", err))
+	}
+	if again.Len() != s.Len() || again.Commits() != s.Commits() || !bytes.Equal(again.Hash(), s.Hash()) {
+		panic(fmt.Sprintf("restored %d key(s) at height %d with hash %X, saved %d at %d with %X", again.Len(), again.Commits(), again.Hash(), s.Len(), s.Commits(), s.Hash()))
+	}
+	var resaved bytes.Buffer
+	if err := again.Save(&resaved); err != nil {
+		panic(err)
+	}
+	if !bytes.Equal(saved.Bytes(), resaved.Bytes()) {
+		panic("a restored state saved differently")
+	}
+	return 1
+}
+
+// FuzzApplication runs blocks of transactions, one per line, with blocks
+// separated by empty lines, through two applications: one checks each block's
+// transactions before they're delivered, as a proposer would, and the other
+// only delivers them. It checks that CheckTx and DeliverTx agree on every
+// transaction, and that checking doesn't affect the committed state.
+func FuzzApplication(data []byte) int {
+	checked, err := NewApplication(nil, nil, log.NewNopLogger())
+	if err != nil {
+		panic(err)
+	}
+	defer checked.Close()
+	delivered, err := NewApplication(nil, nil, log.NewNopLogger())
+	if err != nil {
+		panic(err)
+	}
+	defer delivered.Close()
+
+	valid := 0
+	for height, block := range bytes.Split(data, []byte("\n\n")) {
+		txs := bytes.Split(block, []byte("\n"))
+		checks := make([]uint32, len(txs))
+		for i, tx := range txs {
+			checks[i] = checked.CheckTx(tx).Code
+		}
+		header := tendermintabci.Header{Height: int64(height + 1), NumTxs: int64(len(txs))}
+		checked.BeginBlock(tendermintabci.RequestBeginBlock{Header: header})
+		delivered.BeginBlock(tendermintabci.RequestBeginBlock{Header: header})
+		for i, tx := range txs {
+			code := checked.DeliverTx(tx).Code
+			if code != checks[i] {
+				panic(fmt.Sprintf("transaction %q: CheckTx returned %d, DeliverTx %d", tx, checks[i], code))
+			}
+			if other := delivered.DeliverTx(tx).Code; other != code {
+				panic(fmt.Sprintf("transaction %q: DeliverTx returned %d after CheckTx, %d without", tx, code, other))
+			}
+			if code == tendermintabci.CodeTypeOK {
+				valid++
+			}
+		}
+		checked.EndBlock(tendermintabci.RequestEndBlock{Height: header.Height})
+		delivered.EndBlock(tendermintabci.RequestEndBlock{Height: header.Height})
+		if a, b := checked.Commit().Data, delivered.Commit().Data; !bytes.Equal(a, b) {
+			panic(fmt.Sprintf("height %d: app hash %X after CheckTx, %X without", header.Height, a, b))
+		}
+	}
+	if valid == 0 {
+		return 0
+	}
+	return 1
+}
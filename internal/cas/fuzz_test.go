@@ -0,0 +1,153 @@
+//go:build gofuzz
+// +build gofuzz
+
+package cas
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestFuzzCorpus runs each fuzz function on every input in its corpus, which
+// includes the seeds, and whatever go-fuzz has added, so that inputs that once
+// failed keep being checked, without go-fuzz, e.g.
+//
+//   go test -tags gofuzz -run Fuzz ./internal/cas
+//
+// With -fuzz.update, it writes the seeds to the corpora first.
+
+var fuzzUpdate = flag.Bool("fuzz.update", false, "write the seed corpora in testdata/fuzz")
+
+func TestFuzzCorpus(t *testing.T) {
+	for _, target := range []struct {
+		name  string
+		fuzz  func([]byte) int
+		seeds func(t *testing.T) [][]byte
+	}{
+		{"tx", FuzzTx, txSeeds},
+		{"restore", FuzzRestore, restoreSeeds},
+		{"application", FuzzApplication, applicationSeeds},
+	} {
+		t.Run(target.name, func(t *testing.T) {
+			dir := filepath.Join("testdata", "fuzz", target.name, "corpus")
+			if *fuzzUpdate {
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				for _, seed := range target.seeds(t) {
+					name := filepath.Join(dir, fmt.Sprintf("%x", sha1.Sum(seed))) // as go-fuzz names them
+					if err := ioutil.WriteFile(name, seed, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			files, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var valid int
+			for _, f := range files {
+				data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				func() {
+					defer func() {
+						if r := recover(); r != nil {
+							t.Errorf("%s: %v", f.Name(), r)
+						}
+					}()
+					valid += target.fuzz(data)
+				}()
+			}
+			if valid == 0 {
+				t.Errorf("none of the %d input(s) is valid", len(files))
+			}
+		})
+	}
+}
+
+func txSeeds(t *testing.T) [][]byte {
+	return [][]byte{
+		SetTx("a", nil, []byte("one")).Encode(),
+		SetTx("a", []byte("one"), []byte("two")).Encode(),
+		DeleteTx("a", []byte("two")).Encode(),
+		Tx{Ops: []Op{
+			{Type: OpCheck, Key: "a", Old: []byte("one")},
+			{Type: OpSet, Key: "b", New: []byte("two")},
+			{Type: OpDelete, Key: "c", Old: []byte("three")},
+			{Type: OpSet, Key: "b", Old: []byte("two"), New: []byte("four")},
+		}}.Encode(),
+		[]byte("a::one"),
+		[]byte("a:one:two:three"),
+		[]byte(encodedTx(`{"ops":[]}`)),
+		[]byte(encodedTx(`{"ops":[{"op":"check","key":"a","new":"b25l"}]}`)),
+		[]byte(encodedTx(`{"ops":[{"op":"swap","key":"a"}]}`)),
+		[]byte(encodedTx(`{"ops":[{"op":"set","key":""}]}`)),
+		[]byte(`{"ops":[{"op":"set","key":"a"}]}`),
+		[]byte("::one"),
+		[]byte("a:one"),
+		[]byte(""),
+	}
+}
+
+func restoreSeeds(t *testing.T) [][]byte {
+	empty := NewState()
+	s := NewState()
+	for _, ops := range [][]Op{
+		{{Type: OpSet, Key: "a", New: []byte("one")}},
+		{{Type: OpSet, Key: "b", New: []byte("two")}, {Type: OpSet, Key: "c:d", New: []byte{0, 1, 2}}},
+		{{Type: OpDelete, Key: "a", Old: []byte("one")}},
+	} {
+		if err := s.Apply(ops); err != nil {
+			t.Fatal(err)
+		}
+		s.freeze()
+	}
+	var seeds [][]byte
+	for _, state := range []*State{empty, s} {
+		var buf bytes.Buffer
+		if err := state.Save(&buf); err != nil {
+			t.Fatal(err)
+		}
+		seeds = append(seeds, buf.Bytes())
+	}
+	return append(seeds,
+		seeds[1][:len(seeds[1])/2],
+		rawStateFile{magic: stateFileMagic, version: stateFileVersion, keys: 1 << 63}.bytes(),
+		rawStateFile{magic: stateFileMagic, version: stateFileVersion, keys: 1, trailing: []byte{0x80, 0x80, 0x80, 0x80, 0x04}}.bytes(),
+		[]byte(`{"data":{"a":"b25l","b":""},"commit_count":3}`),
+		[]byte("cas-state"),
+	)
+}
+
+func applicationSeeds(t *testing.T) [][]byte {
+	block := func(txs ...[]byte) []byte { return bytes.Join(txs, []byte("\n")) }
+	blocks := func(blocks ...[]byte) []byte { return bytes.Join(blocks, []byte("\n\n")) }
+	return [][]byte{
+		blocks(
+			block(SetTx("a", nil, []byte("one")).Encode(), SetTx("a", nil, []byte("two")).Encode()),
+			block(SetTx("a", []byte("one"), []byte("two")).Encode(), DeleteTx("a", []byte("two")).Encode()),
+			block([]byte("b::three"), []byte("b:three:four"), []byte("b:three:five")),
+		),
+		blocks(
+			block(Tx{Ops: []Op{
+				{Type: OpSet, Key: "a", New: []byte("one")},
+				{Type: OpCheck, Key: "a", Old: []byte("one")},
+				{Type: OpSet, Key: "b", New: []byte("two")},
+			}}.Encode()),
+			block(Tx{Ops: []Op{
+				{Type: OpCheck, Key: "a", Old: []byte("one")},
+				{Type: OpDelete, Key: "b", Old: []byte("wrong")},
+			}}.Encode(), DeleteTx("b", []byte("two")).Encode()),
+		),
+		blocks(block([]byte("malformed"), []byte(encodedTx(`{"ops":[]}`)), []byte("a::one"), []byte("::two"))),
+	}
+}
@@ -0,0 +1,105 @@
+package cas
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"io"
+)
+
+// The app hash is part of consensus, so every node must compute it from the
+// same state in the same way, whatever versions of Go and Tendermint they were
+// built with. It's defined here, from first principles, rather than by the
+// storage format or any library, as follows.
+//
+// H(x) is the first 20 bytes of the SHA-256 of x, U(n) is the unsigned integer
+// n as a varint (as encoding/binary's PutUvarint writes it), and B(x) is the
+// byte string x, prefixed with U(its length). Keys are UTF-8 strings, compared
+// as bytes, and a value may be empty.
+//
+//   - The hash of a value v is H(v).
+//   - The leaf of a key k with value v is H(0x00 || B(k) || B(H(v))).
+//   - The priority of a key k is the first 8 bytes of SHA-256(k), as a
+//     big-endian unsigned integer.
+//   - The keys form a treap: its root is the key with the highest priority,
+//     or, of keys with equal priorities, the least. The keys less than the
+//     root form its left subtree, and the keys greater than it its right
+//     subtree, each a treap of the same kind.
+//   - The hash of a treap with no keys is empty. The hash of a treap of n keys
+//     is H(0x01 || U(n) || B(left) || B(leaf) || B(right)), where leaf is the
+//     leaf of its root, and left and right are the hashes of its subtrees.
+//
+// The app hash is the hash of the treap of every key in the state. Nothing
+// else is covered, including the commit count, which is only stored. The
+// shape of the treap depends only on its keys, so the app hash does too, but
+// setting or deleting a key changes the hashes of only the O(log n) nodes on
+// the path to it. The prefixes keep a leaf from being taken for a node, or a
+// node for a leaf, and U(n) binds the number of keys, so a proof (proof.go)
+// can't misstate either. The golden vectors in hash_test.go fix the
+// definition, which must not change.
+
+// hashSize is the size of every hash, in bytes.
+const hashSize = 20
+
+func newHasher() hash.Hash {
+	return truncatedHasher{sha256.New()}
+}
+
+type truncatedHasher struct{ hash.Hash }
+
+func (h truncatedHasher) Sum(b []byte) []byte {
+	return h.Hash.Sum(b)[:len(b)+hashSize]
+}
+
+func (h truncatedHasher) Size() int {
+	return hashSize
+}
+
+// valueHash returns H(value).
+func valueHash(value []byte) []byte {
+	sum := sha256.Sum256(value)
+	return sum[:hashSize]
+}
+
+// Leaves and nodes are hashed with different prefixes, so that neither can be
+// passed off as the other in a proof.
+const (
+	leafPrefix = 0x00
+	nodePrefix = 0x01
+)
+
+// leafHash returns H(0x00 || B(key) || B(valueHash)).
+func leafHash(key string, valueHash []byte) []byte {
+	var buf [64]byte
+	sum := sha256.Sum256(appendBytes(appendBytes(append(buf[:0], leafPrefix), []byte(key)), valueHash))
+	return sum[:hashSize]
+}
+
+// nodeHash returns H(0x01 || U(size) || B(left) || B(leaf) || B(right)).
+func nodeHash(size int, left, leaf, right []byte) []byte {
+	var buf [1 + binary.MaxVarintLen64 + 3*(1+hashSize)]byte
+	p := append(buf[:0], nodePrefix)
+	p = p[:len(p)+binary.PutUvarint(buf[len(p):], uint64(size))]
+	sum := sha256.Sum256(appendBytes(appendBytes(appendBytes(p, left), leaf), right))
+	return sum[:hashSize]
+}
+
+// writeUvarint writes U(x).
+func writeUvarint(w io.Writer, x uint64) {
+	var n [binary.MaxVarintLen64]byte
+	w.Write(n[:binary.PutUvarint(n[:], x)])
+}
+
+// writeBytes writes B(b).
+func writeBytes(w io.Writer, b []byte) {
+	var n [binary.MaxVarintLen64]byte
+	w.Write(n[:binary.PutUvarint(n[:], uint64(len(b)))])
+	w.Write(b)
+}
+
+// appendBytes appends B(b) to p.
+func appendBytes(p, b []byte) []byte {
+	var n [binary.MaxVarintLen64]byte
+	p = append(p, n[:binary.PutUvarint(n[:], uint64(len(b)))]...)
+	return append(p, b...)
+}
@@ -0,0 +1,156 @@
+package cas
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// These hashes are part of consensus. If they change, nodes built before and
+// after the change will halt on an app hash mismatch, so never update them to
+// make this test pass. Each is also checked against the definition in
+// hash.go, followed literally.
+func TestHashGoldenVectors(t *testing.T) {
+	for i, testcase := range []struct {
+		data map[string][]byte
+		want string
+	}{
+		{
+			data: map[string][]byte{},
+			want: "",
+		},
+		{
+			data: map[string][]byte{"a": []byte("1")},
+			want: "77C2DC9C41EBF94D163CCD34572F8DE29C8E3AD9",
+		},
+		{
+			data: map[string][]byte{"": nil},
+			want: "A04F3559E361173948121B01E6EE35C9C6A3BBE3",
+		},
+		{
+			data: map[string][]byte{"a": []byte("1"), "b": []byte("2")},
+			want: "AE25062320EA5E9D3A5B763691333B3DB104A715",
+		},
+		{
+			data: map[string][]byte{"a": []byte("1"), "b": []byte("2"), "c": []byte("3")},
+			want: "2D8CCE4C65AC99520D30E19CE36FDD1929295C94",
+		},
+		{
+			data: map[string][]byte{
+				"user/1": []byte(`{"name":"alice"}`),
+				"user/2": []byte(`{"name":"bob"}`),
+				"é":      {0x00, 0xff, '\n'},
+				"x":      []byte("one"),
+				"y":      []byte(""),
+			},
+			want: "CA303101C0EEC60A32269BDE61E9E911332DF3D9",
+		},
+		{
+			data: numberedData(100),
+			want: "A828A3A74FD7071FC6920B0506F74CBB59D4EE01",
+		},
+	} {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			if want, have := testcase.want, fmt.Sprintf("%X", newMerkleTree(1, newTreap(testcase.data)).hash()); want != have {
+				t.Errorf("want %s, have %s", want, have)
+			}
+			if want, have := testcase.want, fmt.Sprintf("%X", definedHash(sortedKeys(testcase.data), testcase.data)); want != have {
+				t.Errorf("definition: want %s, have %s", want, have)
+			}
+		})
+	}
+}
+
+// TestHashDefinition checks the hash of the treap against the definition in
+// hash.go, followed literally, rather than as the treap is built.
+func TestHashDefinition(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		data := map[string][]byte{}
+		for j := rng.Intn(50); j > 0; j-- {
+			data[fmt.Sprint(rng.Intn(100))] = []byte(fmt.Sprint(j))
+		}
+		keys := sortedKeys(data)
+		if want, have := definedHash(keys, data), newMerkleTree(1, newTreap(data)).hash(); !bytes.Equal(want, have) {
+			t.Fatalf("%d keys: want %X, have %X", len(keys), want, have)
+		}
+	}
+}
+
+// definedHash returns the hash of the treap of the keys, in ascending order.
+func definedHash(keys []string, data map[string][]byte) []byte {
+	if len(keys) == 0 {
+		return nil
+	}
+	priority := func(k string) uint64 {
+		sum := sha256.Sum256([]byte(k))
+		return binary.BigEndian.Uint64(sum[:8])
+	}
+	root := 0
+	for i, k := range keys {
+		if priority(k) > priority(keys[root]) {
+			root = i // equal priorities keep the least key
+		}
+	}
+	var b bytes.Buffer
+	b.WriteByte(0x01)
+	writeUvarint(&b, uint64(len(keys)))
+	writeBytes(&b, definedHash(keys[:root], data))
+	writeBytes(&b, leafHash(keys[root], valueHash(data[keys[root]])))
+	writeBytes(&b, definedHash(keys[root+1:], data))
+	return valueHash(b.Bytes())
+}
+
+func sortedKeys(data map[string][]byte) []string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func numberedData(n int) map[string][]byte {
+	data := make(map[string][]byte, n)
+	for i := 0; i < n; i++ {
+		data[fmt.Sprintf("k%02d", i)] = []byte(fmt.Sprintf("v%02d", i))
+	}
+	return data
+}
+
+func TestHashCommitCount(t *testing.T) {
+	data := map[string][]byte{"a": []byte("1")}
+	if a, b := newMerkleTree(1, newTreap(data)).hash(), newMerkleTree(2, newTreap(data)).hash(); !bytes.Equal(a, b) {
+		t.Errorf("want the same hash at different heights, have %X and %X", a, b)
+	}
+}
+
+func TestHashEncoding(t *testing.T) {
+	// H(0x00 || B("a") || B(H("1"))), with the value hash spelled out.
+	leaf := valueHash(append([]byte{0x00, 0x01, 'a', hashSize}, mustDecodeHex(t, "6B86B273FF34FCE19D6B804EFF5A3F5747ADA4EA")...))
+	if have := leafHash("a", valueHash([]byte("1"))); !bytes.Equal(leaf, have) {
+		t.Errorf("leafHash: want %X, have %X", leaf, have)
+	}
+	// H(0x01 || U(1) || B("") || B(leaf) || B("")), the tree of just "a".
+	want := valueHash(append(append([]byte{0x01, 0x01, 0x00, hashSize}, leaf...), 0x00))
+	if have := nodeHash(1, nil, leaf, nil); !bytes.Equal(want, have) {
+		t.Errorf("nodeHash: want %X, have %X", want, have)
+	}
+	if want, have := 20, len(valueHash(nil)); want != have {
+		t.Errorf("valueHash: want %d bytes, have %d", want, have)
+	}
+}
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,100 @@
+package cas
+
+import (
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics contains metrics exposed by the application.
+type Metrics struct {
+	// CompareAndSwaps counts compare-and-swap operations. The state label is
+	// either mempool or consensus, and the success label is true or false.
+	CompareAndSwaps metrics.Counter
+
+	// Keys is the number of keys in the most recently committed state.
+	Keys metrics.Gauge
+
+	// StateBytes is the size of the most recently committed state, as
+	// persisted.
+	StateBytes metrics.Gauge
+
+	// CommitDuration is the time taken by Commit, in seconds. The state is
+	// persisted afterwards, in the background.
+	CommitDuration metrics.Histogram
+
+	// PersistDuration is the time taken to persist a committed state, in
+	// seconds.
+	PersistDuration metrics.Histogram
+
+	// PersistedHeight is the height of the most recently persisted state.
+	PersistedHeight metrics.Gauge
+
+	// PersistFailures counts failures to persist a committed state.
+	PersistFailures metrics.Counter
+}
+
+// PrometheusMetrics returns Metrics built using the Prometheus client library,
+// and registered with the default Prometheus registry.
+func PrometheusMetrics(namespace string) *Metrics {
+	return &Metrics{
+		CompareAndSwaps: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "app",
+			Name:      "compare_and_swaps_total",
+			Help:      "Compare-and-swap operations, by state and success.",
+		}, []string{"state", "success"}),
+		Keys: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "app",
+			Name:      "keys",
+			Help:      "Number of keys in the committed state.",
+		}, []string{}),
+		StateBytes: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "app",
+			Name:      "state_bytes",
+			Help:      "Size of the committed state, as persisted.",
+		}, []string{}),
+		CommitDuration: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "app",
+			Name:      "commit_duration_seconds",
+			Help:      "Time taken to commit state.",
+			Buckets:   stdprometheus.DefBuckets,
+		}, []string{}),
+		PersistDuration: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "app",
+			Name:      "persist_duration_seconds",
+			Help:      "Time taken to persist committed state.",
+			Buckets:   stdprometheus.DefBuckets,
+		}, []string{}),
+		PersistedHeight: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "app",
+			Name:      "persisted_height",
+			Help:      "Height of the most recently persisted state.",
+		}, []string{}),
+		PersistFailures: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "app",
+			Name:      "persist_failures_total",
+			Help:      "Failures to persist committed state.",
+		}, []string{}),
+	}
+}
+
+// NopMetrics returns no-op Metrics.
+func NopMetrics() *Metrics {
+	return &Metrics{
+		CompareAndSwaps: discard.NewCounter(),
+		Keys:            discard.NewGauge(),
+		StateBytes:      discard.NewGauge(),
+		CommitDuration:  discard.NewHistogram(),
+		PersistDuration: discard.NewHistogram(),
+		PersistedHeight: discard.NewGauge(),
+		PersistFailures: discard.NewCounter(),
+	}
+}
@@ -0,0 +1,118 @@
+package cas
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// Committing the state only freezes it, which is cheap, as the state is
+// persistent, and leaves writing it to a persister, which writes committed
+// states in the background, in order. At most one state waits to be written:
+// as each state is complete, a newer one replaces any that's still waiting.
+// So neither commits nor reads ever wait for the disk, and the persisted state
+// is at most a write or so behind.
+//
+// Each state is written with its commit count, and the WriteCloser should only
+// replace the previous state on Close, so a crash leaves a complete state
+// behind. The application restarts at that state's height, which Info reports,
+// and Tendermint replays the blocks after it.
+
+type persister struct {
+	state   *State
+	wc      io.WriteCloser
+	logger  log.Logger
+	metrics *Metrics
+
+	mtx      sync.Mutex
+	cond     *sync.Cond
+	pending  *merkleTree // waiting to be written
+	closed   bool
+	err      error // of the last write
+	failures int   // in a row, up to the last write
+	done     chan struct{}
+}
+
+func newPersister(s *State, wc io.WriteCloser, logger log.Logger, metrics *Metrics) *persister {
+	p := &persister{
+		state:   s,
+		wc:      wc,
+		logger:  logger,
+		metrics: metrics,
+		done:    make(chan struct{}),
+	}
+	p.cond = sync.NewCond(&p.mtx)
+	go p.loop()
+	return p
+}
+
+// persist queues the committed state t to be written, replacing any state
+// that's still waiting.
+func (p *persister) persist(t *merkleTree) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.pending != nil {
+		level.Debug(p.logger).Log("persist", "skipped", "height", p.pending.height, "superseded_by", t.height)
+	}
+	p.pending = t
+	p.cond.Broadcast()
+}
+
+func (p *persister) loop() {
+	defer close(p.done)
+	for {
+		p.mtx.Lock()
+		for p.pending == nil && !p.closed {
+			p.cond.Wait()
+		}
+		t := p.pending
+		if t == nil {
+			p.mtx.Unlock()
+			return
+		}
+		p.pending = nil
+		p.mtx.Unlock()
+
+		begin := time.Now()
+		err := p.state.persist(t, p.wc)
+		if err != nil {
+			level.Error(p.logger).Log("during", "persist", "height", t.height, "err", err)
+			p.metrics.PersistFailures.Add(1)
+		} else {
+			p.metrics.PersistDuration.Observe(time.Since(begin).Seconds())
+			p.metrics.PersistedHeight.Set(float64(t.height))
+			p.metrics.StateBytes.Set(float64(p.state.Size()))
+		}
+
+		p.mtx.Lock()
+		p.err = err
+		if err != nil {
+			p.failures++
+		} else {
+			p.failures = 0
+		}
+		p.mtx.Unlock()
+	}
+}
+
+// failing returns how many writes in a row have failed, up to the last, and
+// the error of the last, if it failed.
+func (p *persister) failing() (int, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.failures, p.err
+}
+
+// close writes any queued state, and stops the persister. It returns the error
+// of the last write, if it failed.
+func (p *persister) close() error {
+	p.mtx.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.mtx.Unlock()
+	<-p.done
+	return p.err
+}
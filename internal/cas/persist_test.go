@@ -0,0 +1,114 @@
+package cas
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestPersister(t *testing.T) {
+	var (
+		s       = NewState()
+		w       = &gatedWriteCloser{gate: make(chan struct{})}
+		p       = newPersister(s, w, log.NewNopLogger(), NopMetrics())
+		commits = 5
+	)
+	for i := 1; i <= commits; i++ {
+		if err := s.CompareAndSwap(fmt.Sprint(i), nil, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		p.persist(s.freeze())
+
+		// While the first state is being written, reads and commits carry on.
+		done := make(chan struct{})
+		go func() {
+			s.Get("1")
+			s.Hash()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("commit %d: reads are waiting for the write", i)
+		}
+	}
+	close(w.gate)
+	if err := p.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The states written are in order, and the last is the last committed,
+	// but those superseded while the first was written were skipped.
+	if len(w.heights) == 0 || len(w.heights) == commits {
+		t.Fatalf("want some of %d states written, have heights %v", commits, w.heights)
+	}
+	for i := 1; i < len(w.heights); i++ {
+		if w.heights[i] <= w.heights[i-1] {
+			t.Errorf("want heights in order, have %v", w.heights)
+		}
+	}
+	if want, have := int64(commits), w.heights[len(w.heights)-1]; want != have {
+		t.Errorf("last height: want %d, have %d", want, have)
+	}
+	restored := NewState()
+	if err := restored.Restore(bytes.NewReader(w.last)); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := s.Hash(), restored.Hash(); !bytes.Equal(want, have) {
+		t.Errorf("Hash: want %X, have %X", want, have)
+	}
+	if want, have := int64(len(w.last)), s.Size(); want != have {
+		t.Errorf("Size: want %d, have %d", want, have)
+	}
+}
+
+func TestPersisterError(t *testing.T) {
+	var (
+		s   = NewState()
+		err = errors.New("disk full")
+		p   = newPersister(s, writeCloser{Writer: failingWriter{err}, Closer: nopCloser}, log.NewNopLogger(), NopMetrics())
+	)
+	p.persist(s.freeze())
+	if want, have := err, p.close(); want != have {
+		t.Errorf("close: want %v, have %v", want, have)
+	}
+	if n, have := p.failing(); n != 1 || have != err {
+		t.Errorf("failing: want 1, %v, have %d, %v", err, n, have)
+	}
+	if want, have := int64(1), s.Commits(); want != have {
+		t.Errorf("Commits: want %d, have %d", want, have)
+	}
+}
+
+// gatedWriteCloser holds up the first Close until the gate is closed, and
+// records the height of every state written.
+type gatedWriteCloser struct {
+	gate    chan struct{}
+	buf     bytes.Buffer
+	last    []byte
+	heights []int64
+}
+
+func (w *gatedWriteCloser) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *gatedWriteCloser) Close() error {
+	<-w.gate
+	state, err := readStateFile(bytes.NewReader(w.buf.Bytes()), func(int, int) {})
+	if err != nil {
+		return err
+	}
+	w.heights = append(w.heights, state.height)
+	w.last = append(w.last[:0], w.buf.Bytes()...)
+	w.buf.Reset()
+	return nil
+}
+
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write([]byte) (int, error) { return 0, w.err }
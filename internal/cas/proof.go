@@ -0,0 +1,140 @@
+package cas
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// The app hash is the root of a Merkle tree, defined in hash.go, with a node
+// per key, shaped as the treap that holds them. Each node is hashed from its
+// key, the hash of its value, its children's hashes, and its number of keys,
+// so a proof about one key needn't reveal the values of any others, and shows
+// how many keys there are.
+//
+// A proof is the path a search for the key takes from the root: each node on
+// it, with the hashes and sizes of its children off the path. If the key
+// exists, the path ends at its node. Otherwise, it ends at the node whose empty
+// subtree the key would be in, which shows it's nowhere else, as the search
+// couldn't have gone any other way.
+
+// ErrInvalidProof is returned when a proof doesn't verify.
+var ErrInvalidProof = errors.New("invalid proof")
+
+// Proof proves the value of a key, or its absence, against an app hash.
+type Proof struct {
+	Total int         `json:"total"` // number of keys in the state
+	Path  []ProofNode `json:"path"`  // from the root, empty if there are no keys
+}
+
+// ProofNode is a node on the path to a key: its key, the hash of its value,
+// and each of its children, except the one on the path, which is omitted, as
+// it's the next node, or the empty subtree where an absent key would be.
+type ProofNode struct {
+	Key       string        `json:"key"`
+	ValueHash []byte        `json:"value_hash"`
+	Left      *ProofSubtree `json:"left,omitempty"`
+	Right     *ProofSubtree `json:"right,omitempty"`
+}
+
+// ProofSubtree is the hash of a subtree, which is empty if it has no keys, and
+// its number of keys.
+type ProofSubtree struct {
+	Hash []byte `json:"hash"`
+	Size int    `json:"size"`
+}
+
+// Verify that the proof shows key to have the given value in the state with
+// the given app hash, or, if exists is false, to be absent from it. The proof's
+// total is checked too, as it's part of the app hash.
+func (p Proof) Verify(appHash []byte, key string, value []byte, exists bool) error {
+	if len(p.Path) == 0 {
+		if exists || p.Total != 0 || len(appHash) != 0 {
+			return ErrInvalidProof
+		}
+		return nil
+	}
+
+	// Hash the path from the bottom up, taking the child on the path, which
+	// is empty below the last node, from the node below, and checking that
+	// the search for the key would have taken it.
+	var (
+		last  = p.Path[len(p.Path)-1]
+		found = last.Key == key
+		below = &ProofSubtree{}
+	)
+	for i := len(p.Path) - 1; i >= 0; i-- {
+		n := p.Path[i]
+		switch {
+		case key < n.Key && n.Left == nil && n.Right != nil:
+			n.Left = below
+		case key > n.Key && n.Right == nil && n.Left != nil:
+			n.Right = below
+		case key == n.Key && i == len(p.Path)-1 && n.Left != nil && n.Right != nil:
+		default:
+			return fmt.Errorf("%v: not the path to key %q", ErrInvalidProof, key)
+		}
+		if n.Left.Size < 0 || n.Right.Size < 0 {
+			return fmt.Errorf("%v: negative size", ErrInvalidProof)
+		}
+		size := 1 + n.Left.Size + n.Right.Size
+		below = &ProofSubtree{
+			Hash: nodeHash(size, n.Left.Hash, leafHash(n.Key, n.ValueHash), n.Right.Hash),
+			Size: size,
+		}
+	}
+	if !bytes.Equal(below.Hash, appHash) || below.Size != p.Total {
+		return fmt.Errorf("%v: path doesn't match the app hash", ErrInvalidProof)
+	}
+
+	switch {
+	case exists && !found:
+		return fmt.Errorf("%v: no node for key %q", ErrInvalidProof, key)
+	case exists && !bytes.Equal(last.ValueHash, valueHash(value)):
+		return fmt.Errorf("%v: wrong value for key %q", ErrInvalidProof, key)
+	case !exists && found:
+		return fmt.Errorf("%v: doesn't show the absence of key %q", ErrInvalidProof, key)
+	}
+	return nil
+}
+
+// merkleTree is an immutable snapshot of the state at the time of a commit.
+// Its treap is its Merkle tree, so it's already hashed, and proofs are cheap.
+type merkleTree struct {
+	height int64 // commit count
+	data   *treapNode
+}
+
+func newMerkleTree(height int64, data *treapNode) *merkleTree {
+	return &merkleTree{height: height, data: data}
+}
+
+func (t *merkleTree) hash() []byte {
+	return t.data.merkleHash()
+}
+
+// get returns the value of the key, and a proof of it, or of its absence.
+func (t *merkleTree) get(key string) ([]byte, Proof, error) {
+	proof := Proof{Total: t.data.len()}
+	for n := t.data; n != nil; {
+		node := ProofNode{Key: n.key, ValueHash: valueHash(n.value)}
+		switch {
+		case key < n.key:
+			node.Right = n.right.proofSubtree()
+			n = n.left
+		case key > n.key:
+			node.Left = n.left.proofSubtree()
+			n = n.right
+		default:
+			node.Left, node.Right = n.left.proofSubtree(), n.right.proofSubtree()
+			proof.Path = append(proof.Path, node)
+			return n.value, proof, nil
+		}
+		proof.Path = append(proof.Path, node)
+	}
+	return nil, proof, ErrKeyNotFound
+}
+
+func (n *treapNode) proofSubtree() *ProofSubtree {
+	return &ProofSubtree{Hash: n.merkleHash(), Size: n.len()}
+}
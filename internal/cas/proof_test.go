@@ -0,0 +1,148 @@
+package cas
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestProof(t *testing.T) {
+	for n := 0; n < 10; n++ {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			// Keys are k00, k02, k04..., leaving gaps for absent keys.
+			s := NewState()
+			for i := 0; i < n; i++ {
+				key, value := fmt.Sprintf("k%02d", 2*i), []byte(fmt.Sprintf("v%02d", 2*i))
+				if err := s.CompareAndSwap(key, nil, value); err != nil {
+					t.Fatalf("CAS(%s): %v", key, err)
+				}
+			}
+			if err := s.Commit(newNopWriteCloser(&bytes.Buffer{})); err != nil {
+				t.Fatalf("Commit: %v", err)
+			}
+
+			for i := -1; i < 2*n; i++ {
+				key := fmt.Sprintf("k%02d", i)
+				value, proof, err := s.Prove(key)
+				exists := i >= 0 && i%2 == 0
+				if want, have := exists, err == nil; want != have {
+					t.Fatalf("Prove(%s): want exists %v, have error %v", key, want, err)
+				}
+				if err := proof.Verify(s.Hash(), key, value, exists); err != nil {
+					t.Errorf("Verify(%s): %v", key, err)
+				}
+				if err := proof.Verify(s.Hash(), key, value, !exists); err == nil {
+					t.Errorf("Verify(%s): want error for exists=%v, have none", key, !exists)
+				}
+				if exists {
+					if err := proof.Verify(s.Hash(), key, []byte("wrong"), true); err == nil {
+						t.Errorf("Verify(%s): want error for wrong value, have none", key)
+					}
+				}
+				if n > 0 {
+					if err := proof.Verify(valueHash(nil), key, value, exists); err == nil {
+						t.Errorf("Verify(%s): want error for wrong app hash, have none", key)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestProofWrongPath(t *testing.T) {
+	s := NewState()
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		if err := s.CompareAndSwap(key, nil, []byte(key)); err != nil {
+			t.Fatalf("CAS(%s): %v", key, err)
+		}
+	}
+	if err := s.Commit(newNopWriteCloser(&bytes.Buffer{})); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	// A valid path to one key, or to where one would be, mustn't prove
+	// anything about another, unless the search for it would take the same
+	// path, e.g. to an absent key next to one with no children.
+	keys := []string{"a", "d", "h", "0", "dd", "z"}
+	for _, key := range keys {
+		_, proof, _ := s.Prove(key)
+		for _, other := range keys {
+			_, otherProof, err := s.Prove(other)
+			if other == key || reflect.DeepEqual(proof, otherProof) {
+				continue
+			}
+			if err := proof.Verify(s.Hash(), other, []byte(other), err == nil); err == nil {
+				t.Errorf("Verify(%s) with the proof of %s: want error, have none", other, key)
+			}
+		}
+	}
+
+	// Nor may the hashes or sizes on the path be changed, or the total.
+	value, proof, _ := s.Prove("h")
+	for i := range proof.Path {
+		for _, child := range []*ProofSubtree{proof.Path[i].Left, proof.Path[i].Right} {
+			if child == nil {
+				continue
+			}
+			saved := *child
+			child.Hash = valueHash(saved.Hash)
+			if err := proof.Verify(s.Hash(), "h", value, true); err == nil {
+				t.Errorf("Verify(h) with node %d's hash changed: want error, have none", i)
+			}
+			*child = saved
+			child.Size++
+			if err := proof.Verify(s.Hash(), "h", value, true); err == nil {
+				t.Errorf("Verify(h) with node %d's size changed: want error, have none", i)
+			}
+			*child = saved
+		}
+	}
+	proof.Total++
+	if err := proof.Verify(s.Hash(), "h", value, true); err == nil {
+		t.Errorf("Verify(h) with the total changed: want error, have none")
+	}
+	proof.Total--
+	if err := proof.Verify(s.Hash(), "h", value, true); err != nil {
+		t.Errorf("Verify(h): %v", err)
+	}
+}
+
+func TestProofForged(t *testing.T) {
+	s := NewState()
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		if err := s.CompareAndSwap(key, nil, []byte(key)); err != nil {
+			t.Fatalf("CAS(%s): %v", key, err)
+		}
+	}
+	if err := s.Commit(newNopWriteCloser(&bytes.Buffer{})); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	root := s.committed().data
+	if root.left == nil || root.right == nil {
+		t.Fatalf("want a root with two children, have %s with %v and %v", root.key, root.left, root.right)
+	}
+
+	// If leaves and nodes were hashed alike, the hash of a node could also be
+	// the hash of a leaf made of its parts, and a proof of that leaf alone
+	// would show any key either side of it to be absent, including those that
+	// exist. Try every way of passing the root's parts off as a single leaf.
+	parts := [][]byte{root.left.hash, root.leaf, root.right.hash}
+	for i, key := range parts {
+		for j, valueHash := range parts {
+			for _, total := range []int{1, root.size} {
+				forged := Proof{Total: total, Path: []ProofNode{{
+					Key:       string(key),
+					ValueHash: valueHash,
+					Left:      &ProofSubtree{},
+					Right:     &ProofSubtree{},
+				}}}
+				for _, absent := range []string{"a", "h"} {
+					if err := forged.Verify(s.Hash(), absent, nil, false); err == nil {
+						t.Errorf("Verify(%s) with parts %d and %d as a leaf, total %d: want error, have none", absent, i, j, total)
+					}
+				}
+			}
+		}
+	}
+}
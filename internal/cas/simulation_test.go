@@ -0,0 +1,375 @@
+package cas
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	tendermintabci "github.com/tendermint/tendermint/abci/types"
+)
+
+// The simulation drives several applications through the same random blocks,
+// as the nodes of a network would be, restarting them at random, and checks
+// them against each other, and against a model of the state as a plain map.
+// Everything random comes from the seed, so a failure can be reproduced with
+// e.g.
+//
+//   go test -run TestSimulation -simulation.seed 3 ./internal/cas
+
+var (
+	simulationSeed   = flag.Int64("simulation.seed", 0, "run TestSimulation with only this seed")
+	simulationBlocks = flag.Int("simulation.blocks", 200, "blocks per TestSimulation run")
+)
+
+func TestSimulation(t *testing.T) {
+	seeds := []int64{1, 2, 3, 4, 5}
+	if *simulationSeed != 0 {
+		seeds = []int64{*simulationSeed}
+	}
+	for _, seed := range seeds {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			newSimulation(t, seed, 3).run(*simulationBlocks)
+		})
+	}
+}
+
+type simulation struct {
+	t      *testing.T
+	seed   int64
+	rng    *rand.Rand
+	nodes  []*simulatedNode
+	model  map[string][]byte
+	blocks [][][]byte // transactions of each block, from height 1
+	codes  [][]uint32 // DeliverTx codes of each block's transactions
+	hashes [][]byte   // app hash after each block
+}
+
+func newSimulation(t *testing.T, seed int64, nodes int) *simulation {
+	s := &simulation{
+		t:     t,
+		seed:  seed,
+		rng:   rand.New(rand.NewSource(seed)),
+		model: map[string][]byte{},
+	}
+	for i := 0; i < nodes; i++ {
+		n := &simulatedNode{id: i, file: &simulatedFile{}}
+		n.app = s.newApp(n, nil)
+		s.nodes = append(s.nodes, n)
+	}
+	return s
+}
+
+// simulatedNode is an application, and the file it persists to.
+type simulatedNode struct {
+	id   int
+	app  *Application
+	file *simulatedFile
+}
+
+func (s *simulation) run(blocks int) {
+	for height := int64(1); height <= int64(blocks); height++ {
+		s.block(height)
+		if s.rng.Intn(5) == 0 {
+			s.restart(s.nodes[s.rng.Intn(len(s.nodes))], height)
+		}
+	}
+	for _, n := range s.nodes {
+		if err := n.app.Close(); err != nil {
+			s.fatalf("node %d: Close: %v", n.id, err)
+		}
+	}
+}
+
+// block proposes a block of random transactions, as checked by the mempool of
+// a random node, plus a few that weren't, and delivers it to every node.
+func (s *simulation) block(height int64) {
+	var (
+		proposer = s.nodes[s.rng.Intn(len(s.nodes))]
+		txs      [][]byte
+	)
+	for i, n := 0, s.rng.Intn(10); i < n; i++ {
+		tx := s.randomTx()
+		if s.rng.Intn(4) == 0 || proposer.app.CheckTx(tx).IsOK() {
+			txs = append(txs, tx)
+		}
+	}
+	codes := make([]uint32, len(txs))
+	for i, tx := range txs {
+		codes[i] = s.modelApply(tx)
+	}
+	s.blocks = append(s.blocks, txs)
+	s.codes = append(s.codes, codes)
+
+	for i, n := range s.nodes {
+		hash := s.deliver(n, height)
+		if i == 0 {
+			s.hashes = append(s.hashes, hash)
+		}
+		s.check(n, height)
+	}
+}
+
+// deliver delivers the block at the height to a node, checking each
+// transaction's result, and returns the app hash.
+func (s *simulation) deliver(n *simulatedNode, height int64) []byte {
+	n.app.BeginBlock(tendermintabci.RequestBeginBlock{Header: tendermintabci.Header{Height: height}})
+	for i, tx := range s.blocks[height-1] {
+		if want, have := s.codes[height-1][i], n.app.DeliverTx(tx).Code; want != have {
+			s.fatalf("node %d, height %d: DeliverTx(%s): want code %d, have %d", n.id, height, tx, want, have)
+		}
+	}
+	n.app.EndBlock(tendermintabci.RequestEndBlock{Height: height})
+	return n.app.Commit().Data
+}
+
+// check that a node agrees with the model, and with every other node.
+func (s *simulation) check(n *simulatedNode, height int64) {
+	info := n.app.Info(tendermintabci.RequestInfo{})
+	if want, have := height, info.LastBlockHeight; want != have {
+		s.fatalf("node %d: height: want %d, have %d", n.id, want, have)
+	}
+	if want, have := s.hashes[height-1], info.LastBlockAppHash; !bytes.Equal(want, have) {
+		s.fatalf("node %d, height %d: app hash: want %X, have %X", n.id, height, want, have)
+	}
+	if want, have := newMerkleTree(height, newTreap(s.model)).hash(), info.LastBlockAppHash; !bytes.Equal(want, have) {
+		s.fatalf("node %d, height %d: app hash: model has %X, node has %X", n.id, height, want, have)
+	}
+
+	// After a commit, the mempool starts again from the committed state.
+	if want, have := n.app.consensus.List(""), n.app.mempool.List(""); !equalKeyValues(want, have) {
+		s.fatalf("node %d, height %d: mempool has %q, consensus has %q", n.id, height, have, want)
+	}
+	if want, have := n.app.consensus.Hash(), n.app.mempool.Hash(); !bytes.Equal(want, have) {
+		s.fatalf("node %d, height %d: mempool app hash %X, consensus %X", n.id, height, have, want)
+	}
+
+	var list []KeyValue
+	if err := json.Unmarshal(n.app.Query(tendermintabci.RequestQuery{Path: QueryPathList}).Value, &list); err != nil {
+		s.fatalf("node %d, height %d: Query(list): %v", n.id, height, err)
+	}
+	if want := s.modelList(); !equalKeyValues(want, list) {
+		s.fatalf("node %d, height %d: Query(list): want %q, have %q", n.id, height, want, list)
+	}
+	for _, key := range simulationKeys {
+		response := n.app.Query(tendermintabci.RequestQuery{Data: []byte(key), Prove: true})
+		value, exists := s.model[key]
+		if want, have := exists, response.IsOK(); want != have {
+			s.fatalf("node %d, height %d: Query(%s): want found %v, have code %d", n.id, height, key, want, response.Code)
+		}
+		if !bytes.Equal(value, response.Value) {
+			s.fatalf("node %d, height %d: Query(%s): want %q, have %q", n.id, height, key, value, response.Value)
+		}
+		var proof Proof
+		if err := json.Unmarshal(response.Proof, &proof); err != nil {
+			s.fatalf("node %d, height %d: Query(%s): proof: %v", n.id, height, key, err)
+		}
+		if err := proof.Verify(info.LastBlockAppHash, key, value, exists); err != nil {
+			s.fatalf("node %d, height %d: Query(%s): %v", n.id, height, key, err)
+		}
+	}
+}
+
+// restart a node, as if it stopped cleanly, crashed, or lost its state. Unless
+// it stopped cleanly, it starts from an earlier state, and the blocks after it
+// are delivered again, as Tendermint would replay them.
+func (s *simulation) restart(n *simulatedNode, height int64) {
+	if err := n.app.Close(); err != nil {
+		s.fatalf("node %d: Close: %v", n.id, err)
+	}
+	var (
+		how     string
+		initial []byte
+		written = n.file.written()
+	)
+	switch r := s.rng.Intn(4); {
+	case r == 0:
+		how = "from scratch"
+	case r == 1 && len(written) > 1:
+		how = "from an earlier state"
+		initial = written[s.rng.Intn(len(written)-1)]
+	default:
+		how = "cleanly"
+		initial = written[len(written)-1]
+	}
+	n.file = &simulatedFile{}
+	n.app = s.newApp(n, initial)
+
+	from := n.app.Info(tendermintabci.RequestInfo{}).LastBlockHeight
+	if how == "cleanly" && from != height {
+		s.fatalf("node %d: restarted %s at height %d, want %d", n.id, how, from, height)
+	}
+	if from > 0 {
+		if want, have := s.hashes[from-1], n.app.Info(tendermintabci.RequestInfo{}).LastBlockAppHash; !bytes.Equal(want, have) {
+			s.fatalf("node %d: restarted %s at height %d: app hash: want %X, have %X", n.id, how, from, want, have)
+		}
+	}
+	for h := from + 1; h <= height; h++ {
+		if want, have := s.hashes[h-1], s.deliver(n, h); !bytes.Equal(want, have) {
+			s.fatalf("node %d: replaying height %d: app hash: want %X, have %X", n.id, h, want, have)
+		}
+	}
+	s.check(n, height)
+}
+
+func (s *simulation) newApp(n *simulatedNode, initial []byte) *Application {
+	var r io.Reader
+	if initial != nil {
+		r = bytes.NewReader(initial)
+	}
+	a, err := NewApplication(r, n.file, log.NewNopLogger())
+	if err != nil {
+		s.fatalf("node %d: NewApplication: %v", n.id, err)
+	}
+	return a
+}
+
+func (s *simulation) fatalf(format string, args ...interface{}) {
+	s.t.Helper()
+	s.t.Fatalf("seed %d: %s", s.seed, fmt.Sprintf(format, args...))
+}
+
+// simulationKeys are few, so that transactions often touch the same keys.
+var simulationKeys = []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+
+// randomTx returns a random transaction, which is usually valid, and usually
+// expects the current values of its keys, as of the model.
+func (s *simulation) randomTx() []byte {
+	rng := s.rng
+	switch r := rng.Intn(20); {
+	case r == 0:
+		malformed := []string{
+			"",
+			"garbage",
+			"{",
+			":old:new",
+			`{"ops":[]}`,
+			`{"ops":[{"op":"set","key":""}]}`,
+			`{"ops":[{"op":"swap","key":"a"}]}`,
+			`{"ops":[{"op":"delete","key":"a","new":"eA=="}]}`,
+		}
+		return []byte(malformed[rng.Intn(len(malformed))])
+	case r < 5:
+		key := s.randomKey()
+		return []byte(fmt.Sprintf("%s:%s:%s", key, s.randomOld(key, s.model), s.randomValue()))
+	default:
+		var (
+			tx      Tx
+			pending = copyData(s.model)
+		)
+		for i, n := 0, 1+rng.Intn(3); i < n; i++ {
+			key := s.randomKey()
+			op := Op{Key: key, Old: s.randomOld(key, pending)}
+			switch rng.Intn(4) {
+			case 0:
+				op.Type = OpCheck
+			case 1:
+				op.Type = OpDelete
+				delete(pending, key)
+			default:
+				op.Type = OpSet
+				op.New = s.randomValue()
+				pending[key] = op.New
+			}
+			tx.Ops = append(tx.Ops, op)
+		}
+		return tx.Encode()
+	}
+}
+
+func (s *simulation) randomKey() string {
+	return simulationKeys[s.rng.Intn(len(simulationKeys))]
+}
+
+// randomOld returns the key's value in data, or sometimes some other value.
+func (s *simulation) randomOld(key string, data map[string][]byte) []byte {
+	if s.rng.Intn(5) == 0 {
+		return s.randomValue()
+	}
+	return data[key]
+}
+
+func (s *simulation) randomValue() []byte {
+	if s.rng.Intn(10) == 0 {
+		return nil
+	}
+	return []byte(fmt.Sprintf("v%d", s.rng.Intn(100)))
+}
+
+// modelApply applies the transaction to the model, and returns the code
+// DeliverTx should.
+func (s *simulation) modelApply(p []byte) uint32 {
+	tx, err := DecodeTx(p)
+	if err != nil {
+		return CodeBadRequest
+	}
+	pending := copyData(s.model)
+	for _, op := range tx.Ops {
+		if !bytes.Equal(pending[op.Key], op.Old) {
+			return CodeCASFailure
+		}
+		switch op.Type {
+		case OpSet:
+			pending[op.Key] = op.New
+		case OpDelete:
+			delete(pending, op.Key)
+		}
+	}
+	s.model = pending
+	return tendermintabci.CodeTypeOK
+}
+
+func (s *simulation) modelList() []KeyValue {
+	kvs := []KeyValue{}
+	for k, v := range s.model {
+		kvs = append(kvs, KeyValue{Key: k, Value: v})
+	}
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+	return kvs
+}
+
+// equalKeyValues compares values with bytes.Equal, as a nil value and an empty
+// one are the same.
+func equalKeyValues(a, b []KeyValue) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Key != b[i].Key || !bytes.Equal(a[i].Value, b[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// simulatedFile keeps every state written to it.
+type simulatedFile struct {
+	mtx   sync.Mutex
+	buf   bytes.Buffer
+	files [][]byte
+}
+
+func (f *simulatedFile) Write(p []byte) (int, error) {
+	return f.buf.Write(p)
+}
+
+func (f *simulatedFile) Close() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.files = append(f.files, append([]byte{}, f.buf.Bytes()...))
+	f.buf.Reset()
+	return nil
+}
+
+// written returns every state written, in order.
+func (f *simulatedFile) written() [][]byte {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.files
+}
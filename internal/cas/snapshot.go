@@ -0,0 +1,239 @@
+package cas
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/golang/snappy"
+	tendermintcommon "github.com/tendermint/tendermint/libs/common"
+)
+
+// A snapshot is the committed state at a height, split into chunks that can be
+// stored and moved around separately, and a manifest that describes them.
+//
+// Each chunk holds a run of keys, in key order, and their values, encoded as
+// B(key) || B(value) for each key, where B is defined in hash.go, and
+// compressed with Snappy's block format. The manifest holds the SHA-256 of each
+// compressed chunk, so a chunk can be checked as soon as it arrives, and the
+// app hash of the state, so the whole can be checked once every chunk has.
+
+// SnapshotVersion is the version of the snapshot format. Restoring a snapshot
+// with any other version fails.
+const SnapshotVersion = 1
+
+// DefaultSnapshotChunkSize is the default size of a chunk, before compression.
+const DefaultSnapshotChunkSize = 1 << 20
+
+// maxSnappyExpansion bounds how many times larger than a compressed chunk its
+// decoding can be, as the most any element of Snappy's block format decodes to
+// is 64 bytes, from a 3-byte copy. Checking the decoded length that a chunk
+// claims against it stops a peer's chunk from allocating much more than its
+// own size.
+const maxSnappyExpansion = 22
+
+// ErrInvalidSnapshot is returned when a snapshot fails to restore.
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// Manifest describes a snapshot.
+type Manifest struct {
+	Version int                         `json:"version"`
+	Height  int64                       `json:"height"`
+	AppHash tendermintcommon.HexBytes   `json:"app_hash"`
+	Keys    int                         `json:"keys"`
+	Chunks  []tendermintcommon.HexBytes `json:"chunks"` // SHA-256 of each compressed chunk
+}
+
+// Snapshot is a manifest and its chunks.
+type Snapshot struct {
+	Manifest Manifest
+	Chunks   [][]byte
+}
+
+// Snapshot returns a snapshot of the state at time of last commit, in chunks of
+// roughly chunkSize bytes, before compression.
+func (s *State) Snapshot(chunkSize int) Snapshot {
+	return s.committed().snapshot(chunkSize)
+}
+
+func (t *merkleTree) snapshot(chunkSize int) Snapshot {
+	snapshot := Snapshot{
+		Manifest: Manifest{
+			Version: SnapshotVersion,
+			Height:  t.height,
+			AppHash: t.hash(),
+			Keys:    t.data.len(),
+			Chunks:  []tendermintcommon.HexBytes{},
+		},
+	}
+	var buf bytes.Buffer
+	flush := func() {
+		chunk := snappy.Encode(nil, buf.Bytes())
+		sum := sha256.Sum256(chunk)
+		snapshot.Chunks = append(snapshot.Chunks, chunk)
+		snapshot.Manifest.Chunks = append(snapshot.Manifest.Chunks, sum[:])
+		buf.Reset()
+	}
+	t.data.ascend(0, func(n *treapNode) bool {
+		writeBytes(&buf, []byte(n.key))
+		writeBytes(&buf, n.value)
+		if buf.Len() >= chunkSize {
+			flush()
+		}
+		return true
+	})
+	if buf.Len() > 0 {
+		flush()
+	}
+	return snapshot
+}
+
+// An application builds the snapshots that are queried in the background, as
+// building one takes time in the number of keys, which mustn't be spent in an
+// ABCI call, while Tendermint holds its lock on the application. The retained
+// states it builds them from are immutable, so the building needs no lock of
+// its own. It keeps the last one built, as its chunks are queried one by one.
+
+type snapshotter struct {
+	chunkSize int
+	logger    log.Logger
+
+	mtx      sync.Mutex
+	building bool
+	last     *Snapshot // the last one built
+	wg       sync.WaitGroup
+}
+
+// lastBuilt returns the last snapshot built, or nil if none is yet.
+func (s *snapshotter) lastBuilt() *Snapshot {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.last
+}
+
+// build starts building a snapshot of t in the background, unless one is
+// already being built.
+func (s *snapshotter) build(t *merkleTree) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.building {
+		return
+	}
+	s.building = true
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		begin := time.Now()
+		snapshot := t.snapshot(s.chunkSize)
+		level.Info(s.logger).Log("snapshot", "built", "height", t.height, "keys", snapshot.Manifest.Keys, "chunks", len(snapshot.Chunks), "took", time.Since(begin))
+		s.mtx.Lock()
+		s.building, s.last = false, &snapshot
+		s.mtx.Unlock()
+	}()
+}
+
+// wait waits for any snapshot being built.
+func (s *snapshotter) wait() {
+	s.wg.Wait()
+}
+
+// SnapshotRestorer rebuilds a state from the chunks of a snapshot, checking
+// each one against the manifest as it's added.
+type SnapshotRestorer struct {
+	manifest Manifest
+	next     int // index of the next chunk
+	data     treapBuilder
+	keys     int
+	last     string // key
+}
+
+// NewSnapshotRestorer returns a restorer for the snapshot with the manifest.
+func NewSnapshotRestorer(m Manifest) (*SnapshotRestorer, error) {
+	if m.Version != SnapshotVersion {
+		return nil, fmt.Errorf("%v: version %d, want %d", ErrInvalidSnapshot, m.Version, SnapshotVersion)
+	}
+	return &SnapshotRestorer{manifest: m}, nil
+}
+
+// Next returns the index of the next chunk to add, or -1 if every chunk has
+// been added.
+func (r *SnapshotRestorer) Next() int {
+	if r.next == len(r.manifest.Chunks) {
+		return -1
+	}
+	return r.next
+}
+
+// Add the next chunk. Chunks must be added in order.
+func (r *SnapshotRestorer) Add(chunk []byte) error {
+	if r.Next() < 0 {
+		return fmt.Errorf("%v: more than %d chunks", ErrInvalidSnapshot, len(r.manifest.Chunks))
+	}
+	if sum := sha256.Sum256(chunk); !bytes.Equal(sum[:], r.manifest.Chunks[r.next]) {
+		return fmt.Errorf("%v: chunk %d has hash %X, want %X", ErrInvalidSnapshot, r.next, sum[:], r.manifest.Chunks[r.next])
+	}
+	n, err := snappy.DecodedLen(chunk)
+	if err == nil && n > maxSnappyExpansion*len(chunk) {
+		err = fmt.Errorf("%d bytes decode to %d", len(chunk), n)
+	}
+	var b []byte
+	if err == nil {
+		b, err = snappy.Decode(nil, chunk)
+	}
+	if err != nil {
+		return fmt.Errorf("%v: chunk %d: %v", ErrInvalidSnapshot, r.next, err)
+	}
+	for len(b) > 0 {
+		var key, value []byte
+		if key, b, err = readBytes(b); err == nil {
+			value, b, err = readBytes(b)
+		}
+		if err != nil {
+			return fmt.Errorf("%v: chunk %d: %v", ErrInvalidSnapshot, r.next, err)
+		}
+		if r.keys > 0 && string(key) <= r.last {
+			return fmt.Errorf("%v: chunk %d: key %q out of order", ErrInvalidSnapshot, r.next, key)
+		}
+		r.data.add(string(key), value)
+		r.keys++
+		r.last = string(key)
+	}
+	r.next++
+	return nil
+}
+
+// State returns the restored state, once every chunk has been added, and if it
+// has the key count and app hash in the manifest. The state is committed, at
+// the manifest's height.
+func (r *SnapshotRestorer) State() (*State, error) {
+	if r.Next() >= 0 {
+		return nil, fmt.Errorf("%v: %d of %d chunks missing", ErrInvalidSnapshot, len(r.manifest.Chunks)-r.next, len(r.manifest.Chunks))
+	}
+	if r.keys != r.manifest.Keys {
+		return nil, fmt.Errorf("%v: %d keys, want %d", ErrInvalidSnapshot, r.keys, r.manifest.Keys)
+	}
+	tree := newMerkleTree(r.manifest.Height, r.data.treap())
+	if !bytes.Equal(tree.hash(), r.manifest.AppHash) {
+		return nil, fmt.Errorf("%v: app hash %X, want %X", ErrInvalidSnapshot, tree.hash(), r.manifest.AppHash)
+	}
+	return &State{
+		data:        tree.data,
+		commitCount: r.manifest.Height,
+		lastCommit:  tree,
+	}, nil
+}
+
+// readBytes reads B(x), and returns x and the rest of b.
+func readBytes(b []byte) (x, rest []byte, err error) {
+	n, size := binary.Uvarint(b)
+	if size <= 0 || n > uint64(len(b)-size) {
+		return nil, nil, errors.New("truncated")
+	}
+	return b[size : size+int(n)], b[size+int(n):], nil
+}
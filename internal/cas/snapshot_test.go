@@ -0,0 +1,122 @@
+package cas
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	for _, chunkSize := range []int{1, 10, 100, DefaultSnapshotChunkSize} {
+		t.Run(fmt.Sprint(chunkSize), func(t *testing.T) {
+			s := NewState()
+			for i := 0; i < 20; i++ {
+				if err := s.CompareAndSwap(fmt.Sprintf("k%02d", i), nil, []byte(fmt.Sprintf("v%d", i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := s.CompareAndSwap("", nil, []byte("empty key")); err != nil {
+				t.Fatal(err)
+			}
+			// A value that compresses as much as Snappy can.
+			if err := s.CompareAndSwap("zeros", nil, make([]byte, 1<<20)); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Commit(newNopWriteCloser(&bytes.Buffer{})); err != nil {
+				t.Fatal(err)
+			}
+
+			snapshot := s.Snapshot(chunkSize)
+			if want, have := len(snapshot.Chunks), len(snapshot.Manifest.Chunks); want != have {
+				t.Fatalf("chunk hashes: want %d, have %d", want, have)
+			}
+			restored, err := restoreSnapshot(snapshot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, have := s.Commits(), restored.Commits(); want != have {
+				t.Errorf("Commits: want %d, have %d", want, have)
+			}
+			if want, have := s.Hash(), restored.Hash(); !bytes.Equal(want, have) {
+				t.Errorf("Hash: want %X, have %X", want, have)
+			}
+			if want, have := s.List(""), restored.List(""); !reflect.DeepEqual(want, have) {
+				t.Errorf("List: want %v, have %v", want, have)
+			}
+
+			// What's saved restores to the same state.
+			var buf bytes.Buffer
+			if err := restored.Save(&buf); err != nil {
+				t.Fatal(err)
+			}
+			saved := NewState()
+			if err := saved.Restore(&buf); err != nil {
+				t.Fatal(err)
+			}
+			if want, have := s.Hash(), saved.Hash(); !bytes.Equal(want, have) {
+				t.Errorf("Save: want hash %X, have %X", want, have)
+			}
+		})
+	}
+}
+
+func TestSnapshotInvalid(t *testing.T) {
+	s := NewState()
+	for _, key := range []string{"a", "b", "c"} {
+		if err := s.CompareAndSwap(key, nil, []byte(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Commit(newNopWriteCloser(&bytes.Buffer{})); err != nil {
+		t.Fatal(err)
+	}
+	valid := s.Snapshot(1)
+
+	for name, corrupt := range map[string]func(*Snapshot){
+		"version": func(s *Snapshot) { s.Manifest.Version++ },
+		"chunk":   func(s *Snapshot) { s.Chunks[1] = append([]byte{}, s.Chunks[0]...) },
+		"missing": func(s *Snapshot) { s.Chunks = s.Chunks[:2] },
+		"extra":   func(s *Snapshot) { s.Chunks = append(s.Chunks, s.Chunks[2]) },
+		"keys":    func(s *Snapshot) { s.Manifest.Keys++ },
+		"hash":    func(s *Snapshot) { s.Manifest.AppHash = valueHash(nil) },
+		"length": func(s *Snapshot) {
+			// A chunk that claims to decode to a terabyte.
+			chunk := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+1)
+			chunk = append(chunk[:binary.PutUvarint(chunk, 1<<40)], 0)
+			sum := sha256.Sum256(chunk)
+			s.Chunks[0], s.Manifest.Chunks[0] = chunk, sum[:]
+		},
+		"order": func(s *Snapshot) {
+			s.Chunks[0], s.Chunks[1] = s.Chunks[1], s.Chunks[0]
+			s.Manifest.Chunks[0], s.Manifest.Chunks[1] = s.Manifest.Chunks[1], s.Manifest.Chunks[0]
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			snapshot := Snapshot{
+				Manifest: valid.Manifest,
+				Chunks:   append([][]byte{}, valid.Chunks...),
+			}
+			snapshot.Manifest.Chunks = append(snapshot.Manifest.Chunks[:0:0], valid.Manifest.Chunks...)
+			corrupt(&snapshot)
+			if _, err := restoreSnapshot(snapshot); err == nil {
+				t.Errorf("want error, have none")
+			}
+		})
+	}
+}
+
+func restoreSnapshot(snapshot Snapshot) (*State, error) {
+	r, err := NewSnapshotRestorer(snapshot.Manifest)
+	if err != nil {
+		return nil, err
+	}
+	for _, chunk := range snapshot.Chunks {
+		if err := r.Add(chunk); err != nil {
+			return nil, err
+		}
+	}
+	return r.State()
+}
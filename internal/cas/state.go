@@ -2,13 +2,20 @@ package cas
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/json"
 	"errors"
 	"io"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 )
 
+// restoreProgressInterval is how often Restore logs its progress, when it's
+// given a logger.
+const restoreProgressInterval = 5 * time.Second
+
 // Errors related to the state.
 var (
 	ErrCASFailure  = errors.New("CAS failure")
@@ -17,18 +24,22 @@ var (
 
 // State provides a key-value store with compare-and-swap mutability.
 // Persistence is achieved by manually invoking Commit (and Restore).
+//
+// The data is a persistent treap, so the state at the time of last commit is
+// kept without copying it, and a copy of the whole state costs nothing.
 type State struct {
 	mtx            sync.RWMutex
-	data           map[string][]byte
+	data           *treapNode
 	commitCount    int64
-	lastCommitHash []byte
+	lastCommit     *merkleTree
+	lastCommitSize int64
 }
 
 // NewState returns a new, empty state.
 // Load persisted data, if any, via Restore.
 func NewState() *State {
 	return &State{
-		data: map[string][]byte{},
+		lastCommit: newMerkleTree(0, nil),
 	}
 }
 
@@ -37,66 +48,180 @@ func NewState() *State {
 func (s *State) Get(key string) ([]byte, error) {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
-	v, ok := s.data[key]
-	if !ok {
+	n := s.data.get(key)
+	if n == nil {
 		return nil, ErrKeyNotFound
 	}
-	return v, nil
+	return n.value, nil
+}
+
+// KeyValue is a single key and its value.
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// List returns every key with the given prefix, and its value, in key order.
+func (s *State) List(prefix string) []KeyValue {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	kvs := []KeyValue{}
+	s.data.ascend(s.data.rank(prefix), func(n *treapNode) bool {
+		if !strings.HasPrefix(n.key, prefix) {
+			return false
+		}
+		kvs = append(kvs, KeyValue{Key: n.key, Value: n.value})
+		return true
+	})
+	return kvs
 }
 
 // CompareAndSwap sets key to new if and only if its current value is old.
 // Returns ErrCASFailure if the current value is not old.
 func (s *State) CompareAndSwap(key string, old, new []byte) error {
+	return s.Apply([]Op{{Type: OpSet, Key: key, Old: old, New: new}})
+}
+
+// Apply the operations atomically, in order. Each operation sees the effects
+// of the operations before it. Returns ErrCASFailure, and makes no changes, if
+// any operation's comparison fails.
+func (s *State) Apply(ops []Op) error {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
-	if current := s.data[key]; !bytes.Equal(current, old) {
-		return ErrCASFailure
+
+	type pendingValue struct {
+		value   []byte
+		deleted bool
+	}
+	pending := make(map[string]pendingValue, len(ops))
+	current := func(key string) []byte {
+		if p, ok := pending[key]; ok {
+			return p.value
+		}
+		if n := s.data.get(key); n != nil {
+			return n.value
+		}
+		return nil
+	}
+
+	for _, op := range ops {
+		if !bytes.Equal(current(op.Key), op.Old) {
+			return ErrCASFailure
+		}
+		switch op.Type {
+		case OpSet:
+			pending[op.Key] = pendingValue{value: op.New}
+		case OpDelete:
+			pending[op.Key] = pendingValue{deleted: true}
+		}
+	}
+
+	for k, p := range pending {
+		switch {
+		case !p.deleted:
+			s.data = s.data.set(k, p.value)
+		case s.data.get(k) != nil:
+			s.data = s.data.delete(k)
+		}
 	}
-	s.data[key] = new
 	return nil
 }
 
-// Commit the current state to the WriteCloser. On success, close the
-// WriteCloser, increment the commit count, and update the last commit hash.
-func (s *State) Commit(wc io.WriteCloser) (err error) {
+// Commit the current state: increment the commit count, and update the last
+// commit hash. Then write the committed state to the WriteCloser, and close it.
+// Only the first part holds the write lock, so reads needn't wait for the
+// write. If the write fails, the state is committed all the same.
+func (s *State) Commit(wc io.WriteCloser) error {
+	return s.persist(s.freeze(), wc)
+}
+
+// freeze commits the current state, and returns it, as committed.
+func (s *State) freeze() *merkleTree {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
-	var (
-		shasum = sha256.New()
-		multi  = io.MultiWriter(wc, shasum)
-	)
-	err = json.NewEncoder(multi).Encode(serializationFormat{
-		Data:        s.data,
-		CommitCount: s.commitCount + 1,
-	})
-	if err == nil {
-		err = wc.Close()
+	s.commit()
+	return s.lastCommit
+}
+
+// persist writes the committed state t to the WriteCloser, and closes it,
+// whether or not the write succeeded, so that it can clean up.
+func (s *State) persist(t *merkleTree, wc io.WriteCloser) error {
+	size := &countingWriter{}
+	err := writeStateFile(io.MultiWriter(wc, size), t)
+	if closeErr := wc.Close(); err == nil {
+		err = closeErr
 	}
 	if err == nil {
-		s.commitCount++
-		s.lastCommitHash = shasum.Sum(nil)
+		s.mtx.Lock()
+		s.lastCommitSize = size.n
+		s.mtx.Unlock()
 	}
 	return err
 }
 
-// Restore state from the Reader, overwriting any current state. On success,
-// update commit count from the serialized data, and writes the last commit hash
-// based on its own computation of a hash.
-func (s *State) Restore(r io.Reader) (err error) {
-	s.mtx.Lock()
-	defer s.mtx.Unlock()
+// commit increments the commit count, and makes the current state the last
+// committed one, which is already hashed, as it was changed. The caller must
+// hold the write lock.
+func (s *State) commit() {
+	s.commitCount++
+	s.lastCommit = newMerkleTree(s.commitCount, s.data)
+}
+
+// Restore state from the Reader, as written by Commit, overwriting any current
+// state. The state is read a key at a time, and its app hash checked against
+// the one written with it. On success, update commit count from the serialized
+// data, and the last commit hash.
+func (s *State) Restore(r io.Reader) error {
+	return s.restore(r, log.NewNopLogger())
+}
+
+// restore is Restore, logging its progress every restoreProgressInterval.
+func (s *State) restore(r io.Reader, logger log.Logger) error {
 	var (
-		intermediate serializationFormat
-		shasum       = sha256.New()
-		tee          = io.TeeReader(r, shasum)
+		size  = &countingWriter{}
+		begin = time.Now()
+		last  = begin
 	)
-	err = json.NewDecoder(tee).Decode(&intermediate)
-	if err == nil {
-		s.data = intermediate.Data
-		s.commitCount = intermediate.CommitCount
-		s.lastCommitHash = shasum.Sum(nil)
+	t, err := readStateFile(io.TeeReader(r, size), func(read, total int) {
+		if now := time.Now(); now.Sub(last) >= restoreProgressInterval {
+			level.Info(logger).Log("restore", "progress", "keys", read, "of", total, "bytes", size.n)
+			last = now
+		}
+	})
+	if err != nil {
+		return err
 	}
-	return err
+	level.Info(logger).Log("restore", "done", "height", t.height, "keys", t.data.len(), "bytes", size.n, "took", time.Since(begin))
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.data = t.data
+	s.commitCount = t.height
+	s.lastCommit = t
+	s.lastCommitSize = size.n
+	return nil
+}
+
+// Save writes the state as of the last commit to the Writer, in the same
+// format as Commit. A state restored from a snapshot is already committed, and
+// can be saved to be restored from later.
+func (s *State) Save(w io.Writer) error {
+	return writeStateFile(w, s.committed())
+}
+
+// Len returns the number of keys in the state.
+func (s *State) Len() int {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.data.len()
+}
+
+// Size returns the size in bytes of the state as last written by Commit, or
+// read by Restore.
+func (s *State) Size() int64 {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.lastCommitSize
 }
 
 // Commits returns the number of successful commits.
@@ -107,28 +232,47 @@ func (s *State) Commits() int64 {
 	return s.commitCount
 }
 
-// Hash returns a SHA256 hash of the state at time of last commit.
-// This value is not persisted, but is recalculated on Restore.
+// Hash returns the root of a Merkle tree of the state at time of last commit,
+// with a node for each key. This value is not persisted, but is recalculated
+// on Restore.
 func (s *State) Hash() []byte {
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
-	return s.lastCommitHash
+	return s.lastCommit.hash()
+}
+
+// Prove returns the value associated with the key at time of last commit, and
+// a proof of it against Hash. Returns ErrKeyNotFound, and a proof of the key's
+// absence, if not found.
+func (s *State) Prove(key string) ([]byte, Proof, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.lastCommit.get(key)
 }
 
-type serializationFormat struct {
-	Data        map[string][]byte `json:"data"`
-	CommitCount int64             `json:"commit_count"`
+// committed returns an immutable snapshot of the state at time of last commit.
+func (s *State) committed() *merkleTree {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.lastCommit
 }
 
+// copyState makes dst a copy of src, which costs nothing, as the data is
+// persistent.
 func copyState(dst, src *State) {
 	src.mtx.RLock()
 	defer src.mtx.RUnlock()
 	dst.mtx.Lock()
 	defer dst.mtx.Unlock()
-	dst.data = make(map[string][]byte, len(src.data))
-	for k, v := range src.data {
-		dst.data[k] = v
-	}
+	dst.data = src.data
 	dst.commitCount = src.commitCount
-	dst.lastCommitHash = src.lastCommitHash
+	dst.lastCommit = src.lastCommit
+	dst.lastCommitSize = src.lastCommitSize
+}
+
+type countingWriter struct{ n int64 }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
 }
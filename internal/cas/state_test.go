@@ -2,6 +2,9 @@ package cas
 
 import (
 	"bytes"
+	"fmt"
+	"math/rand"
+	"reflect"
 	"testing"
 )
 
@@ -64,3 +67,165 @@ func TestState(t *testing.T) {
 		t.Errorf("Get(x): want %v, have %v", want, have)
 	}
 }
+
+func TestStateSize(t *testing.T) {
+	s := NewState()
+	for _, key := range []string{"a", "b"} {
+		if err := s.CompareAndSwap(key, nil, []byte(key)); err != nil {
+			t.Fatalf("CAS(%s): %v", key, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := s.Commit(newNopWriteCloser(&buf)); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if want, have := 2, s.Len(); want != have {
+		t.Errorf("Len: want %d, have %d", want, have)
+	}
+	if want, have := int64(buf.Len()), s.Size(); want != have {
+		t.Errorf("Size: want %d, have %d", want, have)
+	}
+
+	other := NewState()
+	if err := other.Restore(&buf); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if want, have := s.Len(), other.Len(); want != have {
+		t.Errorf("Len: want %d, have %d", want, have)
+	}
+	if want, have := s.Size(), other.Size(); want != have {
+		t.Errorf("Size: want %d, have %d", want, have)
+	}
+}
+
+func TestStateApply(t *testing.T) {
+	s := NewState()
+
+	if err := s.Apply(SetTx("a", nil, []byte("one")).Ops); err != nil {
+		t.Fatalf("Apply(set a): %v", err)
+	}
+
+	// A failed comparison anywhere in the transaction means no changes.
+	if want, have := ErrCASFailure, s.Apply([]Op{
+		{Type: OpSet, Key: "b", New: []byte("two")},
+		{Type: OpCheck, Key: "a", Old: []byte("wrong")},
+	}); want != have {
+		t.Errorf("Apply(failed txn): want %v, have %v", want, have)
+	}
+	if _, err := s.Get("b"); err != ErrKeyNotFound {
+		t.Errorf("Get(b): want %v, have %v", ErrKeyNotFound, err)
+	}
+
+	// Operations see the effects of earlier operations in the transaction.
+	if err := s.Apply([]Op{
+		{Type: OpCheck, Key: "a", Old: []byte("one")},
+		{Type: OpSet, Key: "b", New: []byte("two")},
+		{Type: OpSet, Key: "b", Old: []byte("two"), New: []byte("three")},
+		{Type: OpDelete, Key: "a", Old: []byte("one")},
+	}); err != nil {
+		t.Fatalf("Apply(txn): %v", err)
+	}
+	if _, err := s.Get("a"); err != ErrKeyNotFound {
+		t.Errorf("Get(a): want %v, have %v", ErrKeyNotFound, err)
+	}
+
+	if want, have := []KeyValue{{Key: "b", Value: []byte("three")}}, s.List(""); !reflect.DeepEqual(want, have) {
+		t.Errorf("List: want %v, have %v", want, have)
+	}
+	if want, have := []KeyValue{}, s.List("x"); !reflect.DeepEqual(want, have) {
+		t.Errorf("List(x): want %v, have %v", want, have)
+	}
+}
+
+func TestStateCommitHash(t *testing.T) {
+	// A commit only hashes the nodes that changed, so check that it's the
+	// same as hashing everything. Every other commit only changes values, and
+	// the rest add and delete keys too.
+	var (
+		rng  = rand.New(rand.NewSource(1))
+		s    = NewState()
+		data = map[string][]byte{}
+	)
+	for commit := 0; commit < 100; commit++ {
+		valuesOnly := commit%2 == 1
+		for i := 0; i < rng.Intn(20); i++ {
+			key := fmt.Sprintf("k%03d", rng.Intn(200))
+			old, exists := data[key]
+			if valuesOnly && !exists {
+				continue
+			}
+			op := Op{Type: OpSet, Key: key, Old: old, New: []byte(fmt.Sprint(commit, i))}
+			if exists && !valuesOnly && rng.Intn(3) == 0 {
+				op = Op{Type: OpDelete, Key: key, Old: old}
+				delete(data, key)
+			} else {
+				data[key] = op.New
+			}
+			if err := s.Apply([]Op{op}); err != nil {
+				t.Fatalf("Apply(%v): %v", op, err)
+			}
+		}
+		if err := s.Commit(newNopWriteCloser(&bytes.Buffer{})); err != nil {
+			t.Fatal(err)
+		}
+		if want, have := newMerkleTree(0, newTreap(data)).hash(), s.Hash(); !bytes.Equal(want, have) {
+			t.Fatalf("commit %d: Hash: want %X, have %X", commit, want, have)
+		}
+		for _, key := range []string{"k000", "k100", "k199"} {
+			value, proof, err := s.Prove(key)
+			if err := proof.Verify(s.Hash(), key, value, err == nil); err != nil {
+				t.Fatalf("commit %d: Verify(%s): %v", commit, key, err)
+			}
+		}
+	}
+}
+
+// BenchmarkCommit measures a block of 100 operations, a commit, and resetting
+// the mempool state, at different state sizes. Persistence, which writes the
+// whole state, isn't included. Updating existing keys and inserting new ones
+// both hash only the paths to them, so take about as long whatever the size of
+// the state, give or take the depth of the treap.
+func BenchmarkCommit(b *testing.B) {
+	for _, keys := range []int{1000, 1000000} {
+		data := make(map[string][]byte, keys)
+		for i := 0; i < keys; i++ {
+			data[fmt.Sprintf("k%08d", 2*i)] = []byte(fmt.Sprint(i))
+		}
+		base := NewState()
+		base.data = newTreap(data)
+		base.lastCommit = newMerkleTree(0, base.data)
+
+		for _, insert := range []bool{false, true} {
+			name := fmt.Sprintf("keys=%d/update", keys)
+			if insert {
+				name = fmt.Sprintf("keys=%d/insert", keys)
+			}
+			b.Run(name, func(b *testing.B) {
+				var (
+					rng     = rand.New(rand.NewSource(1))
+					s       = NewState()
+					mempool = NewState()
+				)
+				copyState(s, base)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					for j := 0; j < 100; j++ {
+						key := fmt.Sprintf("k%08d", 2*rng.Intn(keys))
+						if insert {
+							key = fmt.Sprintf("k%08d", 2*rng.Intn(keys)+1)
+						}
+						old, _ := s.Get(key)
+						if err := s.Apply([]Op{{Type: OpSet, Key: key, Old: old, New: []byte(fmt.Sprint(i))}}); err != nil {
+							b.Fatal(err)
+						}
+					}
+					s.mtx.Lock()
+					s.commit()
+					s.mtx.Unlock()
+					copyState(mempool, s)
+				}
+			})
+		}
+	}
+}
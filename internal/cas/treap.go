@@ -0,0 +1,286 @@
+package cas
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+)
+
+// The state is held in a persistent treap: a binary search tree, ordered by
+// key, that's also a heap, ordered by a priority derived from each key. Nodes
+// are never modified once they're shared. Setting or deleting a key copies
+// only the nodes on the path to it, so keeping a version of the state, e.g. as
+// of the last commit, costs nothing, and versions share every node they can.
+//
+// The priority is a hash of the key, so the shape of a treap depends only on
+// its keys, and is balanced, with a depth of O(log n), however the keys were
+// chosen, unless someone does a lot of work to find keys that aren't. Equal
+// priorities are ordered by key, so that even they can't make the shape
+// depend on the order the keys were set in.
+//
+// Each node also holds the size of its subtree, so keys can be found by index,
+// and the hash of its subtree, as defined in hash.go. The Merkle tree of the
+// app hash is the treap itself, so a node is hashed when it's made, from its
+// children's hashes, and setting or deleting a key hashes only the nodes it
+// copies, however many keys there are.
+
+// treapNode is the root of a treap, or nil for an empty one.
+type treapNode struct {
+	key         string
+	value       []byte
+	leaf        []byte // leafHash(key, valueHash(value))
+	priority    uint64
+	size        int    // of the subtree
+	hash        []byte // of the subtree
+	left, right *treapNode
+}
+
+// newTreapNode returns a node of the key, without children, whose size and
+// hash aren't yet set.
+func newTreapNode(key string, value []byte) *treapNode {
+	sum := sha256.Sum256([]byte(key))
+	return &treapNode{
+		key:      key,
+		value:    value,
+		leaf:     leafHash(key, valueHash(value)),
+		priority: binary.BigEndian.Uint64(sum[:8]),
+	}
+}
+
+// newTreap returns a treap of the data.
+func newTreap(data map[string][]byte) *treapNode {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b treapBuilder
+	for _, k := range keys {
+		b.add(k, data[k])
+	}
+	return b.treap()
+}
+
+// treapBuilder builds a treap from keys added in ascending order, in linear
+// time. The right spine of the treap so far is kept on a stack, and each new
+// node is the new bottom of it, with any nodes of lower priority as its left
+// child.
+type treapBuilder struct {
+	spine []*treapNode
+}
+
+// add adds the key, which must be greater than any added before, and returns
+// its node.
+func (b *treapBuilder) add(key string, value []byte) *treapNode {
+	n := newTreapNode(key, value)
+	var last *treapNode
+	for len(b.spine) > 0 && n.above(b.spine[len(b.spine)-1]) {
+		last = b.spine[len(b.spine)-1]
+		b.spine = b.spine[:len(b.spine)-1]
+	}
+	n.left = last
+	if len(b.spine) > 0 {
+		b.spine[len(b.spine)-1].right = n
+	}
+	b.spine = append(b.spine, n)
+	return n
+}
+
+// treap returns the treap, updating the size and hash of every node, as nodes
+// were added under them. Nothing else may be added afterwards.
+func (b *treapBuilder) treap() *treapNode {
+	if len(b.spine) == 0 {
+		return nil
+	}
+	root := b.spine[0]
+	root.updateAll()
+	return root
+}
+
+func (n *treapNode) updateAll() {
+	if n == nil {
+		return
+	}
+	n.left.updateAll()
+	n.right.updateAll()
+	n.update()
+}
+
+// update sets the size and hash of n from its children's, and returns it. n
+// must be new, or a copy, not yet shared.
+func (n *treapNode) update() *treapNode {
+	n.size = 1 + n.left.len() + n.right.len()
+	n.hash = nodeHash(n.size, n.left.merkleHash(), n.leaf, n.right.merkleHash())
+	return n
+}
+
+// merkleHash returns the hash of the treap, which is empty if it is.
+func (n *treapNode) merkleHash() []byte {
+	if n == nil {
+		return nil
+	}
+	return n.hash
+}
+
+func (n *treapNode) len() int {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
+
+// get returns the node of the key, or nil if there isn't one.
+func (n *treapNode) get(key string) *treapNode {
+	for n != nil {
+		switch {
+		case key < n.key:
+			n = n.left
+		case key > n.key:
+			n = n.right
+		default:
+			return n
+		}
+	}
+	return nil
+}
+
+// rank returns the number of keys less than the key, which is the index of the
+// key, if it's present, or the index it would have, if it were.
+func (n *treapNode) rank(key string) int {
+	var r int
+	for n != nil {
+		if key <= n.key {
+			n = n.left
+		} else {
+			r += n.left.len() + 1
+			n = n.right
+		}
+	}
+	return r
+}
+
+// at returns the node at the index, which must be in range.
+func (n *treapNode) at(index int) *treapNode {
+	for {
+		switch l := n.left.len(); {
+		case index < l:
+			n = n.left
+		case index > l:
+			index -= l + 1
+			n = n.right
+		default:
+			return n
+		}
+	}
+}
+
+// ascend calls f with each node from the index onwards, in key order, until f
+// returns false. It returns false if f did.
+func (n *treapNode) ascend(from int, f func(*treapNode) bool) bool {
+	if n == nil {
+		return true
+	}
+	l := n.left.len()
+	if from < l && !n.left.ascend(from, f) {
+		return false
+	}
+	if from <= l && !f(n) {
+		return false
+	}
+	from -= l + 1
+	if from < 0 {
+		from = 0
+	}
+	return n.right.ascend(from, f)
+}
+
+// set returns a treap with the key set to the value.
+func (n *treapNode) set(key string, value []byte) *treapNode {
+	if n == nil {
+		return newTreapNode(key, value).update()
+	}
+	c := n.copy()
+	switch {
+	case key < n.key:
+		c.left = n.left.set(key, value)
+		if c.left.above(c) {
+			c = c.rotateRight()
+		}
+	case key > n.key:
+		c.right = n.right.set(key, value)
+		if c.right.above(c) {
+			c = c.rotateLeft()
+		}
+	default:
+		c.value = value
+		c.leaf = leafHash(key, valueHash(value))
+	}
+	return c.update()
+}
+
+// delete returns a treap without the key, which must be present.
+func (n *treapNode) delete(key string) *treapNode {
+	switch {
+	case key < n.key:
+		c := n.copy()
+		c.left = n.left.delete(key)
+		return c.update()
+	case key > n.key:
+		c := n.copy()
+		c.right = n.right.delete(key)
+		return c.update()
+	default:
+		return mergeTreaps(n.left, n.right)
+	}
+}
+
+// mergeTreaps returns a treap of every key in both, where every key in a is
+// less than every key in b.
+func mergeTreaps(a, b *treapNode) *treapNode {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.above(b):
+		c := a.copy()
+		c.right = mergeTreaps(a.right, b)
+		return c.update()
+	default:
+		c := b.copy()
+		c.left = mergeTreaps(a, b.left)
+		return c.update()
+	}
+}
+
+// above returns true if n belongs above m: if it has the higher priority, or,
+// if they're equal, the lower key.
+func (n *treapNode) above(m *treapNode) bool {
+	if n.priority != m.priority {
+		return n.priority > m.priority
+	}
+	return n.key < m.key
+}
+
+func (n *treapNode) copy() *treapNode {
+	c := *n
+	return &c
+}
+
+// rotateRight makes the left child of n the parent of n. Both must be copies,
+// not yet shared. Only n is updated, as the caller updates the new parent.
+func (n *treapNode) rotateRight() *treapNode {
+	l := n.left
+	n.left, l.right = l.right, n
+	n.update()
+	return l
+}
+
+// rotateLeft makes the right child of n the parent of n. Both must be copies,
+// not yet shared. Only n is updated, as the caller updates the new parent.
+func (n *treapNode) rotateLeft() *treapNode {
+	r := n.right
+	n.right, r.left = r.left, n
+	n.update()
+	return r
+}
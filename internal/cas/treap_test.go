@@ -0,0 +1,143 @@
+package cas
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestTreap(t *testing.T) {
+	var (
+		rng      = rand.New(rand.NewSource(1))
+		data     = map[string][]byte{}
+		treap    *treapNode
+		versions []*treapNode
+		want     []map[string][]byte
+	)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("k%03d", rng.Intn(300))
+		if treap.get(key) != nil && rng.Intn(3) == 0 {
+			delete(data, key)
+			treap = treap.delete(key)
+		} else {
+			value := []byte(fmt.Sprint(i))
+			data[key] = value
+			treap = treap.set(key, value)
+		}
+		if i%100 == 0 {
+			versions = append(versions, treap)
+			want = append(want, copyData(data))
+		}
+	}
+
+	// Every version is as it was, and as one built from scratch.
+	for i, v := range versions {
+		checkTreap(t, fmt.Sprintf("version %d", i), v, want[i])
+		checkTreap(t, fmt.Sprintf("version %d, built", i), newTreap(want[i]), want[i])
+	}
+	checkTreap(t, "latest", treap, data)
+	if want, have := 0, (*treapNode)(nil).len(); want != have {
+		t.Errorf("len(nil): want %d, have %d", want, have)
+	}
+}
+
+func checkTreap(t *testing.T, name string, treap *treapNode, data map[string][]byte) {
+	t.Helper()
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if want, have := len(keys), treap.len(); want != have {
+		t.Fatalf("%s: len: want %d, have %d", name, want, have)
+	}
+	ascended := []string{}
+	treap.ascend(0, func(n *treapNode) bool {
+		ascended = append(ascended, n.key)
+		return true
+	})
+	if !reflect.DeepEqual(keys, ascended) {
+		t.Fatalf("%s: ascend: want %q, have %q", name, keys, ascended)
+	}
+	for i, k := range keys {
+		n := treap.get(k)
+		if n == nil || !bytes.Equal(n.value, data[k]) {
+			t.Fatalf("%s: get(%s): want %q, have %v", name, k, data[k], n)
+		}
+		if want, have := leafHash(k, valueHash(data[k])), n.leaf; !bytes.Equal(want, have) {
+			t.Fatalf("%s: get(%s): want leaf %X, have %X", name, k, want, have)
+		}
+		if want, have := i, treap.rank(k); want != have {
+			t.Fatalf("%s: rank(%s): want %d, have %d", name, k, want, have)
+		}
+		if want, have := k, treap.at(i).key; want != have {
+			t.Fatalf("%s: at(%d): want %s, have %s", name, i, want, have)
+		}
+		var from []string
+		treap.ascend(i, func(n *treapNode) bool {
+			from = append(from, n.key)
+			return len(from) < 3
+		})
+		if want := keys[i:min(i+3, len(keys))]; !reflect.DeepEqual(want, from) {
+			t.Fatalf("%s: ascend(%d): want %q, have %q", name, i, want, from)
+		}
+	}
+	if treap.get("absent") != nil {
+		t.Fatalf("%s: get(absent): want nil", name)
+	}
+	checkHeap(t, name, treap)
+}
+
+func checkHeap(t *testing.T, name string, n *treapNode) {
+	t.Helper()
+	if n == nil {
+		return
+	}
+	for _, child := range []*treapNode{n.left, n.right} {
+		if child != nil {
+			if child.above(n) {
+				t.Fatalf("%s: %s belongs above its parent %s", name, child.key, n.key)
+			}
+			checkHeap(t, name, child)
+		}
+	}
+	if want, have := 1+n.left.len()+n.right.len(), n.size; want != have {
+		t.Fatalf("%s: %s: want size %d, have %d", name, n.key, want, have)
+	}
+	if want, have := nodeHash(n.size, n.left.merkleHash(), n.leaf, n.right.merkleHash()), n.hash; !bytes.Equal(want, have) {
+		t.Fatalf("%s: %s: want hash %X, have %X", name, n.key, want, have)
+	}
+}
+
+func TestTreapEqualPriorities(t *testing.T) {
+	// Keys whose priorities are equal, which takes work to find, are ordered
+	// by key, so the shape doesn't depend on which was set first.
+	a := &treapNode{key: "a", priority: 1}
+	b := &treapNode{key: "b", priority: 1}
+	if !a.above(b) || b.above(a) {
+		t.Errorf("want a above b, have a.above(b) %v, b.above(a) %v", a.above(b), b.above(a))
+	}
+	c := &treapNode{key: "c", priority: 2}
+	if !c.above(a) || a.above(c) {
+		t.Errorf("want c above a, have c.above(a) %v, a.above(c) %v", c.above(a), a.above(c))
+	}
+}
+
+func copyData(data map[string][]byte) map[string][]byte {
+	c := make(map[string][]byte, len(data))
+	for k, v := range data {
+		c[k] = v
+	}
+	return c
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
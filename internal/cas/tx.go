@@ -0,0 +1,133 @@
+package cas
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// OpType identifies the kind of an Op.
+type OpType string
+
+// Operations that may be included in a transaction.
+const (
+	// OpCheck asserts that the current value of the key is Old.
+	OpCheck OpType = "check"
+
+	// OpSet sets the key to New, if its current value is Old.
+	OpSet OpType = "set"
+
+	// OpDelete deletes the key, if its current value is Old.
+	OpDelete OpType = "delete"
+)
+
+// Op is a single compare-and-swap operation on a key. Every operation compares
+// the current value of the key with Old; an empty Old matches a key that
+// doesn't exist.
+type Op struct {
+	Type OpType `json:"op"`
+	Key  string `json:"key"`
+	Old  []byte `json:"old,omitempty"`
+	New  []byte `json:"new,omitempty"`
+}
+
+// Tx is a transaction: a sequence of operations that are applied atomically,
+// in order. Either every operation succeeds, or none of them take effect.
+type Tx struct {
+	Ops []Op `json:"ops"`
+}
+
+// Keys returns the keys touched by the transaction, in order of first
+// appearance.
+func (tx Tx) Keys() []string {
+	var (
+		keys = make([]string, 0, len(tx.Ops))
+		seen = make(map[string]bool, len(tx.Ops))
+	)
+	for _, op := range tx.Ops {
+		if !seen[op.Key] {
+			keys = append(keys, op.Key)
+			seen[op.Key] = true
+		}
+	}
+	return keys
+}
+
+// txPrefix marks a transaction encoded by Encode. The original format is any
+// string with at least two colons, so, to tell the two apart without changing
+// the meaning of any transaction that was valid before, an encoded transaction
+// has exactly one: the one in the prefix. The JSON that follows it is base64
+// encoded, as it would otherwise have colons of its own.
+const txPrefix = "cas.tx:"
+
+// Encode the transaction for broadcast to Tendermint.
+func (tx Tx) Encode() []byte {
+	buf, _ := json.Marshal(tx) // can't fail
+	p := make([]byte, len(txPrefix)+base64.StdEncoding.EncodedLen(len(buf)))
+	copy(p, txPrefix)
+	base64.StdEncoding.Encode(p[len(txPrefix):], buf)
+	return p
+}
+
+// Validate returns an error if the transaction is malformed.
+func (tx Tx) Validate() error {
+	if len(tx.Ops) == 0 {
+		return errors.New("transaction has no operations")
+	}
+	for i, op := range tx.Ops {
+		if op.Key == "" {
+			return fmt.Errorf("operation %d: empty key", i)
+		}
+		switch op.Type {
+		case OpCheck, OpDelete:
+			if len(op.New) > 0 {
+				return fmt.Errorf("operation %d: %s may not have a new value", i, op.Type)
+			}
+		case OpSet:
+		default:
+			return fmt.Errorf("operation %d: unknown type %q", i, op.Type)
+		}
+	}
+	return nil
+}
+
+// DecodeTx parses and validates a transaction received from Tendermint.
+//
+// Transactions are normally encoded by Encode. For compatibility, the original
+// "<key>:<old>:<new>" format is also accepted, and decoded, exactly as it
+// always was, as a transaction with a single set operation. As that includes
+// any key at all, even an empty one, which Validate would reject, a legacy
+// transaction isn't validated.
+func DecodeTx(p []byte) (Tx, error) {
+	if tokens := bytes.SplitN(p, []byte{':'}, 3); len(tokens) == 3 {
+		return SetTx(string(tokens[0]), tokens[1], tokens[2]), nil
+	}
+	if !bytes.HasPrefix(p, []byte(txPrefix)) {
+		return Tx{}, errors.New(`bad request: tx data must be "<key>:<old>:<new>" or an encoded transaction`)
+	}
+	buf := make([]byte, base64.StdEncoding.DecodedLen(len(p)-len(txPrefix)))
+	n, err := base64.StdEncoding.Decode(buf, p[len(txPrefix):])
+	if err != nil {
+		return Tx{}, fmt.Errorf("bad request: %v", err)
+	}
+	var tx Tx
+	if err := json.Unmarshal(buf[:n], &tx); err != nil {
+		return Tx{}, fmt.Errorf("bad request: %v", err)
+	}
+	if err := tx.Validate(); err != nil {
+		return Tx{}, fmt.Errorf("bad request: %v", err)
+	}
+	return tx, nil
+}
+
+// SetTx returns a transaction with a single set operation.
+func SetTx(key string, old, new []byte) Tx {
+	return Tx{Ops: []Op{{Type: OpSet, Key: key, Old: old, New: new}}}
+}
+
+// DeleteTx returns a transaction with a single delete operation.
+func DeleteTx(key string, old []byte) Tx {
+	return Tx{Ops: []Op{{Type: OpDelete, Key: key, Old: old}}}
+}
@@ -0,0 +1,98 @@
+package cas
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeTx(t *testing.T) {
+	for _, testcase := range []struct {
+		name  string
+		input string
+		want  Tx
+		ok    bool
+	}{
+		{
+			name:  "legacy",
+			input: "a:one:two",
+			want:  SetTx("a", []byte("one"), []byte("two")),
+			ok:    true,
+		},
+		{
+			name:  "legacy with colons in new",
+			input: "a::b:c",
+			want:  SetTx("a", []byte{}, []byte("b:c")),
+			ok:    true,
+		},
+		{
+			name:  "legacy empty key",
+			input: "::x",
+			want:  SetTx("", []byte{}, []byte("x")),
+			ok:    true,
+		},
+		{
+			name:  "legacy key like JSON",
+			input: `{"ops":[{"op":"set","key":"a"}]}`,
+			want:  SetTx(`{"ops"`, []byte(`[{"op"`), []byte(`"set","key":"a"}]}`)),
+			ok:    true,
+		},
+		{
+			name:  "legacy key like the prefix",
+			input: "cas.tx:e30=:",
+			want:  SetTx("cas.tx", []byte("e30="), []byte{}),
+			ok:    true,
+		},
+		{
+			name:  "legacy too few tokens",
+			input: "a:b",
+		},
+		{
+			name:  "JSON round trip",
+			input: string(Tx{Ops: []Op{{Type: OpCheck, Key: "a:b", Old: []byte("1")}, {Type: OpDelete, Key: "c"}}}.Encode()),
+			want:  Tx{Ops: []Op{{Type: OpCheck, Key: "a:b", Old: []byte("1")}, {Type: OpDelete, Key: "c"}}},
+			ok:    true,
+		},
+		{
+			name:  "JSON no ops",
+			input: encodedTx(`{"ops":[]}`),
+		},
+		{
+			name:  "JSON unknown op",
+			input: encodedTx(`{"ops":[{"op":"frobnicate","key":"a"}]}`),
+		},
+		{
+			name:  "JSON delete with new value",
+			input: encodedTx(`{"ops":[{"op":"delete","key":"a","new":"Zm9v"}]}`),
+		},
+		{
+			name:  "JSON malformed",
+			input: encodedTx(`{"ops":`),
+		},
+		{
+			name:  "JSON not base64",
+			input: txPrefix + `{"ops"}`,
+		},
+		{
+			name:  "JSON without the prefix",
+			input: `{"ops"}`,
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			tx, err := DecodeTx([]byte(testcase.input))
+			if want, have := testcase.ok, err == nil; want != have {
+				t.Fatalf("DecodeTx(%q): want ok=%v, have error %v", testcase.input, want, err)
+			}
+			if !testcase.ok {
+				return
+			}
+			if want, have := testcase.want, tx; !reflect.DeepEqual(want, have) {
+				t.Errorf("DecodeTx(%q): want %+v, have %+v", testcase.input, want, have)
+			}
+		})
+	}
+}
+
+func encodedTx(json string) string {
+	return txPrefix + base64.StdEncoding.EncodeToString([]byte(json))
+}
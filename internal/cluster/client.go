@@ -0,0 +1,241 @@
+package cluster
+
+import (
+	"fmt"
+
+	tendermintabci "github.com/tendermint/tendermint/abci/types"
+	tendermintcommon "github.com/tendermint/tendermint/libs/common"
+	tendermintdb "github.com/tendermint/tendermint/libs/db"
+	tendermintquery "github.com/tendermint/tendermint/libs/pubsub/query"
+	tendermintnode "github.com/tendermint/tendermint/node"
+	tendermintrpcclient "github.com/tendermint/tendermint/rpc/client"
+	tendermintcoretypes "github.com/tendermint/tendermint/rpc/core/types"
+	tendermintstate "github.com/tendermint/tendermint/state"
+	tendermintkv "github.com/tendermint/tendermint/state/txindex/kv"
+	tenderminttypes "github.com/tendermint/tendermint/types"
+)
+
+// Client is a client of one node, with the methods of Tendermint's RPC client
+// that the HTTP API, and state sync, use. Each method does what Tendermint's RPC server does,
+// but for the one node, rather than for whichever node configured the server.
+type Client struct {
+	*tenderminttypes.EventBus // Subscribe, Unsubscribe, and UnsubscribeAll
+
+	node      *tendermintnode.Node
+	stateDB   tendermintdb.DB
+	txIndexer *tendermintkv.TxIndex
+}
+
+func newClient(node *tendermintnode.Node, dbs map[string]tendermintdb.DB) *Client {
+	return &Client{
+		EventBus:  node.EventBus(),
+		node:      node,
+		stateDB:   dbs["state"],
+		txIndexer: tendermintkv.NewTxIndex(dbs["tx_index"]),
+	}
+}
+
+// Status returns the node's status.
+func (c *Client) Status() (*tendermintcoretypes.ResultStatus, error) {
+	var (
+		consensus = c.node.ConsensusState()
+		height    = consensus.GetLastHeight()
+		pubKey    = c.node.PrivValidator().GetPubKey()
+		syncInfo  = tendermintcoretypes.SyncInfo{CatchingUp: c.node.ConsensusReactor().FastSync()}
+	)
+	if syncInfo.CatchingUp {
+		height = c.node.BlockStore().Height()
+	}
+	syncInfo.LatestBlockHeight = height
+	if height > 0 {
+		meta := c.node.BlockStore().LoadBlockMeta(height)
+		syncInfo.LatestBlockHash = meta.BlockID.Hash
+		syncInfo.LatestAppHash = meta.Header.AppHash
+		syncInfo.LatestBlockTime = meta.Header.Time
+	}
+	var votingPower int64
+	if validators, err := tendermintstate.LoadValidators(c.stateDB, height); err == nil {
+		if _, v := validators.GetByAddress(pubKey.Address()); v != nil {
+			votingPower = v.VotingPower
+		}
+	}
+	return &tendermintcoretypes.ResultStatus{
+		NodeInfo: c.node.NodeInfo(),
+		SyncInfo: syncInfo,
+		ValidatorInfo: tendermintcoretypes.ValidatorInfo{
+			Address:     pubKey.Address(),
+			PubKey:      pubKey,
+			VotingPower: votingPower,
+		},
+	}, nil
+}
+
+// NetInfo returns the node's peers. Like Tendermint's, it reads the status of
+// each peer's connection without synchronization, so the race detector may
+// object to it while the peers are busy.
+func (c *Client) NetInfo() (*tendermintcoretypes.ResultNetInfo, error) {
+	peers := []tendermintcoretypes.Peer{}
+	for _, peer := range c.node.Switch().Peers().List() {
+		peers = append(peers, tendermintcoretypes.Peer{
+			NodeInfo:         peer.NodeInfo(),
+			IsOutbound:       peer.IsOutbound(),
+			ConnectionStatus: peer.Status(),
+		})
+	}
+	return &tendermintcoretypes.ResultNetInfo{
+		Listening: c.node.IsListening(),
+		Listeners: c.node.Listeners(),
+		NPeers:    len(peers),
+		Peers:     peers,
+	}, nil
+}
+
+// Validators returns the validators at the height, or the latest, if height
+// is nil.
+func (c *Client) Validators(height *int64) (*tendermintcoretypes.ResultValidators, error) {
+	h := c.node.ConsensusState().GetState().LastBlockHeight + 1
+	if height != nil {
+		if *height <= 0 || *height > h {
+			return nil, fmt.Errorf("height %d out of range", *height)
+		}
+		h = *height
+	}
+	validators, err := tendermintstate.LoadValidators(c.stateDB, h)
+	if err != nil {
+		return nil, err
+	}
+	return &tendermintcoretypes.ResultValidators{BlockHeight: h, Validators: validators.Validators}, nil
+}
+
+// Block returns the block at the height, or the latest, if height is nil.
+func (c *Client) Block(height *int64) (*tendermintcoretypes.ResultBlock, error) {
+	h, err := c.height(height)
+	if err != nil {
+		return nil, err
+	}
+	return &tendermintcoretypes.ResultBlock{
+		BlockMeta: c.node.BlockStore().LoadBlockMeta(h),
+		Block:     c.node.BlockStore().LoadBlock(h),
+	}, nil
+}
+
+// Commit returns the header at the height, or the latest, if height is nil,
+// and the commit for it. The latest block's commit is the one the node saw,
+// which isn't canonical, as the next block may include another.
+func (c *Client) Commit(height *int64) (*tendermintcoretypes.ResultCommit, error) {
+	h, err := c.height(height)
+	if err != nil {
+		return nil, err
+	}
+	header := c.node.BlockStore().LoadBlockMeta(h).Header
+	if h == c.node.BlockStore().Height() {
+		return tendermintcoretypes.NewResultCommit(&header, c.node.BlockStore().LoadSeenCommit(h), false), nil
+	}
+	return tendermintcoretypes.NewResultCommit(&header, c.node.BlockStore().LoadBlockCommit(h), true), nil
+}
+
+// height returns the height, or the block store's, if height is nil.
+func (c *Client) height(height *int64) (int64, error) {
+	h := c.node.BlockStore().Height()
+	if height != nil {
+		if *height <= 0 || *height > h {
+			return 0, fmt.Errorf("height %d out of range", *height)
+		}
+		h = *height
+	}
+	return h, nil
+}
+
+// ABCIInfo returns the application's Info.
+func (c *Client) ABCIInfo() (*tendermintcoretypes.ResultABCIInfo, error) {
+	info, err := c.node.ProxyApp().Query().InfoSync(tendermintabci.RequestInfo{})
+	if err != nil {
+		return nil, err
+	}
+	return &tendermintcoretypes.ResultABCIInfo{Response: *info}, nil
+}
+
+// ABCIQuery queries the application, with a proof.
+func (c *Client) ABCIQuery(path string, data tendermintcommon.HexBytes) (*tendermintcoretypes.ResultABCIQuery, error) {
+	return c.ABCIQueryWithOptions(path, data, tendermintrpcclient.DefaultABCIQueryOptions)
+}
+
+// ABCIQueryWithOptions queries the application.
+func (c *Client) ABCIQueryWithOptions(path string, data tendermintcommon.HexBytes, opts tendermintrpcclient.ABCIQueryOptions) (*tendermintcoretypes.ResultABCIQuery, error) {
+	if opts.Height < 0 {
+		return nil, fmt.Errorf("height must be non-negative")
+	}
+	response, err := c.node.ProxyApp().Query().QuerySync(tendermintabci.RequestQuery{
+		Path:   path,
+		Data:   data,
+		Height: opts.Height,
+		Prove:  !opts.Trusted,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &tendermintcoretypes.ResultABCIQuery{Response: *response}, nil
+}
+
+// BroadcastTxSync adds the transaction to the node's mempool, and returns the
+// result of CheckTx.
+func (c *Client) BroadcastTxSync(tx tenderminttypes.Tx) (*tendermintcoretypes.ResultBroadcastTx, error) {
+	results := make(chan *tendermintabci.Response, 1)
+	if err := c.node.MempoolReactor().Mempool.CheckTx(tx, func(r *tendermintabci.Response) {
+		results <- r
+	}); err != nil {
+		return nil, fmt.Errorf("Error broadcasting transaction: %v", err)
+	}
+	r := (<-results).GetCheckTx()
+	return &tendermintcoretypes.ResultBroadcastTx{
+		Code: r.Code,
+		Data: r.Data,
+		Log:  r.Log,
+		Hash: tx.Hash(),
+	}, nil
+}
+
+// TxSearch searches the node's transaction index.
+func (c *Client) TxSearch(query string, prove bool, page, perPage int) (*tendermintcoretypes.ResultTxSearch, error) {
+	q, err := tendermintquery.New(query)
+	if err != nil {
+		return nil, err
+	}
+	results, err := c.txIndexer.Search(q)
+	if err != nil {
+		return nil, err
+	}
+
+	// Page as Tendermint does.
+	total := len(results)
+	const defaultPerPage, maxPerPage = 30, 100
+	if perPage < 1 || perPage > maxPerPage {
+		perPage = defaultPerPage
+	}
+	if pages := (total-1)/perPage + 1; page < 1 {
+		page = 1
+	} else if page > pages {
+		page = pages
+	}
+	results = results[(page-1)*perPage:]
+	if len(results) > perPage {
+		results = results[:perPage]
+	}
+
+	txs := make([]*tendermintcoretypes.ResultTx, len(results))
+	for i, r := range results {
+		var proof tenderminttypes.TxProof
+		if prove {
+			proof = c.node.BlockStore().LoadBlock(r.Height).Data.Txs.Proof(int(r.Index))
+		}
+		txs[i] = &tendermintcoretypes.ResultTx{
+			Hash:     r.Tx.Hash(),
+			Height:   r.Height,
+			Index:    r.Index,
+			TxResult: r.Result,
+			Tx:       r.Tx,
+			Proof:    proof,
+		}
+	}
+	return &tendermintcoretypes.ResultTxSearch{Txs: txs, TotalCount: total}, nil
+}
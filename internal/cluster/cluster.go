@@ -0,0 +1,322 @@
+// Package cluster runs a network of validators in one process, for integration
+// tests. Each node is a full Tendermint node, with a cas.Application, in-memory
+// databases, generated keys, and ephemeral ports, and optionally an HTTP API.
+// Nodes can be stopped and started again, and keep their blocks and their
+// persisted application state in between, as a real node would.
+//
+// Faults can be injected too: nodes can be killed, the network between nodes
+// can be cut, and writes of their application state can fail, or be slow.
+// Inject injects them at random.
+//
+// Tendermint's own RPC server, and its in-process client, serve whichever node
+// configured them last, so they can't be used with more than one node in a
+// process. Each node has its own Client instead, which implements the same
+// methods, with the same results, for the one node.
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+	tendermintconfig "github.com/tendermint/tendermint/config"
+	tendermintcommon "github.com/tendermint/tendermint/libs/common"
+	tendermintdb "github.com/tendermint/tendermint/libs/db"
+	tendermintp2p "github.com/tendermint/tendermint/p2p"
+	tendermintprivval "github.com/tendermint/tendermint/privval"
+	tendermintrpcclient "github.com/tendermint/tendermint/rpc/client"
+	tenderminttypes "github.com/tendermint/tendermint/types"
+	tenderminttime "github.com/tendermint/tendermint/types/time"
+)
+
+// Config describes a cluster.
+type Config struct {
+	// Nodes is the number of nodes, all of them validators, with equal power.
+	// A cluster of N nodes keeps making blocks with up to (N-1)/3 of them
+	// stopped, so it takes 4 to tolerate one. AddNode adds nodes that aren't
+	// validators.
+	Nodes int
+
+	// Handler, if set, returns the HTTP API of a node, given its client. It's
+	// served on an ephemeral port, at the node's APIAddr.
+	Handler func(client *Client) http.Handler
+
+	// BlockInterval is roughly how often blocks are made. The default is
+	// DefaultBlockInterval.
+	BlockInterval time.Duration
+
+	// Logger gets the logs of every node, with a "node" key. Tendermint's are
+	// filtered to warnings and errors. The default discards them.
+	Logger log.Logger
+}
+
+// DefaultBlockInterval is the default Config.BlockInterval.
+const DefaultBlockInterval = 100 * time.Millisecond
+
+// Cluster is a running network of nodes. Its methods, and its nodes', aren't
+// safe for concurrent use.
+type Cluster struct {
+	config  Config
+	dir     string
+	genesis *tenderminttypes.GenesisDoc
+	nodes   []*Node
+	cut     map[[2]string]bool // pairs of nodes' names, in order
+}
+
+// New creates a cluster, and starts every node.
+func New(config Config) (*Cluster, error) {
+	if config.Nodes < 1 {
+		return nil, errors.New("a cluster needs at least one node")
+	}
+	if config.BlockInterval <= 0 {
+		config.BlockInterval = DefaultBlockInterval
+	}
+	if config.Logger == nil {
+		config.Logger = log.NewNopLogger()
+	}
+	dir, err := ioutil.TempDir("", "cluster")
+	if err != nil {
+		return nil, err
+	}
+	c := &Cluster{config: config, dir: dir, cut: map[[2]string]bool{}}
+	if err := c.create(); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	for _, n := range c.nodes {
+		if err := n.Start(); err != nil {
+			c.Close()
+			return nil, errors.Wrap(err, n.Name)
+		}
+	}
+	return c, nil
+}
+
+// create the keys, config, and genesis of every node.
+func (c *Cluster) create() error {
+	validators := make([]tenderminttypes.GenesisValidator, c.config.Nodes)
+	for i := range validators {
+		n, err := c.newNode(fmt.Sprintf("node%d", i))
+		if err != nil {
+			return err
+		}
+		validators[i] = tenderminttypes.GenesisValidator{
+			Address: n.privValidator.GetAddress(),
+			PubKey:  n.privValidator.GetPubKey(),
+			Power:   10,
+			Name:    n.Name,
+		}
+		c.nodes = append(c.nodes, n)
+	}
+
+	c.genesis = &tenderminttypes.GenesisDoc{
+		GenesisTime: tenderminttime.Now(),
+		ChainID:     "cluster-" + tendermintcommon.RandStr(6),
+		Validators:  validators,
+	}
+	if err := c.genesis.ValidateAndComplete(); err != nil {
+		return errors.Wrap(err, "invalid genesis")
+	}
+	return nil
+}
+
+// newNode creates the keys and config of a node.
+func (c *Cluster) newNode(name string) (*Node, error) {
+	n := &Node{
+		Name:    name,
+		cluster: c,
+		dbs:     map[string]tendermintdb.DB{},
+		file:    &memFile{},
+	}
+	n.config = nodeConfig(filepath.Join(c.dir, n.Name), c.config.BlockInterval)
+	for _, dir := range []string{
+		filepath.Join(n.config.RootDir, "config"),
+		filepath.Join(n.config.RootDir, "data"),
+	} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	nodeKey, err := tendermintp2p.LoadOrGenNodeKey(n.config.NodeKeyFile())
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: generating node key", n.Name)
+	}
+	n.nodeKey = nodeKey
+	n.privValidator = tendermintprivval.GenFilePV(n.config.PrivValidatorFile())
+	n.privValidator.Save()
+	if n.p2pAddr, err = freeAddr(); err != nil {
+		return nil, err
+	}
+	n.config.P2P.ListenAddress = "tcp://" + n.p2pAddr
+	return n, nil
+}
+
+// AddNode creates a node that isn't a validator, with no blocks, and doesn't
+// start it, so that it can be given a state first, as a new node would be
+// synced from a snapshot of its peers' state.
+func (c *Cluster) AddNode() (*Node, error) {
+	n, err := c.newNode(fmt.Sprintf("node%d", len(c.nodes)))
+	if err != nil {
+		return nil, err
+	}
+	c.nodes = append(c.nodes, n)
+	return n, nil
+}
+
+// nodeConfig returns the Tendermint config of a node in dir, based on
+// Tendermint's own config for tests. Its consensus timeouts are too short for
+// several nodes in one process, though, particularly with the race detector, so
+// rounds fail more often than not, and a round's timeouts are longer here.
+func nodeConfig(dir string, blockInterval time.Duration) *tendermintconfig.Config {
+	c := tendermintconfig.TestConfig().SetRoot(dir)
+	c.ProxyApp = ""          // the application runs in-process
+	c.RPC.ListenAddress = "" // see the package comment
+	c.RPC.GRPCListenAddress = ""
+	c.P2P.PexReactor = false // see Node.connect
+	c.P2P.AddrBookStrict = false
+	c.P2P.AllowDuplicateIP = true
+	c.Consensus.TimeoutPropose = 1000
+	c.Consensus.TimeoutProposeDelta = 500
+	c.Consensus.TimeoutPrevote = 100
+	c.Consensus.TimeoutPrevoteDelta = 100
+	c.Consensus.TimeoutPrecommit = 100
+	c.Consensus.TimeoutPrecommitDelta = 100
+	c.Consensus.TimeoutCommit = int(blockInterval / time.Millisecond)
+	c.Consensus.SkipTimeoutCommit = false
+	c.TxIndex.IndexTags = cas.TagKey
+	return c
+}
+
+// Nodes returns every node, running or not.
+func (c *Cluster) Nodes() []*Node {
+	return c.nodes
+}
+
+// Node returns the i'th node.
+func (c *Cluster) Node(i int) *Node {
+	return c.nodes[i]
+}
+
+// Running returns the nodes that are running.
+func (c *Cluster) Running() []*Node {
+	var running []*Node
+	for _, n := range c.nodes {
+		if n.Running() {
+			running = append(running, n)
+		}
+	}
+	return running
+}
+
+// Genesis returns the genesis of the chain.
+func (c *Cluster) Genesis() *tenderminttypes.GenesisDoc {
+	return c.genesis
+}
+
+// WaitForHeight waits until every running node has committed the height.
+func (c *Cluster) WaitForHeight(ctx context.Context, height int64) error {
+	for _, n := range c.Running() {
+		if err := n.WaitForHeight(ctx, height); err != nil {
+			return errors.Wrap(err, n.Name)
+		}
+	}
+	return nil
+}
+
+// Eventually calls f with every running node, until it returns nil for all
+// of them, or the context is done, when it returns the last error.
+func (c *Cluster) Eventually(ctx context.Context, f func(*Node) error) error {
+	for {
+		var err error
+		for _, n := range c.Running() {
+			if err = f(n); err != nil {
+				err = errors.Wrap(err, n.Name)
+				break
+			}
+		}
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// CheckAgreement waits until every running node has committed the height, and
+// checks that their application states agree at that height, by comparing
+// their digests of the whole state. The height must be one of the recent
+// heights that applications retain.
+func (c *Cluster) CheckAgreement(ctx context.Context, height int64) error {
+	if err := c.WaitForHeight(ctx, height); err != nil {
+		return err
+	}
+	var (
+		first *Node
+		want  cas.Digest
+	)
+	for _, n := range c.Running() {
+		result, err := n.Client().ABCIQueryWithOptions(cas.QueryPathDigest, nil, tendermintrpcclient.ABCIQueryOptions{Height: height, Trusted: true})
+		if err != nil {
+			return errors.Wrap(err, n.Name)
+		}
+		if !result.Response.IsOK() {
+			return errors.Errorf("%s: digest at height %d: %s", n.Name, height, result.Response.Log)
+		}
+		var have cas.Digest
+		if err := json.Unmarshal(result.Response.Value, &have); err != nil {
+			return errors.Wrap(err, n.Name)
+		}
+		if first == nil {
+			first, want = n, have
+			continue
+		}
+		if have.Count != want.Count || !bytes.Equal(have.Hash, want.Hash) {
+			return errors.Errorf("height %d: %s has %d key(s) with hash %X, but %s has %d with hash %X", height, first.Name, want.Count, want.Hash, n.Name, have.Count, have.Hash)
+		}
+	}
+	return nil
+}
+
+// Close stops every running node, and removes the cluster's files. It returns
+// the first error stopping a node.
+func (c *Cluster) Close() error {
+	var err error
+	for _, n := range c.Running() {
+		if stopErr := n.Stop(); err == nil && stopErr != nil {
+			err = errors.Wrap(stopErr, n.Name)
+		}
+	}
+	os.RemoveAll(c.dir)
+	return err
+}
+
+// pollInterval is how often the cluster checks for a condition it's waiting
+// for.
+const pollInterval = 10 * time.Millisecond
+
+// connectTimeout is how long a node that's starting waits for each of its
+// peers to drop its last connection, and add its new one.
+const connectTimeout = 10 * time.Second
+
+// freeAddr returns a local address with a port that's free, for now.
+func freeAddr() (string, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer ln.Close()
+	return ln.Addr().String(), nil
+}
@@ -0,0 +1,238 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+)
+
+func TestCluster(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a cluster")
+	}
+	c, err := New(Config{Nodes: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if err := c.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	// A transaction sent to one node is committed by every node.
+	set(t, c.Node(0), "a", nil, "one")
+	if err := c.Eventually(ctx, hasValue("a", "one")); err != nil {
+		t.Fatal(err)
+	}
+
+	// With one node of four stopped, the others carry on.
+	stopped := c.Node(3)
+	if err := stopped.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 3, len(c.Running()); want != have {
+		t.Fatalf("Running: want %d nodes, have %d", want, have)
+	}
+	set(t, c.Node(1), "a", []byte("one"), "two")
+	set(t, c.Node(2), "b", nil, "three")
+	if err := c.Eventually(ctx, hasValue("b", "three")); err != nil {
+		t.Fatal(err)
+	}
+	if stopped.Persisted() == nil {
+		t.Errorf("%s persisted nothing", stopped.Name)
+	}
+
+	// Once it's started again, it catches up.
+	if err := stopped.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Eventually(ctx, hasValue("a", "two")); err != nil {
+		t.Fatal(err)
+	}
+	height, err := c.Node(0).Height()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CheckAgreement(ctx, height); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restarting every node at once loses nothing. A restarted node only has
+	// the heights from the state it restored on, so agreement is checked at a
+	// later height than any.
+	for _, n := range c.Nodes() {
+		if err := n.Restart(); err != nil {
+			t.Fatalf("%s: %v", n.Name, err)
+		}
+	}
+	if err := c.Eventually(ctx, hasValue("b", "three")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CheckAgreement(ctx, maxHeight(t, c)+2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts a cluster")
+	}
+	c, err := New(Config{Nodes: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	// A node whose writes fail carries on, but doesn't persist anything, and
+	// when it's killed, it starts again from the last state it did.
+	n := c.Node(3)
+	if err := c.Eventually(ctx, func(n *Node) error {
+		if n.Persisted() == nil {
+			return errors.New("persisted nothing")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	n.SetDiskFaults(DiskFaults{ErrorRate: 1})
+	if err := c.WaitForHeight(ctx, maxHeight(t, c)+1); err != nil {
+		t.Fatal(err)
+	}
+	persisted := n.Persisted()
+	set(t, c.Node(0), "a", nil, "one")
+	if err := c.Eventually(ctx, hasValue("a", "one")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitForHeight(ctx, maxHeight(t, c)+2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(persisted, n.Persisted()) {
+		t.Fatalf("%s persisted a state despite failed writes", n.Name)
+	}
+	if err := n.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	n.SetDiskFaults(DiskFaults{})
+	if err := n.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Eventually(ctx, hasValue("a", "one")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A node that's cut off from the rest falls behind, and catches up once
+	// the network's healed.
+	if err := c.Partition([]*Node{c.Node(0)}, c.Nodes()[1:]); err != nil {
+		t.Fatal(err)
+	}
+	before, err := c.Node(0).Height()
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(t, c.Node(1), "a", []byte("one"), "two")
+	if err := c.Node(1).WaitForHeight(ctx, maxHeight(t, c)+2); err != nil {
+		t.Fatal(err)
+	}
+	after, err := c.Node(0).Height()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after > before+1 { // it might have been finishing a height
+		t.Fatalf("%s went from height %d to %d while cut off", c.Node(0).Name, before, after)
+	}
+	if err := hasValue("a", "one")(c.Node(0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Heal(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Eventually(ctx, hasValue("a", "two")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two nodes that are cut off from each other, but not from the rest, both
+	// carry on.
+	if err := c.Cut(c.Node(0), c.Node(1)); err != nil {
+		t.Fatal(err)
+	}
+	set(t, c.Node(0), "b", nil, "three")
+	if err := c.Eventually(ctx, hasValue("b", "three")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Heal(); err != nil {
+		t.Fatal(err)
+	}
+
+	// After random faults, the nodes still agree.
+	injectCtx, cancelInject := context.WithTimeout(ctx, 5*time.Second)
+	defer cancelInject()
+	if err := c.Inject(injectCtx, Schedule{
+		Seed:      1,
+		Interval:  500 * time.Millisecond,
+		Duration:  500 * time.Millisecond,
+		Kill:      true,
+		Partition: true,
+		Disk:      DiskFaults{ErrorRate: 0.2, Latency: time.Millisecond},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 4, len(c.Running()); want != have {
+		t.Fatalf("Running: want %d nodes, have %d", want, have)
+	}
+	set(t, c.Node(2), "b", []byte("three"), "four")
+	if err := c.Eventually(ctx, hasValue("b", "four")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CheckAgreement(ctx, maxHeight(t, c)+2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func maxHeight(t *testing.T, c *Cluster) int64 {
+	t.Helper()
+	var max int64
+	for _, n := range c.Running() {
+		height, err := n.Height()
+		if err != nil {
+			t.Fatalf("%s: %v", n.Name, err)
+		}
+		if height > max {
+			max = height
+		}
+	}
+	return max
+}
+
+func set(t *testing.T, n *Node, key string, old []byte, new string) {
+	t.Helper()
+	result, err := n.Client().BroadcastTxSync(cas.SetTx(key, old, []byte(new)).Encode())
+	if err != nil {
+		t.Fatalf("%s: set %s: %v", n.Name, key, err)
+	}
+	if result.Code != 0 {
+		t.Fatalf("%s: set %s: code %d: %s", n.Name, key, result.Code, result.Log)
+	}
+}
+
+func hasValue(key, value string) func(*Node) error {
+	return func(n *Node) error {
+		result, err := n.Client().ABCIQuery(cas.QueryPathKey, []byte(key))
+		if err != nil {
+			return err
+		}
+		if have := result.Response.Value; !bytes.Equal([]byte(value), have) {
+			return fmt.Errorf("%s: want %q, have %q", key, value, have)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,172 @@
+package cluster
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DiskFaults are faults injected into the writes of a node's persisted
+// application state.
+type DiskFaults struct {
+	// ErrorRate is the probability that a write fails. The state that it's
+	// part of isn't persisted, and the node keeps the last state that was.
+	ErrorRate float64
+
+	// Latency is added to every write.
+	Latency time.Duration
+}
+
+// ErrInjected is the error of a write that fails because of DiskFaults.
+var ErrInjected = errors.New("injected fault")
+
+// SetDiskFaults sets the faults injected into the node's writes, from now on,
+// and after it's restarted. The zero DiskFaults injects none.
+func (n *Node) SetDiskFaults(faults DiskFaults) {
+	n.disk.set(faults)
+}
+
+type diskFaults struct {
+	mtx    sync.Mutex
+	faults DiskFaults
+}
+
+func (d *diskFaults) set(faults DiskFaults) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.faults = faults
+}
+
+func (d *diskFaults) get() DiskFaults {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.faults
+}
+
+// faultyFile is the WriteCloser that a node's application persists its state
+// to. It injects the node's disk faults into writes to the node's memFile, and
+// like the serve subcommand's file, a state with a failed write is discarded
+// on Close. Once it's killed, every write fails.
+type faultyFile struct {
+	file   *memFile
+	faults *diskFaults
+
+	mtx    sync.Mutex
+	err    error // of a write since the last Close
+	killed bool
+}
+
+// errKilled is the error of writes after a node's killed.
+var errKilled = errors.New("killed")
+
+func (f *faultyFile) Write(p []byte) (int, error) {
+	faults := f.faults.get()
+	if faults.Latency > 0 {
+		time.Sleep(faults.Latency)
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	switch {
+	case f.killed:
+		f.err = errKilled
+	case f.err != nil:
+	case rand.Float64() < faults.ErrorRate:
+		f.err = ErrInjected
+	}
+	if f.err != nil {
+		return 0, f.err
+	}
+	return f.file.Write(p)
+}
+
+func (f *faultyFile) Close() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	err := f.err
+	if f.killed {
+		err = errKilled
+	}
+	f.err = nil
+	if err != nil {
+		f.file.abort()
+		return err
+	}
+	return f.file.Close()
+}
+
+func (f *faultyFile) kill() {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.killed = true
+}
+
+// Cut the network between two nodes: drop their connection, if they're
+// running, and keep them apart, even if they're restarted, until Heal.
+func (c *Cluster) Cut(a, b *Node) error {
+	if a == b {
+		return errors.New("can't cut a node off from itself")
+	}
+	c.cut[pair(a, b)] = true
+	if !a.Running() || !b.Running() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	return a.disconnect(ctx, b)
+}
+
+// Partition cuts the network between every node in each group, and every node
+// in the others. Nodes that aren't in any group are still connected to every
+// other node, so the network is only partly partitioned.
+func (c *Cluster) Partition(groups ...[]*Node) error {
+	for i, group := range groups {
+		for _, other := range groups[i+1:] {
+			for _, a := range group {
+				for _, b := range other {
+					if err := c.Cut(a, b); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Heal the network, by connecting every pair of running nodes that Cut had cut
+// off from each other.
+func (c *Cluster) Heal() error {
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	for _, a := range c.nodes {
+		for _, b := range c.nodes {
+			if !c.cut[pair(a, b)] || a.Name >= b.Name {
+				continue
+			}
+			delete(c.cut, pair(a, b))
+			if !a.Running() || !b.Running() {
+				continue
+			}
+			if err := a.dial(ctx, b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Cluster) isCut(a, b *Node) bool {
+	return c.cut[pair(a, b)]
+}
+
+// pair returns the names of two nodes, in order.
+func pair(a, b *Node) [2]string {
+	if a.Name > b.Name {
+		a, b = b, a
+	}
+	return [2]string{a.Name, b.Name}
+}
@@ -0,0 +1,363 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	tendermintconfig "github.com/tendermint/tendermint/config"
+	tendermintdb "github.com/tendermint/tendermint/libs/db"
+	tendermintlog "github.com/tendermint/tendermint/libs/log"
+	tendermintnode "github.com/tendermint/tendermint/node"
+	tendermintp2p "github.com/tendermint/tendermint/p2p"
+	tendermintprivval "github.com/tendermint/tendermint/privval"
+	tendermintproxy "github.com/tendermint/tendermint/proxy"
+	tenderminttypes "github.com/tendermint/tendermint/types"
+)
+
+// Node is one node of a cluster.
+type Node struct {
+	// Name is the node's name, and its validator's, e.g. "node0".
+	Name string
+
+	// APIAddr is the host:port of the node's HTTP API, once it's started, if
+	// the cluster has one. It stays the same when the node's restarted.
+	APIAddr string
+
+	cluster       *Cluster
+	config        *tendermintconfig.Config
+	nodeKey       *tendermintp2p.NodeKey
+	p2pAddr       string
+	privValidator *tendermintprivval.FilePV
+	dbs           map[string]tendermintdb.DB // by Tendermint's name for them
+	file          *memFile
+	disk          diskFaults
+
+	// Set while the node's running.
+	app     *cas.Application
+	persist *faultyFile
+	node    *tendermintnode.Node
+	client  *Client
+	api     *http.Server
+}
+
+// Start the node, with the blocks it had, and the application state it last
+// persisted, if it was started before. Like a real node, it replays the blocks
+// after that state to the application, and catches up with its peers.
+func (n *Node) Start() error {
+	if n.Running() {
+		return errors.New("already running")
+	}
+	logger := log.With(n.cluster.config.Logger, "node", n.Name)
+
+	var initial io.Reader
+	if last := n.file.last(); last != nil {
+		initial = bytes.NewReader(last)
+	}
+	persist := &faultyFile{file: n.file, faults: &n.disk}
+	app, err := cas.NewApplication(initial, persist, log.With(logger, "component", "App"))
+	if err != nil {
+		return errors.Wrap(err, "creating application")
+	}
+
+	node, err := tendermintnode.NewNode(
+		n.config,
+		n.privValidator,
+		n.nodeKey,
+		tendermintproxy.NewLocalClientCreator(app),
+		func() (*tenderminttypes.GenesisDoc, error) { return n.cluster.genesis, nil },
+		n.db,
+		tendermintnode.DefaultMetricsProvider(n.config.Instrumentation),
+		tendermintAdapter{level.NewFilter(log.With(logger, "component", "Node"), level.AllowWarn())},
+	)
+	if err != nil {
+		app.Close()
+		return errors.Wrap(err, "creating Tendermint node")
+	}
+	if err := node.Start(); err != nil {
+		app.Close()
+		return errors.Wrap(err, "starting Tendermint node")
+	}
+	n.app, n.persist, n.node, n.client = app, persist, node, newClient(node, n.dbs)
+	if err := n.connect(); err != nil {
+		n.Stop()
+		return err
+	}
+
+	if handler := n.cluster.config.Handler; handler != nil {
+		addr := n.APIAddr
+		if addr == "" {
+			addr = "127.0.0.1:0"
+		}
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			n.Stop()
+			return errors.Wrap(err, "starting HTTP API")
+		}
+		n.APIAddr = ln.Addr().String()
+		n.api = &http.Server{Handler: handler(n.client)}
+		go n.api.Serve(ln)
+	}
+	return nil
+}
+
+// connect dials every other running node, except those it's cut off from. The
+// nodes aren't each other's persistent peers, as Tendermint redials those in
+// the background, and a dial that's under way when a node's stopped can still
+// connect, to a switch that's stopped. Its peer then rejects the node, when
+// it's started again, as a duplicate of that connection, which never closes.
+// Instead, only a node that's starting, or Heal, dials, and no node dials in
+// the background.
+func (n *Node) connect() error {
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	defer cancel()
+	for _, peer := range n.cluster.Running() {
+		if peer == n || n.cluster.isCut(n, peer) {
+			continue
+		}
+		if err := n.dial(ctx, peer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dial connects the node to the peer, and waits until both have added the
+// connection.
+func (n *Node) dial(ctx context.Context, peer *Node) error {
+	// The peer might not have noticed yet that the node's last connection
+	// closed, and would reject a new one as a duplicate.
+	for peer.node.Switch().Peers().Has(n.nodeKey.ID()) {
+		select {
+		case <-ctx.Done():
+			return errors.Errorf("%s still has a connection to %s", peer.Name, n.Name)
+		case <-time.After(pollInterval):
+		}
+	}
+	addr, err := tendermintp2p.NewNetAddressString(tendermintp2p.IDAddressString(peer.nodeKey.ID(), peer.p2pAddr))
+	if err != nil {
+		return err
+	}
+	if err := n.node.Switch().DialPeerWithAddress(addr, false); err != nil {
+		return errors.Wrapf(err, "connecting %s to %s", n.Name, peer.Name)
+	}
+
+	// The peer adds the connection in the background, and if it were stopped
+	// before then, it would be left with the same problem.
+	for !peer.node.Switch().Peers().Has(n.nodeKey.ID()) {
+		select {
+		case <-ctx.Done():
+			return errors.Errorf("%s hasn't added the connection to %s", peer.Name, n.Name)
+		case <-time.After(pollInterval):
+		}
+	}
+	return nil
+}
+
+// disconnect drops the node's connection to the peer, if it has one, and
+// waits until the peer has noticed, and dropped it too.
+func (n *Node) disconnect(ctx context.Context, peer *Node) error {
+	if p := n.node.Switch().Peers().Get(peer.nodeKey.ID()); p != nil {
+		n.node.Switch().StopPeerGracefully(p)
+	}
+	for peer.node.Switch().Peers().Has(n.nodeKey.ID()) {
+		select {
+		case <-ctx.Done():
+			return errors.Errorf("%s still has a connection to %s", peer.Name, n.Name)
+		case <-time.After(pollInterval):
+		}
+	}
+	return nil
+}
+
+// Stop the node, and persist the last state its application committed. It
+// returns the error persisting it, if any.
+func (n *Node) Stop() error {
+	if !n.Running() {
+		return errors.New("not running")
+	}
+	return n.stop()
+}
+
+// Kill stops the node as if it had crashed: its application doesn't persist
+// the states it's committed since it last did, and loses any write that's
+// under way. Tendermint's databases are in memory, so it loses nothing.
+func (n *Node) Kill() error {
+	if !n.Running() {
+		return errors.New("not running")
+	}
+	n.persist.kill()
+	n.stop() // fails, as the application can't persist its last state
+	return nil
+}
+
+func (n *Node) stop() error {
+	if n.api != nil {
+		n.api.Close() // not Shutdown, as watches never finish
+	}
+	if err := n.node.Stop(); err != nil {
+		level.Error(n.cluster.config.Logger).Log("node", n.Name, "during", "node.Stop", "err", err)
+	}
+	n.node.Wait()
+	err := n.app.Close()
+	n.app, n.persist, n.node, n.client, n.api = nil, nil, nil, nil, nil
+	return err
+}
+
+// Restart stops the node, and starts it again.
+func (n *Node) Restart() error {
+	if err := n.Stop(); err != nil {
+		return err
+	}
+	return n.Start()
+}
+
+// Running returns whether the node is running.
+func (n *Node) Running() bool {
+	return n.node != nil
+}
+
+// App returns the node's application, while it's running. Its methods mustn't
+// be called while the node's running, except through Client, as Tendermint
+// expects to call them one at a time.
+func (n *Node) App() *cas.Application {
+	return n.app
+}
+
+// Tendermint returns the node's Tendermint node, while it's running.
+func (n *Node) Tendermint() *tendermintnode.Node {
+	return n.node
+}
+
+// Client returns a client of the node, while it's running.
+func (n *Node) Client() *Client {
+	return n.client
+}
+
+// Height returns the last height the node's application committed.
+func (n *Node) Height() (int64, error) {
+	if !n.Running() {
+		return 0, errors.New("not running")
+	}
+	info, err := n.client.ABCIInfo()
+	if err != nil {
+		return 0, err
+	}
+	return info.Response.LastBlockHeight, nil
+}
+
+// WaitForHeight waits until the node's application has committed the height.
+func (n *Node) WaitForHeight(ctx context.Context, height int64) error {
+	for {
+		have, err := n.Height()
+		if err != nil {
+			return err
+		}
+		if have >= height {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Errorf("at height %d, waiting for %d: %v", have, height, ctx.Err())
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// Persisted returns the application state the node last persisted, in the
+// format of cas.State's Commit, or nil if it hasn't persisted any.
+func (n *Node) Persisted() []byte {
+	return n.file.last()
+}
+
+// Persist replaces the application state the node last persisted, which it
+// starts from, while it's stopped, as a subcommand would write a stopped
+// node's application file.
+func (n *Node) Persist(s *cas.State) error {
+	if n.Running() {
+		return errors.New("running")
+	}
+	if err := s.Save(n.file); err != nil {
+		n.file.abort()
+		return err
+	}
+	return n.file.Close()
+}
+
+// DB returns the node's Tendermint database with the ID, e.g. "blockstore".
+// It outlives the node, so it can be read, or written, while the node's
+// stopped, as a subcommand would read or write a stopped node's.
+func (n *Node) DB(id string) tendermintdb.DB {
+	db, _ := n.db(&tendermintnode.DBContext{ID: id})
+	return db
+}
+
+// db is the node's Tendermint DBProvider. Each database is in memory, and
+// outlives the Tendermint node, so it's there when the node's restarted.
+func (n *Node) db(ctx *tendermintnode.DBContext) (tendermintdb.DB, error) {
+	db, ok := n.dbs[ctx.ID]
+	if !ok {
+		db = tendermintdb.NewMemDB()
+		n.dbs[ctx.ID] = db
+	}
+	return db, nil
+}
+
+// memFile is an application persistence file in memory. Like the file of the
+// serve subcommand, it only replaces the last state written on Close.
+type memFile struct {
+	mtx     sync.Mutex
+	buf     bytes.Buffer
+	written []byte
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	return f.buf.Write(p) // only the persister writes, one state at a time
+}
+
+func (f *memFile) Close() error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.written = append([]byte{}, f.buf.Bytes()...)
+	f.buf.Reset()
+	return nil
+}
+
+// abort discards what's been written since the last Close, as the serve
+// subcommand's file does when a write fails.
+func (f *memFile) abort() {
+	f.buf.Reset()
+}
+
+func (f *memFile) last() []byte {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.written
+}
+
+// tendermintAdapter is a Tendermint logger that logs to a Go kit logger.
+type tendermintAdapter struct{ log.Logger }
+
+func (a tendermintAdapter) Debug(msg string, keyvals ...interface{}) {
+	level.Debug(log.With(a.Logger, keyvals...)).Log("msg", msg)
+}
+
+func (a tendermintAdapter) Info(msg string, keyvals ...interface{}) {
+	level.Info(log.With(a.Logger, keyvals...)).Log("msg", msg)
+}
+
+func (a tendermintAdapter) Error(msg string, keyvals ...interface{}) {
+	level.Error(log.With(a.Logger, keyvals...)).Log("msg", msg)
+}
+
+func (a tendermintAdapter) With(keyvals ...interface{}) tendermintlog.Logger {
+	return tendermintAdapter{log.With(a.Logger, keyvals...)}
+}
@@ -0,0 +1,183 @@
+package cluster
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+)
+
+// Schedule describes the faults that Inject injects.
+type Schedule struct {
+	// Seed seeds the choices of faults, of the nodes they affect, and of when.
+	Seed int64
+
+	// Interval is roughly the time between one fault being healed and the
+	// next, and Duration how long each lasts. The defaults are a second each.
+	Interval time.Duration
+	Duration time.Duration
+
+	// Kill, if set, lets Inject kill nodes, and start them again. A node that's
+	// started again is sometimes killed again before it's caught up.
+	Kill bool
+
+	// Partition, if set, lets Inject cut the network between some nodes and the
+	// rest, or between just two nodes, which are both still connected to the
+	// others, and then heal it.
+	Partition bool
+
+	// Disk faults are injected into every node's writes, for as long as Inject
+	// runs.
+	Disk DiskFaults
+}
+
+// Inject injects faults into the cluster, chosen at random, one at a time,
+// until the context is done, when it heals the last, and returns. Each fault
+// affects at most (N-1)/3 of the cluster's N nodes, or one, so clusters of 4
+// or more keep making blocks. It returns the first error injecting or healing
+// a fault, which leaves the fault as it is. The cluster mustn't be used by
+// anything else until it returns.
+func (c *Cluster) Inject(ctx context.Context, s Schedule) error {
+	if s.Interval <= 0 {
+		s.Interval = time.Second
+	}
+	if s.Duration <= 0 {
+		s.Duration = time.Second
+	}
+	for _, n := range c.nodes {
+		n.SetDiskFaults(s.Disk)
+		defer n.SetDiskFaults(DiskFaults{})
+	}
+
+	var faults []fault
+	if s.Kill {
+		faults = append(faults, c.kill)
+	}
+	if s.Partition {
+		faults = append(faults, c.isolate, c.cutPair)
+	}
+	if len(faults) == 0 {
+		<-ctx.Done()
+		return nil
+	}
+	rng := rand.New(rand.NewSource(s.Seed))
+	for {
+		if !sleep(ctx, jitter(rng, s.Interval)) {
+			return nil
+		}
+		heal, err := faults[rng.Intn(len(faults))](rng, s)
+		if err != nil {
+			return err
+		}
+		sleep(ctx, jitter(rng, s.Duration))
+		if err := heal(); err != nil {
+			return err
+		}
+	}
+}
+
+// fault injects a fault, and returns a function that heals it.
+type fault func(rng *rand.Rand, s Schedule) (heal func() error, err error)
+
+// kill kills some nodes, and starts them again, when it's healed.
+func (c *Cluster) kill(rng *rand.Rand, s Schedule) (func() error, error) {
+	nodes := c.pick(rng)
+	for _, n := range nodes {
+		level.Info(c.config.Logger).Log("fault", "kill", "node", n.Name)
+		if err := n.Kill(); err != nil {
+			return nil, err
+		}
+	}
+	return func() error {
+		for _, n := range nodes {
+			level.Info(c.config.Logger).Log("heal", "start", "node", n.Name)
+			if err := n.Start(); err != nil {
+				return err
+			}
+			if rng.Intn(3) > 0 {
+				continue
+			}
+			time.Sleep(jitter(rng, s.Duration/4))
+			level.Info(c.config.Logger).Log("fault", "kill", "node", n.Name, "while", "catching up")
+			if err := n.Kill(); err != nil {
+				return err
+			}
+			if err := n.Start(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, nil
+}
+
+// isolate cuts some nodes off from the rest.
+func (c *Cluster) isolate(rng *rand.Rand, s Schedule) (func() error, error) {
+	var (
+		nodes    = c.pick(rng)
+		isolated = map[*Node]bool{}
+		rest     []*Node
+	)
+	for _, n := range nodes {
+		level.Info(c.config.Logger).Log("fault", "isolate", "node", n.Name)
+		isolated[n] = true
+	}
+	for _, n := range c.nodes {
+		if !isolated[n] {
+			rest = append(rest, n)
+		}
+	}
+	if err := c.Partition(nodes, rest); err != nil {
+		return nil, err
+	}
+	return c.heal, nil
+}
+
+// cutPair cuts two nodes off from each other, but not from the rest.
+func (c *Cluster) cutPair(rng *rand.Rand, s Schedule) (func() error, error) {
+	if len(c.nodes) < 2 {
+		return func() error { return nil }, nil
+	}
+	i := rng.Intn(len(c.nodes))
+	j := (i + 1 + rng.Intn(len(c.nodes)-1)) % len(c.nodes)
+	a, b := c.nodes[i], c.nodes[j]
+	level.Info(c.config.Logger).Log("fault", "cut", "between", a.Name, "and", b.Name)
+	if err := c.Cut(a, b); err != nil {
+		return nil, err
+	}
+	return c.heal, nil
+}
+
+func (c *Cluster) heal() error {
+	level.Info(c.config.Logger).Log("heal", "network")
+	return c.Heal()
+}
+
+// pick returns up to (N-1)/3 of the N nodes, or one, at random.
+func (c *Cluster) pick(rng *rand.Rand) []*Node {
+	max := (len(c.nodes) - 1) / 3
+	if max < 1 {
+		max = 1
+	}
+	var nodes []*Node
+	for _, i := range rng.Perm(len(c.nodes))[:1+rng.Intn(max)] {
+		nodes = append(nodes, c.nodes[i])
+	}
+	return nodes
+}
+
+// jitter returns a random duration between half and one and a half times d.
+func jitter(rng *rand.Rand, d time.Duration) time.Duration {
+	return d/2 + time.Duration(rng.Int63n(int64(d)+1))
+}
+
+// sleep sleeps for d, or until the context is done, and returns false if it's
+// done.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
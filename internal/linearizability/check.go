@@ -0,0 +1,268 @@
+package linearizability
+
+import (
+	"sort"
+	"time"
+)
+
+// Result is the result of checking a history.
+type Result struct {
+	// Linearizable is whether the whole history is linearizable.
+	Linearizable bool
+
+	// Key is the first key, in order, whose history isn't linearizable.
+	Key string
+
+	// Counterexample is a minimal history of the key that isn't linearizable,
+	// in the order of the operations' calls. It's the shortest prefix of the
+	// key's history that isn't, less every get, and every compare-and-swap
+	// that conflicted, that it doesn't need. Operations that hadn't returned
+	// by the end of the prefix have unknown outcomes.
+	Counterexample []Operation
+}
+
+// Check whether the history is linearizable.
+func Check(history []Operation) Result {
+	byKey := map[string][]Operation{}
+	for _, op := range history {
+		byKey[op.Key] = append(byKey[op.Key], op)
+	}
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if ops := byKey[key]; !linearizable(ops) {
+			return Result{Key: key, Counterexample: minimize(ops)}
+		}
+	}
+	return Result{Linearizable: true}
+}
+
+// minimize returns a minimal history that isn't linearizable, given one of a
+// single key that isn't. Linearizability is prefix-closed, so the shortest
+// prefix that isn't can be found by bisection. Then operations that can't have
+// changed the value are removed, one at a time, if the rest still isn't: if it
+// isn't, then no history that adds them back can be. Removing any other
+// operation could make a history that isn't linearizable only because a value
+// it wrote is read.
+func minimize(ops []Operation) []Operation {
+	var ends []time.Time
+	for _, op := range ops {
+		if op.Outcome != Unknown {
+			ends = append(ends, op.Return)
+		}
+	}
+	sort.Slice(ends, func(i, j int) bool { return ends[i].Before(ends[j]) })
+	n := sort.Search(len(ends), func(i int) bool { return !linearizable(prefix(ops, ends[i])) })
+	if n == len(ends) {
+		return ops // not reached, as the history isn't linearizable
+	}
+	min := prefix(ops, ends[n])
+
+	for i := 0; i < len(min); {
+		if !min[i].readOnly() {
+			i++
+			continue
+		}
+		without := append(append([]Operation{}, min[:i]...), min[i+1:]...)
+		if linearizable(without) {
+			i++
+			continue
+		}
+		min = without
+	}
+	sortByCall(min)
+	return min
+}
+
+// prefix returns the operations called by the end. Of those that hadn't
+// returned by then, the ones that can't have changed the value are left out,
+// and the others' outcomes are unknown.
+func prefix(ops []Operation, end time.Time) []Operation {
+	var p []Operation
+	for _, op := range ops {
+		if op.Call.After(end) {
+			continue
+		}
+		if op.Return.After(end) {
+			if op.readOnly() {
+				continue // it can't have changed the value
+			}
+			op.Outcome, op.Return = Unknown, time.Time{}
+		}
+		p = append(p, op)
+	}
+	return p
+}
+
+// linearizable returns whether the history of a single key is linearizable. It
+// searches for an order of the operations' effects, trying each operation that
+// can take effect next, and backtracking when one that's already returned
+// can't, and caches the operations that have taken effect, with the value
+// they've left, so that it doesn't search from the same point twice.
+func linearizable(ops []Operation) bool {
+	head := events(ops)
+	var (
+		value  string
+		done   = newBitset(len(ops))
+		seen   = map[string]bool{}
+		undo   []undoEntry
+		e      = head.next
+		cached = func(value string) bool {
+			key := done.key() + "\x00" + value
+			if seen[key] {
+				return true
+			}
+			seen[key] = true
+			return false
+		}
+	)
+	for head.next != nil {
+		if e.call {
+			if next, ok := step(value, ops[e.op]); ok {
+				done.set(e.op)
+				if !cached(next) {
+					undo = append(undo, undoEntry{e, value})
+					value = next
+					e.lift()
+					e = head.next
+					continue
+				}
+				done.clear(e.op)
+			}
+			e = e.next
+			continue
+		}
+
+		// An operation returned before taking effect, so an earlier choice
+		// was wrong.
+		if len(undo) == 0 {
+			return false
+		}
+		last := undo[len(undo)-1]
+		undo = undo[:len(undo)-1]
+		value = last.value
+		done.clear(last.entry.op)
+		last.entry.unlift()
+		e = last.entry.next
+	}
+	return true
+}
+
+// step returns the value after the operation takes effect on the value, and
+// whether it can.
+func step(value string, op Operation) (string, bool) {
+	switch {
+	case op.Kind == Get:
+		return value, op.Value == value
+	case op.Outcome == OK:
+		return op.New, op.Old == value
+	case op.Outcome == Conflict:
+		return value, op.Old != value
+	case op.Old == value: // an unknown compare-and-swap that swaps
+		return op.New, true
+	default:
+		return value, true
+	}
+}
+
+type undoEntry struct {
+	entry *entry
+	value string
+}
+
+// entry is a call or a return in a doubly-linked list of them, in order. The
+// operations that have taken effect are lifted out of the list.
+type entry struct {
+	op         int
+	call       bool
+	match      *entry // the return of a call
+	prev, next *entry
+}
+
+// events returns the head of the list of the calls and returns of the
+// operations. Unknown operations never return, and gets that failed are left
+// out. When a call and a return are at the same time, the call comes first, so
+// the operations are concurrent.
+func events(ops []Operation) *entry {
+	type event struct {
+		entry *entry
+		at    time.Time
+		never bool
+	}
+	var es []event
+	for i, op := range ops {
+		if op.Kind == Get && op.Outcome == Unknown {
+			continue
+		}
+		call := &entry{op: i, call: true}
+		ret := &entry{op: i}
+		call.match = ret
+		es = append(es, event{call, op.Call, false}, event{ret, op.Return, op.Outcome == Unknown})
+	}
+	sort.SliceStable(es, func(i, j int) bool {
+		a, b := es[i], es[j]
+		switch {
+		case a.never || b.never:
+			return !a.never && b.never
+		case !a.at.Equal(b.at):
+			return a.at.Before(b.at)
+		default:
+			return a.entry.call && !b.entry.call
+		}
+	})
+
+	head := &entry{}
+	prev := head
+	for _, ev := range es {
+		ev.entry.prev, prev.next = prev, ev.entry
+		prev = ev.entry
+	}
+	return head
+}
+
+// lift removes the call, and its return, from the list.
+func (e *entry) lift() {
+	e.prev.next = e.next
+	if e.next != nil {
+		e.next.prev = e.prev
+	}
+	m := e.match
+	m.prev.next = m.next
+	if m.next != nil {
+		m.next.prev = m.prev
+	}
+}
+
+// unlift puts the call, and its return, back where they were.
+func (e *entry) unlift() {
+	m := e.match
+	m.prev.next = m
+	if m.next != nil {
+		m.next.prev = m
+	}
+	e.prev.next = e
+	if e.next != nil {
+		e.next.prev = e
+	}
+}
+
+type bitset []uint64
+
+func newBitset(n int) bitset { return make(bitset, (n+63)/64) }
+
+func (b bitset) set(i int)   { b[i/64] |= 1 << uint(i%64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1 << uint(i%64) }
+
+func (b bitset) key() string {
+	buf := make([]byte, 8*len(b))
+	for i, word := range b {
+		for j := 0; j < 8; j++ {
+			buf[8*i+j] = byte(word >> uint(8*j))
+		}
+	}
+	return string(buf)
+}
@@ -0,0 +1,267 @@
+package linearizability
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		history []Operation
+		want    []Operation // the counterexample, or nil if it's linearizable
+	}{
+		{
+			name: "sequential",
+			history: []Operation{
+				get(0, "", 0, 1),
+				cas(0, "", "a", OK, 2, 3),
+				get(0, "a", 4, 5),
+				cas(1, "", "b", Conflict, 6, 7),
+				cas(1, "a", "b", OK, 8, 9),
+				get(0, "b", 10, 11),
+			},
+		},
+		{
+			name: "concurrent reads see either value",
+			history: []Operation{
+				cas(0, "", "a", OK, 0, 10),
+				get(1, "", 1, 2),
+				get(2, "a", 3, 4),
+				get(1, "a", 5, 6),
+			},
+		},
+		{
+			name: "stale read",
+			history: []Operation{
+				get(2, "", 0, 1),
+				cas(0, "", "a", OK, 2, 3),
+				get(2, "a", 4, 5),
+				get(1, "", 6, 7),
+				cas(0, "a", "b", OK, 8, 9),
+			},
+			want: []Operation{
+				cas(0, "", "a", OK, 2, 3),
+				get(1, "", 6, 7),
+			},
+		},
+		{
+			name: "read goes back",
+			history: []Operation{
+				cas(0, "", "a", OK, 0, 10),
+				get(1, "a", 1, 2),
+				get(2, "", 3, 4),
+			},
+			want: []Operation{
+				cas(0, "", "a", Unknown, 0, 0), // it hadn't returned by the second get's return
+				get(1, "a", 1, 2),
+				get(2, "", 3, 4),
+			},
+		},
+		{
+			name: "conflict with the current value",
+			history: []Operation{
+				cas(0, "", "a", OK, 0, 1),
+				cas(1, "a", "b", Conflict, 2, 3),
+			},
+			want: []Operation{
+				cas(0, "", "a", OK, 0, 1),
+				cas(1, "a", "b", Conflict, 2, 3),
+			},
+		},
+		{
+			name: "unknown write that's read",
+			history: []Operation{
+				cas(0, "", "a", Unknown, 0, 1),
+				get(1, "", 2, 3),
+				get(1, "a", 4, 5),
+			},
+		},
+		{
+			name: "unknown write that isn't",
+			history: []Operation{
+				cas(0, "", "a", Unknown, 0, 1),
+				get(1, "", 2, 3),
+				cas(1, "", "b", OK, 4, 5),
+				get(1, "b", 6, 7),
+			},
+		},
+		{
+			name: "value that was never written",
+			history: []Operation{
+				cas(0, "", "a", OK, 0, 1),
+				get(1, "a", 2, 3),
+				get(1, "c", 4, 5),
+				get(1, "a", 6, 7),
+			},
+			want: []Operation{
+				cas(0, "", "a", OK, 0, 1), // writes are kept, as a read of what they wrote would fail without them
+				get(1, "c", 4, 5),
+			},
+		},
+		{
+			name: "failed reads are ignored",
+			history: []Operation{
+				cas(0, "", "a", OK, 0, 1),
+				{Client: 1, Key: "k", Kind: Get, Outcome: Unknown, Call: at(2), Return: at(3)},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result := Check(tc.history)
+			if want, have := tc.want == nil, result.Linearizable; want != have {
+				t.Fatalf("Linearizable: want %v, have %v: %v", want, have, result.Counterexample)
+			}
+			if tc.want == nil {
+				return
+			}
+			if want, have := "k", result.Key; want != have {
+				t.Errorf("Key: want %q, have %q", want, have)
+			}
+			if !reflect.DeepEqual(tc.want, result.Counterexample) {
+				t.Errorf("Counterexample:\nwant %v\nhave %v", tc.want, result.Counterexample)
+			}
+		})
+	}
+}
+
+func TestCheckKeys(t *testing.T) {
+	history := []Operation{
+		cas(0, "", "a", OK, 0, 1),
+		get(1, "", 2, 3), // stale
+		cas(0, "", "a", OK, 0, 1),
+		get(1, "a", 2, 3),
+	}
+	history[0].Key, history[1].Key = "b", "b"
+	history[2].Key, history[3].Key = "a", "a"
+	result := Check(history)
+	if result.Linearizable {
+		t.Fatal("Linearizable: want false, have true")
+	}
+	if want, have := "b", result.Key; want != have {
+		t.Errorf("Key: want %q, have %q", want, have)
+	}
+}
+
+// TestCheckRandom checks histories of a register that is linearizable, with
+// random concurrency, which must be, and the same histories with a random read
+// changed, which mightn't be. A counterexample must not be linearizable, and
+// must be minimal: removing any operation that can be removed makes it so.
+func TestCheckRandom(t *testing.T) {
+	for seed := int64(1); seed <= 200; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		history := randomHistory(rng, 1+rng.Intn(5), 1+rng.Intn(30))
+		if result := Check(history); !result.Linearizable {
+			t.Fatalf("seed %d: a linearizable history isn't: %v", seed, result.Counterexample)
+		}
+
+		var gets []int
+		for i, op := range history {
+			if op.Kind == Get {
+				gets = append(gets, i)
+			}
+		}
+		if len(gets) == 0 {
+			continue
+		}
+		history[gets[rng.Intn(len(gets))]].Value = fmt.Sprint(rng.Intn(3))
+		result := Check(history)
+		if result.Linearizable {
+			continue
+		}
+		min := result.Counterexample
+		if linearizable(min) {
+			t.Fatalf("seed %d: the counterexample is linearizable: %v", seed, min)
+		}
+		for i := range min {
+			if !min[i].readOnly() {
+				continue
+			}
+			without := append(append([]Operation{}, min[:i]...), min[i+1:]...)
+			if !linearizable(without) {
+				t.Fatalf("seed %d: the counterexample isn't minimal without %v: %v", seed, min[i], min)
+			}
+		}
+	}
+}
+
+// randomHistory returns a history of clients calling random operations on a
+// register, which take effect at random times between their calls and returns.
+func randomHistory(rng *rand.Rand, clients, ops int) []Operation {
+	type pending struct {
+		i      int // in the history
+		effect int // when it takes effect
+		done   bool
+	}
+	var (
+		value   string
+		written int
+		history []Operation
+		busy    = make([]*pending, clients)
+	)
+	for now := 0; ; now++ {
+		idle := true
+		for client, p := range busy {
+			if p == nil {
+				if len(history) == ops || rng.Intn(3) > 0 {
+					continue
+				}
+				op := Operation{Client: client, Key: "k", Kind: Get, Call: at(now)}
+				if rng.Intn(2) == 0 {
+					written++
+					op.Kind, op.Old, op.New = CAS, value, fmt.Sprint(written)
+					if rng.Intn(3) == 0 {
+						op.Old = fmt.Sprint(rng.Intn(written))
+					}
+				}
+				busy[client] = &pending{i: len(history), effect: now + 1 + rng.Intn(5)}
+				history = append(history, op)
+				idle = false
+				continue
+			}
+			idle = false
+			op := &history[p.i]
+			switch {
+			case p.effect == now:
+				switch {
+				case op.Kind == Get:
+					op.Value, op.Outcome = value, OK
+				case op.Old == value:
+					value, op.Outcome = op.New, OK
+				default:
+					op.Outcome = Conflict
+				}
+				if op.Kind == CAS && rng.Intn(10) == 0 {
+					op.Outcome = Unknown
+				}
+			case p.effect < now && rng.Intn(2) == 0:
+				op.Return = at(now)
+				busy[client] = nil
+			}
+		}
+		if idle && len(history) == ops {
+			return history
+		}
+	}
+}
+
+func get(client int, value string, call, ret int) Operation {
+	return Operation{Client: client, Key: "k", Kind: Get, Value: value, Outcome: OK, Call: at(call), Return: at(ret)}
+}
+
+func cas(client int, old, new string, outcome Outcome, call, ret int) Operation {
+	op := Operation{Client: client, Key: "k", Kind: CAS, Old: old, New: new, Outcome: outcome, Call: at(call), Return: at(ret)}
+	if outcome == Unknown && call == ret {
+		op.Return = time.Time{}
+	}
+	return op
+}
+
+var epoch = time.Date(2018, 10, 1, 0, 0, 0, 0, time.UTC)
+
+func at(ms int) time.Time {
+	return epoch.Add(time.Duration(ms) * time.Millisecond)
+}
@@ -0,0 +1,85 @@
+// Package linearizability checks that histories of concurrent operations on
+// compare-and-swap registers are linearizable: that every operation appears to
+// take effect at some instant between its call and its return, in an order
+// that's consistent with a single register per key.
+//
+// Each key is an independent register, so each key's history is checked on
+// its own, with the algorithm of Wing and Gong, and the cache of Lowe, which
+// is also used by Knossos and Porcupine. A key that doesn't exist has an empty
+// value, as with the HTTP API.
+package linearizability
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Kind is the kind of an operation.
+type Kind string
+
+// Kinds of operations.
+const (
+	Get Kind = "get"
+	CAS Kind = "cas"
+)
+
+// Outcome is what a client saw of an operation.
+type Outcome string
+
+// Outcomes of operations.
+const (
+	// OK means a get returned a value, or a compare-and-swap swapped.
+	OK Outcome = "ok"
+
+	// Conflict means a compare-and-swap didn't swap, as the value wasn't old.
+	Conflict Outcome = "conflict"
+
+	// Unknown means the operation failed, so the client can't tell whether it
+	// took effect. It might take effect at any time after its call, or never.
+	Unknown Outcome = "unknown"
+)
+
+// Operation is a single operation by a client, from its call to its return.
+type Operation struct {
+	Client  int       `json:"client"`
+	Key     string    `json:"key"`
+	Kind    Kind      `json:"kind"`
+	Old     string    `json:"old,omitempty"`   // compare-and-swap
+	New     string    `json:"new,omitempty"`   // compare-and-swap
+	Value   string    `json:"value,omitempty"` // returned by a get
+	Outcome Outcome   `json:"outcome"`
+	Call    time.Time `json:"call"`
+	Return  time.Time `json:"return"`
+}
+
+// readOnly returns whether the operation can't have changed the value.
+func (op Operation) readOnly() bool {
+	return op.Kind == Get || op.Outcome == Conflict
+}
+
+// Recorder records a history of operations. It's safe for concurrent use.
+type Recorder struct {
+	mtx sync.Mutex
+	ops []Operation
+}
+
+// Record the operation, once it's returned.
+func (r *Recorder) Record(op Operation) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.ops = append(r.ops, op)
+}
+
+// History returns the operations recorded so far, in the order of their calls.
+func (r *Recorder) History() []Operation {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	history := append([]Operation{}, r.ops...)
+	sortByCall(history)
+	return history
+}
+
+func sortByCall(ops []Operation) {
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].Call.Before(ops[j].Call) })
+}
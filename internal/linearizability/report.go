@@ -0,0 +1,190 @@
+package linearizability
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"time"
+)
+
+// WriteReport writes an HTML report of the result of checking the history,
+// with a timeline of the counterexample, if there is one.
+func WriteReport(w io.Writer, history []Operation, result Result) error {
+	var (
+		keys    = map[string]bool{}
+		clients = map[int]bool{}
+	)
+	for _, op := range history {
+		keys[op.Key], clients[op.Client] = true, true
+	}
+	r := report{
+		Result:     result,
+		Operations: len(history),
+		Keys:       len(keys),
+		Clients:    len(clients),
+	}
+	if !result.Linearizable {
+		r.Timeline = newTimeline(result.Counterexample)
+	}
+	return reportTemplate.Execute(w, r)
+}
+
+type report struct {
+	Result
+	Operations, Keys, Clients int
+	Timeline                  *timeline
+}
+
+// timeline lays out operations as bars from their calls to their returns, in
+// a row per client. Unknown operations run off the end.
+type timeline struct {
+	Width, Height int
+	Rows          []timelineRow
+	Bars          []timelineBar
+}
+
+type timelineRow struct {
+	Client int
+	Y      int
+}
+
+type timelineBar struct {
+	Operation
+	X, Y, Width       int
+	Label             string
+	CallAt, ReturnAt  string // since the first call
+	Unknown, Conflict bool
+}
+
+// Dimensions of a timeline, in pixels.
+const (
+	timelineLabelWidth = 80
+	timelineWidth      = 1000
+	timelineRowHeight  = 40
+	timelineBarHeight  = 28
+)
+
+func newTimeline(ops []Operation) *timeline {
+	if len(ops) == 0 {
+		return nil
+	}
+	start, end := ops[0].Call, ops[0].Call
+	for _, op := range ops {
+		if op.Call.Before(start) {
+			start = op.Call
+		}
+		if op.Call.After(end) {
+			end = op.Call
+		}
+		if op.Outcome != Unknown && op.Return.After(end) {
+			end = op.Return
+		}
+	}
+	span := end.Sub(start)
+	span += span/10 + time.Microsecond // room for unknown operations to run off
+	x := func(t time.Time) int {
+		return timelineLabelWidth + int(float64(timelineWidth-timelineLabelWidth)*float64(t.Sub(start))/float64(span))
+	}
+
+	rows := map[int]int{}
+	var clients []int
+	for _, op := range ops {
+		if _, ok := rows[op.Client]; !ok {
+			rows[op.Client] = 0
+			clients = append(clients, op.Client)
+		}
+	}
+	sort.Ints(clients)
+	t := &timeline{Width: timelineWidth, Height: len(clients) * timelineRowHeight}
+	for i, client := range clients {
+		rows[client] = i * timelineRowHeight
+		t.Rows = append(t.Rows, timelineRow{client, i * timelineRowHeight})
+	}
+
+	for _, op := range ops {
+		bar := timelineBar{
+			Operation: op,
+			X:         x(op.Call),
+			Y:         rows[op.Client] + (timelineRowHeight-timelineBarHeight)/2,
+			Label:     label(op),
+			CallAt:    since(start, op.Call),
+			ReturnAt:  "never",
+			Unknown:   op.Outcome == Unknown,
+			Conflict:  op.Outcome == Conflict,
+		}
+		if bar.Unknown {
+			bar.Width = timelineWidth - bar.X
+		} else {
+			bar.Width = x(op.Return) - bar.X
+			bar.ReturnAt = since(start, op.Return)
+		}
+		if bar.Width < 2 {
+			bar.Width = 2
+		}
+		t.Bars = append(t.Bars, bar)
+	}
+	return t
+}
+
+func label(op Operation) string {
+	switch {
+	case op.Kind == Get:
+		return fmt.Sprintf("get %q", op.Value)
+	case op.Outcome == Conflict:
+		return fmt.Sprintf("cas %q→%q conflict", op.Old, op.New)
+	case op.Outcome == Unknown:
+		return fmt.Sprintf("cas %q→%q ?", op.Old, op.New)
+	default:
+		return fmt.Sprintf("cas %q→%q", op.Old, op.New)
+	}
+}
+
+func since(start, t time.Time) string {
+	return t.Sub(start).Round(time.Microsecond).String()
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Linearizability report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.2em 1em; text-align: left; }
+tr:nth-child(even) { background: #f4f4f4; }
+.ok { fill: #cfe8cf; stroke: #3a7a3a; }
+.conflict { fill: #e4e4e4; stroke: #777; }
+.unknown { fill: #fbe3c4; stroke: #b06f00; stroke-dasharray: 4 2; }
+text { font-family: monospace; font-size: 12px; }
+</style>
+</head>
+<body>
+<h1>Linearizability report</h1>
+<p>{{.Operations}} operation(s) on {{.Keys}} key(s) by {{.Clients}} client(s).</p>
+{{if .Linearizable}}
+<p>The history is linearizable.</p>
+{{else}}
+<p>The history of key <code>{{printf "%q" .Key}}</code> isn't linearizable. These {{len .Counterexample}} operation(s) of it can't be put in any order that's consistent with one register, and with their calls and returns. Each bar runs from an operation's call to its return. Dashed bars are of operations whose outcomes are unknown.</p>
+{{with .Timeline}}
+<svg width="{{.Width}}" height="{{.Height}}" xmlns="http://www.w3.org/2000/svg">
+{{range .Rows}}<text x="0" y="{{.Y}}" dy="24">client {{.Client}}</text>
+{{end}}
+{{range .Bars}}<g>
+<title>{{.Label}}: {{.CallAt}} to {{.ReturnAt}}</title>
+<rect x="{{.X}}" y="{{.Y}}" width="{{.Width}}" height="28" class="{{if .Unknown}}unknown{{else if .Conflict}}conflict{{else}}ok{{end}}"/>
+<text x="{{.X}}" y="{{.Y}}" dx="4" dy="18">{{.Label}}</text>
+</g>
+{{end}}
+</svg>
+<table>
+<tr><th>Client</th><th>Operation</th><th>Call</th><th>Return</th></tr>
+{{range .Bars}}<tr><td>{{.Client}}</td><td><code>{{.Label}}</code></td><td>{{.CallAt}}</td><td>{{.ReturnAt}}</td></tr>
+{{end}}
+</table>
+{{end}}
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,56 @@
+package linearizability
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteReport(t *testing.T) {
+	history := []Operation{
+		cas(0, "", "a", OK, 0, 1),
+		get(1, "", 2, 3),
+		cas(2, "a", "b", Unknown, 4, 4),
+	}
+	for _, tc := range []struct {
+		name    string
+		history []Operation
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "linearizable",
+			history: history[:1],
+			want:    []string{"1 operation(s) on 1 key(s) by 1 client(s)", "The history is linearizable."},
+		},
+		{
+			name:    "not linearizable",
+			history: history,
+			want: []string{
+				"3 operation(s) on 1 key(s) by 3 client(s)",
+				"These 2 operation(s)",
+				"<svg",
+				"client 0", "client 1",
+				"cas &#34;&#34;→&#34;a&#34;", "get &#34;&#34;",
+			},
+			notWant: []string{"client 2"}, // called after the stale get returned
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WriteReport(&buf, tc.history, Check(tc.history)); err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("want %q in the report:\n%s", want, buf.String())
+				}
+			}
+			for _, notWant := range tc.notWant {
+				if strings.Contains(buf.String(), notWant) {
+					t.Errorf("don't want %q in the report:\n%s", notWant, buf.String())
+				}
+			}
+		})
+	}
+}
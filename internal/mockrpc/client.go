@@ -0,0 +1,599 @@
+// Package mockrpc implements, in memory, the methods of Tendermint's RPC
+// client, for unit tests. A Client runs a real cas.Application, synchronously:
+// transactions are checked as they're broadcast, and kept in a mempool until
+// MakeBlock makes a block of them, which delivers and indexes them, and
+// publishes their events, as a node would. Its one validator signs each block,
+// so that a light client can verify the headers, and the proofs against them.
+//
+// There's no consensus, and no network, so blocks are only made when a test
+// asks, and its reads of the committed state are deterministic.
+package mockrpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	tendermintabci "github.com/tendermint/tendermint/abci/types"
+	tendermintcommon "github.com/tendermint/tendermint/libs/common"
+	tendermintdb "github.com/tendermint/tendermint/libs/db"
+	tendermintpubsub "github.com/tendermint/tendermint/libs/pubsub"
+	tendermintquery "github.com/tendermint/tendermint/libs/pubsub/query"
+	tendermintp2p "github.com/tendermint/tendermint/p2p"
+	tendermintrpcclient "github.com/tendermint/tendermint/rpc/client"
+	tendermintcoretypes "github.com/tendermint/tendermint/rpc/core/types"
+	tendermintstate "github.com/tendermint/tendermint/state"
+	tendermintkv "github.com/tendermint/tendermint/state/txindex/kv"
+	tenderminttypes "github.com/tendermint/tendermint/types"
+	tenderminttime "github.com/tendermint/tendermint/types/time"
+)
+
+var (
+	_ tendermintrpcclient.ABCIClient    = (*Client)(nil)
+	_ tendermintrpcclient.SignClient    = (*Client)(nil)
+	_ tendermintrpcclient.HistoryClient = (*Client)(nil)
+	_ tendermintrpcclient.StatusClient  = (*Client)(nil)
+	_ tendermintrpcclient.EventsClient  = (*Client)(nil)
+)
+
+// ChainID is the chain ID that a Client reports.
+const ChainID = "mockrpc"
+
+// Client is an in-memory node, with one validator, and the methods of
+// Tendermint's RPC client, except those of a service, and of its network.
+// It's safe for concurrent use.
+type Client struct {
+	events     *tenderminttypes.EventBus
+	txIndex    *tendermintkv.TxIndex
+	pv         *tenderminttypes.MockPV
+	validator  *tenderminttypes.Validator
+	validators *tenderminttypes.ValidatorSet
+	genesis    *tenderminttypes.GenesisDoc
+
+	mtx        sync.Mutex
+	app        *cas.Application
+	mempool    []tenderminttypes.Tx
+	height     int64
+	appHash    []byte
+	blockTime  time.Time
+	totalTxs   int64
+	blocks     map[int64]*block // from the first block made
+	err        error
+	catchingUp bool
+	peers      int
+}
+
+// block is a block that the client made, with its validator's commit, and
+// the application's results.
+type block struct {
+	block     *tenderminttypes.Block
+	parts     *tenderminttypes.PartSet
+	commit    *tenderminttypes.Commit
+	responses *tendermintstate.ABCIResponses
+}
+
+func (b *block) meta() *tenderminttypes.BlockMeta {
+	return tenderminttypes.NewBlockMeta(b.block, b.parts)
+}
+
+// New returns a client of a node running the application, at height 0, and
+// starts publishing events. The application must be new, or restored from a
+// file, but not yet used. Close stops the client, but not the application.
+func New(app *cas.Application) (*Client, error) {
+	pv := tenderminttypes.NewMockPV()
+	validator := tenderminttypes.NewValidator(pv.GetPubKey(), 10)
+	c := &Client{
+		events:     tenderminttypes.NewEventBus(),
+		txIndex:    tendermintkv.NewTxIndex(tendermintdb.NewMemDB(), tendermintkv.IndexTags([]string{cas.TagKey})),
+		pv:         pv,
+		validator:  validator,
+		validators: tenderminttypes.NewValidatorSet([]*tenderminttypes.Validator{validator}),
+		genesis: &tenderminttypes.GenesisDoc{
+			GenesisTime: tenderminttime.Now(),
+			ChainID:     ChainID,
+			Validators: []tenderminttypes.GenesisValidator{{
+				PubKey: validator.PubKey,
+				Power:  validator.VotingPower,
+				Name:   "node",
+			}},
+		},
+		app:    app,
+		blocks: make(map[int64]*block),
+	}
+	info := app.Info(tendermintabci.RequestInfo{})
+	c.height, c.appHash = info.LastBlockHeight, info.LastBlockAppHash
+	if err := c.events.Start(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close stops publishing events, and closes every subscription.
+func (c *Client) Close() error {
+	return c.events.Stop()
+}
+
+// MakeBlock makes a block of every transaction in the mempool, in the order
+// they were broadcast, and delivers it to the application, which commits it.
+// The validator signs it, and each transaction is indexed, and its event
+// published, with its result, as it would be by a node, even if it failed. It
+// returns the block's height.
+func (c *Client) MakeBlock() (int64, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	height := c.height + 1
+	lastCommit := &tenderminttypes.Commit{}
+	last := c.blocks[c.height]
+	if last != nil {
+		lastCommit = last.commit
+	}
+	b := tenderminttypes.MakeBlock(height, c.mempool, lastCommit, nil)
+	b.ChainID = ChainID
+	b.Time = tenderminttime.Now()
+	b.TotalTxs = c.totalTxs + b.NumTxs
+	b.ValidatorsHash = c.validators.Hash()
+	b.NextValidatorsHash = c.validators.Hash()
+	b.ConsensusHash = tenderminttypes.DefaultConsensusParams().Hash()
+	b.AppHash = c.appHash // after the last block, as in a node's headers
+	b.ProposerAddress = c.validator.Address
+	if last != nil {
+		b.LastBlockID = last.commit.BlockID
+		b.LastResultsHash = tenderminttypes.NewResults(last.responses.DeliverTx).Hash()
+	}
+
+	parts := b.MakePartSet(tenderminttypes.BlockPartSizeBytes)
+	vote := &tenderminttypes.Vote{
+		ValidatorAddress: c.validator.Address,
+		ValidatorIndex:   0,
+		Height:           height,
+		Timestamp:        b.Time,
+		Type:             tenderminttypes.VoteTypePrecommit,
+		BlockID:          tenderminttypes.BlockID{Hash: b.Hash(), PartsHeader: parts.Header()},
+	}
+	if err := c.pv.SignVote(ChainID, vote); err != nil {
+		return 0, err
+	}
+
+	c.app.BeginBlock(tendermintabci.RequestBeginBlock{Header: tenderminttypes.TM2PB.Header(&b.Header)})
+	responses := &tendermintstate.ABCIResponses{DeliverTx: make([]*tendermintabci.ResponseDeliverTx, len(c.mempool))}
+	results := make([]*tenderminttypes.TxResult, len(c.mempool))
+	for i, tx := range c.mempool {
+		r := c.app.DeliverTx(tx)
+		responses.DeliverTx[i] = &r
+		results[i] = &tenderminttypes.TxResult{
+			Height: height,
+			Index:  uint32(i),
+			Tx:     tx,
+			Result: r,
+		}
+	}
+	endBlock := c.app.EndBlock(tendermintabci.RequestEndBlock{Height: height})
+	responses.EndBlock = &endBlock
+	commit := c.app.Commit()
+
+	c.blocks[height] = &block{
+		block:     b,
+		parts:     parts,
+		commit:    &tenderminttypes.Commit{BlockID: vote.BlockID, Precommits: []*tenderminttypes.Vote{vote}},
+		responses: responses,
+	}
+	c.height, c.appHash, c.blockTime = height, commit.Data, b.Time
+	c.totalTxs = b.TotalTxs
+	c.mempool = nil
+
+	for _, result := range results {
+		if err := c.txIndex.Index(result); err != nil {
+			return height, err
+		}
+		if err := c.events.PublishEventTx(tenderminttypes.EventDataTx{TxResult: *result}); err != nil {
+			return height, err
+		}
+	}
+	return height, nil
+}
+
+// Height returns the height of the last block.
+func (c *Client) Height() int64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.height
+}
+
+// Mempool returns the number of transactions waiting for the next block.
+func (c *Client) Mempool() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return len(c.mempool)
+}
+
+// Fail makes every method of Tendermint's client return the error, as if the
+// node couldn't be reached, until it's called again with nil. Subscriptions
+// that already exist aren't affected.
+func (c *Client) Fail(err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.err = err
+}
+
+// SetCatchingUp sets whether the node reports that it's catching up.
+func (c *Client) SetCatchingUp(catchingUp bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.catchingUp = catchingUp
+}
+
+// SetPeers sets the number of peers that the node reports. The default is 0.
+func (c *Client) SetPeers(n int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.peers = n
+}
+
+// Status returns the node's status.
+func (c *Client) Status() (*tendermintcoretypes.ResultStatus, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &tendermintcoretypes.ResultStatus{
+		NodeInfo: nodeInfo("node"),
+		SyncInfo: tendermintcoretypes.SyncInfo{
+			LatestBlockHeight: c.height,
+			LatestAppHash:     c.appHash,
+			LatestBlockTime:   c.blockTime,
+			CatchingUp:        c.catchingUp,
+		},
+		ValidatorInfo: tendermintcoretypes.ValidatorInfo{
+			Address:     c.validator.Address,
+			PubKey:      c.validator.PubKey,
+			VotingPower: c.validator.VotingPower,
+		},
+	}, nil
+}
+
+// NetInfo returns the node's peers, which are made up.
+func (c *Client) NetInfo() (*tendermintcoretypes.ResultNetInfo, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	peers := []tendermintcoretypes.Peer{}
+	for i := 0; i < c.peers; i++ {
+		peers = append(peers, tendermintcoretypes.Peer{
+			NodeInfo:   nodeInfo(fmt.Sprintf("peer%d", i)),
+			IsOutbound: i%2 == 0,
+		})
+	}
+	return &tendermintcoretypes.ResultNetInfo{
+		Listening: true,
+		NPeers:    len(peers),
+		Peers:     peers,
+	}, nil
+}
+
+// Validators returns the one validator, at any height up to the next.
+func (c *Client) Validators(height *int64) (*tendermintcoretypes.ResultValidators, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	h := c.height + 1
+	if height != nil {
+		if *height <= 0 || *height > h {
+			return nil, fmt.Errorf("height %d out of range", *height)
+		}
+		h = *height
+	}
+	return &tendermintcoretypes.ResultValidators{
+		BlockHeight: h,
+		Validators:  []*tenderminttypes.Validator{c.validator},
+	}, nil
+}
+
+// Genesis returns the genesis of the chain, with the one validator, so that a
+// light client can start out trusting it.
+func (c *Client) Genesis() (*tendermintcoretypes.ResultGenesis, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &tendermintcoretypes.ResultGenesis{Genesis: c.genesis}, nil
+}
+
+// BlockchainInfo returns the metadata of the blocks between the heights, from
+// the latest, as Tendermint does: at most 20, and a maxHeight of 0 is the
+// latest. Blocks the client didn't make, as the application was restored, are
+// left out.
+func (c *Client) BlockchainInfo(minHeight, maxHeight int64) (*tendermintcoretypes.ResultBlockchainInfo, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	const limit = 20
+	if minHeight == 0 {
+		minHeight = 1
+	}
+	if maxHeight == 0 || maxHeight > c.height {
+		maxHeight = c.height
+	}
+	if minHeight < maxHeight-limit+1 {
+		minHeight = maxHeight - limit + 1
+	}
+	if minHeight > maxHeight {
+		return nil, fmt.Errorf("min height %d can't be greater than max height %d", minHeight, maxHeight)
+	}
+	metas := []*tenderminttypes.BlockMeta{}
+	for h := maxHeight; h >= minHeight; h-- {
+		if b, ok := c.blocks[h]; ok {
+			metas = append(metas, b.meta())
+		}
+	}
+	return &tendermintcoretypes.ResultBlockchainInfo{LastHeight: c.height, BlockMetas: metas}, nil
+}
+
+// Block returns the block at the height, or the latest, if it's nil.
+func (c *Client) Block(height *int64) (*tendermintcoretypes.ResultBlock, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	b, err := c.blockAt(height)
+	if err != nil {
+		return nil, err
+	}
+	return &tendermintcoretypes.ResultBlock{BlockMeta: b.meta(), Block: b.block}, nil
+}
+
+// BlockResults returns the application's results of the block at the height,
+// or the latest, if it's nil.
+func (c *Client) BlockResults(height *int64) (*tendermintcoretypes.ResultBlockResults, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	b, err := c.blockAt(height)
+	if err != nil {
+		return nil, err
+	}
+	return &tendermintcoretypes.ResultBlockResults{Height: b.block.Height, Results: b.responses}, nil
+}
+
+// Commit returns the header of the block at the height, or the latest, if
+// it's nil, and the validator's commit of it. As a node does, it reports only
+// the commits of earlier blocks as canonical.
+func (c *Client) Commit(height *int64) (*tendermintcoretypes.ResultCommit, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	b, err := c.blockAt(height)
+	if err != nil {
+		return nil, err
+	}
+	return tendermintcoretypes.NewResultCommit(&b.block.Header, b.commit, b.block.Height < c.height), nil
+}
+
+// blockAt returns the block at the height, or the latest, if it's nil. The
+// mutex must be held.
+func (c *Client) blockAt(height *int64) (*block, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	h := c.height
+	if height != nil {
+		if *height <= 0 || *height > c.height {
+			return nil, fmt.Errorf("height %d out of range", *height)
+		}
+		h = *height
+	}
+	b, ok := c.blocks[h]
+	if !ok {
+		return nil, fmt.Errorf("no block at height %d", h)
+	}
+	return b, nil
+}
+
+// ABCIInfo returns the application's Info.
+func (c *Client) ABCIInfo() (*tendermintcoretypes.ResultABCIInfo, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &tendermintcoretypes.ResultABCIInfo{Response: c.app.Info(tendermintabci.RequestInfo{})}, nil
+}
+
+// ABCIQuery queries the application, with a proof.
+func (c *Client) ABCIQuery(path string, data tendermintcommon.HexBytes) (*tendermintcoretypes.ResultABCIQuery, error) {
+	return c.ABCIQueryWithOptions(path, data, tendermintrpcclient.DefaultABCIQueryOptions)
+}
+
+// ABCIQueryWithOptions queries the application.
+func (c *Client) ABCIQueryWithOptions(path string, data tendermintcommon.HexBytes, opts tendermintrpcclient.ABCIQueryOptions) (*tendermintcoretypes.ResultABCIQuery, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	if opts.Height < 0 {
+		return nil, fmt.Errorf("height must be non-negative")
+	}
+	response := c.app.Query(tendermintabci.RequestQuery{
+		Path:   path,
+		Data:   data,
+		Height: opts.Height,
+		Prove:  !opts.Trusted,
+	})
+	return &tendermintcoretypes.ResultABCIQuery{Response: response}, nil
+}
+
+// BroadcastTxAsync checks the transaction, and adds it to the mempool, if it
+// passes, but, as a node doesn't wait for CheckTx, returns only its hash.
+func (c *Client) BroadcastTxAsync(tx tenderminttypes.Tx) (*tendermintcoretypes.ResultBroadcastTx, error) {
+	if _, err := c.BroadcastTxSync(tx); err != nil {
+		return nil, err
+	}
+	return &tendermintcoretypes.ResultBroadcastTx{Hash: tx.Hash()}, nil
+}
+
+// BroadcastTxSync checks the transaction, and adds it to the mempool, if it
+// passes, and returns the result of CheckTx.
+func (c *Client) BroadcastTxSync(tx tenderminttypes.Tx) (*tendermintcoretypes.ResultBroadcastTx, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	r := c.checkTx(tx)
+	return &tendermintcoretypes.ResultBroadcastTx{
+		Code: r.Code,
+		Data: r.Data,
+		Log:  r.Log,
+		Hash: tx.Hash(),
+	}, nil
+}
+
+// BroadcastTxCommit checks the transaction, and, if it passes, makes a block
+// straight away, with it and the rest of the mempool, instead of waiting for
+// the next, and returns the results of CheckTx and DeliverTx.
+func (c *Client) BroadcastTxCommit(tx tenderminttypes.Tx) (*tendermintcoretypes.ResultBroadcastTxCommit, error) {
+	c.mtx.Lock()
+	if c.err != nil {
+		c.mtx.Unlock()
+		return nil, c.err
+	}
+	checkTx := c.checkTx(tx)
+	c.mtx.Unlock()
+	result := &tendermintcoretypes.ResultBroadcastTxCommit{CheckTx: checkTx, Hash: tx.Hash()}
+	if !checkTx.IsOK() {
+		return result, nil
+	}
+	if _, err := c.MakeBlock(); err != nil {
+		return nil, err
+	}
+	r, err := c.txIndex.Get(tx.Hash())
+	if err != nil {
+		return nil, err
+	}
+	result.DeliverTx, result.Height = r.Result, r.Height
+	return result, nil
+}
+
+// checkTx checks the transaction, and adds it to the mempool if it passes.
+// The mutex must be held.
+func (c *Client) checkTx(tx tenderminttypes.Tx) tendermintabci.ResponseCheckTx {
+	r := c.app.CheckTx(tx)
+	if r.IsOK() {
+		c.mempool = append(c.mempool, tx)
+	}
+	return r
+}
+
+// Tx returns the transaction with the hash, and its result, from the index,
+// and, if asked, its proof against its block's header.
+func (c *Client) Tx(hash []byte, prove bool) (*tendermintcoretypes.ResultTx, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.err != nil {
+		return nil, c.err
+	}
+	r, err := c.txIndex.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, fmt.Errorf("tx %X not found", hash)
+	}
+	return c.resultTx(r, prove), nil
+}
+
+// resultTx returns the indexed transaction, with its proof if asked. The mutex
+// must be held.
+func (c *Client) resultTx(r *tenderminttypes.TxResult, prove bool) *tendermintcoretypes.ResultTx {
+	result := &tendermintcoretypes.ResultTx{
+		Hash:     r.Tx.Hash(),
+		Height:   r.Height,
+		Index:    r.Index,
+		TxResult: r.Result,
+		Tx:       r.Tx,
+	}
+	if prove {
+		result.Proof = c.blocks[r.Height].block.Data.Txs.Proof(int(r.Index))
+	}
+	return result
+}
+
+// TxSearch searches the transaction index, which indexes cas.TagKey.
+func (c *Client) TxSearch(query string, prove bool, page, perPage int) (*tendermintcoretypes.ResultTxSearch, error) {
+	c.mtx.Lock()
+	err := c.err
+	c.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	q, err := tendermintquery.New(query)
+	if err != nil {
+		return nil, err
+	}
+	results, err := c.txIndex.Search(q)
+	if err != nil {
+		return nil, err
+	}
+
+	// Page as Tendermint does.
+	total := len(results)
+	const defaultPerPage, maxPerPage = 30, 100
+	if perPage < 1 || perPage > maxPerPage {
+		perPage = defaultPerPage
+	}
+	if pages := (total-1)/perPage + 1; page < 1 {
+		page = 1
+	} else if page > pages {
+		page = pages
+	}
+	results = results[(page-1)*perPage:]
+	if len(results) > perPage {
+		results = results[:perPage]
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	txs := make([]*tendermintcoretypes.ResultTx, len(results))
+	for i, r := range results {
+		txs[i] = c.resultTx(r, prove)
+	}
+	return &tendermintcoretypes.ResultTxSearch{Txs: txs, TotalCount: total}, nil
+}
+
+// Subscribe subscribes to the node's events.
+func (c *Client) Subscribe(ctx context.Context, subscriber string, query tendermintpubsub.Query, out chan<- interface{}) error {
+	c.mtx.Lock()
+	err := c.err
+	c.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.events.Subscribe(ctx, subscriber, query, out)
+}
+
+// Unsubscribe ends a subscription.
+func (c *Client) Unsubscribe(ctx context.Context, subscriber string, query tendermintpubsub.Query) error {
+	return c.events.Unsubscribe(ctx, subscriber, query)
+}
+
+// UnsubscribeAll ends every subscription of the subscriber.
+func (c *Client) UnsubscribeAll(ctx context.Context, subscriber string) error {
+	return c.events.UnsubscribeAll(ctx, subscriber)
+}
+
+func nodeInfo(moniker string) tendermintp2p.NodeInfo {
+	return tendermintp2p.NodeInfo{
+		ID:         tendermintp2p.ID(moniker + "-id"),
+		ListenAddr: "tcp://" + moniker + ":26656",
+		Network:    ChainID,
+		Moniker:    moniker,
+		Other:      tendermintp2p.NodeInfoOther{TxIndex: "on"},
+	}
+}
@@ -0,0 +1,178 @@
+package mockrpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/6thc/tendermint-cas-demo/internal/cas"
+	"github.com/go-kit/kit/log"
+	tendermintabci "github.com/tendermint/tendermint/abci/types"
+	tenderminttypes "github.com/tendermint/tendermint/types"
+)
+
+func TestClient(t *testing.T) {
+	app, err := cas.NewApplication(nil, nil, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	c, err := New(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	out := make(chan interface{}, 10)
+	if err := c.Subscribe(context.Background(), "test", tenderminttypes.EventQueryTx, out); err != nil {
+		t.Fatal(err)
+	}
+
+	// A transaction is checked against the mempool, and kept there until the
+	// next block, when it's committed.
+	broadcast(t, c, cas.SetTx("a", nil, []byte("one")), tendermintabci.CodeTypeOK)
+	broadcast(t, c, cas.SetTx("a", nil, []byte("two")), cas.CodeCASFailure)
+	if want, have := 1, c.Mempool(); want != have {
+		t.Fatalf("Mempool: want %d, have %d", want, have)
+	}
+	checkValue(t, c, "a", "")
+	height, err := c.MakeBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := int64(1), height; want != have {
+		t.Fatalf("MakeBlock: want height %d, have %d", want, have)
+	}
+	checkValue(t, c, "a", "one")
+
+	// Its event is published, and it's indexed.
+	select {
+	case v := <-out:
+		data, ok := v.(tenderminttypes.EventDataTx)
+		if !ok || data.Height != height || data.Result.Code != tendermintabci.CodeTypeOK {
+			t.Fatalf("want an event of a transaction at height %d, have %+v", height, v)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no event")
+	}
+	result, err := c.TxSearch(fmt.Sprintf("%s='a'", cas.TagKey), false, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 1, result.TotalCount; want != have {
+		t.Fatalf("TxSearch: want %d result(s), have %d", want, have)
+	}
+
+	// Blocks are made even without transactions.
+	if height, err = c.MakeBlock(); err != nil || height != 2 {
+		t.Fatalf("MakeBlock: want height 2, have %d, %v", height, err)
+	}
+	status, err := c.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := height, status.SyncInfo.LatestBlockHeight; want != have {
+		t.Fatalf("Status: want height %d, have %d", want, have)
+	}
+
+	// Each block is signed by the validator in the genesis, and its header
+	// has the app hash after the block before.
+	genesis, err := c.Genesis()
+	if err != nil {
+		t.Fatal(err)
+	}
+	validators := tenderminttypes.NewValidatorSet([]*tenderminttypes.Validator{
+		tenderminttypes.NewValidator(genesis.Genesis.Validators[0].PubKey, genesis.Genesis.Validators[0].Power),
+	})
+	first := int64(1)
+	signed, err := c.Commit(&first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signed.ValidateBasic(ChainID); err != nil {
+		t.Fatal(err)
+	}
+	if err := validators.VerifyCommit(ChainID, signed.Commit.BlockID, first, signed.Commit); err != nil {
+		t.Fatal(err)
+	}
+	latest, err := c.Commit(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.Height != height || !signed.CanonicalCommit || latest.CanonicalCommit {
+		t.Fatalf("Commit: want the canonical commit of block 1, and the latest of block %d, have %+v and %+v", height, signed, latest)
+	}
+	if after := status.SyncInfo.LatestAppHash; bytes.Equal(signed.AppHash, after) || !bytes.Equal(latest.AppHash, after) {
+		t.Fatalf("Commit: want header 1 to have the app hash before it, and header 2 the one after block 1, %X, have %X and %X", after, signed.AppHash, latest.AppHash)
+	}
+	if _, err := c.Commit(&[]int64{height + 1}[0]); err == nil {
+		t.Fatalf("Commit: want an error for block %d, which isn't made yet", height+1)
+	}
+
+	// A transaction is found by its hash, with a proof against its block.
+	block, err := c.Block(&first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := c.Tx(block.Block.Txs[0].Hash(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Proof.Validate(block.Block.DataHash); err != nil {
+		t.Fatalf("Tx: %v", err)
+	}
+	results, err := c.BlockResults(&first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Results.DeliverTx) != 1 || results.Results.DeliverTx[0].Code != tx.TxResult.Code {
+		t.Fatalf("BlockResults: want the result of the transaction, have %+v", results.Results)
+	}
+
+	// BroadcastTxCommit makes a block straight away.
+	committed, err := c.BroadcastTxCommit(cas.SetTx("b", nil, []byte("two")).Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if committed.CheckTx.IsErr() || committed.DeliverTx.IsErr() || committed.Height != height+1 {
+		t.Fatalf("BroadcastTxCommit: want a transaction committed at height %d, have %+v", height+1, committed)
+	}
+	checkValue(t, c, "b", "two")
+
+	// A failing node fails every call.
+	failure := errors.New("connection refused")
+	c.Fail(failure)
+	if _, err := c.ABCIQuery(cas.QueryPathKey, []byte("a")); err != failure {
+		t.Fatalf("ABCIQuery: want %v, have %v", failure, err)
+	}
+	if _, err := c.BroadcastTxSync(cas.SetTx("a", []byte("one"), []byte("two")).Encode()); err != failure {
+		t.Fatalf("BroadcastTxSync: want %v, have %v", failure, err)
+	}
+	c.Fail(nil)
+	checkValue(t, c, "a", "one")
+}
+
+func broadcast(t *testing.T, c *Client, tx cas.Tx, code uint32) {
+	t.Helper()
+	result, err := c.BroadcastTxSync(tx.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != result.Code {
+		t.Fatalf("BroadcastTxSync: want code %d, have %d: %s", code, result.Code, result.Log)
+	}
+}
+
+func checkValue(t *testing.T, c *Client, key, value string) {
+	t.Helper()
+	result, err := c.ABCIQuery(cas.QueryPathKey, []byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := value, string(result.Response.Value); want != have {
+		t.Fatalf("%s: want %q, have %q", key, want, have)
+	}
+}